@@ -81,5 +81,5 @@ then
   export BPO=1
 fi
 # double complex alpha(double complex arg, double complex period, double complex offset, double complex power) {
-echo "LIB=\"libjpegbw.so\" RC=1 GC=1 BC=1 NA=1 RF=\"alpha($RX, $RPE, $ROF, $RPO)\" GF=\"alpha($GX, $GPE, $GOF, $GPO)\" BF=\"alpha($BX, $BPE, $BOF, $BPO)\" jpeg [args]"
-LIB="libjpegbw.so" RC=1 GC=1 BC=1 NA=1 RF="alpha($RX, $RPE, $ROF, $RPO)" GF="alpha($GX, $GPE, $GOF, $GPO)" BF="alpha($BX, $BPE, $BOF, $BPO)" jpeg $*
+echo "RC=1 GC=1 BC=1 NA=1 RF=\"alpha($RX, $RPE, $ROF, $RPO)\" GF=\"alpha($GX, $GPE, $GOF, $GPO)\" BF=\"alpha($BX, $BPE, $BOF, $BPO)\" jpeg [args]"
+RC=1 GC=1 BC=1 NA=1 RF="alpha($RX, $RPE, $ROF, $RPO)" GF="alpha($GX, $GPE, $GOF, $GPO)" BF="alpha($BX, $BPE, $BOF, $BPO)" jpeg $*
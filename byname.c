@@ -1,222 +1,140 @@
+#ifdef __linux__
+#define _GNU_SOURCE
+#endif
 #include "byname.h"
+#ifdef __linux__
+#include <link.h>
+#endif
 
-static void* handle = 0;
-static size_t maxfn = 0;
-static double complex (**fptra)(double complex) = 0;
-static double complex (**fptra2)(double complex, double complex) = 0;
-static double complex (**fptra3)(double complex, double complex, double complex) = 0;
-static double complex (**fptra4)(double complex, double complex, double complex, double complex) = 0;
-static char** fnames = 0;
-static char** fnames2 = 0;
-static char** fnames3 = 0;
-static char** fnames4 = 0;
-static int nptrs = 0;
-static int nptrs2 = 0;
-static int nptrs3 = 0;
-static int nptrs4 = 0;
+/* No global state here: library handles and function pointers are owned by the Go side (see fparlib.go) */
 
-double complex byname(char* fname, double complex arg, int* res) {
-  int i;
-  double complex (*fptr)(double complex) = 0;
-  if (!handle) {
-    printf("byname %s,%f+%fi library not open\n", fname, creal(arg), cimag(arg));
-    *res = 1;
-    return 0.0;
-  }
-  for (i=0;i<nptrs;i++) {
-    if (!strcmp(fnames[i], fname)) {
-      fptr = fptra[i];
-    }
-  }
-  if (!fptr) {
-    if (nptrs >= maxfn) {
-      printf("byname %s,%f+%fi function table full\n", fname, creal(arg), cimag(arg));
-      *res = 2;
-      return 0.0;
-    }
-    fptr = (double complex (*)(double complex))dlsym(handle, fname);
-    if (!fptr) {
-      printf("byname %s,%f+%fi function not found\n", fname, creal(arg), cimag(arg));
-      *res = 3;
-      return 0.0;
-    }
-    fptra[nptrs] = fptr;
-    fnames[nptrs] = (char*)malloc((strlen(fname)+1)*sizeof(char));
-    strcpy(fnames[nptrs], fname);
-    nptrs ++;
-  }
-  *res = 0;
-  return (*fptr)(arg);
+void* lib_open(char* lib) {
+  /* RTLD_LOCAL so the same function name can come from different libraries */
+  return dlopen(lib, RTLD_LAZY | RTLD_LOCAL);
 }
 
-double complex byname2(char* fname, double complex arg1, double complex arg2, int* res) {
-  int i;
-  double complex (*fptr)(double complex, double complex) = 0;
-  if (!handle) {
-    printf("byname2 %s,%f+%fi,%f+%fi: library not open\n", fname, creal(arg1), cimag(arg1), creal(arg2), cimag(arg2));
-    *res = 1;
-    return 0.0;
-  }
-  for (i=0;i<nptrs2;i++) {
-    if (!strcmp(fnames2[i], fname)) {
-      fptr = fptra2[i];
-    }
-  }
-  if (!fptr) {
-    if (nptrs2 >= maxfn) {
-      printf("byname2 %s,%f+%fi,%f+%fi: function table full\n", fname, creal(arg1), cimag(arg1), creal(arg2), cimag(arg2));
-      *res = 2;
-      return 0.0;
-    }
-    fptr = (double complex (*)(double complex, double complex))dlsym(handle, fname);
-    if (!fptr) {
-      printf("byname2 %s,%f+%fi,%f+%fi: function not found\n", fname, creal(arg1), cimag(arg1), creal(arg2), cimag(arg2));
-      *res = 3;
-      return 0.0;
-    }
-    fptra2[nptrs2] = fptr;
-    fnames2[nptrs2] = (char*)malloc((strlen(fname)+1)*sizeof(char));
-    strcpy(fnames2[nptrs2], fname);
-    nptrs2 ++;
-  }
-  *res = 0;
-  return (*fptr)(arg1, arg2);
+void* lib_sym(void* handle, char* fname) {
+  return dlsym(handle, fname);
 }
 
-double complex byname3(char* fname, double complex arg1, double complex arg2, double complex arg3, int* res) {
-  int i;
-  double complex (*fptr)(double complex, double complex, double complex) = 0;
-  if (!handle) {
-    printf("byname3 %s,%f+%fi,%f+%fi,%f+%fi: library not open\n", fname, creal(arg1), cimag(arg1), creal(arg2), cimag(arg2), creal(arg3), cimag(arg3));
-    *res = 1;
-    return 0.0;
-  }
-  for (i=0;i<nptrs3;i++) {
-    if (!strcmp(fnames3[i], fname)) {
-      fptr = fptra3[i];
-    }
-  }
-  if (!fptr) {
-    if (nptrs3 >= maxfn) {
-      printf("byname3 %s,%f+%fi,%f+%fi,%f+%fi: function table full\n", fname, creal(arg1), cimag(arg1), creal(arg2), cimag(arg2), creal(arg3), cimag(arg3));
-      *res = 2;
-      return 0.0;
-    }
-    fptr = (double complex (*)(double complex, double complex, double complex))dlsym(handle, fname);
-    if (!fptr) {
-      printf("byname3 %s,%f+%fi,%f+%fi,%f+%fi: function not found\n", fname, creal(arg1), cimag(arg1), creal(arg2), cimag(arg2), creal(arg3), cimag(arg3));
-      *res = 3;
-      return 0.0;
-    }
-    fptra3[nptrs3] = fptr;
-    fnames3[nptrs3] = (char*)malloc((strlen(fname)+1)*sizeof(char));
-    strcpy(fnames3[nptrs3], fname);
-    nptrs3 ++;
-  }
-  *res = 0;
-  return (*fptr)(arg1, arg2, arg3);
+int lib_close(void* handle) {
+  return dlclose(handle);
 }
 
-double complex byname4(char* fname, double complex arg1, double complex arg2, double complex arg3, double complex arg4, int* res) {
-  int i;
-  double complex (*fptr)(double complex, double complex, double complex, double complex) = 0;
-  if (!handle) {
-    printf("byname4 %s,%f+%fi,%f+%fi,%f+%fi,%f+%fi: library not open\n", fname, creal(arg1), cimag(arg1), creal(arg2), cimag(arg2), creal(arg3), cimag(arg3), creal(arg4), cimag(arg4));
-    *res = 1;
-    return 0.0;
-  }
-  for (i=0;i<nptrs4;i++) {
-    if (!strcmp(fnames4[i], fname)) {
-      fptr = fptra4[i];
-    }
-  }
-  if (!fptr) {
-    if (nptrs4 >= maxfn) {
-      printf("byname4 %s,%f+%fi,%f+%fi,%f+%fi,%f+%fi: function table full\n", fname, creal(arg1), cimag(arg1), creal(arg2), cimag(arg2), creal(arg3), cimag(arg3), creal(arg4), cimag(arg4));
-      *res = 2;
-      return 0.0;
-    }
-    fptr = (double complex (*)(double complex, double complex, double complex, double complex))dlsym(handle, fname);
-    if (!fptr) {
-      printf("byname4 %s,%f+%fi,%f+%fi,%f+%fi,%f+%fi: function not found\n", fname, creal(arg1), cimag(arg1), creal(arg2), cimag(arg2), creal(arg3), cimag(arg3), creal(arg4), cimag(arg4));
-      *res = 3;
-      return 0.0;
-    }
-    fptra4[nptrs4] = fptr;
-    fnames4[nptrs4] = (char*)malloc((strlen(fname)+1)*sizeof(char));
-    strcpy(fnames4[nptrs4], fname);
-    nptrs4 ++;
-  }
-  *res = 0;
-  return (*fptr)(arg1, arg2, arg3, arg4);
+char* lib_error(void) {
+  return dlerror();
 }
 
-int init(char* lib, size_t mfn) {
-  if (mfn < 1) {
-    printf("init(%s, %ld): mfn must be >= 1\n", lib, mfn);
+/* path of the loaded library file, 0 when it cannot be determined */
+char* lib_path(void* handle) {
+#ifdef __linux__
+  struct link_map* map = 0;
+  if (dlinfo(handle, RTLD_DI_LINKMAP, &map) == 0 && map && map->l_name) {
+    return map->l_name;
+  }
+#endif
+  return 0;
+}
+
+/*
+  Signature code: return type and up to 4 argument types, 2 bits each (see fparsig.go)
+  0 - no argument, 1 - double, 2 - double complex, 3 - int, return type is in the lowest 2 bits
+*/
+#define SIG_d 1
+#define SIG_z 2
+#define SIG_i 3
+#define T_d double
+#define T_z double complex
+#define T_i int
+#define V_d(x) creal(x)
+#define V_z(x) (x)
+#define V_i(x) toint(creal(x))
+#define SIG1(r, a) (SIG_##r | (SIG_##a << 2))
+#define SIG2(r, a, b) (SIG1(r, a) | (SIG_##b << 4))
+#define SIG3(r, a, b, c) (SIG2(r, a, b) | (SIG_##c << 6))
+#define SIG4(r, a, b, c, d) (SIG3(r, a, b, c) | (SIG_##d << 8))
+
+#define CASE1(r, a) case SIG1(r, a): return (double complex)((*(T_##r (*)(T_##a))fn)(V_##a(x[0])));
+#define CASE2(r, a, b) case SIG2(r, a, b): return (double complex)((*(T_##r (*)(T_##a, T_##b))fn)(V_##a(x[0]), V_##b(x[1])));
+#define CASE3(r, a, b, c) case SIG3(r, a, b, c): return (double complex)((*(T_##r (*)(T_##a, T_##b, T_##c))fn)(V_##a(x[0]), V_##b(x[1]), V_##c(x[2])));
+#define CASE4(r, a, b, c, d) case SIG4(r, a, b, c, d): return (double complex)((*(T_##r (*)(T_##a, T_##b, T_##c, T_##d))fn)(V_##a(x[0]), V_##b(x[1]), V_##c(x[2]), V_##d(x[3])));
+
+#define EACH1(r) CASE1(r, d) CASE1(r, z) CASE1(r, i)
+#define EACH2_(r, a) CASE2(r, a, d) CASE2(r, a, z) CASE2(r, a, i)
+#define EACH2(r) EACH2_(r, d) EACH2_(r, z) EACH2_(r, i)
+#define EACH3__(r, a, b) CASE3(r, a, b, d) CASE3(r, a, b, z) CASE3(r, a, b, i)
+#define EACH3_(r, a) EACH3__(r, a, d) EACH3__(r, a, z) EACH3__(r, a, i)
+#define EACH3(r) EACH3_(r, d) EACH3_(r, z) EACH3_(r, i)
+#define EACH4___(r, a, b, c) CASE4(r, a, b, c, d) CASE4(r, a, b, c, z) CASE4(r, a, b, c, i)
+#define EACH4__(r, a, b) EACH4___(r, a, b, d) EACH4___(r, a, b, z) EACH4___(r, a, b, i)
+#define EACH4_(r, a) EACH4__(r, a, d) EACH4__(r, a, z) EACH4__(r, a, i)
+#define EACH4(r) EACH4_(r, d) EACH4_(r, z) EACH4_(r, i)
+#define EACH(r) EACH1(r) EACH2(r) EACH3(r) EACH4(r)
+
+/* the same for functions without complex arguments and return value called with double arguments (see callreal) */
+#define R_d(x) (x)
+#define R_i(x) toint(x)
+#define RCASE1(r, a) case SIG1(r, a): return (double)((*(T_##r (*)(T_##a))fn)(R_##a(x[0])));
+#define RCASE2(r, a, b) case SIG2(r, a, b): return (double)((*(T_##r (*)(T_##a, T_##b))fn)(R_##a(x[0]), R_##b(x[1])));
+#define RCASE3(r, a, b, c) case SIG3(r, a, b, c): return (double)((*(T_##r (*)(T_##a, T_##b, T_##c))fn)(R_##a(x[0]), R_##b(x[1]), R_##c(x[2])));
+#define RCASE4(r, a, b, c, d) case SIG4(r, a, b, c, d): return (double)((*(T_##r (*)(T_##a, T_##b, T_##c, T_##d))fn)(R_##a(x[0]), R_##b(x[1]), R_##c(x[2]), R_##d(x[3])));
+
+#define REACH1(r) RCASE1(r, d) RCASE1(r, i)
+#define REACH2_(r, a) RCASE2(r, a, d) RCASE2(r, a, i)
+#define REACH2(r) REACH2_(r, d) REACH2_(r, i)
+#define REACH3__(r, a, b) RCASE3(r, a, b, d) RCASE3(r, a, b, i)
+#define REACH3_(r, a) REACH3__(r, a, d) REACH3__(r, a, i)
+#define REACH3(r) REACH3_(r, d) REACH3_(r, i)
+#define REACH4___(r, a, b, c) RCASE4(r, a, b, c, d) RCASE4(r, a, b, c, i)
+#define REACH4__(r, a, b) REACH4___(r, a, b, d) REACH4___(r, a, b, i)
+#define REACH4_(r, a) REACH4__(r, a, d) REACH4__(r, a, i)
+#define REACH4(r) REACH4_(r, d) REACH4_(r, i)
+#define REACH(r) REACH1(r) REACH2(r) REACH3(r) REACH4(r)
+
+/* int arguments are truncated and clipped to int range, NaN gives 0 */
+static int toint(double v) {
+  if (v != v) {
     return 0;
   }
-  maxfn = mfn;
-  handle = dlopen(lib, RTLD_LAZY);
-  if (!handle) {
-    printf("init(%s, %ld): cannot load library\n", lib, mfn);
-    return 0;
+  if (v >= 2147483647.0) {
+    return 2147483647;
   }
-  fptra = malloc(maxfn*sizeof(void*));
-  fptra2 = malloc(maxfn*sizeof(void*));
-  fptra3 = malloc(maxfn*sizeof(void*));
-  fptra4 = malloc(maxfn*sizeof(void*));
-  fnames = (char**)malloc(maxfn*sizeof(char*));
-  fnames2 = (char**)malloc(maxfn*sizeof(char*));
-  fnames3 = (char**)malloc(maxfn*sizeof(char*));
-  fnames4 = (char**)malloc(maxfn*sizeof(char*));
-  if (!fptra || !fnames || !fptra2 || !fnames2 || !fptra3 || !fnames3 || !fptra4 || !fnames4) {
-    printf("%s malloc failed\n", lib);
-    return 0;
+  if (v <= -2147483648.0) {
+    return -2147483647 - 1;
   }
-  return 1;
+  return (int)v;
 }
 
-void tidy(void) {
-  if (handle) {
-    dlclose(handle);
-    handle = 0;
-  }
-  if (fptra) {
-    free((void*)fptra);
-    fptra = 0;
-  }
-  if (fptra2) {
-    free((void*)fptra2);
-    fptra2 = 0;
-  }
-  if (fptra3) {
-    free((void*)fptra3);
-    fptra3 = 0;
-  }
-  if (fptra4) {
-    free((void*)fptra4);
-    fptra4 = 0;
-  }
-  if (fnames) {
-    free((void*)fnames);
-    fnames = 0;
-  }
-  if (fnames2) {
-    free((void*)fnames2);
-    fnames2 = 0;
-  }
-  if (fnames3) {
-    free((void*)fnames3);
-    fnames3 = 0;
-  }
-  if (fnames4) {
-    free((void*)fnames4);
-    fnames4 = 0;
-  }
-  nptrs = 0;
-  nptrs2 = 0;
-  nptrs3 = 0;
-  nptrs4 = 0;
+/* call function using its declared signature, returns 0 when signature is not supported */
+double complex callsig(void* fptr, int sig, double complex arg1, double complex arg2, double complex arg3, double complex arg4) {
+  void (*fn)(void);
+  double complex x[4];
+  /* dlsym returns object pointer, copying avoids object to function pointer conversion */
+  memcpy(&fn, &fptr, sizeof(fn));
+  x[0] = arg1;
+  x[1] = arg2;
+  x[2] = arg3;
+  x[3] = arg4;
+  switch (sig) {
+    EACH(d)
+    EACH(z)
+    EACH(i)
+  }
+  return 0.0;
 }
 
+/* callsig for signatures without double complex, arguments and result are passed as double, returns 0 when signature is not supported */
+double callreal(void* fptr, int sig, double arg1, double arg2, double arg3, double arg4) {
+  void (*fn)(void);
+  double x[4];
+  memcpy(&fn, &fptr, sizeof(fn));
+  x[0] = arg1;
+  x[1] = arg2;
+  x[2] = arg3;
+  x[3] = arg4;
+  switch (sig) {
+    REACH(d)
+    REACH(i)
+  }
+  return 0.0;
+}
@@ -1,8 +1,9 @@
 #include "util.h"
 
-double complex byname(char* fname, double complex arg, int* res);
-double complex byname2(char* fname, double complex arg1, double complex arg2, int* res);
-double complex byname3(char* fname, double complex arg1, double complex arg2, double complex arg3, int* res);
-double complex byname4(char* fname, double complex arg1, double complex arg2, double complex arg3, double complex arg4, int* res);
-int init(char* lib, size_t mfn);
-void tidy(void);
+void* lib_open(char* lib);
+void* lib_sym(void* handle, char* fname);
+int lib_close(void* handle);
+char* lib_error(void);
+char* lib_path(void* handle);
+double complex callsig(void* fptr, int sig, double complex arg1, double complex arg2, double complex arg3, double complex arg4);
+double callreal(void* fptr, int sig, double arg1, double arg2, double arg3, double arg4);
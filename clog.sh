@@ -1,2 +1,2 @@
 #!/bin/bash
-LIB="./libjpegbw.so" X=300 Y=300 U="101|fz;r;0.5;255:0:0:255;x1-x2;-0.5:0:0:0;0|fz;i;0.5;0:0:255:255;x1-x2;0:0:-0.5:0;0|fz;m;1;0:255:0:255;x1-x2;0:-0.5:0:0;0" ./cmap out.gif "clog(x1)"
+X=300 Y=300 U="101|fz;r;0.5;255:0:0:255;x1-x2;-0.5:0:0:0;0|fz;i;0.5;0:0:255:255;x1-x2;0:0:-0.5:0;0|fz;m;1;0:255:0:255;x1-x2;0:-0.5:0:0;0" ./cmap out.gif "clog(x1)"
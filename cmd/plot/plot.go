@@ -76,9 +76,9 @@ func makeScene() []float32 {
 			}
 			nf = v
 		}
-		ok := fc.Init(lib, uint(nf))
-		if !ok {
-			panic(fmt.Errorf("LIB init failed for: %s", lib))
+		err := fc.Init(lib, uint(nf))
+		if err != nil {
+			panic(fmt.Errorf("LIB init failed: %w", err))
 		}
 		defer func() { fc.Tidy() }()
 	}
@@ -88,6 +88,7 @@ func makeScene() []float32 {
 	}
 	err = fc.FparOK(1)
 	if err != nil {
+		fmt.Printf("%s", jpegbw.ErrorCaret(err))
 		panic(err)
 	}
 
@@ -1,5 +1,5 @@
 #!/bin/bash
-LIB="./libjpegbw.so" R0=-3.5 R1=3.5 I0=-3.5 I1=3.5 X=500 Y=500 U="
+R0=-3.5 R1=3.5 I0=-3.5 I1=3.5 X=500 Y=500 U="
 101|
 z;  r; 0;     0:  0:  0   :255;  0;        0 :0 :0  :0;0|
 z;  i; 0;     0:  0:  0   :255;  0;        0 :0 :0  :0;0|
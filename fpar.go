@@ -7,91 +7,434 @@ package jpegbw
 import "C"
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"math/cmplx"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"unsafe"
 )
 
-var gmtx [4]sync.RWMutex
+type fparOp int
 
-// FparCtx - context for expression parser
-type FparCtx struct {
-	buffer   string
-	rbuffer  string
-	position int
-	ch       string
-	maxpos   int
-	err      error
-	arg      []complex128
-	nvar     int
-	digits   map[string]struct{}
-	alphas   map[string]struct{}
-	cidents  map[string]*C.char
-	cacheLvl int
-	cacheIdx int
-	cacheL1  map[complex128]complex128
-	cacheL2  map[[2]complex128]complex128
-	cacheL3  map[[3]complex128]complex128
-	cacheL4  map[[4]complex128]complex128
+const (
+	opConst fparOp = iota
+	opArg
+	opNeg
+	opAdd
+	opSub
+	opMul
+	opDiv
+	opMod
+	opPow
+	opLt
+	opGt
+	opLe
+	opGe
+	opEq
+	opNe
+	opOr
+	opAnd
+	opNot
+	opIf
+	opLocal
+	opLet
+	opSeq
+	opCse
+	opFunc
+	opGoFunc
+	opCall
+	opIter
+	opSum
+	opProd
+	opEscape
+	opBound
+	opPowInt
+)
+
+// fparNode - single node of compiled expression tree
+type fparNode struct {
+	op    fparOp
+	val   complex128
+	idx   int
+	name  string
+	vname string
+	off   int
+	fn    func([]complex128) complex128
+	gfn   func(...complex128) (complex128, error)
+	fptr  unsafe.Pointer
+	sig   int
+	rfn   func(float64) (float64, bool)
+	args  []*fparNode
+}
+
+// fparBuiltin - pure Go function callable from expressions, no LIB is needed for those
+type fparBuiltin struct {
+	minArgs int
+	maxArgs int
+	fn      func([]complex128) complex128
+}
+
+func fn1(f func(complex128) complex128) fparBuiltin {
+	return fparBuiltin{1, 1, func(a []complex128) complex128 { return f(a[0]) }}
+}
+
+func fn2(f func(complex128, complex128) complex128) fparBuiltin {
+	return fparBuiltin{2, 2, func(a []complex128) complex128 { return f(a[0], a[1]) }}
+}
+
+func fn3(f func(complex128, complex128, complex128) complex128) fparBuiltin {
+	return fparBuiltin{3, 3, func(a []complex128) complex128 { return f(a[0], a[1], a[2]) }}
 }
 
-func copyL1(i map[complex128]complex128) map[complex128]complex128 {
-	if i == nil {
-		return nil
+func fnReal1(f func(float64) float64) fparBuiltin {
+	return fn1(func(z complex128) complex128 { return complex(f(real(z)), 0.0) })
+}
+
+func fnReal2(f func(float64, float64) float64) fparBuiltin {
+	return fn2(func(z1, z2 complex128) complex128 { return complex(f(real(z1), real(z2)), 0.0) })
+}
+
+// fnParts - apply real function to both real and imaginary parts
+func fnParts(f func(float64) float64) fparBuiltin {
+	return fn1(func(z complex128) complex128 { return complex(f(real(z)), f(imag(z))) })
+}
+
+// fnPick - min/max like functions, returns argument with the lowest/highest real part
+func fnPick(less func(float64, float64) bool) fparBuiltin {
+	return fparBuiltin{2, 4, func(a []complex128) complex128 {
+		v := a[0]
+		for _, z := range a[1:] {
+			if less(real(z), real(v)) {
+				v = z
+			}
+		}
+		return v
+	}}
+}
+
+func frac(x float64) float64 {
+	return x - math.Floor(x)
+}
+
+func sign(z complex128) complex128 {
+	if z == 0 {
+		return 0
+	}
+	return z / complex(cmplx.Abs(z), 0.0)
+}
+
+func clamp(z, lo, hi complex128) complex128 {
+	if real(z) < real(lo) {
+		return lo
 	}
-	o := make(map[complex128]complex128)
-	for k, v := range i {
-		o[k] = v
+	if real(z) > real(hi) {
+		return hi
 	}
-	return o
+	return z
+}
+
+func lerp(a, b, t complex128) complex128 {
+	return a + (b-a)*t
 }
 
-func copyL2(i map[[2]complex128]complex128) map[[2]complex128]complex128 {
-	if i == nil {
-		return nil
+func smoothstep(e0, e1, z complex128) complex128 {
+	t := (real(z) - real(e0)) / (real(e1) - real(e0))
+	t = math.Max(0.0, math.Min(1.0, t))
+	return complex(t*t*(3.0-2.0*t), 0.0)
+}
+
+func step(edge, z complex128) complex128 {
+	return boolVal(real(z) >= real(edge))
+}
+
+func fma(a, b, c complex128) complex128 {
+	return a*b + c
+}
+
+// alpha - same as alpha from libjpegbw.so: ((cos(period*arg+offset)+1)/2)^power
+func alpha(a []complex128) complex128 {
+	return cmplx.Pow(.5*(cmplx.Cos(a[1]*a[0]+a[2])+1.), a[3])
+}
+
+// fparAliases - readable names of positional arguments
+var fparAliases = map[string]int{
+	"gray":  0,
+	"pos":   1,
+	"rg":    2,
+	"ba":    3,
+	"frame": 4,
+}
+
+// fparConsts - built-in constants
+var fparConsts = map[string]complex128{
+	"pi": complex(math.Pi, 0.0),
+	"e":  complex(math.E, 0.0),
+	"i":  complex(0.0, 1.0),
+}
+
+// fparRegFunc - Go function registered via RegisterFunc
+type fparRegFunc struct {
+	nargs int
+	fn    func(...complex128) (complex128, error)
+}
+
+var (
+	regMtx   sync.RWMutex
+	regFuncs = map[string]fparRegFunc{}
+)
+
+// RegisterFunc - register Go function callable from expressions as name(arg1, ..., argN), N = nargs (1-4)
+// Registered functions are found before builtins and LIB's C functions, they are bound when FparOK is called
+// fn can be called from many goroutines at the same time, so it must be safe for concurrent use, it must not keep args slice
+func RegisterFunc(name string, nargs int, fn func(args ...complex128) (complex128, error)) error {
+	if nargs < 1 || nargs > 4 {
+		return fmt.Errorf("RegisterFunc: %s: number of arguments must be from 1-4 range, got %d", name, nargs)
 	}
-	o := make(map[[2]complex128]complex128)
-	for k, v := range i {
-		o[k] = v
+	if fn == nil {
+		return fmt.Errorf("RegisterFunc: %s: nil function", name)
 	}
-	return o
+	name = strings.ToLower(name)
+	if name == "if" || !validIdent(name) {
+		return fmt.Errorf("RegisterFunc: invalid function name '%s'", name)
+	}
+	regMtx.Lock()
+	regFuncs[name] = fparRegFunc{nargs: nargs, fn: fn}
+	regMtx.Unlock()
+	return nil
 }
 
-func copyL3(i map[[3]complex128]complex128) map[[3]complex128]complex128 {
-	if i == nil {
-		return nil
+// validIdent - name can be used in expressions: lower case letters, digits (not first) and '_'
+func validIdent(name string) bool {
+	if name == "" {
+		return false
 	}
-	o := make(map[[3]complex128]complex128)
-	for k, v := range i {
-		o[k] = v
+	for i, c := range name {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (i > 0 && c >= '0' && c <= '9')) {
+			return false
+		}
 	}
-	return o
+	return true
 }
 
-func copyL4(i map[[4]complex128]complex128) map[[4]complex128]complex128 {
-	if i == nil {
-		return nil
+// FuncInfo - function callable from expressions
+// Lib is library path for C functions, "builtin" for built-in functions and "go" for functions registered via RegisterFunc
+// Proto is declared C prototype (Go prototype for plugin's functions, syntax for loops like iter), empty when it is not declared (then function takes 1-4 double complex arguments)
+type FuncInfo struct {
+	Name    string
+	Lib     string
+	Proto   string
+	MinArgs int
+	MaxArgs int
+}
+
+// BuiltinFunctions - lists built-in and registered Go functions sorted by name
+func BuiltinFunctions() []FuncInfo {
+	funcs := []FuncInfo{}
+	regMtx.RLock()
+	for name, rf := range regFuncs {
+		funcs = append(funcs, FuncInfo{Name: name, Lib: "go", MinArgs: rf.nargs, MaxArgs: rf.nargs})
+	}
+	regMtx.RUnlock()
+	for name, bf := range fparBuiltins {
+		funcs = append(funcs, FuncInfo{Name: name, Lib: "builtin", MinArgs: bf.minArgs, MaxArgs: bf.maxArgs})
 	}
-	o := make(map[[4]complex128]complex128)
-	for k, v := range i {
-		o[k] = v
+	for name, lp := range fparLoops {
+		funcs = append(funcs, FuncInfo{Name: name, Lib: "builtin", Proto: lp.syntax, MinArgs: lp.nargs, MaxArgs: lp.nargs})
 	}
-	return o
+	funcs = append(funcs, FuncInfo{Name: "lut", Lib: "builtin", Proto: lutSyntax, MinArgs: 2, MaxArgs: 3})
+	sort.Slice(funcs, func(i, j int) bool {
+		if funcs[i].Name == funcs[j].Name {
+			return funcs[i].Lib < funcs[j].Lib
+		}
+		return funcs[i].Name < funcs[j].Name
+	})
+	return funcs
+}
+
+// fparBuiltins - functions resolved before falling back to LIB, C99 complex names are aliases
+var fparBuiltins = map[string]fparBuiltin{
+	"sin":        fn1(cmplx.Sin),
+	"cos":        fn1(cmplx.Cos),
+	"tan":        fn1(cmplx.Tan),
+	"asin":       fn1(cmplx.Asin),
+	"acos":       fn1(cmplx.Acos),
+	"atan":       fn1(cmplx.Atan),
+	"sinh":       fn1(cmplx.Sinh),
+	"cosh":       fn1(cmplx.Cosh),
+	"tanh":       fn1(cmplx.Tanh),
+	"asinh":      fn1(cmplx.Asinh),
+	"acosh":      fn1(cmplx.Acosh),
+	"atanh":      fn1(cmplx.Atanh),
+	"exp":        fn1(cmplx.Exp),
+	"log":        fn1(cmplx.Log),
+	"log10":      fn1(cmplx.Log10),
+	"log2":       fn1(func(z complex128) complex128 { return cmplx.Log(z) / math.Ln2 }),
+	"sqrt":       fn1(cmplx.Sqrt),
+	"cbrt":       fnReal1(math.Cbrt),
+	"pow":        fn2(cmplx.Pow),
+	"abs":        fn1(func(z complex128) complex128 { return complex(cmplx.Abs(z), 0.0) }),
+	"arg":        fn1(func(z complex128) complex128 { return complex(cmplx.Phase(z), 0.0) }),
+	"conj":       fn1(cmplx.Conj),
+	"re":         fn1(func(z complex128) complex128 { return complex(real(z), 0.0) }),
+	"im":         fn1(func(z complex128) complex128 { return complex(imag(z), 0.0) }),
+	"sign":       fn1(sign),
+	"floor":      fnParts(math.Floor),
+	"ceil":       fnParts(math.Ceil),
+	"round":      fnParts(math.Round),
+	"trunc":      fnParts(math.Trunc),
+	"frac":       fnParts(frac),
+	"atan2":      fnReal2(math.Atan2),
+	"hypot":      fnReal2(math.Hypot),
+	"erf":        fnReal1(math.Erf),
+	"gamma":      fnReal1(math.Gamma),
+	"min":        fnPick(func(x, y float64) bool { return x < y }),
+	"max":        fnPick(func(x, y float64) bool { return x > y }),
+	"clamp":      fn3(clamp),
+	"lerp":       fn3(lerp),
+	"smoothstep": fn3(smoothstep),
+	"step":       fn2(step),
+	"fma":        fn3(fma),
+	"alpha":      {4, 4, alpha},
+	"rand":       {1, 2, randFn},
+	"hash":       fn1(hashFn),
+	"perlin":     {2, 3, noiseFn(perlin2, true)},
+	"simplex":    {2, 3, noiseFn(simplex2, true)},
+	"worley":     {2, 3, noiseFn(worley2, false)},
+	"fbm":        {2, 4, fbmFn},
+	"csin":       fn1(cmplx.Sin),
+	"ccos":       fn1(cmplx.Cos),
+	"ctan":       fn1(cmplx.Tan),
+	"casin":      fn1(cmplx.Asin),
+	"cacos":      fn1(cmplx.Acos),
+	"catan":      fn1(cmplx.Atan),
+	"csinh":      fn1(cmplx.Sinh),
+	"ccosh":      fn1(cmplx.Cosh),
+	"ctanh":      fn1(cmplx.Tanh),
+	"casinh":     fn1(cmplx.Asinh),
+	"cacosh":     fn1(cmplx.Acosh),
+	"catanh":     fn1(cmplx.Atanh),
+	"cexp":       fn1(cmplx.Exp),
+	"clog":       fn1(cmplx.Log),
+	"csqrt":      fn1(cmplx.Sqrt),
+	"cpow":       fn2(cmplx.Pow),
+	"cabs":       fn1(func(z complex128) complex128 { return complex(cmplx.Abs(z), 0.0) }),
+	"carg":       fn1(func(z complex128) complex128 { return complex(cmplx.Phase(z), 0.0) }),
+	"creal":      fn1(func(z complex128) complex128 { return complex(real(z), 0.0) }),
+	"cimag":      fn1(func(z complex128) complex128 { return complex(imag(z), 0.0) }),
+}
+
+// ParseError - syntax error in expression, Offset is 0-based byte offset in the original expression
+type ParseError struct {
+	Expr     string
+	Offset   int
+	Msg      string
+	Expected string
+	Found    string
+	Hint     string
+}
+
+func (e *ParseError) Error() string {
+	if e.Hint != "" {
+		return fmt.Sprintf("%s: expected %s, found %s at offset %d, did you mean %s?", e.Msg, e.Expected, e.Found, e.Offset, e.Hint)
+	}
+	return fmt.Sprintf("%s: expected %s, found %s at offset %d", e.Msg, e.Expected, e.Found, e.Offset)
+}
+
+// Caret - returns the expression line containing error and a caret under the failing column
+func (e *ParseError) Caret() string {
+	off := e.Offset
+	if off > len(e.Expr) {
+		off = len(e.Expr)
+	}
+	start := strings.LastIndex(e.Expr[:off], "\n") + 1
+	end := strings.Index(e.Expr[off:], "\n")
+	if end < 0 {
+		end = len(e.Expr)
+	} else {
+		end += off
+	}
+	pad := []byte(e.Expr[start:off])
+	for i, c := range pad {
+		if c != '\t' {
+			pad[i] = ' '
+		}
+	}
+	return e.Expr[start:end] + "\n" + string(pad) + "^\n"
+}
+
+// EvalError - error calling function while evaluating expression
+// Err is an error returned by function registered via RegisterFunc
+type EvalError struct {
+	Func string
+	Args []complex128
+	Err  error
+}
+
+func (e *EvalError) Error() string {
+	return fmt.Sprintf("error calling %d argument(s) function %s%v: %v", len(e.Args), e.Func, e.Args, e.Err)
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCaret - returns ParseError's caret diagnostics if err is ParseError, empty string otherwise
+func ErrorCaret(err error) string {
+	var pe *ParseError
+	if errors.As(err, &pe) {
+		return pe.Caret()
+	}
+	return ""
+}
+
+// FparCtx - context for expression parser
+type FparCtx struct {
+	buffer   string
+	rbuffer  string
+	position int
+	ch       string
+	maxpos   int
+	err      error
+	arg      []complex128
+	nvar     int
+	digits   map[string]struct{}
+	alphas   map[string]struct{}
+	tree     *fparNode
+	parsed   *fparNode
+	stack    []complex128
+	locals   map[string]int
+	nlocals  int
+	vars     []complex128
+	ncse     int
+	cseGen   []uint64
+	cseVal   []complex128
+	gen      uint64
+	used     []bool
+	external bool
+	cache    *fparCache
+	rows     *rowState
+	loader   *Loader
+	realOK   bool
+	realArgs []bool
+	noReal   bool
+	varsR    []float64
+	cseValR  []float64
+	rfail    bool
 }
 
 // Cpy - copies one context to the another, it is partially shallow copy (we copy references to maps not maps)
+// Copy holds its own reference to the loader, so each copy should be released by Tidy like the original
 func (ctx *FparCtx) Cpy() FparCtx {
 	// debug: fmt.Printf("copying context\n")
 	// We just copy references to maps, not maps, but init is only called from single thread and then map is only read not modified
-
-	// Not sure if this is safe, but seems like we can skip mutex when copying context
-	//if ctx.cacheLvl > 0 {
-	//  gmtx[ctx.cacheIdx].Lock()
-	//  defer func() { gmtx[ctx.cacheIdx].Unlock() }()
-	//}
+	// Cache and loader are shared too, they are safe for concurrent use, libraries are closed when the last context using them is tidied
+	if ctx.loader != nil {
+		ctx.loader.retain()
+	}
 	return FparCtx{
 		buffer:   ctx.buffer,
 		rbuffer:  ctx.rbuffer,
@@ -103,65 +446,46 @@ func (ctx *FparCtx) Cpy() FparCtx {
 		nvar:     ctx.nvar,
 		digits:   ctx.digits,
 		alphas:   ctx.alphas,
-		cidents:  ctx.cidents,
-		cacheLvl: ctx.cacheLvl,
-		cacheIdx: ctx.cacheIdx,
-		cacheL1:  ctx.cacheL1,
-		cacheL2:  ctx.cacheL2,
-		cacheL3:  ctx.cacheL3,
-		cacheL4:  ctx.cacheL4,
-		//cacheL1:  copyL1(ctx.cacheL1),
-		//cacheL2:  copyL2(ctx.cacheL2),
-		//cacheL3:  copyL3(ctx.cacheL3),
-		//cacheL4:  copyL4(ctx.cacheL4),
-	}
-}
-
-// Init - initialize context, allocate internal C structs
-func (ctx *FparCtx) Init(lib string, n uint) bool {
-	// debug: fmt.Printf("init library: %s,%d\n", lib, n)
-	clib := C.CString(lib)
-	defer C.free(unsafe.Pointer(clib))
-	return C.init(clib, C.size_t(n)) == 1
+		tree:     ctx.tree,
+		parsed:   ctx.parsed,
+		nlocals:  ctx.nlocals,
+		ncse:     ctx.ncse,
+		used:     ctx.used,
+		external: ctx.external,
+		cache:    ctx.cache,
+		loader:   ctx.loader,
+		realOK:   ctx.realOK,
+		realArgs: ctx.realArgs,
+		noReal:   ctx.noReal,
+	}
 }
 
-// SetCache - sets N dimensional cache, I is color idx R=0, G=1, B=2, A=3
-// Not thread safe, should be called before using multiple threads
-func (ctx *FparCtx) SetCache(n, i int) {
-	if n < 1 || n > 4 || i < 0 || i >= 4 {
-		return
+// Init - open C libraries (':' separated) used by this context, n is the maximum number of distinct C functions
+// Each context has its own loader (shared with its copies), use SetLoader to share it with other contexts
+func (ctx *FparCtx) Init(lib string, n uint) error {
+	// debug: fmt.Printf("init library: %s,%d\n", lib, n)
+	if n < 1 {
+		return fmt.Errorf("init(%s, %d): n must be >= 1", lib, n)
 	}
-	ctx.cacheIdx = i
-	ctx.cacheLvl = n
-	if n == 1 {
-		ctx.cacheL1 = make(map[complex128]complex128)
-	} else if n == 2 {
-		ctx.cacheL2 = make(map[[2]complex128]complex128)
-	} else if n == 3 {
-		ctx.cacheL3 = make(map[[3]complex128]complex128)
-	} else {
-		ctx.cacheL4 = make(map[[4]complex128]complex128)
+	l, err := NewLoader(lib, int(n))
+	if err != nil {
+		return fmt.Errorf("init(%s, %d): %w", lib, n, err)
 	}
+	ctx.releaseLoader()
+	ctx.loader = l
+	return nil
 }
 
-// Tidy - free memory, release context, deallocate insternal C structs
-func (ctx *FparCtx) Tidy() {
-	ctx.freeCIdents()
-	C.tidy()
-}
-
-func (ctx *FparCtx) freeCIdents() {
-	if ctx.cidents != nil {
-		for _, cident := range ctx.cidents {
-			C.free(unsafe.Pointer(cident))
-		}
-		ctx.cidents = nil
-	}
+// SetCache - sets N dimensional cache of DefaultCacheSize values, each context has its own cache (shared with its copies)
+// I (color idx) is not used anymore, it is kept for compatibility
+// Not thread safe, should be called before using multiple threads
+func (ctx *FparCtx) SetCache(n, i int) {
+	ctx.SetCacheSize(n, DefaultCacheSize)
 }
 
-func (ctx *FparCtx) makeCIdents() {
-	ctx.freeCIdents()
-	ctx.cidents = make(map[string]*C.char)
+// Tidy - release context's C libraries, they are closed when no other context uses them
+func (ctx *FparCtx) Tidy() {
+	ctx.releaseLoader()
 }
 
 func (ctx *FparCtx) zeroVect() []complex128 {
@@ -211,6 +535,95 @@ func (ctx *FparCtx) pos() string {
 	return fmt.Sprintf("'%s;%s' (%d/%d,ch=%s)", s1, s2, ctx.position, ctx.maxpos, ctx.ch)
 }
 
+// offset - offset of the current character in the expression
+func (ctx *FparCtx) offset() int {
+	if ctx.position > 0 {
+		return ctx.position - 1
+	}
+	return 0
+}
+
+// found - current character description for ParseError
+func (ctx *FparCtx) found() string {
+	if ctx.ch == "" || (ctx.ch == ";" && ctx.position >= ctx.maxpos) {
+		return "end of expression"
+	}
+	return "'" + ctx.rbuffer[ctx.position-1:ctx.position] + "'"
+}
+
+// syntaxErr - sets ParseError at the current character
+func (ctx *FparCtx) syntaxErr(msg, expected string) {
+	ctx.syntaxErrAt(ctx.offset(), msg, expected, ctx.found())
+}
+
+func (ctx *FparCtx) syntaxErrAt(off int, msg, expected, found string) {
+	ctx.er(&ParseError{Expr: ctx.rbuffer[:ctx.maxpos-1], Offset: off, Msg: msg, Expected: expected, Found: found})
+}
+
+// hint - adds "did you mean" hint to the current parse error
+func (ctx *FparCtx) hint(hint string) {
+	var pe *ParseError
+	if hint != "" && errors.As(ctx.err, &pe) && pe.Hint == "" {
+		pe.Hint = hint
+	}
+}
+
+// suggest - returns the candidate closest to name (edit distance), empty string if none is close enough
+// Candidates with the same distance are compared by common prefix length ('sinn' -> 'sin' not 'sign') and then by name
+func suggest(name string, candidates []string) string {
+	maxDist := len(name)/3 + 1
+	if maxDist > 3 {
+		maxDist = 3
+	}
+	best, bestDist, bestPrefix := "", maxDist+1, 0
+	for _, c := range candidates {
+		d := editDistance(name, c)
+		if d == 0 || d > bestDist {
+			continue
+		}
+		p := commonPrefix(name, c)
+		if d < bestDist || p > bestPrefix || (p == bestPrefix && c < best) {
+			best, bestDist, bestPrefix = c, d, p
+		}
+	}
+	return best
+}
+
+func commonPrefix(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// editDistance - Levenshtein distance
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j] + 1
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+			if prev[j-1]+cost < curr[j] {
+				curr[j] = prev[j-1] + cost
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
 func (ctx *FparCtx) isDigit() bool {
 	_, ok := ctx.digits[ctx.ch]
 	// debug2: fmt.Printf("isDigit: position: %s -> %t\n", ctx.pos(), ok)
@@ -228,22 +641,45 @@ func (ctx *FparCtx) FparFunction(def string) error {
 	if def == "" {
 		return fmt.Errorf("FparFunction: empty function definition")
 	}
-	ctx.rbuffer = strings.Replace(def, ";", "", -1) + ";"
-	ctx.buffer = strings.ToLower(ctx.rbuffer)
+	ctx.rbuffer = def + ";"
+	// lower case ASCII only, so offsets in buffer and rbuffer are the same
+	ctx.buffer = strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, ctx.rbuffer)
 	ctx.maxpos = len(ctx.buffer)
 	ctx.makeDigits()
 	ctx.makeAlphas()
-	ctx.makeCIdents()
+	ctx.tree = nil
+	ctx.parsed = nil
 	ctx.err = nil
 	return nil
 }
 
-// FparOK - check if definition is correct
+// FparOK - check if definition is correct, compiles it into expression tree evaluated by FparF
 func (ctx *FparCtx) FparOK(nvar int) error {
 	if nvar < 1 {
 		return fmt.Errorf("FparOK: must be positive, got %v", nvar)
 	}
 	ctx.nvar = nvar
+	ctx.tree = nil
+	ctx.parsed = nil
+	ctx.err = nil
+	ctx.position = 0
+	ctx.ch = ""
+	ctx.locals = make(map[string]int)
+	ctx.nlocals = 0
+	tree := ctx.statements()
+	if ctx.ch != ";" {
+		ctx.syntaxErr("unexpected input after expression", "operator or end of expression")
+	}
+	if ctx.err != nil {
+		return ctx.err
+	}
+	ctx.parsed = cloneNode(tree)
+	ctx.tree = ctx.optimize(tree)
 	_, _ = ctx.FparF(ctx.zeroVect())
 	return ctx.err
 }
@@ -299,15 +735,73 @@ func (ctx *FparCtx) parseComplex(arg string) (complex128, error) {
 	return complex(re, im), nil
 }
 
+// peek - returns n-th character after the current one without consuming anything
+func (ctx *FparCtx) peek(n int) string {
+	return ctx.peekAt(ctx.position + n)
+}
+
+// peekAt - returns character at given buffer position or empty string if out of range
+func (ctx *FparCtx) peekAt(p int) string {
+	if p < 0 || p >= ctx.maxpos {
+		return ""
+	}
+	return ctx.buffer[p : p+1]
+}
+
+func isDecDigit(c string) bool {
+	return c != "" && c[0] >= '0' && c[0] <= '9'
+}
+
+// isExponent - current 'e' starts exponent when it follows mantissa and is followed by [+-]digit
+func (ctx *FparCtx) isExponent(digitStr string) bool {
+	l := len(digitStr)
+	if ctx.ch != "e" || l == 0 || !(isDecDigit(digitStr[l-1:]) || digitStr[l-1:] == ".") {
+		return false
+	}
+	next := ctx.peek(0)
+	if next == "+" || next == "-" {
+		next = ctx.peek(1)
+	}
+	return isDecDigit(next)
+}
+
+// isImagSuffix - current 'i' or 'j' is imaginary unit suffix (3+4i), not a start of an identifier
+func (ctx *FparCtx) isImagSuffix() bool {
+	if ctx.ch != "i" && ctx.ch != "j" {
+		return false
+	}
+	_, alpha := ctx.alphas[ctx.peek(0)]
+	_, digit := ctx.digits[ctx.peek(0)]
+	return !alpha && !digit
+}
+
 func (ctx *FparCtx) readNumber() complex128 {
+	off := ctx.offset()
 	digitStr := ""
-	for ctx.isDigit() {
-		digitStr += ctx.ch
-		ctx.readNextChar()
+	for {
+		if ctx.isDigit() {
+			digitStr += ctx.ch
+			ctx.readNextChar()
+		} else if ctx.isExponent(digitStr) {
+			digitStr += ctx.ch
+			ctx.readNextChar()
+			if ctx.ch == "+" || ctx.ch == "-" {
+				digitStr += ctx.ch
+				ctx.readNextChar()
+			}
+		} else {
+			break
+		}
 	}
 	f, err := ctx.parseComplex(digitStr)
+	if ctx.isImagSuffix() {
+		f *= complex(0.0, 1.0)
+		ctx.readNextChar()
+	}
 	// debug: fmt.Printf("readNumber: position: %s -> (%s,%f,%v)\n", ctx.pos(), digitStr, f, err)
-	ctx.er(err)
+	if err != nil {
+		ctx.syntaxErrAt(off, "invalid number", "number", "'"+ctx.rbuffer[off:off+len(digitStr)]+"'")
+	}
 	return f
 }
 
@@ -320,132 +814,304 @@ func (ctx *FparCtx) readIdent() string {
 			ctx.readNextChar()
 		}
 	} else {
-		ctx.er(fmt.Errorf("readIdent: expected function name or variable: position: %s", ctx.pos()))
+		ctx.syntaxErr("syntax error", "number, '(', function name or variable")
 	}
 	ctx.skipBlanks()
 	// debug: fmt.Printf("readIdent: position: %s -> %s\n", ctx.pos(), ident)
 	return ident
 }
 
-func (ctx *FparCtx) callFunction(ident string) (complex128, bool) {
+func (ctx *FparCtx) callFunction(ident string, off int) (*fparNode, bool) {
 	// debug: fmt.Printf("callFunction: position: %s %s(...)\n", ctx.pos(), ident)
 	ctx.skipBlanks()
-	res := 10
 	if ctx.ch == "(" {
-		// cident := C.CString(ident)
-		// defer C.free(unsafe.Pointer(cident))
-		var cident *C.char
-		cident, ok := ctx.cidents[ident]
-		if !ok {
-			cident = C.CString(ident)
-			ctx.cidents[ident] = cident
-			// debug: fmt.Printf("callFunction: position: %s added '%s' to cache\n", ctx.pos(), ident)
-		}
-		res1 := ctx.expression()
-		ctx.skipBlanks()
-		v := complex(0.0, 0.0)
-		if ctx.ch == ")" {
-			v = complex128(C.byname(cident, C.complexdouble(res1), (*C.int)(unsafe.Pointer(&res))))
-			// info: fmt.Printf("callFunction: position: %s %s(%f) -> (%f,%d)\n", ctx.pos(), ident, res1, v, res)
-			ctx.readNextChar()
-			ctx.skipBlanks()
-			if res != 0 {
-				ctx.er(fmt.Errorf("error %d calling 1 argument function %s(%f): position: %s", res, ident, res1, ctx.pos()))
-				return 0.0, false
-			}
-		} else if ctx.ch == "," {
-			ctx.skipBlanks()
-			res2 := ctx.expression()
+		node := &fparNode{op: opCall, name: ident, off: off}
+		for {
+			node.args = append(node.args, ctx.expression())
 			ctx.skipBlanks()
+			nargs := len(node.args)
 			if ctx.ch == ")" {
-				v = complex128(C.byname2(cident, C.complexdouble(res1), C.complexdouble(res2), (*C.int)(unsafe.Pointer(&res))))
-				// info: fmt.Printf("callFunction: position: %s %s(%f,%f) -> (%f,%d)\n", ctx.pos(), ident, res1, res2, v, res)
+				// info: fmt.Printf("callFunction: position: %s %s(%d args)\n", ctx.pos(), ident, nargs)
 				ctx.readNextChar()
 				ctx.skipBlanks()
-				if res != 0 {
-					ctx.er(fmt.Errorf("error %d calling 2 arguments function %s(%f,%f): position: %s", res, ident, res1, res2, ctx.pos()))
-					return 0.0, false
-				}
-			} else if ctx.ch == "," {
-				ctx.skipBlanks()
-				res3 := ctx.expression()
-				ctx.skipBlanks()
-				if ctx.ch == ")" {
-					v = complex128(C.byname3(cident, C.complexdouble(res1), C.complexdouble(res2), C.complexdouble(res3), (*C.int)(unsafe.Pointer(&res))))
-					// info: fmt.Printf("callFunction: position: %s %s(%f,%f,%f) -> (%f,%d)\n", ctx.pos(), ident, res1, res2, res3, v, res)
-					ctx.readNextChar()
-					ctx.skipBlanks()
-					if res != 0 {
-						ctx.er(fmt.Errorf("error %d calling 3 arguments function %s(%f,%f,%f): position: %s", res, ident, res1, res2, res3, ctx.pos()))
-						return 0.0, false
-					}
-				} else if ctx.ch == "," {
-					ctx.skipBlanks()
-					res4 := ctx.expression()
-					ctx.skipBlanks()
-					if ctx.ch == ")" {
-						v = complex128(C.byname4(cident, C.complexdouble(res1), C.complexdouble(res2), C.complexdouble(res3), C.complexdouble(res4), (*C.int)(unsafe.Pointer(&res))))
-						// info: fmt.Printf("callFunction: position: %s %s(%f,%f,%f,%f) -> (%f,%d)\n", ctx.pos(), ident, res1, res2, res3, res4, v, res)
-						ctx.readNextChar()
-						ctx.skipBlanks()
-						if res != 0 {
-							ctx.er(fmt.Errorf("error %d calling 4 arguments function %s(%f,%f,%f,%f): position: %s", res, ident, res1, res2, res3, res4, ctx.pos()))
-							return 0.0, false
-						}
-					} else {
-						ctx.er(fmt.Errorf("expected: ')' after 4 arguments function %s(%f,%f,%f: position: %s", ident, res1, res2, res3, ctx.pos()))
-						return 0.0, false
-					}
+				return node, ctx.resolveFunction(node)
+			}
+			if ctx.ch != "," || nargs == 4 {
+				if nargs == 4 {
+					ctx.syntaxErr(fmt.Sprintf("function %s can have at most 4 arguments", ident), "')'")
 				} else {
-					ctx.er(fmt.Errorf("expected: ')' after 3 arguments function %s(%f,%f,: position: %s", ident, res1, res2, ctx.pos()))
-					return 0.0, false
+					ctx.syntaxErr(fmt.Sprintf("function %s arguments", ident), "',' or ')'")
 				}
-			} else {
-				ctx.er(fmt.Errorf("expected: ')' after 2 arguments function %s(%f,: position: %s", ident, res1, ctx.pos()))
-				return 0.0, false
+				return nil, false
 			}
-		} else {
-			ctx.er(fmt.Errorf("expected: ')' after 1 argument function %s: position: %s", ident, ctx.pos()))
-			return 0.0, false
+			ctx.skipBlanks()
+		}
+	}
+	ctx.syntaxErrAt(off, fmt.Sprintf("'%s' is not a variable, so it must be a function call", ident), "'('", ctx.found())
+	if ident != "" {
+		ctx.hint(suggest(ident, ctx.variableNames()))
+	}
+	return nil, false
+}
+
+// variableNames - names that can be used as variables at current position
+func (ctx *FparCtx) variableNames() []string {
+	names := []string{}
+	for i := 1; i <= ctx.nvar; i++ {
+		names = append(names, fmt.Sprintf("x%d", i))
+	}
+	for name, idx := range fparAliases {
+		if idx < ctx.nvar {
+			names = append(names, name)
 		}
-		return v, true
 	}
-	ctx.er(fmt.Errorf("callFunction: expected '(' after %s: position: %s", ident, ctx.pos()))
-	return 0.0, false
+	for name := range fparConsts {
+		names = append(names, name)
+	}
+	for name := range ctx.locals {
+		names = append(names, name)
+	}
+	return names
 }
 
-func (ctx *FparCtx) argVal(ident string) (complex128, bool) {
+// functionNames - names of all functions that can be called: registered, builtin and LIB's
+func (ctx *FparCtx) functionNames() []string {
+	names := []string{}
+	for _, f := range BuiltinFunctions() {
+		names = append(names, f.Name)
+	}
+	return append(names, ctx.libFunctionNames()...)
+}
+
+// libFunctionNames - names of functions exported by LIB
+func (ctx *FparCtx) libFunctionNames() []string {
+	names := []string{}
+	if ctx.loader != nil {
+		funcs, err := ctx.loader.Functions()
+		if err == nil {
+			for _, f := range funcs {
+				names = append(names, f.Name)
+			}
+		}
+	}
+	return names
+}
+
+// prefixed - name with LibPrefix, empty string stays empty
+func prefixed(name string) string {
+	if name == "" {
+		return ""
+	}
+	return LibPrefix + name
+}
+
+// LibPrefix - prefix of function names that are only resolved in LIB, lib.alpha(...) calls LIB's alpha even if alpha is built-in
+const LibPrefix = "lib."
+
+// resolveFunction - bind call node to registered Go function, builtin function or LIB's C function (in that order)
+// Names with LibPrefix are only resolved in LIB
+func (ctx *FparCtx) resolveFunction(node *fparNode) bool {
+	nargs := len(node.args)
+	name := node.name
+	libOnly := strings.HasPrefix(name, LibPrefix)
+	if libOnly {
+		name = name[len(LibPrefix):]
+	}
+	regMtx.RLock()
+	rf, ok := regFuncs[node.name]
+	regMtx.RUnlock()
+	if ok && !libOnly {
+		if nargs != rf.nargs {
+			ctx.syntaxErrAt(node.off, fmt.Sprintf("function %s", node.name), fmt.Sprintf("%d argument(s)", rf.nargs), fmt.Sprintf("%d", nargs))
+			return false
+		}
+		node.op = opGoFunc
+		node.gfn = rf.fn
+		return true
+	}
+	bf, ok := fparBuiltins[node.name]
+	if ok && !libOnly {
+		if nargs < bf.minArgs || nargs > bf.maxArgs {
+			expected := fmt.Sprintf("%d argument(s)", bf.minArgs)
+			if bf.minArgs != bf.maxArgs {
+				expected = fmt.Sprintf("%d-%d arguments", bf.minArgs, bf.maxArgs)
+			}
+			ctx.syntaxErrAt(node.off, fmt.Sprintf("function %s", node.name), expected, fmt.Sprintf("%d", nargs))
+			return false
+		}
+		node.op = opFunc
+		node.fn = bf.fn
+		return true
+	}
+	if ctx.loader == nil {
+		expected := "built-in or registered function"
+		if libOnly {
+			expected = "LIB function"
+		}
+		ctx.syntaxErrAt(node.off, "unknown function (no LIB loaded)", expected, node.name)
+		ctx.hint(suggest(node.name, ctx.functionNames()))
+		return false
+	}
+	f, found, err := ctx.loader.resolve(name)
+	if err != nil {
+		ctx.syntaxErrAt(node.off, err.Error(), "LIB function", node.name)
+		if !found && libOnly {
+			ctx.hint(prefixed(suggest(name, ctx.libFunctionNames())))
+		} else if !found {
+			ctx.hint(suggest(node.name, ctx.functionNames()))
+		}
+		return false
+	}
+	if f.gfn != nil {
+		if nargs != f.nargs {
+			ctx.syntaxErrAt(node.off, fmt.Sprintf("function %s", node.name), fmt.Sprintf("%d argument(s)", f.nargs), fmt.Sprintf("%d", nargs))
+			return false
+		}
+		node.op = opGoFunc
+		node.gfn = f.gfn
+		return true
+	}
+	sig := defaultSig(nargs)
+	if f.decl {
+		if nargs != len(f.sig.args) {
+			ctx.syntaxErrAt(node.off, fmt.Sprintf("function %s declared as %s", node.name, f.sig), fmt.Sprintf("%d argument(s)", len(f.sig.args)), fmt.Sprintf("%d", nargs))
+			return false
+		}
+		sig = f.sig
+	}
+	// debug: fmt.Printf("resolveFunction: position: %s resolved '%s' %v\n", ctx.pos(), node.name, sig)
+	node.fptr = f.fptr
+	node.sig = sig.code()
+	return true
+}
+
+func (ctx *FparCtx) argIdx(ident string) (int, bool) {
 	if ident == "" {
-		// debug: fmt.Printf("argVal: position: %s '' -> 0,false\n", ctx.pos())
-		return 0.0, false
+		// debug: fmt.Printf("argIdx: position: %s '' -> 0,false\n", ctx.pos())
+		return 0, false
 	}
 	if ident[:1] == "x" {
 		num, err := strconv.Atoi(ident[1:])
 		if err != nil || num < 1 || num > ctx.nvar {
-			// debug: fmt.Printf("argVal: position: %s ident=%s -> (%d,%v) -> 0,false\n", ctx.pos(), ident, num, err)
-			return 0.0, false
+			// debug: fmt.Printf("argIdx: position: %s ident=%s -> (%d,%v) -> 0,false\n", ctx.pos(), ident, num, err)
+			return 0, false
 		}
-		// debug: fmt.Printf("argVal: position: %s ident=%s -> x%d -> %f,true\n", ctx.pos(), ident, num, ctx.arg[num-1])
-		return ctx.arg[num-1], true
+		// debug: fmt.Printf("argIdx: position: %s ident=%s -> x%d,true\n", ctx.pos(), ident, num)
+		return num - 1, true
+	}
+	// debug: fmt.Printf("argIdx: position: %s ident=%s -> 0,false\n", ctx.pos(), ident)
+	return 0, false
+}
+
+// assignment - checks if statement starting at current position is 'name = expression;' followed by another statement
+// last statement is always an expression, so 'x1=0.5' alone is still a comparison
+func (ctx *FparCtx) assignment() (string, int, int, bool) {
+	p := ctx.position
+	for p < ctx.maxpos && strings.TrimSpace(ctx.buffer[p:p+1]) == "" {
+		p++
+	}
+	start := p
+	for p < ctx.maxpos {
+		c := ctx.buffer[p]
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (p > start && c >= '0' && c <= '9')) {
+			break
+		}
+		p++
+	}
+	name := ctx.buffer[start:p]
+	for p < ctx.maxpos && strings.TrimSpace(ctx.buffer[p:p+1]) == "" {
+		p++
+	}
+	if name == "" || p >= ctx.maxpos || ctx.buffer[p] != '=' || ctx.peekAt(p+1) == "=" {
+		return "", 0, 0, false
+	}
+	end := strings.Index(ctx.buffer[p:], ";")
+	if end < 0 || strings.Trim(ctx.buffer[p+end:], " \t\r\n;") == "" {
+		return "", 0, 0, false
+	}
+	return name, start, p + 1, true
+}
+
+// statements - parse 'name = expression; ...; expression', bindings are visible in all following statements
+func (ctx *FparCtx) statements() *fparNode {
+	var stmts []*fparNode
+	for {
+		name, start, next, ok := ctx.assignment()
+		if !ok {
+			break
+		}
+		if !ctx.bindable(name) {
+			ctx.syntaxErrAt(start, fmt.Sprintf("cannot assign to '%s'", name), "local variable name", "'"+ctx.rbuffer[start:start+len(name)]+"'")
+			return nil
+		}
+		ctx.position = next
+		ctx.ch = "="
+		e := ctx.expression()
+		if ctx.ch != ";" {
+			ctx.syntaxErr(fmt.Sprintf("'%s' assignment", name), "';'")
+			return nil
+		}
+		// new slot for each assignment, so 'a = a + 1' uses previous 'a' on the right side
+		ctx.locals[name] = ctx.nlocals
+		stmts = append(stmts, &fparNode{op: opLet, idx: ctx.nlocals, name: name, args: []*fparNode{e}})
+		ctx.nlocals++
+		ctx.ch = ""
+	}
+	e := ctx.expression()
+	if ctx.ch == ";" && strings.Trim(ctx.buffer[ctx.position:], " \t\r\n;") != "" {
+		ctx.syntaxErr("only the last statement can be an expression, use 'name = expression;' before it", "end of expression")
+	}
+	if len(stmts) == 0 {
+		return e
+	}
+	return &fparNode{op: opSeq, args: append(stmts, e)}
+}
+
+// variable - local variable, positional argument alias or constant; those names are not followed by '('
+func (ctx *FparCtx) variable(ident string) (*fparNode, bool) {
+	if ctx.ch == "(" {
+		return nil, false
+	}
+	slot, ok := ctx.locals[ident]
+	if ok {
+		return &fparNode{op: opLocal, idx: slot, name: ident}, true
 	}
-	// debug: fmt.Printf("argVal: position: %s ident=%s -> 0,false\n", ctx.pos(), ident)
-	return 0.0, false
+	idx, ok := fparAliases[ident]
+	if ok && idx < ctx.nvar {
+		return &fparNode{op: opArg, idx: idx}, true
+	}
+	val, ok := fparConsts[ident]
+	if ok {
+		return &fparNode{op: opConst, val: val}, true
+	}
+	return nil, false
 }
 
-func (ctx *FparCtx) factor() complex128 {
-	f := complex(0.0, 0.0)
-	minus := complex(1.0, 0.0)
+func (ctx *FparCtx) factor() *fparNode {
+	var (
+		f      *fparNode
+		prefix []fparOp
+	)
 	ctx.readNextChar()
 	ctx.skipBlanks()
-	for ctx.ch == "+" || ctx.ch == "-" {
+	for ctx.ch == "+" || ctx.ch == "-" || ctx.ch == "!" {
 		if ctx.ch == "-" {
 			// debug: fmt.Printf("factor: position: %s minus\n", ctx.pos())
-			minus *= -1.0
+			// two minuses cancel out, so '--x' is just 'x'
+			l := len(prefix)
+			if l > 0 && prefix[l-1] == opNeg {
+				prefix = prefix[:l-1]
+			} else {
+				prefix = append(prefix, opNeg)
+			}
+		} else if ctx.ch == "!" {
+			prefix = append(prefix, opNot)
 		}
 		ctx.readNextChar()
+		ctx.skipBlanks()
 	}
 	if ctx.isDigit() {
-		f = ctx.readNumber()
+		f = &fparNode{op: opConst, val: ctx.readNumber()}
 		ctx.skipBlanks()
 	} else if ctx.ch == "(" {
 		// debug: fmt.Printf("factor: position: %s new expression in (\n", ctx.pos())
@@ -456,15 +1122,24 @@ func (ctx *FparCtx) factor() complex128 {
 			ctx.readNextChar()
 			ctx.skipBlanks()
 		} else {
-			ctx.er(fmt.Errorf("expected: ')': position: %s", ctx.pos()))
+			ctx.syntaxErr("unbalanced parentheses", "')'")
 		}
 	} else {
+		off := ctx.offset()
 		ident := ctx.readIdent()
-		arg, isArg := ctx.argVal(ident)
+		idx, isArg := ctx.argIdx(ident)
+		v, isVar := ctx.variable(ident)
 		if isArg {
-			f = arg
+			f = &fparNode{op: opArg, idx: idx}
+		} else if isVar {
+			f = v
 		} else {
-			if ident == "if" {
+			_, isLoop := fparLoops[ident]
+			if isLoop && ctx.ch == "(" {
+				f = ctx.loop(ident, off)
+			} else if ident == "lut" && ctx.ch == "(" {
+				f = ctx.lutCall(off)
+			} else if ident == "if" {
 				ctx.skipBlanks()
 				if ctx.ch == "(" {
 					cond := ctx.expression()
@@ -478,208 +1153,384 @@ func (ctx *FparCtx) factor() complex128 {
 							if ctx.ch == ")" {
 								ctx.readNextChar()
 								ctx.skipBlanks()
-								if real(cond) > 0 {
-									f = alt1
-								} else {
-									f = alt2
-								}
+								f = &fparNode{op: opIf, args: []*fparNode{cond, alt1, alt2}}
 							} else {
-								ctx.er(fmt.Errorf("missing ) after if 2nd alternative: position: %s", ctx.pos()))
+								ctx.syntaxErr("if 2nd alternative", "')'")
 							}
 						} else {
-							ctx.er(fmt.Errorf("missing , after if 1st alternative: position: %s", ctx.pos()))
+							ctx.syntaxErr("if 1st alternative", "','")
 						}
 					} else {
-						ctx.er(fmt.Errorf("missing , after if condition: position: %s", ctx.pos()))
+						ctx.syntaxErr("if condition", "','")
 					}
 				} else {
-					ctx.er(fmt.Errorf("missing ( after if: position: %s", ctx.pos()))
+					ctx.syntaxErr("if", "'('")
 				}
 			} else {
-				val, gotVal := ctx.callFunction(ident)
-				if gotVal {
-					f = val
+				call, gotCall := ctx.callFunction(ident, off)
+				if gotCall {
+					f = call
 				} else {
-					ctx.er(fmt.Errorf("don't know what to do with '%s': position: %s", ident, ctx.pos()))
+					ctx.syntaxErrAt(off, fmt.Sprintf("don't know what to do with '%s'", ident), "variable or function call", "'"+ident+"'")
 				}
 			}
 		}
 	}
 	ctx.skipBlanks()
-	// debug: fmt.Printf("factor: position: %s -> %f\n", ctx.pos(), f * minus)
-	return f * minus
+	if f == nil {
+		f = &fparNode{op: opConst}
+	}
+	for i := len(prefix) - 1; i >= 0; i-- {
+		f = &fparNode{op: prefix[i], args: []*fparNode{f}}
+	}
+	// debug: fmt.Printf("factor: position: %s -> %+v\n", ctx.pos(), f)
+	return f
 }
 
-func (ctx *FparCtx) exponential() complex128 {
+func (ctx *FparCtx) exponential() *fparNode {
 	f := ctx.factor()
 	for ctx.ch == "^" {
-		// debug: fmt.Printf("exponential: position: %s %f ^ ...\n", ctx.pos(), f)
-		f = cmplx.Pow(f, ctx.exponential())
-		// debug: fmt.Printf("exponential: position: %s -> %f\n", ctx.pos(), f)
+		// debug: fmt.Printf("exponential: position: %s ^ ...\n", ctx.pos())
+		f = &fparNode{op: opPow, args: []*fparNode{f, ctx.exponential()}}
 	}
 	return f
 }
 
-func (ctx *FparCtx) term() complex128 {
+func (ctx *FparCtx) term() *fparNode {
 	f := ctx.exponential()
 	for {
 		switch ctx.ch {
 		case "*":
-			// debug: fmt.Printf("term: position: %s %f * ...\n", ctx.pos(), f)
-			f *= ctx.exponential()
-			// debug: fmt.Printf("term: position: %s -> %f\n", ctx.pos(), f)
+			f = &fparNode{op: opMul, args: []*fparNode{f, ctx.exponential()}}
 		case "/":
-			// debug: fmt.Printf("term: position: %s %f / ...\n", ctx.pos(), f)
-			f /= ctx.exponential()
-			// debug: fmt.Printf("term: position: %s -> %f\n", ctx.pos(), f)
+			f = &fparNode{op: opDiv, args: []*fparNode{f, ctx.exponential()}}
 		case "%":
-			// debug: fmt.Printf("term: position: %s %f / ...\n", ctx.pos(), f)
-			f = complex(float64(int64(real(f))%int64(real(ctx.exponential()))), 0.0)
-			// debug: fmt.Printf("term: position: %s -> %f\n", ctx.pos(), f)
+			f = &fparNode{op: opMod, args: []*fparNode{f, ctx.exponential()}}
 		default:
 			return f
 		}
 	}
 }
 
-func (ctx *FparCtx) conditional() complex128 {
+func (ctx *FparCtx) conditional() *fparNode {
 	t := ctx.term()
 	for {
 		switch ctx.ch {
 		case "+":
-			// debug: fmt.Printf("expression: position: %s %f + ...\n", ctx.pos(), t)
-			t += ctx.term()
-			// debug: fmt.Printf("expression: position: %s -> %f\n", ctx.pos(), t)
+			t = &fparNode{op: opAdd, args: []*fparNode{t, ctx.term()}}
 		case "-":
-			// debug: fmt.Printf("expression: position: %s %f - ...\n", ctx.pos(), t)
-			t -= ctx.term()
-			// debug: fmt.Printf("expression: position: %s -> %f\n", ctx.pos(), t)
+			t = &fparNode{op: opSub, args: []*fparNode{t, ctx.term()}}
 		default:
 			return t
 		}
 	}
 }
 
-func (ctx *FparCtx) expression() complex128 {
+// relational - a < b, a > b, a <= b, a >= b
+func (ctx *FparCtx) relational() *fparNode {
 	c1 := ctx.conditional()
 	for {
+		op := opLt
 		switch ctx.ch {
 		case "<":
-			c2 := ctx.conditional()
-			if real(c1) < real(c2) {
-				c1 = complex128(1)
-			} else {
-				c1 = complex128(0)
+			if ctx.peek(0) == "=" {
+				ctx.readNextChar()
+				op = opLe
 			}
 		case ">":
-			c2 := ctx.conditional()
-			if real(c1) > real(c2) {
-				c1 = complex128(1)
-			} else {
-				c1 = complex128(0)
+			op = opGt
+			if ctx.peek(0) == "=" {
+				ctx.readNextChar()
+				op = opGe
 			}
+		default:
+			return c1
+		}
+		c1 = &fparNode{op: op, args: []*fparNode{c1, ctx.conditional()}}
+	}
+}
+
+// equality - a = b, a == b, a != b
+func (ctx *FparCtx) equality() *fparNode {
+	c1 := ctx.relational()
+	for {
+		op := opEq
+		switch ctx.ch {
 		case "=":
-			c2 := ctx.conditional()
-			if real(c1) == real(c2) {
-				c1 = complex128(1)
-			} else {
-				c1 = complex128(0)
-			}
-		case "|":
-			c2 := ctx.conditional()
-			if real(c1) > 0 || real(c2) > 0 {
-				c1 = complex128(1)
-			} else {
-				c1 = complex128(0)
+			if ctx.peek(0) == "=" {
+				ctx.readNextChar()
 			}
-		case "&":
-			c2 := ctx.conditional()
-			if real(c1) > 0 && real(c2) > 0 {
-				c1 = complex128(1)
-			} else {
-				c1 = complex128(0)
+		case "!":
+			if ctx.peek(0) != "=" {
+				return c1
 			}
+			ctx.readNextChar()
+			op = opNe
 		default:
 			return c1
 		}
+		c1 = &fparNode{op: op, args: []*fparNode{c1, ctx.relational()}}
 	}
 }
 
-// cacheHit - do we have current arg(s) in cache?
-func (ctx *FparCtx) cacheHit(args []complex128) (complex128, bool) {
-	var (
-		v  complex128
-		ok bool
-	)
-	if ctx.cacheL1 != nil {
-		k := args[0]
-		gmtx[ctx.cacheIdx].RLock()
-		v, ok = ctx.cacheL1[k]
-		gmtx[ctx.cacheIdx].RUnlock()
-	} else if ctx.cacheL2 != nil {
-		k := [2]complex128{args[0], args[1]}
-		gmtx[ctx.cacheIdx].RLock()
-		v, ok = ctx.cacheL2[k]
-		gmtx[ctx.cacheIdx].RUnlock()
-	} else if ctx.cacheL3 != nil {
-		k := [3]complex128{args[0], args[1], args[2]}
-		gmtx[ctx.cacheIdx].RLock()
-		v, ok = ctx.cacheL3[k]
-		gmtx[ctx.cacheIdx].RUnlock()
-	} else if ctx.cacheL4 != nil {
-		k := [4]complex128{args[0], args[1], args[2], args[3]}
-		gmtx[ctx.cacheIdx].RLock()
-		v, ok = ctx.cacheL4[k]
-		gmtx[ctx.cacheIdx].RUnlock()
-	}
-	return v, ok
-}
-
-// setCache - store value for cache
-func (ctx *FparCtx) setCache(args []complex128, v complex128) {
-	if ctx.cacheL1 != nil {
-		k := args[0]
-		gmtx[ctx.cacheIdx].Lock()
-		ctx.cacheL1[k] = v
-		gmtx[ctx.cacheIdx].Unlock()
-	} else if ctx.cacheL2 != nil {
-		k := [2]complex128{args[0], args[1]}
-		gmtx[ctx.cacheIdx].Lock()
-		ctx.cacheL2[k] = v
-		gmtx[ctx.cacheIdx].Unlock()
-	} else if ctx.cacheL3 != nil {
-		k := [3]complex128{args[0], args[1], args[2]}
-		gmtx[ctx.cacheIdx].Lock()
-		ctx.cacheL3[k] = v
-		gmtx[ctx.cacheIdx].Unlock()
-	} else if ctx.cacheL4 != nil {
-		k := [4]complex128{args[0], args[1], args[2], args[3]}
-		gmtx[ctx.cacheIdx].Lock()
-		ctx.cacheL4[k] = v
-		gmtx[ctx.cacheIdx].Unlock()
+// logicalAnd - a & b, a && b
+func (ctx *FparCtx) logicalAnd() *fparNode {
+	c1 := ctx.equality()
+	for ctx.ch == "&" {
+		if ctx.peek(0) == "&" {
+			ctx.readNextChar()
+		}
+		c1 = &fparNode{op: opAnd, args: []*fparNode{c1, ctx.equality()}}
+	}
+	return c1
+}
+
+// logicalOr - a | b, a || b
+func (ctx *FparCtx) logicalOr() *fparNode {
+	c1 := ctx.logicalAnd()
+	for ctx.ch == "|" {
+		if ctx.peek(0) == "|" {
+			ctx.readNextChar()
+		}
+		c1 = &fparNode{op: opOr, args: []*fparNode{c1, ctx.logicalAnd()}}
+	}
+	return c1
+}
+
+// expression - cond ? a : b (right associative), lowest precedence
+func (ctx *FparCtx) expression() *fparNode {
+	c := ctx.logicalOr()
+	if ctx.ch != "?" {
+		return c
+	}
+	alt1 := ctx.expression()
+	if ctx.ch != ":" {
+		ctx.syntaxErr("?: 1st alternative", "':'")
+		return c
 	}
+	alt2 := ctx.expression()
+	return &fparNode{op: opIf, args: []*fparNode{c, alt1, alt2}}
+}
+
+// fmod - complex modulo a - b*floor(a/b), floor is applied to real and imaginary parts
+// for real numbers result has the sign of b (-1 % 3 = 2), a % 0 = a
+func fmod(a, b complex128) complex128 {
+	if b == 0 {
+		return a
+	}
+	q := a / b
+	return a - b*complex(math.Floor(real(q)), math.Floor(imag(q)))
+}
+
+func boolVal(b bool) complex128 {
+	if b {
+		return complex128(1)
+	}
+	return complex128(0)
+}
+
+// eval - evaluate compiled expression tree node using current arguments
+func (ctx *FparCtx) eval(n *fparNode) complex128 {
+	switch n.op {
+	case opConst:
+		return n.val
+	case opArg:
+		return ctx.arg[n.idx]
+	case opNeg:
+		// multiply (not negate) so signed zeros and branch cuts stay as they were
+		return ctx.eval(n.args[0]) * complex(-1.0, 0.0)
+	case opAdd:
+		return ctx.eval(n.args[0]) + ctx.eval(n.args[1])
+	case opSub:
+		return ctx.eval(n.args[0]) - ctx.eval(n.args[1])
+	case opMul:
+		return ctx.eval(n.args[0]) * ctx.eval(n.args[1])
+	case opDiv:
+		return ctx.eval(n.args[0]) / ctx.eval(n.args[1])
+	case opMod:
+		return fmod(ctx.eval(n.args[0]), ctx.eval(n.args[1]))
+	case opPow:
+		return cmplx.Pow(ctx.eval(n.args[0]), ctx.eval(n.args[1]))
+	case opPowInt:
+		return powInt(ctx.eval(n.args[0]), n.idx)
+	case opLt:
+		return boolVal(real(ctx.eval(n.args[0])) < real(ctx.eval(n.args[1])))
+	case opGt:
+		return boolVal(real(ctx.eval(n.args[0])) > real(ctx.eval(n.args[1])))
+	case opLe:
+		return boolVal(real(ctx.eval(n.args[0])) <= real(ctx.eval(n.args[1])))
+	case opGe:
+		return boolVal(real(ctx.eval(n.args[0])) >= real(ctx.eval(n.args[1])))
+	case opEq:
+		return boolVal(real(ctx.eval(n.args[0])) == real(ctx.eval(n.args[1])))
+	case opNe:
+		return boolVal(real(ctx.eval(n.args[0])) != real(ctx.eval(n.args[1])))
+	case opNot:
+		return boolVal(real(ctx.eval(n.args[0])) <= 0)
+	case opOr:
+		c1 := ctx.eval(n.args[0])
+		c2 := ctx.eval(n.args[1])
+		return boolVal(real(c1) > 0 || real(c2) > 0)
+	case opAnd:
+		c1 := ctx.eval(n.args[0])
+		c2 := ctx.eval(n.args[1])
+		return boolVal(real(c1) > 0 && real(c2) > 0)
+	case opIf:
+		if real(ctx.eval(n.args[0])) > 0 {
+			return ctx.eval(n.args[1])
+		}
+		return ctx.eval(n.args[2])
+	case opLocal, opBound:
+		return ctx.vars[n.idx]
+	case opIter, opSum, opProd, opEscape:
+		return ctx.evalLoop(n)
+	case opLet:
+		ctx.vars[n.idx] = ctx.eval(n.args[0])
+		return ctx.vars[n.idx]
+	case opSeq:
+		v := complex(0.0, 0.0)
+		for _, stmt := range n.args {
+			v = ctx.eval(stmt)
+		}
+		return v
+	case opCse:
+		// common subexpression, evaluated once per FparF call
+		if ctx.cseGen[n.idx] != ctx.gen {
+			ctx.cseVal[n.idx] = ctx.eval(n.args[0])
+			ctx.cseGen[n.idx] = ctx.gen
+		}
+		return ctx.cseVal[n.idx]
+	case opFunc:
+		// arguments go to context's stack, so calling builtins does not allocate
+		base := len(ctx.stack)
+		for _, arg := range n.args {
+			v := ctx.eval(arg)
+			ctx.stack = append(ctx.stack, v)
+		}
+		v := n.fn(ctx.stack[base:])
+		ctx.stack = ctx.stack[:base]
+		return v
+	case opGoFunc:
+		base := len(ctx.stack)
+		for _, arg := range n.args {
+			v := ctx.eval(arg)
+			ctx.stack = append(ctx.stack, v)
+		}
+		v, err := n.gfn(ctx.stack[base:]...)
+		if err != nil {
+			ctx.er(&EvalError{Func: n.name, Args: append([]complex128{}, ctx.stack[base:]...), Err: err})
+			v = 0.0
+		}
+		ctx.stack = ctx.stack[:base]
+		return v
+	case opCall:
+		var a [4]complex128
+		for i, arg := range n.args {
+			a[i] = ctx.eval(arg)
+		}
+		return callC(n, a[:len(n.args)])
+	}
+	ctx.er(fmt.Errorf("eval: unknown node type %d", n.op))
+	return 0.0
 }
 
 // FparF - call user defined function
 func (ctx *FparCtx) FparF(args []complex128) (complex128, error) {
-	if ctx.cacheLvl > 0 {
-		ce, hit := ctx.cacheHit(args)
-		if hit {
-			return ce, nil
+	if ctx.tree == nil {
+		return 0.0, fmt.Errorf("FparF: function not compiled, FparOK must be called first")
+	}
+	var (
+		key    cacheKey
+		cached bool
+	)
+	if ctx.cache != nil {
+		key, cached = ctx.cache.key(args)
+		if cached {
+			ce, hit := ctx.cache.get(&key)
+			if hit {
+				return ce, nil
+			}
 		}
 	}
 	ctx.err = nil
 	ctx.arg = args
-	ctx.position = 0
-	ctx.ch = ""
-	// debug: fmt.Printf("FparF: position: %s f(%v) ...\n", ctx.pos(), args)
-	e := ctx.expression()
-	if ctx.ch != ";" {
-		ctx.er(fmt.Errorf("FparF: garbage in function expression"))
+	if len(ctx.vars) < ctx.nlocals {
+		ctx.vars = make([]complex128, ctx.nlocals)
+	}
+	if len(ctx.cseVal) < ctx.ncse {
+		ctx.cseVal = make([]complex128, ctx.ncse)
+		ctx.cseGen = make([]uint64, ctx.ncse)
 	}
-	if ctx.cacheLvl > 0 && ctx.err == nil {
-		ctx.setCache(args, e)
+	ctx.gen++
+	// debug: fmt.Printf("FparF: f(%v) ...\n", args)
+	e := ctx.evalTop()
+	if cached && ctx.err == nil {
+		ctx.cache.put(&key, e)
 	}
-	// info: fmt.Printf("FparF: position: %s f(%v) = %f\n", ctx.pos(), args, e)
+	// info: fmt.Printf("FparF: f(%v) = %f\n", args, e)
 	return e, ctx.err
 }
+
+// LUT16 - for expressions using only x1 returns table of results for all 16-bit values v, nil otherwise
+// x1 = in(v)/65535 (in returns 0-65535), result's real (or imaginary if useImag) part is scaled to 0-65535 and clipped
+// Table is computed using thrN threads, cache is not used
+func (ctx *FparCtx) LUT16(thrN int, in func(uint16) float64, useImag bool) (*[65536]uint16, error) {
+	for i, used := range ctx.used {
+		if used && i > 0 {
+			return nil, nil
+		}
+	}
+	if thrN < 1 {
+		thrN = 1
+	}
+	var (
+		lut  [65536]uint16
+		wg   sync.WaitGroup
+		emtx sync.Mutex
+		err  error
+	)
+	chunk := (65536 + thrN - 1) / thrN
+	for t := 0; t < thrN; t++ {
+		from := t * chunk
+		to := from + chunk
+		if to > 65536 {
+			to = 65536
+		}
+		wg.Add(1)
+		go func(c FparCtx, from, to int) {
+			defer wg.Done()
+			defer func() { c.Tidy() }()
+			c.cache = nil
+			args := c.zeroVect()
+			for v := from; v < to; v++ {
+				args[0] = complex(in(uint16(v))/65535.0, 0.0)
+				cv, e := c.FparF(args)
+				if e != nil {
+					emtx.Lock()
+					if err == nil {
+						err = e
+					}
+					emtx.Unlock()
+					return
+				}
+				fv := real(cv)
+				if useImag {
+					fv = imag(cv)
+				}
+				fv *= 65535.0
+				if fv < 0.0 {
+					fv = 0.0
+				}
+				if fv > 65535.0 {
+					fv = 65535.0
+				}
+				lut[v] = uint16(fv)
+			}
+		}(ctx.Cpy(), from, to)
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return &lut, nil
+}
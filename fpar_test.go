@@ -0,0 +1,353 @@
+package jpegbw
+
+import (
+	"errors"
+	"math"
+	"math/cmplx"
+	"testing"
+)
+
+// compile - compiles expression of nvar variables
+func compile(t *testing.T, expr string, nvar int) (*FparCtx, error) {
+	t.Helper()
+	ctx := &FparCtx{}
+	err := ctx.FparFunction(expr)
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.FparOK(nvar)
+	if err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// same - the same complex values: equal bits, NaNs are the same
+func same(a, b complex128) bool {
+	eq := func(x, y float64) bool {
+		return math.Float64bits(x) == math.Float64bits(y) || (x != x && y != y)
+	}
+	return eq(real(a), real(b)) && eq(imag(a), imag(b))
+}
+
+// testArgs - argument sets x1..x3 used to compare evaluations: zeros, negative, complex and large values
+var testArgs = [][]complex128{
+	{0, 0, 0},
+	{0.25, 0.5 + 0.5i, 1},
+	{-1.5, 2, -0.5i},
+	{1, complex(math.Copysign(0, -1), 0), 3},
+	{0.7, 0.1, 0.9},
+	{-0.3, -2.5, 0.5},
+	{1e300, 1e-300, -7},
+}
+
+// evalParsed - evaluates expression tree as it was parsed, without optimizations and real path
+func evalParsed(ctx *FparCtx, args []complex128) (complex128, error) {
+	ctx.err = nil
+	ctx.arg = args
+	if len(ctx.vars) < ctx.nlocals {
+		ctx.vars = make([]complex128, ctx.nlocals)
+	}
+	ctx.gen++
+	v := ctx.eval(ctx.parsed)
+	return v, ctx.err
+}
+
+// valueCase - expression, x1 and expected value
+type valueCase struct {
+	expr string
+	x1   complex128
+	want complex128
+}
+
+// checkValues - compiles expressions of x1 and checks their values
+func checkValues(t *testing.T, testCases []valueCase) {
+	t.Helper()
+	for _, tc := range testCases {
+		ctx, err := compile(t, tc.expr, 1)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		got, err := ctx.FparF([]complex128{tc.x1})
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if cmplx.Abs(got-tc.want) > 1e-12 {
+			t.Errorf("%s(%v): got %v, expected %v", tc.expr, tc.x1, got, tc.want)
+		}
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	checkValues(t, []valueCase{
+		{expr: "3+4i", want: 3 + 4i},
+		{expr: "4j", want: 4i},
+		{expr: "3_1 * 2", want: 6 + 2i},
+		{expr: "_1", want: 1i},
+		{expr: "1_", want: 1},
+		{expr: "1e-3i + 2.5E3", want: 2500 + 0.001i},
+		{expr: "1e+2 - 1E2", want: 0},
+		{expr: "x1*2i", x1: 0.5, want: 1i},
+	})
+}
+
+func TestStatements(t *testing.T) {
+	checkValues(t, []valueCase{
+		{expr: "a = 2; b = a*3; a + b", want: 8},
+		{expr: "a = x1^2; b = 1 - a; a*b/(a+b)", x1: 0.5, want: 0.1875},
+		{expr: "a = x1; a = a*2; a", x1: 3, want: 6},
+		{expr: "x1 = 0.5", x1: 0.5, want: 1},
+		{expr: "gray*2", x1: 0.25, want: 0.5},
+		{expr: "e^(i*pi)", want: -1},
+		{expr: "2*pi", want: 6.283185307179586},
+	})
+}
+
+func TestPrecedence(t *testing.T) {
+	checkValues(t, []valueCase{
+		{expr: "2+3*4", want: 14},
+		{expr: "(2+3)*4", want: 20},
+		{expr: "2*3^2", want: 18},
+		{expr: "2^3^2", want: 512},
+		{expr: "-2^2", want: 4},
+		{expr: "-x1^2", x1: 3, want: 9},
+		{expr: "2*-3", want: -6},
+		{expr: "2^-1", want: 0.5},
+		{expr: "10 - 4 - 3", want: 3},
+		{expr: "64 / 4 / 2", want: 8},
+		{expr: "1 + 7 % 4 * 2", want: 7},
+		{expr: "-1 % 3", want: 2},
+		{expr: "5.5 % 2", want: 1.5},
+		{expr: "7 % 0", want: 7},
+		{expr: "1 < 2 = 1", want: 1},
+		{expr: "1 != 2 = 1", want: 1},
+		{expr: "1 + 1 > 1", want: 1},
+		{expr: "2 <= 2", want: 1},
+		{expr: "3 >= 4", want: 0},
+		{expr: "1 | 0 & 0", want: 1},
+		{expr: "(1 | 0) & 0", want: 0},
+		{expr: "1 || 0 && 0", want: 1},
+		{expr: "!0 + 1", want: 2},
+		{expr: "!(0 + 1)", want: 0},
+		{expr: "1 ? 2 : 3 + 4", want: 2},
+		{expr: "0 ? 2 : 3 + 4", want: 7},
+		{expr: "x1 < .3 ? 0 : x1 > .7 ? 1 : x1", x1: 0.5, want: 0.5},
+		{expr: "x1 < .3 ? 0 : x1 > .7 ? 1 : x1", x1: 0.8, want: 1},
+		{expr: "x1 < .3 ? 0 : x1 > .7 ? 1 : x1", x1: 0.1, want: 0},
+	})
+}
+
+func TestParseErrors(t *testing.T) {
+	var testCases = []struct {
+		expr   string
+		offset int
+		found  string
+		hint   string
+	}{
+		{expr: "x1+", offset: 3, found: "end of expression"},
+		{expr: `x1+"a"`, offset: 3, found: `'"'`},
+		{expr: "x1*(2", offset: 5},
+		{expr: "sinn(x1)", offset: 0, hint: "sin"},
+		{expr: "x1 + gra", offset: 5, hint: "gray"},
+		{expr: "x1 x2", offset: 3},
+		{expr: "min(x1, 2, 3, 4, 5)", offset: 15},
+		{expr: "lib.sin(x1)", offset: 0},
+		{expr: "x1 ? 1", offset: 6, found: "end of expression"},
+		{expr: "1 ? 2 3", offset: 6, found: "'3'"},
+		{expr: "!", offset: 1},
+		{expr: "x1 <= ", offset: 6},
+		{expr: "(x1", offset: 3},
+		{expr: "sin(x1,)", offset: 7, found: "')'"},
+		{expr: "a = 1; b", offset: 7, hint: "ba"},
+		{expr: "x1 + 1e", offset: 6, found: "'e'"},
+		{expr: "sum(k, 1, 3)", offset: 11, found: "')'"},
+	}
+	for _, tc := range testCases {
+		_, err := compile(t, tc.expr, 5)
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("%s: expected ParseError, got %v", tc.expr, err)
+			continue
+		}
+		if pe.Offset != tc.offset || pe.Hint != tc.hint || (tc.found != "" && pe.Found != tc.found) {
+			t.Errorf("%s: got offset %d, found %s, hint %q (%v), expected offset %d, found %s, hint %q", tc.expr, pe.Offset, pe.Found, pe.Hint, err, tc.offset, tc.found, tc.hint)
+		}
+	}
+}
+
+func TestInitErrors(t *testing.T) {
+	var testCases = []struct {
+		lib string
+		n   uint
+	}{
+		{lib: "libjpegbw.so", n: 0},
+		{lib: "./no-such-library.so", n: 16},
+	}
+	for _, tc := range testCases {
+		ctx := &FparCtx{}
+		err := ctx.Init(tc.lib, tc.n)
+		if err == nil {
+			ctx.Tidy()
+			t.Errorf("Init(%s, %d): expected error", tc.lib, tc.n)
+		}
+	}
+}
+
+// register - registers Go function for the test only
+func register(t *testing.T, name string, nargs int, fn func(args ...complex128) (complex128, error)) {
+	t.Helper()
+	err := RegisterFunc(name, nargs, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		regMtx.Lock()
+		delete(regFuncs, name)
+		regMtx.Unlock()
+	})
+}
+
+func TestRegisterFunc(t *testing.T) {
+	fail := errors.New("negative argument")
+	register(t, "testhalf", 1, func(a ...complex128) (complex128, error) { return a[0] / 2, nil })
+	register(t, "testmadd", 3, func(a ...complex128) (complex128, error) { return a[0]*a[1] + a[2], nil })
+	register(t, "testfail", 1, func(a ...complex128) (complex128, error) {
+		if real(a[0]) < 0 {
+			return 0, fail
+		}
+		return a[0], nil
+	})
+	// registered functions are found before built-ins
+	register(t, "abs", 1, func(a ...complex128) (complex128, error) { return 42, nil })
+	checkValues(t, []valueCase{
+		{expr: "testhalf(x1)", x1: 3, want: 1.5},
+		{expr: "TestHalf(x1) + 1", x1: 1i, want: 1 + 0.5i},
+		{expr: "testmadd(x1, 2, testhalf(4))", x1: 5, want: 12},
+		{expr: "abs(x1)", x1: -1, want: 42},
+		{expr: "testfail(x1)", x1: 2, want: 2},
+	})
+	ctx, err := compile(t, "testfail(x1)", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ctx.FparF([]complex128{-1})
+	var ee *EvalError
+	if !errors.As(err, &ee) || ee.Func != "testfail" || !errors.Is(err, fail) {
+		t.Errorf("testfail(-1): expected EvalError wrapping %v, got %v", fail, err)
+	}
+	for _, expr := range []string{"testhalf(x1, 2)", "testmadd(x1, 2)"} {
+		_, err := compile(t, expr, 1)
+		if err == nil {
+			t.Errorf("%s: expected wrong number of arguments error", expr)
+		}
+	}
+	var testCases = []struct {
+		name  string
+		nargs int
+		fn    func(args ...complex128) (complex128, error)
+	}{
+		{name: "testzero", nargs: 0, fn: func(a ...complex128) (complex128, error) { return 0, nil }},
+		{name: "testfive", nargs: 5, fn: func(a ...complex128) (complex128, error) { return 0, nil }},
+		{name: "testnil", nargs: 1},
+		{name: "if", nargs: 1, fn: func(a ...complex128) (complex128, error) { return 0, nil }},
+		{name: "1abc", nargs: 1, fn: func(a ...complex128) (complex128, error) { return 0, nil }},
+		{name: "a-b", nargs: 1, fn: func(a ...complex128) (complex128, error) { return 0, nil }},
+		{name: "", nargs: 1, fn: func(a ...complex128) (complex128, error) { return 0, nil }},
+	}
+	for _, tc := range testCases {
+		if RegisterFunc(tc.name, tc.nargs, tc.fn) == nil {
+			t.Errorf("RegisterFunc(%q, %d): expected error", tc.name, tc.nargs)
+		}
+	}
+}
+
+func TestLibPrefix(t *testing.T) {
+	lib := testLib(t)
+	var testCases = []struct {
+		expr string
+		lib  bool
+	}{
+		{expr: "alpha(x1, x2, x3, x4)", lib: false},
+		{expr: "lib.alpha(x1, x2, x3, x4)", lib: true},
+		{expr: "LIB.alpha(x1, x2, x3, x4)", lib: true},
+	}
+	for _, tc := range testCases {
+		ctx := &FparCtx{}
+		err := ctx.Init(lib, 16)
+		if err != nil {
+			t.Fatalf("Init: %v", err)
+		}
+		err = ctx.FparFunction(tc.expr)
+		if err == nil {
+			err = ctx.FparOK(4)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			ctx.Tidy()
+			continue
+		}
+		if ctx.External() != tc.lib {
+			t.Errorf("%s: calls LIB: %t, expected %t", tc.expr, ctx.External(), tc.lib)
+		}
+		ctx.Tidy()
+	}
+}
+
+func TestLUT16(t *testing.T) {
+	var testCases = []struct {
+		expr    string
+		useImag bool
+		table   bool
+	}{
+		{expr: "x1^2", table: true},
+		{expr: "1 - x1", table: true},
+		{expr: "x1*2 - 0.5", table: true},
+		{expr: "x1*(1+2i)", useImag: true, table: true},
+		{expr: "sin(x1*pi)", table: true},
+		{expr: "x1*x2", table: false},
+		{expr: "x1 + re(x5)", table: false},
+	}
+	gamma := func(v uint16) float64 { return math.Pow(float64(v)/65535.0, 0.7) * 65535.0 }
+	for _, tc := range testCases {
+		ctx, err := compile(t, tc.expr, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lut, err := ctx.LUT16(3, gamma, tc.useImag)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if (lut != nil) != tc.table {
+			t.Errorf("%s: table %t, expected %t", tc.expr, lut != nil, tc.table)
+		}
+		if lut == nil {
+			continue
+		}
+		for v := 0; v < 65536; v += 97 {
+			cv, err := ctx.FparF([]complex128{complex(gamma(uint16(v))/65535.0, 0), 0, 0, 0, 0})
+			if err != nil {
+				t.Fatal(err)
+			}
+			fv := real(cv)
+			if tc.useImag {
+				fv = imag(cv)
+			}
+			want := uint16(math.Max(0, math.Min(65535, fv*65535.0)))
+			if lut[v] != want {
+				t.Errorf("%s: table[%d] = %d, expected %d", tc.expr, v, lut[v], want)
+				break
+			}
+		}
+	}
+	ctx, err := compile(t, "iter(z -> z + 1, 0, (x1 > 0.5)*1e7)", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ctx.LUT16(2, func(v uint16) float64 { return float64(v) }, false)
+	if err == nil {
+		t.Errorf("expected error for too many iterations")
+	}
+}
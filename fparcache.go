@@ -0,0 +1,184 @@
+package jpegbw
+
+import (
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultCacheSize - default maximum number of cached function values
+const DefaultCacheSize = 1 << 20
+
+// CacheStats - cache statistics
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Capacity  int
+}
+
+type cacheKey [4]complex128
+
+// cacheEntry - ref is CLOCK reference bit, set atomically by lookups holding only the read lock
+type cacheEntry struct {
+	key cacheKey
+	val complex128
+	ref uint32
+}
+
+// cacheShard - part of the cache guarded by its own RW mutex, evicts using CLOCK algorithm
+// Lookups only take the read lock (hits/misses counters and reference bits are atomic), inserts take the write lock
+type cacheShard struct {
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	mtx       sync.RWMutex
+	idx       map[cacheKey]int
+	entries   []cacheEntry
+	hand      int
+	capacity  int
+}
+
+// fparCache - bounded cache of function values keyed by first n arguments, shared by all context copies
+type fparCache struct {
+	n      int
+	mask   uint64
+	shards []cacheShard
+}
+
+func newFparCache(n, size int) *fparCache {
+	if size < 1 {
+		size = DefaultCacheSize
+	}
+	// power of 2 shards, at most size shards, so each one has at least 1 entry
+	nShards := 1
+	for nShards < 4*runtime.GOMAXPROCS(0) && nShards < 256 && nShards*2 <= size {
+		nShards <<= 1
+	}
+	// entries left after even split go to the first shards, so total capacity is exactly size
+	perShard, extra := size/nShards, size%nShards
+	c := &fparCache{n: n, mask: uint64(nShards - 1), shards: make([]cacheShard, nShards)}
+	for i := range c.shards {
+		c.shards[i].capacity = perShard
+		if i < extra {
+			c.shards[i].capacity++
+		}
+		c.shards[i].idx = make(map[cacheKey]int)
+	}
+	return c
+}
+
+// key - returns cache key and false if it cannot be cached (NaN never equals itself, so it would never hit)
+func (c *fparCache) key(args []complex128) (cacheKey, bool) {
+	var k cacheKey
+	for i := 0; i < c.n; i++ {
+		a := args[i]
+		if a != a {
+			return k, false
+		}
+		k[i] = a
+	}
+	return k, true
+}
+
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func (c *fparCache) shard(k *cacheKey) *cacheShard {
+	// float bits differ mostly in high bits, so they are mixed down (murmur3 finalizer)
+	h := uint64(0)
+	for i := 0; i < c.n; i++ {
+		h = mix64(h ^ math.Float64bits(real(k[i])))
+		h = mix64(h ^ math.Float64bits(imag(k[i])))
+	}
+	return &c.shards[h&c.mask]
+}
+
+func (c *fparCache) get(k *cacheKey) (complex128, bool) {
+	s := c.shard(k)
+	s.mtx.RLock()
+	i, ok := s.idx[*k]
+	if !ok {
+		s.mtx.RUnlock()
+		atomic.AddUint64(&s.misses, 1)
+		return 0.0, false
+	}
+	e := &s.entries[i]
+	if atomic.LoadUint32(&e.ref) == 0 {
+		atomic.StoreUint32(&e.ref, 1)
+	}
+	v := e.val
+	s.mtx.RUnlock()
+	atomic.AddUint64(&s.hits, 1)
+	return v, true
+}
+
+func (c *fparCache) put(k *cacheKey, v complex128) {
+	s := c.shard(k)
+	s.mtx.Lock()
+	i, ok := s.idx[*k]
+	if ok {
+		s.entries[i].val = v
+		s.mtx.Unlock()
+		return
+	}
+	if len(s.entries) < s.capacity {
+		s.idx[*k] = len(s.entries)
+		s.entries = append(s.entries, cacheEntry{key: *k, val: v})
+		s.mtx.Unlock()
+		return
+	}
+	// CLOCK: give recently used entries a second chance
+	for atomic.LoadUint32(&s.entries[s.hand].ref) != 0 {
+		atomic.StoreUint32(&s.entries[s.hand].ref, 0)
+		s.hand = (s.hand + 1) % s.capacity
+	}
+	delete(s.idx, s.entries[s.hand].key)
+	s.entries[s.hand] = cacheEntry{key: *k, val: v}
+	s.idx[*k] = s.hand
+	s.hand = (s.hand + 1) % s.capacity
+	s.evictions++
+	s.mtx.Unlock()
+}
+
+func (c *fparCache) stats() CacheStats {
+	var st CacheStats
+	for i := range c.shards {
+		s := &c.shards[i]
+		st.Hits += atomic.LoadUint64(&s.hits)
+		st.Misses += atomic.LoadUint64(&s.misses)
+		s.mtx.RLock()
+		st.Evictions += s.evictions
+		st.Entries += len(s.entries)
+		st.Capacity += s.capacity
+		s.mtx.RUnlock()
+	}
+	return st
+}
+
+// SetCacheSize - caches function values keyed by the first n (1-4) arguments, keeps at most size values (0 - DefaultCacheSize)
+// Cache is shared with all context copies made via Cpy after this call, it is safe to use them from many goroutines
+// Not thread safe itself, should be called before using multiple threads, n = 0 disables cache
+func (ctx *FparCtx) SetCacheSize(n, size int) {
+	if n < 1 || n > 4 {
+		ctx.cache = nil
+		return
+	}
+	ctx.cache = newFparCache(n, size)
+}
+
+// CacheStats - returns cache statistics, zero stats if cache is not used
+func (ctx *FparCtx) CacheStats() CacheStats {
+	if ctx.cache == nil {
+		return CacheStats{}
+	}
+	return ctx.cache.stats()
+}
@@ -0,0 +1,63 @@
+package jpegbw
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCacheConcurrent(t *testing.T) {
+	var testCases = []struct {
+		size int
+		keys int
+	}{
+		{size: 64, keys: 16},
+		{size: 64, keys: 1000},
+		{size: 1, keys: 10},
+	}
+	for _, tc := range testCases {
+		c := newFparCache(2, tc.size)
+		workers, loops := 8, 2000
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < loops; i++ {
+					j := (i*7 + w) % tc.keys
+					k, _ := c.key([]complex128{complex(float64(j), 0), complex(0, float64(j))})
+					v, ok := c.get(&k)
+					if !ok {
+						c.put(&k, complex(float64(2*j), 1))
+						continue
+					}
+					if v != complex(float64(2*j), 1) {
+						t.Errorf("size %d keys %d: got %v for key %d", tc.size, tc.keys, v, j)
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		st := c.stats()
+		if st.Hits+st.Misses != uint64(workers*loops) {
+			t.Errorf("size %d keys %d: %d hits + %d misses, expected %d lookups", tc.size, tc.keys, st.Hits, st.Misses, workers*loops)
+		}
+		if st.Entries > st.Capacity {
+			t.Errorf("size %d keys %d: %d entries exceed capacity %d", tc.size, tc.keys, st.Entries, st.Capacity)
+		}
+	}
+}
+
+func TestCacheCapacity(t *testing.T) {
+	for _, size := range []int{1, 2, 3, 7, 100, 255, 1000, 4097} {
+		c := newFparCache(1, size)
+		for i := 0; i < 20*size; i++ {
+			k, _ := c.key([]complex128{complex(float64(i), 0)})
+			c.put(&k, 1)
+		}
+		st := c.stats()
+		if st.Capacity != size || st.Entries != size {
+			t.Errorf("size %d: capacity %d, %d entries", size, st.Capacity, st.Entries)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package jpegbw
+
+import (
+	"fmt"
+)
+
+// DeriveStep - step of central difference used for functions without symbolic derivative (C, Go and some built-in functions)
+const DeriveStep = 1e-6
+
+// deriver - state of symbolic differentiation with respect to argument v
+type deriver struct {
+	v      int
+	dnames map[string]string
+	dslots map[int]*fparNode
+	lets   map[int]*fparNode
+	names  map[string]struct{}
+}
+
+// holomorphic - derivatives of one argument built-in functions: f(u)' = rule(u) * u'
+var holomorphic = map[string]func(u *fparNode) *fparNode{
+	"sin":   func(u *fparNode) *fparNode { return fcall("cos", u) },
+	"cos":   func(u *fparNode) *fparNode { return neg(fcall("sin", u)) },
+	"tan":   func(u *fparNode) *fparNode { return div(one(), pow(fcall("cos", u), num(2))) },
+	"asin":  func(u *fparNode) *fparNode { return div(one(), fcall("sqrt", sub(one(), pow(u, num(2))))) },
+	"acos":  func(u *fparNode) *fparNode { return neg(div(one(), fcall("sqrt", sub(one(), pow(u, num(2)))))) },
+	"atan":  func(u *fparNode) *fparNode { return div(one(), add(one(), pow(u, num(2)))) },
+	"sinh":  func(u *fparNode) *fparNode { return fcall("cosh", u) },
+	"cosh":  func(u *fparNode) *fparNode { return fcall("sinh", u) },
+	"tanh":  func(u *fparNode) *fparNode { return div(one(), pow(fcall("cosh", u), num(2))) },
+	"asinh": func(u *fparNode) *fparNode { return div(one(), fcall("sqrt", add(pow(u, num(2)), one()))) },
+	"acosh": func(u *fparNode) *fparNode {
+		return div(one(), mul(fcall("sqrt", sub(u, one())), fcall("sqrt", add(u, one()))))
+	},
+	"atanh": func(u *fparNode) *fparNode { return div(one(), sub(one(), pow(u, num(2)))) },
+	"exp":   func(u *fparNode) *fparNode { return fcall("exp", u) },
+	"log":   func(u *fparNode) *fparNode { return div(one(), u) },
+	"log10": func(u *fparNode) *fparNode { return div(one(), mul(u, fcall("log", num(10)))) },
+	"log2":  func(u *fparNode) *fparNode { return div(one(), mul(u, fcall("log", num(2)))) },
+	"sqrt":  func(u *fparNode) *fparNode { return div(one(), mul(num(2), fcall("sqrt", u))) },
+}
+
+// cAliases - C99 complex names of built-in functions
+var cAliases = map[string]string{
+	"csin": "sin", "ccos": "cos", "ctan": "tan", "casin": "asin", "cacos": "acos", "catan": "atan",
+	"csinh": "sinh", "ccosh": "cosh", "ctanh": "tanh", "casinh": "asinh", "cacosh": "acosh", "catanh": "atanh",
+	"cexp": "exp", "clog": "log", "csqrt": "sqrt", "cpow": "pow", "cabs": "abs", "carg": "arg", "creal": "re", "cimag": "im",
+}
+
+func num(v float64) *fparNode {
+	return &fparNode{op: opConst, val: complex(v, 0.0)}
+}
+
+func zero() *fparNode {
+	return num(0)
+}
+
+func one() *fparNode {
+	return num(1)
+}
+
+func isNum(n *fparNode, v complex128) bool {
+	return n.op == opConst && n.val == v
+}
+
+func fcall(name string, args ...*fparNode) *fparNode {
+	return &fparNode{op: opFunc, name: name, args: args}
+}
+
+// add, sub, mul, div, neg, pow - build nodes, simplifying operations with 0 and 1 and constants
+func add(a, b *fparNode) *fparNode {
+	switch {
+	case isNum(a, 0):
+		return b
+	case isNum(b, 0):
+		return a
+	case isConst(a) && isConst(b):
+		return &fparNode{op: opConst, val: a.val + b.val}
+	}
+	return &fparNode{op: opAdd, args: []*fparNode{a, b}}
+}
+
+func sub(a, b *fparNode) *fparNode {
+	switch {
+	case isNum(b, 0):
+		return a
+	case isNum(a, 0):
+		return neg(b)
+	case isConst(a) && isConst(b):
+		return &fparNode{op: opConst, val: a.val - b.val}
+	}
+	return &fparNode{op: opSub, args: []*fparNode{a, b}}
+}
+
+func mul(a, b *fparNode) *fparNode {
+	switch {
+	case isNum(a, 0) || isNum(b, 0):
+		return zero()
+	case isNum(a, 1):
+		return b
+	case isNum(b, 1):
+		return a
+	case isNum(a, -1):
+		return neg(b)
+	case isNum(b, -1):
+		return neg(a)
+	case isConst(a) && isConst(b):
+		return &fparNode{op: opConst, val: a.val * b.val}
+	}
+	return &fparNode{op: opMul, args: []*fparNode{a, b}}
+}
+
+func div(a, b *fparNode) *fparNode {
+	switch {
+	case isNum(a, 0) && !isNum(b, 0):
+		return zero()
+	case isNum(b, 1):
+		return a
+	}
+	return &fparNode{op: opDiv, args: []*fparNode{a, b}}
+}
+
+func neg(a *fparNode) *fparNode {
+	switch {
+	case isConst(a):
+		return &fparNode{op: opConst, val: -a.val}
+	case a.op == opNeg:
+		return a.args[0]
+	}
+	return &fparNode{op: opNeg, args: []*fparNode{a}}
+}
+
+func pow(a, b *fparNode) *fparNode {
+	switch {
+	case isNum(b, 0):
+		return one()
+	case isNum(b, 1):
+		return a
+	}
+	return &fparNode{op: opPow, args: []*fparNode{a, b}}
+}
+
+// Derive - returns derivative of compiled expression with respect to variable (x1..xN or its alias) as expression text
+// Result can be compiled using FparFunction and FparOK, local variables get their derivatives as new local variables
+// C, Go and built-in functions without known derivative are differentiated numerically using central difference
+// Comparisons, floor, escape etc. are piecewise constant, so their derivative is 0
+func (ctx *FparCtx) Derive(variable string) (string, error) {
+	if ctx.tree == nil {
+		return "", fmt.Errorf("Derive: function not compiled, FparOK must be called first")
+	}
+	v, ok := ctx.argIdx(variable)
+	if !ok {
+		v, ok = fparAliases[variable]
+		if !ok || v >= ctx.nvar {
+			return "", fmt.Errorf("Derive: '%s' is not a variable, expected x1-x%d", variable, ctx.nvar)
+		}
+	}
+	d := &deriver{
+		v:      v,
+		dnames: make(map[string]string),
+		dslots: make(map[int]*fparNode),
+		lets:   make(map[int]*fparNode),
+		names:  make(map[string]struct{}),
+	}
+	collectNames(ctx.tree, d.names)
+	expr := formatNode(d.derive(ctx.tree), false)
+	// debug: fmt.Printf("Derive: d/d%s %s = %s\n", variable, formatNode(ctx.tree, false), expr)
+	// make sure result compiles
+	var dc FparCtx
+	err := dc.FparFunction(expr)
+	if err != nil {
+		return "", err
+	}
+	dc.SetLoader(ctx.loader)
+	defer dc.Tidy()
+	err = dc.FparOK(ctx.nvar)
+	if err != nil {
+		return "", fmt.Errorf("Derive: derivative '%s': %v", expr, err)
+	}
+	return expr, nil
+}
+
+// collectNames - local and loop variable names used in expression
+func collectNames(n *fparNode, names map[string]struct{}) {
+	switch n.op {
+	case opLet, opLocal, opBound:
+		names[n.name] = struct{}{}
+	case opIter, opSum, opProd, opEscape:
+		names[n.vname] = struct{}{}
+	}
+	for _, arg := range n.args {
+		collectNames(arg, names)
+	}
+}
+
+// dname - name of local variable holding derivative of local variable name
+func (d *deriver) dname(name string) string {
+	dn, ok := d.dnames[name]
+	if ok {
+		return dn
+	}
+	dn = "d" + name
+	for {
+		_, used := d.names[dn]
+		if !used {
+			break
+		}
+		dn += "_"
+	}
+	d.names[dn] = struct{}{}
+	d.dnames[name] = dn
+	return dn
+}
+
+// derive - derivative of node, statements 'a = e' get 'da = e” before them, so da uses values from before a is assigned
+func (d *deriver) derive(n *fparNode) *fparNode {
+	switch n.op {
+	case opConst, opBound, opNot, opLt, opGt, opLe, opGe, opEq, opNe, opOr, opAnd, opEscape:
+		return zero()
+	case opArg:
+		if n.idx == d.v {
+			return one()
+		}
+		return zero()
+	case opNeg:
+		return neg(d.derive(n.args[0]))
+	case opAdd:
+		return add(d.derive(n.args[0]), d.derive(n.args[1]))
+	case opSub:
+		return sub(d.derive(n.args[0]), d.derive(n.args[1]))
+	case opMul:
+		a, b := n.args[0], n.args[1]
+		return add(mul(d.derive(a), b), mul(a, d.derive(b)))
+	case opDiv:
+		a, b := n.args[0], n.args[1]
+		da, db := d.derive(a), d.derive(b)
+		if isNum(db, 0) {
+			return div(da, b)
+		}
+		return div(sub(mul(da, b), mul(a, db)), pow(b, num(2)))
+	case opMod:
+		// a % b = a - b*floor(a/b)
+		a, b := n.args[0], n.args[1]
+		return sub(d.derive(a), mul(d.derive(b), fcall("floor", div(a, b))))
+	case opPow, opPowInt:
+		return d.derivePow(n.args[0], n.args[1])
+	case opIf:
+		da, db := d.derive(n.args[1]), d.derive(n.args[2])
+		if isNum(da, 0) && isNum(db, 0) {
+			return zero()
+		}
+		return &fparNode{op: opIf, args: []*fparNode{n.args[0], da, db}}
+	case opLocal:
+		dv, ok := d.dslots[n.idx]
+		if ok {
+			return dv
+		}
+		return zero()
+	case opSeq:
+		stmts := []*fparNode{}
+		last := len(n.args) - 1
+		for _, stmt := range n.args[:last] {
+			if stmt.op != opLet {
+				continue
+			}
+			de := d.derive(stmt.args[0])
+			d.lets[stmt.idx] = stmt.args[0]
+			if isConst(de) {
+				d.dslots[stmt.idx] = de
+			} else {
+				dn := d.dname(stmt.name)
+				d.dslots[stmt.idx] = &fparNode{op: opLocal, name: dn}
+				stmts = append(stmts, &fparNode{op: opLet, name: dn, args: []*fparNode{de}})
+			}
+			stmts = append(stmts, stmt)
+		}
+		stmts = append(stmts, d.derive(n.args[last]))
+		if len(stmts) == 1 {
+			return stmts[0]
+		}
+		return &fparNode{op: opSeq, args: stmts}
+	case opCse:
+		return d.derive(n.args[0])
+	case opSum:
+		db := d.derive(n.args[0])
+		if isNum(db, 0) {
+			return zero()
+		}
+		return &fparNode{op: opSum, name: n.name, vname: n.vname, args: []*fparNode{db, n.args[1], n.args[2]}}
+	case opProd:
+		// (f1*f2*...)' = f1*f2*... * (f1'/f1 + f2'/f2 + ...)
+		db := d.derive(n.args[0])
+		if isNum(db, 0) {
+			return zero()
+		}
+		return mul(n, &fparNode{op: opSum, name: "sum", vname: n.vname, args: []*fparNode{div(db, n.args[0]), n.args[1], n.args[2]}})
+	case opIter:
+		return d.numeric(n)
+	case opFunc, opGoFunc, opCall:
+		return d.deriveCall(n)
+	}
+	return d.numeric(n)
+}
+
+// derivePow - a^b, the simpler rule is used when b doesn't depend on the variable
+func (d *deriver) derivePow(a, b *fparNode) *fparNode {
+	da, db := d.derive(a), d.derive(b)
+	if isNum(db, 0) {
+		if isConst(b) {
+			return mul(mul(b, pow(a, &fparNode{op: opConst, val: b.val - 1})), da)
+		}
+		return mul(mul(b, pow(a, sub(b, one()))), da)
+	}
+	return mul(pow(a, b), add(mul(db, fcall("log", a)), div(mul(b, da), a)))
+}
+
+// deriveCall - chain rule, functions without known derivative get numeric partial derivatives
+func (d *deriver) deriveCall(n *fparNode) *fparNode {
+	name := n.name
+	if n.op == opFunc {
+		alias, ok := cAliases[name]
+		if ok {
+			name = alias
+		}
+	}
+	var du []*fparNode
+	for _, arg := range n.args {
+		du = append(du, d.derive(arg))
+	}
+	if n.op == opFunc {
+		u := n.args[0]
+		rule, ok := holomorphic[name]
+		if ok && len(n.args) == 1 {
+			if isNum(du[0], 0) {
+				return zero()
+			}
+			return mul(rule(u), du[0])
+		}
+		switch name {
+		case "pow":
+			return d.derivePow(n.args[0], n.args[1])
+		case "conj", "re", "im":
+			return fcall(name, du[0])
+		case "frac":
+			return du[0]
+		case "floor", "ceil", "round", "trunc", "sign", "step":
+			return zero()
+		case "abs":
+			// real direction derivative: re(conj(u)*u')/|u|
+			if isNum(du[0], 0) {
+				return zero()
+			}
+			return div(fcall("re", mul(fcall("conj", u), du[0])), fcall("abs", u))
+		case "arg":
+			if isNum(du[0], 0) {
+				return zero()
+			}
+			return fcall("im", div(du[0], u))
+		case "fma":
+			return add(add(mul(du[0], n.args[1]), mul(n.args[0], du[1])), du[2])
+		case "lerp":
+			a, b, t := n.args[0], n.args[1], n.args[2]
+			return add(add(du[0], mul(sub(du[1], du[0]), t)), mul(sub(b, a), du[2]))
+		}
+	}
+	// numeric partial derivatives: (f(.., a+h, ..) - f(.., a-h, ..))/2h
+	res := zero()
+	for j := range n.args {
+		if isNum(du[j], 0) {
+			continue
+		}
+		// copies keep resolved function and its details (like lut's curve)
+		plus, minus := *n, *n
+		plus.args = append([]*fparNode{}, n.args...)
+		minus.args = append([]*fparNode{}, n.args...)
+		plus.args[j] = add(n.args[j], num(DeriveStep))
+		minus.args[j] = sub(n.args[j], num(DeriveStep))
+		res = add(res, mul(div(sub(&plus, &minus), num(2*DeriveStep)), du[j]))
+	}
+	return res
+}
+
+// numeric - central difference of the whole node, local variables it uses are replaced with their expressions
+func (d *deriver) numeric(n *fparNode) *fparNode {
+	plus := d.shift(n, num(DeriveStep))
+	minus := d.shift(n, num(-DeriveStep))
+	return div(sub(plus, minus), num(2*DeriveStep))
+}
+
+// shift - copy of node with variable replaced by (variable + h)
+func (d *deriver) shift(n *fparNode, h *fparNode) *fparNode {
+	switch n.op {
+	case opArg:
+		if n.idx == d.v {
+			return &fparNode{op: opAdd, args: []*fparNode{n, h}}
+		}
+		return n
+	case opLocal:
+		e, ok := d.lets[n.idx]
+		if ok {
+			return d.shift(e, h)
+		}
+		return n
+	case opCse:
+		return d.shift(n.args[0], h)
+	}
+	c := *n
+	c.args = nil
+	for _, arg := range n.args {
+		c.args = append(c.args, d.shift(arg, h))
+	}
+	return &c
+}
@@ -0,0 +1,81 @@
+package jpegbw
+
+import (
+	"math/cmplx"
+	"testing"
+)
+
+func TestDerive(t *testing.T) {
+	var testCases = []struct {
+		expr     string
+		variable string
+	}{
+		{expr: "x1^2", variable: "x1"},
+		{expr: "3*x1^3 - 2*x1 + 7", variable: "x1"},
+		{expr: "sin(x1)*x2", variable: "x1"},
+		{expr: "sin(x1)*x2", variable: "x2"},
+		{expr: "x1/x2", variable: "x2"},
+		{expr: "a = x1^2; b = 1 - a; a*b/(a+b)", variable: "x1"},
+		{expr: "exp(x1*x2) + log(x1) + sqrt(x1)", variable: "x1"},
+		{expr: "x1 < .5 ? x1^2 : 2*x1", variable: "x1"},
+		{expr: "sum(k, 1, 3, x1^k/k)", variable: "x1"},
+		{expr: "prod(k, 1, 3, x1 + k)", variable: "x1"},
+		{expr: "iter(z -> z*x1 + 1, 0, 3)", variable: "x1"},
+		{expr: "gamma(x1+1)", variable: "x1"},
+		{expr: "x1^x2", variable: "x1"},
+		{expr: "x1^x2", variable: "x2"},
+		{expr: "atan2(x1, x2) + hypot(x1, x2)", variable: "x2"},
+		{expr: "tanh(gray*2) + cosh(gray)", variable: "gray"},
+		{expr: "floor(x1*10 + 0.5) + (x1 > x2)", variable: "x1"},
+	}
+	points := [][]complex128{{0.3, 0.6}, {0.8, 1.7}, {1.7, 0.45}}
+	h := 1e-6
+	for _, tc := range testCases {
+		ctx, err := compile(t, tc.expr, 2)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		def, err := ctx.Derive(tc.variable)
+		if err != nil {
+			t.Errorf("%s: Derive(%s): %v", tc.expr, tc.variable, err)
+			continue
+		}
+		dctx, err := compile(t, def, 2)
+		if err != nil {
+			t.Errorf("%s: derivative %s: %v", tc.expr, def, err)
+			continue
+		}
+		v := 0
+		if tc.variable == "x2" {
+			v = 1
+		}
+		for _, p := range points {
+			got, err := dctx.FparF(p)
+			if err != nil {
+				t.Errorf("%s: derivative %s%v: %v", tc.expr, def, p, err)
+				continue
+			}
+			lo := append([]complex128{}, p...)
+			hi := append([]complex128{}, p...)
+			lo[v] -= complex(h, 0)
+			hi[v] += complex(h, 0)
+			flo, _ := ctx.FparF(lo)
+			fhi, _ := ctx.FparF(hi)
+			want := (fhi - flo) / complex(2*h, 0)
+			if cmplx.Abs(got-want) > 1e-5*(1+cmplx.Abs(want)) {
+				t.Errorf("%s: d/d%s = %s at %v: got %v, numeric %v", tc.expr, tc.variable, def, p, got, want)
+			}
+		}
+	}
+	ctx, err := compile(t, "x1*x2", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, variable := range []string{"x3", "rg", "y"} {
+		_, err := ctx.Derive(variable)
+		if err == nil {
+			t.Errorf("Derive(%s) of 2 variables function: expected error", variable)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package jpegbw
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// precedence - operator precedence of node, the same levels as in parser: ?: is the lowest, atoms are the highest
+func precedence(n *fparNode) int {
+	switch n.op {
+	case opLet, opSeq:
+		return -1
+	case opIf:
+		return 0
+	case opOr:
+		return 1
+	case opAnd:
+		return 2
+	case opEq, opNe:
+		return 3
+	case opLt, opGt, opLe, opGe:
+		return 4
+	case opAdd, opSub:
+		return 5
+	case opMul, opDiv, opMod:
+		return 6
+	case opPow, opPowInt:
+		return 7
+	case opNeg, opNot:
+		return 8
+	case opConst:
+		if strings.HasPrefix(formatConst(n.val), "-") {
+			return 8
+		}
+	case opCse:
+		return precedence(n.args[0])
+	}
+	return 9
+}
+
+// binaryOps - operator text of binary nodes
+var binaryOps = map[fparOp]string{
+	opAdd: " + ",
+	opSub: " - ",
+	opMul: "*",
+	opDiv: "/",
+	opMod: " % ",
+	opPow: "^",
+	opLt:  " < ",
+	opGt:  " > ",
+	opLe:  " <= ",
+	opGe:  " >= ",
+	opEq:  " == ",
+	opNe:  " != ",
+	opOr:  " || ",
+	opAnd: " && ",
+}
+
+// formatFloat - shortest representation that parses back to the same value, (1/0) style for infinities and NaN
+func formatFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "(0/0)"
+	case math.IsInf(f, 1):
+		return "(1/0)"
+	case math.IsInf(f, -1):
+		return "(-1/0)"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// formatConst - complex constant using 'i' suffix for imaginary part: 2, 0.5i, (1 - 2i)
+func formatConst(v complex128) string {
+	re, im := real(v), imag(v)
+	if im == 0 {
+		return formatFloat(re)
+	}
+	if math.IsNaN(im) || math.IsInf(im, 0) {
+		return "(" + formatFloat(re) + " + " + formatFloat(im) + "*i)"
+	}
+	if re == 0 && !math.Signbit(re) {
+		return formatFloat(im) + "i"
+	}
+	if im < 0 {
+		return "(" + formatFloat(re) + " - " + formatFloat(-im) + "i)"
+	}
+	return "(" + formatFloat(re) + " + " + formatFloat(im) + "i)"
+}
+
+// paren - formats node, in parentheses when its precedence is lower than min (or when it is an operator and full is set)
+func paren(n *fparNode, min int, full bool) string {
+	s := formatNode(n, full)
+	p := precedence(n)
+	if p < min || (full && p < 9 && n.op != opConst) {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+// formatNode - formats expression tree as expression text that compiles to the same tree
+// Arguments are always written as x1..xN, common subexpressions are written in place
+// When full is set, each operator's operands are in parentheses, so precedence doesn't matter when reading it
+func formatNode(n *fparNode, full bool) string {
+	switch n.op {
+	case opConst:
+		return formatConst(n.val)
+	case opArg:
+		return fmt.Sprintf("x%d", n.idx+1)
+	case opLocal, opBound:
+		return n.name
+	case opCse:
+		return formatNode(n.args[0], full)
+	case opNeg:
+		return "-" + paren(n.args[0], 8, full)
+	case opNot:
+		return "!" + paren(n.args[0], 8, full)
+	case opPow, opPowInt:
+		// right associative, unary minus binds stronger than ^ so (-x)^2 is written with parentheses too
+		return paren(n.args[0], 9, full) + "^" + paren(n.args[1], 7, full)
+	case opIf:
+		return paren(n.args[0], 1, full) + " ? " + paren(n.args[1], 1, full) + " : " + paren(n.args[2], 0, full)
+	case opLet:
+		return n.name + " = " + formatNode(n.args[0], full)
+	case opSeq:
+		stmts := []string{}
+		for _, stmt := range n.args {
+			stmts = append(stmts, formatNode(stmt, full))
+		}
+		return strings.Join(stmts, "; ")
+	case opIter:
+		return fmt.Sprintf("iter(%s -> %s, %s, %s)", n.vname, formatNode(n.args[0], full), formatNode(n.args[1], full), formatNode(n.args[2], full))
+	case opEscape:
+		return fmt.Sprintf("escape(%s -> %s, %s, %s, %s)", n.vname, formatNode(n.args[0], full), formatNode(n.args[1], full), formatNode(n.args[2], full), formatNode(n.args[3], full))
+	case opSum, opProd:
+		return fmt.Sprintf("%s(%s, %s, %s, %s)", n.name, n.vname, formatNode(n.args[1], full), formatNode(n.args[2], full), formatNode(n.args[0], full))
+	case opFunc, opGoFunc, opCall:
+		if n.op == opFunc && n.name == "lut" {
+			return formatLUT(n, full)
+		}
+		args := []string{}
+		for _, arg := range n.args {
+			args = append(args, formatNode(arg, full))
+		}
+		return n.name + "(" + strings.Join(args, ", ") + ")"
+	}
+	op, ok := binaryOps[n.op]
+	if !ok {
+		return fmt.Sprintf("<unknown node type %d>", n.op)
+	}
+	// left associative: right operand with the same precedence needs parentheses
+	p := precedence(n)
+	return paren(n.args[0], p, full) + op + paren(n.args[1], p+1, full)
+}
+
+// cloneNode - deep copy of expression tree, optimizer modifies tree in place
+func cloneNode(n *fparNode) *fparNode {
+	c := *n
+	c.args = nil
+	for _, arg := range n.args {
+		c.args = append(c.args, cloneNode(arg))
+	}
+	return &c
+}
+
+// String - canonical form of compiled expression as it was parsed (before optimization)
+// It is lower case, arguments are x1..xN (not aliases), numbers are normalized and each operator's operands are in parentheses
+func (ctx *FparCtx) String() string {
+	if ctx.parsed == nil {
+		return ""
+	}
+	return formatNode(ctx.parsed, true)
+}
+
+// ExprNode - JSON representation of expression tree node
+// Op is operator (add, sub, mul, div, mod, pow, neg, not, lt, gt, le, ge, eq, ne, and, or, if), const, arg, var (local or loop variable),
+// let (assignment), seq (statements), call (function) or loop (iter, sum, prod, escape)
+// Value is constant's value (or lut's curve name), Name is argument's, variable's or function's name, Var is loop variable (or lut's "cubic")
+// Loop arguments are in the order they are written: sum's from, to, expr and iter's expr, z0, n
+type ExprNode struct {
+	Op    string      `json:"op"`
+	Value string      `json:"value,omitempty"`
+	Name  string      `json:"name,omitempty"`
+	Var   string      `json:"var,omitempty"`
+	Args  []*ExprNode `json:"args,omitempty"`
+}
+
+// exprOps - ExprNode operator names
+var exprOps = map[fparOp]string{
+	opConst: "const", opArg: "arg", opNeg: "neg", opAdd: "add", opSub: "sub", opMul: "mul", opDiv: "div",
+	opMod: "mod", opPow: "pow", opLt: "lt", opGt: "gt", opLe: "le", opGe: "ge", opEq: "eq", opNe: "ne",
+	opOr: "or", opAnd: "and", opNot: "not", opIf: "if", opLocal: "var", opLet: "let", opSeq: "seq",
+	opFunc: "call", opGoFunc: "call", opCall: "call", opIter: "iter", opSum: "sum", opProd: "prod",
+	opEscape: "escape", opBound: "var",
+}
+
+func exprNode(n *fparNode) *ExprNode {
+	if n.op == opCse {
+		return exprNode(n.args[0])
+	}
+	e := &ExprNode{Op: exprOps[n.op], Var: n.vname}
+	switch n.op {
+	case opConst:
+		e.Value = formatConst(n.val)
+	case opArg:
+		e.Name = fmt.Sprintf("x%d", n.idx+1)
+	case opLocal, opBound, opLet, opFunc, opGoFunc, opCall:
+		e.Name = n.name
+	}
+	if n.op == opFunc && n.name == "lut" {
+		e.Value = n.vname
+		e.Var = ""
+		if n.idx > 0 {
+			e.Var = lutModes[n.idx]
+		}
+	}
+	args := n.args
+	if n.op == opSum || n.op == opProd {
+		args = []*fparNode{n.args[1], n.args[2], n.args[0]}
+	}
+	for _, arg := range args {
+		e.Args = append(e.Args, exprNode(arg))
+	}
+	return e
+}
+
+// Tree - expression tree as it was parsed, nil if expression is not compiled
+func (ctx *FparCtx) Tree() *ExprNode {
+	if ctx.parsed == nil {
+		return nil
+	}
+	return exprNode(ctx.parsed)
+}
+
+// MarshalJSON - JSON serialization of expression tree (see ExprNode)
+func (ctx *FparCtx) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ctx.Tree())
+}
+
+// Expr - expression text (canonical form like FparCtx.String) of tree read from JSON, it can be compiled using FparFunction
+func (e *ExprNode) Expr() (string, error) {
+	n, err := e.node()
+	if err != nil {
+		return "", err
+	}
+	return formatNode(n, true), nil
+}
+
+// node - converts ExprNode to tree that can be formatted, functions are not resolved
+func (e *ExprNode) node() (*fparNode, error) {
+	n := &fparNode{name: e.Name, vname: e.Var}
+	found := false
+	for op, name := range exprOps {
+		if name == e.Op && op != opGoFunc && op != opCall && op != opBound {
+			n.op = op
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown expression node operator '%s'", e.Op)
+	}
+	for _, arg := range e.Args {
+		a, err := arg.node()
+		if err != nil {
+			return nil, err
+		}
+		n.args = append(n.args, a)
+	}
+	nargs := -1
+	switch n.op {
+	case opConst:
+		var c FparCtx
+		err := c.FparFunction(e.Value)
+		if err == nil {
+			err = c.FparOK(1)
+		}
+		if err != nil || c.tree.op != opConst {
+			return nil, fmt.Errorf("invalid constant '%s'", e.Value)
+		}
+		n.val = c.tree.val
+		nargs = 0
+	case opArg:
+		var c FparCtx
+		c.nvar = 1 << 16
+		idx, ok := c.argIdx(e.Name)
+		if !ok {
+			return nil, fmt.Errorf("invalid argument '%s'", e.Name)
+		}
+		n.idx = idx
+		nargs = 0
+	case opLocal:
+		nargs = 0
+	case opNeg, opNot, opLet:
+		nargs = 1
+	case opIf, opIter:
+		nargs = 3
+	case opSum, opProd:
+		n.name = e.Op
+		if len(n.args) == 3 {
+			n.args = []*fparNode{n.args[2], n.args[0], n.args[1]}
+		}
+		nargs = 3
+	case opEscape:
+		nargs = 4
+	case opFunc:
+		if n.name == "lut" {
+			n.vname = e.Value
+			n.idx = -1
+			for i, m := range lutModes {
+				if m == e.Var || (e.Var == "" && i == 0) {
+					n.idx = i
+				}
+			}
+			if !validLUTName(n.vname) || n.idx < 0 {
+				return nil, fmt.Errorf("invalid lut curve '%s' or interpolation '%s'", e.Value, e.Var)
+			}
+			nargs = 1
+		}
+	case opSeq:
+	default:
+		nargs = 2
+	}
+	if nargs >= 0 && len(n.args) != nargs {
+		return nil, fmt.Errorf("expression node '%s' must have %d argument(s), got %d", e.Op, nargs, len(n.args))
+	}
+	return n, nil
+}
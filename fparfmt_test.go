@@ -0,0 +1,118 @@
+package jpegbw
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStringRoundTrip(t *testing.T) {
+	c, err := NewCurve([]float64{0, 0.5, 1}, []float64{0, 0.25, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RegisterLUT("fmtcurve", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testCases = []struct {
+		expr string
+		str  string
+	}{
+		{expr: "x1+x2*x3", str: "x1 + (x2*x3)"},
+		{expr: "(x1+x2)*x3", str: "(x1 + x2)*x3"},
+		{expr: "x1 - (x2 - x3)", str: "x1 - (x2 - x3)"},
+		{expr: "x1 - x2 - x3", str: "(x1 - x2) - x3"},
+		{expr: "2^3^x1", str: "2^(3^x1)"},
+		{expr: "(2^3)^x1", str: "(2^3)^x1"},
+		{expr: "-x1^2", str: "(-x1)^2"},
+		{expr: "-(x1+x2)", str: "-(x1 + x2)"},
+		{expr: "GRAY * Pos", str: "x1*x2"},
+		{expr: "3+4i + 1e-3 + 2_1 + _1", str: "(((3 + 4i) + 0.001) + (2 + 1i)) + 1i"},
+		{expr: "x1 < .3 ? 0 : x1 > .7 ? 1 : x1"},
+		{expr: "!(x1 > 2) & x2 != x3 | x1 = 0.5"},
+		{expr: "-1 % 3 + x1 % x2"},
+		{expr: "a = x1^2; b = 1 - a; a*b/(a+b)"},
+		{expr: "d = cabs(2*pos-1_1); 1 - .4*d^2"},
+		{expr: "sin(x1)+sin(x1)^2"},
+		{expr: "alpha(x1, 6.28, -.1, .9) + min(x1, x2, x3)"},
+		{expr: "sum(j, 1, 3, sum(k, 1, j, j*k*x1))"},
+		{expr: "prod(k, 1, 3, x1 + k)"},
+		{expr: "iter(z -> z^2 + x1, 0, 10)"},
+		{expr: "escape(z -> z^2 + x2, 0, 100, 2)"},
+		{expr: `lut("fmtcurve", x1) + lut("FmtCurve", x2, "cubic")`},
+		{expr: "e^(i*pi*x1)"},
+	}
+	for _, tc := range testCases {
+		ctx, err := compile(t, tc.expr, 3)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		str := ctx.String()
+		if tc.str != "" && str != tc.str {
+			t.Errorf("%s: String() %s, expected %s", tc.expr, str, tc.str)
+		}
+		ctx2, err := compile(t, str, 3)
+		if err != nil {
+			t.Errorf("%s: String() %s: %v", tc.expr, str, err)
+			continue
+		}
+		if ctx2.String() != str {
+			t.Errorf("%s: String() %s of String() %s differs", tc.expr, ctx2.String(), str)
+		}
+		data, err := json.Marshal(ctx)
+		if err != nil {
+			t.Errorf("%s: JSON: %v", tc.expr, err)
+			continue
+		}
+		var tree ExprNode
+		err = json.Unmarshal(data, &tree)
+		if err != nil {
+			t.Errorf("%s: JSON %s: %v", tc.expr, string(data), err)
+			continue
+		}
+		expr, err := tree.Expr()
+		if err != nil {
+			t.Errorf("%s: JSON %s: %v", tc.expr, string(data), err)
+			continue
+		}
+		if expr != str {
+			t.Errorf("%s: JSON %s expression %s, expected %s", tc.expr, string(data), expr, str)
+		}
+		for _, args := range testArgs {
+			want, err := ctx.FparF(args)
+			if err != nil {
+				t.Errorf("%s%v: %v", tc.expr, args, err)
+				continue
+			}
+			got, err := ctx2.FparF(args)
+			if err != nil {
+				t.Errorf("%s%v: String() %s: %v", tc.expr, args, str, err)
+				continue
+			}
+			if !same(got, want) {
+				t.Errorf("%s%v: %v, String() %s: %v", tc.expr, args, want, str, got)
+			}
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	var testCases = []string{
+		`{"op": "nosuchop"}`,
+		`{"op": "+", "args": [{"op": "arg", "name": "x1"}]}`,
+		`{"op": "const", "value": "abc"}`,
+	}
+	for _, data := range testCases {
+		var tree ExprNode
+		err := json.Unmarshal([]byte(data), &tree)
+		if err != nil {
+			t.Errorf("%s: %v", data, err)
+			continue
+		}
+		expr, err := tree.Expr()
+		if err == nil {
+			t.Errorf("%s: expected error, got %s", data, expr)
+		}
+	}
+}
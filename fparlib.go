@@ -0,0 +1,393 @@
+package jpegbw
+
+/*
+#include "byname.h"
+*/
+import "C"
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"plugin"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// PluginSymbol - name of the registration function that Go plugin (built using -buildmode=plugin) must export
+// Its type is PluginRegister, it should call register for each function it provides
+const PluginSymbol = "JpegbwRegister"
+
+// PluginRegister - type of plugin's registration function, register's arguments are the same as RegisterFunc's
+// Only builtin types are used, so plugin doesn't need to import jpegbw package
+type PluginRegister = func(register func(name string, nargs int, fn func(args ...complex128) (complex128, error)) error) error
+
+// cFunc - resolved C function and its prototype, or Go plugin's function (gfn != nil)
+type cFunc struct {
+	fptr  unsafe.Pointer
+	sig   cSig
+	decl  bool
+	gfn   func(...complex128) (complex128, error)
+	nargs int
+}
+
+// Loader - set of C libraries opened via dlopen and Go plugins, functions are looked up in libraries in the order they were given
+// Functions are resolved by FparOK, evaluation only uses resolved function pointers, so it is safe for concurrent use
+type Loader struct {
+	mtx     sync.Mutex
+	libs    []string
+	handles []unsafe.Pointer
+	plugins []map[string]fparRegFunc
+	protos  []map[string]cSig
+	syms    map[string]cFunc
+	exports []FuncInfo
+	maxfn   int
+	refs    int
+}
+
+// NewLoader - opens libraries from ':' separated list, maxfn is the maximum number of distinct functions resolved, 0 means no limit
+// Library can declare C prototypes of its functions inline: "libm.so.6(double j0(double); double jn(int, double))"
+// Or it can be a manifest file with ".sig" extension, containing "lib path" lines and prototypes (one per line)
+// Functions without prototype take and return double complex values
+// Library can also be a Go plugin exporting PluginSymbol (bare names are searched like dlopen does), plugins cannot be unloaded
+// Returned loader has one reference, it is released by Close
+func NewLoader(libs string, maxfn int) (*Loader, error) {
+	l := &Loader{syms: make(map[string]cFunc), maxfn: maxfn, refs: 1}
+	for _, item := range splitLibs(libs) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		paths := []string{item}
+		protos := make(map[string]cSig)
+		var err error
+		if strings.HasSuffix(item, ".sig") {
+			paths, protos, err = readManifest(item)
+		} else if strings.HasSuffix(item, ")") && strings.Contains(item, "(") {
+			open := strings.Index(item, "(")
+			paths = []string{strings.TrimSpace(item[:open])}
+			err = parseProtos(item[open+1:len(item)-1], protos)
+		}
+		if err != nil {
+			_ = l.closeHandles()
+			return nil, err
+		}
+		for _, lib := range paths {
+			if path := libPath(lib); path != "" && isGoPlugin(path) {
+				if len(protos) > 0 {
+					_ = l.closeHandles()
+					return nil, fmt.Errorf("%s is a Go plugin, C prototypes cannot be used with it", lib)
+				}
+				funcs, err := openPlugin(path)
+				if err != nil {
+					_ = l.closeHandles()
+					return nil, err
+				}
+				l.libs = append(l.libs, lib)
+				l.handles = append(l.handles, nil)
+				l.plugins = append(l.plugins, funcs)
+				l.protos = append(l.protos, protos)
+				continue
+			}
+			clib := C.CString(lib)
+			handle := C.lib_open(clib)
+			C.free(unsafe.Pointer(clib))
+			if handle == nil {
+				err := fmt.Errorf("cannot load library %s: %s", lib, C.GoString(C.lib_error()))
+				_ = l.closeHandles()
+				return nil, err
+			}
+			l.libs = append(l.libs, lib)
+			l.handles = append(l.handles, handle)
+			l.plugins = append(l.plugins, nil)
+			l.protos = append(l.protos, protos)
+		}
+	}
+	if len(l.libs) == 0 {
+		return nil, fmt.Errorf("no libraries given: '%s'", libs)
+	}
+	// debug: fmt.Printf("NewLoader: %v %v\n", l.libs, l.protos)
+	return l, nil
+}
+
+// Libs - returns libraries paths
+func (l *Loader) Libs() []string {
+	return append([]string{}, l.libs...)
+}
+
+// resolve - returns C function and its prototype, the first library exporting name wins
+// found is false when no library exports name
+func (l *Loader) resolve(name string) (cFunc, bool, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.refs <= 0 {
+		return cFunc{}, true, fmt.Errorf("resolving %s: loader is closed", name)
+	}
+	f, ok := l.syms[name]
+	if ok {
+		return f, true, nil
+	}
+	if l.maxfn > 0 && len(l.syms) >= l.maxfn {
+		return cFunc{}, true, fmt.Errorf("resolving %s: functions table full (%d functions)", name, l.maxfn)
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	for i, handle := range l.handles {
+		if handle == nil {
+			rf, ok := l.plugins[i][name]
+			if ok {
+				f = cFunc{gfn: rf.fn, nargs: rf.nargs}
+				l.syms[name] = f
+				return f, true, nil
+			}
+			continue
+		}
+		fptr := C.lib_sym(handle, cname)
+		if fptr != nil {
+			f = cFunc{fptr: fptr}
+			f.sig, f.decl = l.protos[i][name]
+			l.syms[name] = f
+			// debug: fmt.Printf("resolve: %s -> %p %v\n", name, fptr, f.sig)
+			return f, true, nil
+		}
+	}
+	return cFunc{}, false, fmt.Errorf("function %s not found in %s", name, strings.Join(l.libs, ":"))
+}
+
+// Functions - lists functions exported by libraries (read from ELF dynamic symbol table) sorted by name
+// Only names usable in expressions are listed, when more libraries export the same name, the first one is used
+func (l *Loader) Functions() ([]FuncInfo, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.exports != nil {
+		return l.exports, nil
+	}
+	seen := make(map[string]struct{})
+	funcs := []FuncInfo{}
+	for i, handle := range l.handles {
+		if handle == nil {
+			for name, rf := range l.plugins[i] {
+				_, ok := seen[name]
+				if ok {
+					continue
+				}
+				seen[name] = struct{}{}
+				funcs = append(funcs, FuncInfo{Name: name, Lib: l.libs[i], Proto: "func(...complex128) (complex128, error)", MinArgs: rf.nargs, MaxArgs: rf.nargs})
+			}
+			continue
+		}
+		path := l.libs[i]
+		cpath := C.lib_path(handle)
+		if cpath != nil && C.GoString(cpath) != "" {
+			path = C.GoString(cpath)
+		}
+		names, err := elfFunctions(path)
+		if err != nil {
+			return nil, fmt.Errorf("listing functions of %s: %v", l.libs[i], err)
+		}
+		for _, name := range names {
+			_, ok := seen[name]
+			if ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			fi := FuncInfo{Name: name, Lib: l.libs[i], MinArgs: 1, MaxArgs: 4}
+			sig, ok := l.protos[i][name]
+			if ok {
+				fi.Proto = sig.String()
+				fi.MinArgs = len(sig.args)
+				fi.MaxArgs = len(sig.args)
+			}
+			funcs = append(funcs, fi)
+		}
+	}
+	sort.Slice(funcs, func(i, j int) bool { return funcs[i].Name < funcs[j].Name })
+	l.exports = funcs
+	return funcs, nil
+}
+
+// libPath - finds library file the way dlopen does: name containing '/' is used as given,
+// bare name is looked up in LD_LIBRARY_PATH directories and then in default library directories
+// (ld.so.cache is not consulted), returns empty string when library file cannot be found
+func libPath(name string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	dirs := filepath.SplitList(os.Getenv("LD_LIBRARY_PATH"))
+	dirs = append(dirs, "/lib", "/usr/lib", "/lib64", "/usr/lib64", "/usr/local/lib")
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+// isGoPlugin - library is a Go plugin when it exports PluginSymbol Go function,
+// Go exports it as "<package path>.JpegbwRegister" in ELF dynamic symbols table
+// (C library exporting plain JpegbwRegister or Go c-shared library are not plugins)
+func isGoPlugin(path string) bool {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+	syms, err := f.DynamicSymbols()
+	if err != nil {
+		return false
+	}
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Section != elf.SHN_UNDEF && strings.HasSuffix(sym.Name, "."+PluginSymbol) {
+			return true
+		}
+	}
+	return false
+}
+
+// openPlugin - opens Go plugin and calls its registration function, returns functions it registered
+func openPlugin(path string) (map[string]fparRegFunc, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load plugin %s: %v", path, err)
+	}
+	sym, err := p.Lookup(PluginSymbol)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %v", path, err)
+	}
+	reg, ok := sym.(PluginRegister)
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: %s has type %T, expected %T", path, PluginSymbol, sym, reg)
+	}
+	funcs := make(map[string]fparRegFunc)
+	err = reg(func(name string, nargs int, fn func(args ...complex128) (complex128, error)) error {
+		if nargs < 1 || nargs > 4 {
+			return fmt.Errorf("%s: number of arguments must be from 1-4 range, got %d", name, nargs)
+		}
+		if fn == nil {
+			return fmt.Errorf("%s: nil function", name)
+		}
+		name = strings.ToLower(name)
+		if name == "if" || !validIdent(name) {
+			return fmt.Errorf("invalid function name '%s'", name)
+		}
+		funcs[name] = fparRegFunc{nargs: nargs, fn: fn}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %v", path, err)
+	}
+	// debug: fmt.Printf("openPlugin: %s: %d functions\n", path, len(funcs))
+	return funcs, nil
+}
+
+// elfFunctions - names of defined global functions from ELF dynamic symbol table that can be used in expressions
+func elfFunctions(path string) ([]string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	syms, err := f.DynamicSymbols()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Section == elf.SHN_UNDEF {
+			continue
+		}
+		bind := elf.ST_BIND(sym.Info)
+		if bind != elf.STB_GLOBAL && bind != elf.STB_WEAK {
+			continue
+		}
+		if !validIdent(sym.Name) || strings.HasPrefix(sym.Name, "_") {
+			continue
+		}
+		names = append(names, sym.Name)
+	}
+	return names, nil
+}
+
+func (l *Loader) retain() {
+	l.mtx.Lock()
+	l.refs++
+	l.mtx.Unlock()
+}
+
+// Close - releases one reference, libraries are closed when the last reference is released
+// Contexts using closed loader must not be evaluated anymore
+func (l *Loader) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.refs <= 0 {
+		return nil
+	}
+	l.refs--
+	if l.refs > 0 {
+		return nil
+	}
+	return l.closeHandles()
+}
+
+func (l *Loader) closeHandles() error {
+	var err error
+	for i, handle := range l.handles {
+		if handle == nil {
+			continue
+		}
+		if C.lib_close(handle) != 0 && err == nil {
+			err = fmt.Errorf("cannot close library %s: %s", l.libs[i], C.GoString(C.lib_error()))
+		}
+	}
+	l.handles = nil
+	l.plugins = nil
+	l.protos = nil
+	l.exports = nil
+	l.syms = make(map[string]cFunc)
+	return err
+}
+
+// SetLoader - use C functions from loader l, takes a reference released by Tidy
+// Many independent contexts can share one loader, each of them can be tidied separately
+func (ctx *FparCtx) SetLoader(l *Loader) {
+	if l != nil {
+		l.retain()
+	}
+	ctx.releaseLoader()
+	ctx.loader = l
+}
+
+// Loader - returns loader used by context, nil if no C library is used
+func (ctx *FparCtx) Loader() *Loader {
+	return ctx.loader
+}
+
+func (ctx *FparCtx) releaseLoader() {
+	if ctx.loader != nil {
+		_ = ctx.loader.Close()
+		ctx.loader = nil
+	}
+}
+
+// callC - call C library function from the compiled call node, arguments are converted to its declared types
+func callC(n *fparNode, a []complex128) complex128 {
+	var x [4]complex128
+	copy(x[:], a)
+	v := complex128(C.callsig(n.fptr, C.int(n.sig), C.complexdouble(x[0]), C.complexdouble(x[1]), C.complexdouble(x[2]), C.complexdouble(x[3])))
+	// info: fmt.Printf("callC: %s(%v) -> %f\n", n.name, a, v)
+	return v
+}
+
+// callCReal - callC for functions without double complex in signature (see realSig), arguments and result are passed as double
+func callCReal(n *fparNode, a []float64) float64 {
+	var x [4]float64
+	copy(x[:], a)
+	return float64(C.callreal(n.fptr, C.int(n.sig), C.double(x[0]), C.double(x[1]), C.double(x[2]), C.double(x[3])))
+}
@@ -0,0 +1,330 @@
+package jpegbw
+
+import (
+	"errors"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testLib - path of libjpegbw.so built by make, test is skipped when it is not built
+func testLib(t *testing.T) string {
+	t.Helper()
+	lib := "./libjpegbw.so"
+	_, err := os.Stat(lib)
+	if err != nil {
+		t.Skipf("%s not built", lib)
+	}
+	return lib
+}
+
+// compileLib - compiles expression of nvar variables using C functions from lib, context is tidied when test ends
+func compileLib(t *testing.T, lib, expr string, nvar int) (*FparCtx, error) {
+	t.Helper()
+	ctx := &FparCtx{}
+	err := ctx.Init(lib, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ctx.Tidy)
+	err = ctx.FparFunction(expr)
+	if err == nil {
+		err = ctx.FparOK(nvar)
+	}
+	return ctx, err
+}
+
+func TestCpyTidy(t *testing.T) {
+	lib := testLib(t)
+	var a FparCtx
+	err := a.Init(lib, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.FparFunction("func(x1)")
+	if err == nil {
+		err = a.FparOK(1)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := a.FparF([]complex128{0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tidying copies must not close libraries still used by the original
+	for i := 0; i < 3; i++ {
+		b := a.Cpy()
+		b.Tidy()
+	}
+	got, err := a.FparF([]complex128{0.5})
+	if err != nil || got != want {
+		t.Fatalf("after tidying copies: got %v, %v, expected %v", got, err, want)
+	}
+	// copy keeps libraries open after the original is tidied
+	b := a.Cpy()
+	l := a.Loader()
+	a.Tidy()
+	got, err = b.FparF([]complex128{0.5})
+	if err != nil || got != want {
+		t.Fatalf("after tidying the original: got %v, %v, expected %v", got, err, want)
+	}
+	b.Tidy()
+	_, _, err = l.resolve("func")
+	if err == nil {
+		t.Errorf("libraries should be closed when the last context is tidied")
+	}
+}
+
+// testPlugin - path of example Go plugin built by make, test is skipped when it is not built
+func testPlugin(t *testing.T) string {
+	t.Helper()
+	lib := "./example.so"
+	_, err := os.Stat(lib)
+	if err != nil {
+		t.Skipf("%s not built", lib)
+	}
+	return lib
+}
+
+func TestIsGoPlugin(t *testing.T) {
+	if !isGoPlugin(testPlugin(t)) {
+		t.Errorf("example.so not detected as a plugin")
+	}
+	if isGoPlugin(testLib(t)) {
+		t.Errorf("libjpegbw.so detected as a plugin")
+	}
+	if testing.Short() {
+		return
+	}
+	// Go c-shared library has Go build info too, but it doesn't export Go JpegbwRegister
+	dir := t.TempDir()
+	src := filepath.Join(dir, "cshared.go")
+	code := "package main\n\nimport \"C\"\n\n//export JpegbwRegister\nfunc JpegbwRegister() {}\n\nfunc main() {}\n"
+	err := os.WriteFile(src, []byte(code), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lib := filepath.Join(dir, "libcshared.so")
+	out, err := exec.Command("go", "build", "-buildmode=c-shared", "-o", lib, src).CombinedOutput()
+	if err != nil {
+		t.Skipf("cannot build c-shared library: %v: %s", err, out)
+	}
+	if isGoPlugin(lib) {
+		t.Errorf("Go c-shared library detected as a plugin")
+	}
+}
+
+func TestPluginBareName(t *testing.T) {
+	lib := testPlugin(t)
+	dir, err := filepath.Abs(filepath.Dir(lib))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LD_LIBRARY_PATH", "")
+	if libPath("example.so") != "" {
+		t.Skipf("example.so found in default library directories")
+	}
+	t.Setenv("LD_LIBRARY_PATH", "/nonexistent:"+dir)
+	if got, want := libPath("example.so"), filepath.Join(dir, "example.so"); got != want {
+		t.Fatalf("libPath: got %q, want %q", got, want)
+	}
+	var ctx FparCtx
+	err = ctx.Init("example.so", 16)
+	if err != nil && strings.Contains(err.Error(), "plugin was built with a different version") {
+		// plugin must be built with the same flags as the test binary (for example -race)
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { ctx.Tidy() }()
+	err = ctx.FparFunction("sigmoid(x1, 8)")
+	if err == nil {
+		err = ctx.FparOK(1)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ctx.FparF([]complex128{0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(real(got)-0.5) > 1e-12 {
+		t.Errorf("sigmoid(0.5, 8): got %v, want 0.5", got)
+	}
+}
+
+func TestLoaderLibraries(t *testing.T) {
+	jpeg := testLib(t)
+	tet := "./libtet.so"
+	_, err := os.Stat(tet)
+	if err != nil {
+		t.Skipf("%s not built", tet)
+	}
+	args := []complex128{0.3}
+	var want complex128
+	for _, tc := range []struct{ lib, expr string }{{lib: jpeg, expr: "func(x1)"}, {lib: tet, expr: "tet(x1)"}} {
+		ctx, err := compileLib(t, tc.lib, tc.expr, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := ctx.FparF(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want += v
+	}
+	l, err := NewLoader(jpeg+":"+tet, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Libs()) != 2 {
+		t.Fatalf("Libs: got %v, expected 2 libraries", l.Libs())
+	}
+	// contexts sharing loader are compiled (and functions resolved) concurrently
+	n := 8
+	ctxs := make([]*FparCtx, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := &FparCtx{}
+			ctx.SetLoader(l)
+			ctxs[i] = ctx
+			errs[i] = ctx.FparFunction("func(x1) + tet(x1)")
+			if errs[i] == nil {
+				errs[i] = ctx.FparOK(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	_ = l.Close()
+	for i, ctx := range ctxs {
+		if errs[i] != nil {
+			t.Fatalf("context %d: %v", i, errs[i])
+		}
+		if !ctx.External() {
+			t.Errorf("context %d: expected LIB functions to be used", i)
+		}
+	}
+	// tidying one context doesn't close libraries used by others
+	for i, ctx := range ctxs {
+		got, err := ctx.FparF(args)
+		if err != nil || got != want {
+			t.Errorf("context %d: got %v, %v, expected %v", i, got, err, want)
+		}
+		ctx.Tidy()
+	}
+	_, _, err = l.resolve("func")
+	if err == nil {
+		t.Errorf("libraries should be closed when the last context is tidied")
+	}
+}
+
+func TestLoaderErrors(t *testing.T) {
+	lib := testLib(t)
+	_, err := compileLib(t, lib, "func(x1) + clr(x1)", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewLoader(lib, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &FparCtx{}
+	ctx.SetLoader(l)
+	_ = l.Close()
+	defer ctx.Tidy()
+	err = ctx.FparFunction("func(x1) + clr(x1)")
+	if err == nil {
+		err = ctx.FparOK(1)
+	}
+	if err == nil {
+		t.Errorf("expected functions table full error")
+	}
+	for _, libs := range []string{lib + ":./no-such-library.so", "./no-such-manifest.sig", lib + "(float func(double))"} {
+		l, err := NewLoader(libs, 0)
+		if err == nil {
+			_ = l.Close()
+			t.Errorf("NewLoader(%s): expected error", libs)
+		}
+	}
+}
+
+func TestLoaderFunctions(t *testing.T) {
+	lib := testLib(t)
+	protos := lib + "(double complex alpha(double complex arg, double complex period, double complex offset, double complex power); double complex toon(double complex, double complex))"
+	var testCases = []struct {
+		lib   string
+		name  string
+		proto string
+		min   int
+		max   int
+	}{
+		{lib: lib, name: "alpha", min: 1, max: 4},
+		{lib: lib, name: "func", min: 1, max: 4},
+		{lib: protos, name: "alpha", proto: "double complex(double complex, double complex, double complex, double complex)", min: 4, max: 4},
+		{lib: protos, name: "toon", proto: "double complex(double complex, double complex)", min: 2, max: 2},
+	}
+	for _, tc := range testCases {
+		l, err := NewLoader(tc.lib, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		funcs, err := l.Functions()
+		_ = l.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fi *FuncInfo
+		for i := range funcs {
+			if !validIdent(funcs[i].Name) {
+				t.Errorf("%s: %q cannot be used in expressions", tc.lib, funcs[i].Name)
+			}
+			if i > 0 && funcs[i-1].Name >= funcs[i].Name {
+				t.Errorf("%s: functions not sorted: %s, %s", tc.lib, funcs[i-1].Name, funcs[i].Name)
+			}
+			if funcs[i].Name == tc.name {
+				fi = &funcs[i]
+			}
+		}
+		if fi == nil {
+			t.Errorf("%s: %s not listed", tc.lib, tc.name)
+			continue
+		}
+		if fi.Proto != tc.proto || fi.MinArgs != tc.min || fi.MaxArgs != tc.max {
+			t.Errorf("%s: %s: got %q %d-%d, expected %q %d-%d", tc.lib, tc.name, fi.Proto, fi.MinArgs, fi.MaxArgs, tc.proto, tc.min, tc.max)
+		}
+	}
+}
+
+func TestLoaderSuggest(t *testing.T) {
+	lib := testLib(t)
+	var testCases = []struct {
+		expr string
+		hint string
+	}{
+		{expr: "vingete(x1, x2, x3)", hint: "vingette"},
+		{expr: "saturat(x1, 0, 1)", hint: "saturate"},
+		{expr: "lib.alhpa(x1, 1, 0, 1)", hint: "lib.alpha"},
+		{expr: "sinn(x1)", hint: "sin"},
+	}
+	for _, tc := range testCases {
+		_, err := compileLib(t, lib, tc.expr, 3)
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("%s: expected ParseError, got %v", tc.expr, err)
+			continue
+		}
+		if pe.Hint != tc.hint {
+			t.Errorf("%s: got hint %q, expected %q", tc.expr, pe.Hint, tc.hint)
+		}
+	}
+}
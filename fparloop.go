@@ -0,0 +1,279 @@
+package jpegbw
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+)
+
+// MaxIterations - maximum number of iterations of a single iter, sum, prod or escape evaluation
+const MaxIterations = 1 << 20
+
+// fparLoop - loop construct: name, number of arguments and syntax shown in errors and functions list
+type fparLoop struct {
+	op     fparOp
+	nargs  int
+	syntax string
+}
+
+// fparLoops - loop constructs, they bind a variable visible only in their body, so they are parsed like 'if' not like functions
+// iter(z -> f(z), z0, n) - applies f n times starting from z0
+// sum(k, from, to, f(k)), prod(k, from, to, f(k)) - sum/product of f(k) for k = from, from+1, ... <= to
+// escape(z -> f(z), z0, maxIter, radius) - number of iterations until |z| > radius (maxIter if it never escapes)
+var fparLoops = map[string]fparLoop{
+	"iter":   {op: opIter, nargs: 3, syntax: "iter(z -> expr, z0, n)"},
+	"sum":    {op: opSum, nargs: 4, syntax: "sum(k, from, to, expr)"},
+	"prod":   {op: opProd, nargs: 4, syntax: "prod(k, from, to, expr)"},
+	"escape": {op: opEscape, nargs: 4, syntax: "escape(z -> expr, z0, maxiter, radius)"},
+}
+
+// bindable - name can be used as a local or loop variable
+func (ctx *FparCtx) bindable(name string) bool {
+	_, isArg := ctx.argIdx(name)
+	_, isAlias := fparAliases[name]
+	_, isConst := fparConsts[name]
+	return !isArg && !isAlias && !isConst && name != "if"
+}
+
+// loop - parses loop construct after its name, ctx.ch is '(', argument order in node: body, then remaining arguments
+// Loop variable gets a new local slot and is only visible in body, it shadows local variable with the same name
+func (ctx *FparCtx) loop(ident string, off int) *fparNode {
+	lp := fparLoops[ident]
+	ctx.readNextChar()
+	ctx.skipBlanks()
+	voff := ctx.offset()
+	name := ctx.readIdent()
+	if ctx.err != nil {
+		return nil
+	}
+	if !ctx.bindable(name) {
+		ctx.syntaxErrAt(voff, fmt.Sprintf("%s: cannot use '%s' as loop variable", lp.syntax, name), "variable name", "'"+ctx.rbuffer[voff:voff+len(name)]+"'")
+		return nil
+	}
+	node := &fparNode{op: lp.op, name: ident, vname: name, off: off, idx: ctx.nlocals}
+	ctx.nlocals++
+	var from, to *fparNode
+	if lp.op == opSum || lp.op == opProd {
+		if ctx.ch != "," {
+			ctx.syntaxErr(lp.syntax, "','")
+			return nil
+		}
+		from = ctx.expression()
+		if ctx.ch != "," {
+			ctx.syntaxErr(lp.syntax, "','")
+			return nil
+		}
+		to = ctx.expression()
+		if ctx.ch != "," {
+			ctx.syntaxErr(lp.syntax, "','")
+			return nil
+		}
+	} else {
+		if ctx.ch != "-" || ctx.peek(0) != ">" {
+			ctx.syntaxErr(lp.syntax, "'->'")
+			return nil
+		}
+		ctx.readNextChar()
+	}
+	prev, shadowed := ctx.locals[name]
+	ctx.locals[name] = node.idx
+	body := ctx.expression()
+	if shadowed {
+		ctx.locals[name] = prev
+	} else {
+		delete(ctx.locals, name)
+	}
+	bindLoopVar(body, node.idx)
+	nargs := lp.nargs
+	node.args = []*fparNode{body}
+	if from != nil {
+		// loop variable is the 1st argument of sum and prod
+		node.args = append(node.args, from, to)
+		nargs--
+	}
+	for len(node.args) < nargs {
+		if ctx.ch != "," {
+			ctx.syntaxErr(lp.syntax, "','")
+			return nil
+		}
+		node.args = append(node.args, ctx.expression())
+	}
+	if ctx.ch != ")" {
+		ctx.syntaxErr(lp.syntax, "')'")
+		return nil
+	}
+	ctx.readNextChar()
+	ctx.skipBlanks()
+	return node
+}
+
+// bindLoopVar - loop variable references change value in each iteration, they are marked so optimizer doesn't hoist them
+func bindLoopVar(n *fparNode, slot int) {
+	if n.op == opLocal && n.idx == slot {
+		n.op = opBound
+	}
+	for _, arg := range n.args {
+		bindLoopVar(arg, slot)
+	}
+}
+
+// iterations - number of iterations from loop count argument (real part, rounded down), error if it is above MaxIterations
+func (ctx *FparCtx) iterations(n *fparNode, v float64) int {
+	if !(v >= 1.0) {
+		return 0
+	}
+	if v > MaxIterations {
+		ctx.er(&EvalError{Func: n.name, Args: []complex128{complex(v, 0.0)}, Err: fmt.Errorf("at most %d iterations allowed", MaxIterations)})
+		return 0
+	}
+	return int(v)
+}
+
+// sumIterations - number of k values from, from+1, ... <= to
+func (ctx *FparCtx) sumIterations(n *fparNode, from, to complex128) int {
+	return ctx.iterations(n, math.Floor(real(to)-real(from))+1.0)
+}
+
+// escaped - escape's stop condition
+func escaped(z, radius complex128) bool {
+	return cmplx.Abs(z) > real(radius)
+}
+
+// evalLoop - evaluates loop node, loop variable is stored in its local slot
+func (ctx *FparCtx) evalLoop(n *fparNode) complex128 {
+	switch n.op {
+	case opIter:
+		z := ctx.eval(n.args[1])
+		it := ctx.iterations(n, real(ctx.eval(n.args[2])))
+		for i := 0; i < it; i++ {
+			ctx.vars[n.idx] = z
+			z = ctx.eval(n.args[0])
+		}
+		return z
+	case opSum, opProd:
+		from := ctx.eval(n.args[1])
+		it := ctx.sumIterations(n, from, ctx.eval(n.args[2]))
+		acc := complex(0.0, 0.0)
+		if n.op == opProd {
+			acc = complex(1.0, 0.0)
+		}
+		for i := 0; i < it; i++ {
+			ctx.vars[n.idx] = complex(real(from)+float64(i), 0.0)
+			if n.op == opSum {
+				acc += ctx.eval(n.args[0])
+			} else {
+				acc *= ctx.eval(n.args[0])
+			}
+		}
+		return acc
+	case opEscape:
+		z := ctx.eval(n.args[1])
+		it := ctx.iterations(n, real(ctx.eval(n.args[2])))
+		radius := ctx.eval(n.args[3])
+		i := 0
+		for i < it && !escaped(z, radius) {
+			ctx.vars[n.idx] = z
+			z = ctx.eval(n.args[0])
+			i++
+		}
+		return complex(float64(i), 0.0)
+	}
+	ctx.er(fmt.Errorf("evalLoop: unknown node type %d", n.op))
+	return 0.0
+}
+
+// loopRows - EvalRows version of evalLoop, in each iteration body is evaluated for rows that still iterate
+func (ctx *FparCtx) loopRows(n *fparNode, idx []int, out []complex128) {
+	rs := ctx.rows
+	m := len(idx)
+	v := rs.vars[n.idx]
+	// loop state: z for iter and escape, k's start for sum and prod
+	z := rs.buf(m)
+	ctx.evalRows(n.args[1], idx, z)
+	cnt := rs.buf(m)
+	ctx.evalRows(n.args[2], idx, cnt)
+	its := rs.ibuf(m)
+	maxIt := 0
+	for k := range cnt {
+		var it int
+		if n.op == opSum || n.op == opProd {
+			it = ctx.sumIterations(n, z[k], cnt[k])
+		} else {
+			it = ctx.iterations(n, real(cnt[k]))
+		}
+		its = append(its, it)
+		if it > maxIt {
+			maxIt = it
+		}
+	}
+	var radius []complex128
+	if n.op == opEscape {
+		radius = rs.buf(m)
+		ctx.evalRows(n.args[3], idx, radius)
+		// from now on cnt holds number of iterations done
+		for k := range cnt {
+			cnt[k] = complex(0.0, 0.0)
+		}
+	}
+	switch n.op {
+	case opIter, opEscape:
+		copy(out, z)
+	case opSum:
+		for k := range out {
+			out[k] = complex(0.0, 0.0)
+		}
+	case opProd:
+		for k := range out {
+			out[k] = complex(1.0, 0.0)
+		}
+	}
+	pos := rs.ibuf(m)
+	body := rs.buf(m)
+	for i := 0; i < maxIt && ctx.err == nil; i++ {
+		pos = pos[:0]
+		for k := range idx {
+			if i >= its[k] || (n.op == opEscape && escaped(out[k], radius[k])) {
+				continue
+			}
+			pos = append(pos, k)
+			switch n.op {
+			case opIter, opEscape:
+				v[idx[k]] = out[k]
+			default:
+				v[idx[k]] = complex(real(z[k])+float64(i), 0.0)
+			}
+		}
+		if len(pos) == 0 {
+			break
+		}
+		if len(pos) == m {
+			ctx.evalRows(n.args[0], idx, body)
+		} else {
+			ctx.branchRows(n.args[0], idx, pos, body)
+		}
+		for _, k := range pos {
+			switch n.op {
+			case opIter, opEscape:
+				out[k] = body[k]
+			case opSum:
+				out[k] += body[k]
+			case opProd:
+				out[k] *= body[k]
+			}
+			if n.op == opEscape {
+				cnt[k] = complex(float64(i+1), 0.0)
+			}
+		}
+	}
+	if n.op == opEscape {
+		copy(out, cnt)
+	}
+	rs.freeBuf()
+	rs.freeIBuf()
+	if radius != nil {
+		rs.freeBuf()
+	}
+	rs.freeIBuf()
+	rs.freeBuf()
+	rs.freeBuf()
+}
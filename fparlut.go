@@ -0,0 +1,440 @@
+package jpegbw
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// lutSyntax - syntax of lut shown in errors and functions list
+const lutSyntax = `lut("name", x, "cubic")`
+
+// lutModes - lut interpolation modes, linear is the default
+var lutModes = []string{"linear", "cubic"}
+
+// Curve - 1D lookup table: strictly increasing X values, Y values can go up or down, it is read only once registered
+// Values outside of X range are clamped to the first/last Y, cubic interpolation is monotone (doesn't overshoot)
+type Curve struct {
+	X []float64
+	Y []float64
+	m []float64
+}
+
+var (
+	lutMtx sync.RWMutex
+	luts   = make(map[string]*Curve)
+)
+
+// NewCurve - creates curve from points, x must be strictly increasing, at least 2 points are needed
+func NewCurve(x, y []float64) (*Curve, error) {
+	if len(x) != len(y) {
+		return nil, fmt.Errorf("curve has %d x and %d y values", len(x), len(y))
+	}
+	if len(x) < 2 {
+		return nil, fmt.Errorf("curve must have at least 2 points, got %d", len(x))
+	}
+	for i := range x {
+		if x[i]-x[i] != 0 || y[i]-y[i] != 0 {
+			return nil, fmt.Errorf("curve point %d: (%g, %g) is not finite", i+1, x[i], y[i])
+		}
+		if i > 0 && x[i] <= x[i-1] {
+			return nil, fmt.Errorf("curve point %d: x values must be increasing, %g after %g", i+1, x[i], x[i-1])
+		}
+	}
+	c := &Curve{X: append([]float64{}, x...), Y: append([]float64{}, y...)}
+	c.tangents()
+	return c, nil
+}
+
+// tangents - Fritsch-Carlson tangents for monotone cubic Hermite interpolation
+func (c *Curve) tangents() {
+	n := len(c.X)
+	d := make([]float64, n-1)
+	for k := range d {
+		d[k] = (c.Y[k+1] - c.Y[k]) / (c.X[k+1] - c.X[k])
+	}
+	c.m = make([]float64, n)
+	c.m[0] = d[0]
+	c.m[n-1] = d[n-2]
+	for k := 1; k < n-1; k++ {
+		if d[k-1]*d[k] > 0 {
+			c.m[k] = (d[k-1] + d[k]) / 2.0
+		}
+	}
+	for k := range d {
+		if d[k] == 0 {
+			c.m[k] = 0.0
+			c.m[k+1] = 0.0
+			continue
+		}
+		a := c.m[k] / d[k]
+		b := c.m[k+1] / d[k]
+		s := a*a + b*b
+		if s > 9.0 {
+			t := 3.0 / math.Sqrt(s)
+			c.m[k] = t * a * d[k]
+			c.m[k+1] = t * b * d[k]
+		}
+	}
+}
+
+// Eval - curve value at x, linear or cubic interpolation
+func (c *Curve) Eval(x float64, cubic bool) float64 {
+	n := len(c.X)
+	if x != x {
+		return x
+	}
+	if x <= c.X[0] {
+		return c.Y[0]
+	}
+	if x >= c.X[n-1] {
+		return c.Y[n-1]
+	}
+	i := sort.SearchFloat64s(c.X, x)
+	k := i - 1
+	h := c.X[i] - c.X[k]
+	t := (x - c.X[k]) / h
+	if !cubic {
+		return c.Y[k] + (c.Y[i]-c.Y[k])*t
+	}
+	t2 := t * t
+	t3 := t2 * t
+	return (2.0*t3-3.0*t2+1.0)*c.Y[k] + (t3-2.0*t2+t)*h*c.m[k] + (3.0*t2-2.0*t3)*c.Y[i] + (t3-t2)*h*c.m[i]
+}
+
+// validLUTName - curve names are identifiers, '.' is also allowed (channels of .cube curves are name.r, name.g, name.b)
+func validLUTName(name string) bool {
+	for _, part := range strings.Split(name, ".") {
+		if !validIdent(part) {
+			return false
+		}
+	}
+	return true
+}
+
+// RegisterLUT - registers curve usable as lut("name", x) in all expressions compiled after that, names are case insensitive
+func RegisterLUT(name string, c *Curve) error {
+	name = strings.ToLower(name)
+	if !validLUTName(name) {
+		return fmt.Errorf("RegisterLUT: invalid curve name '%s'", name)
+	}
+	if c == nil {
+		return fmt.Errorf("RegisterLUT: curve '%s' is nil", name)
+	}
+	lutMtx.Lock()
+	luts[name] = c
+	lutMtx.Unlock()
+	return nil
+}
+
+// LUTNames - names of registered curves, sorted
+func LUTNames() []string {
+	lutMtx.RLock()
+	names := []string{}
+	for name := range luts {
+		names = append(names, name)
+	}
+	lutMtx.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+func lookupLUT(name string) (*Curve, bool) {
+	lutMtx.RLock()
+	c, ok := luts[name]
+	lutMtx.RUnlock()
+	return c, ok
+}
+
+// LoadLUTs - reads and registers curves from ':' separated name=file list (like LUTS env), empty list does nothing
+// Files with .cube extension are 1D cube LUTs, other files are CSV (see ReadCurves)
+// Multi channel files register name (1st channel) and name.r, name.g, name.b
+func LoadLUTs(spec string) error {
+	for _, item := range strings.Split(spec, ":") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		eq := strings.Index(item, "=")
+		if eq < 0 {
+			return fmt.Errorf("LUTS: expected name=file, got '%s'", item)
+		}
+		name := strings.ToLower(strings.TrimSpace(item[:eq]))
+		if !validIdent(name) {
+			return fmt.Errorf("LUTS: invalid curve name '%s'", name)
+		}
+		curves, err := ReadCurves(strings.TrimSpace(item[eq+1:]))
+		if err != nil {
+			return fmt.Errorf("LUTS: %s: %v", name, err)
+		}
+		err = RegisterLUT(name, curves[0])
+		if err != nil {
+			return err
+		}
+		if len(curves) == 3 {
+			for i, ch := range []string{"r", "g", "b"} {
+				err = RegisterLUT(name+"."+ch, curves[i])
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ReadCurves - reads curve file, returns 1 curve or 3 curves (red, green, blue)
+// .cube: 1D cube file (LUT_1D_SIZE, optional DOMAIN_MIN, DOMAIN_MAX or LUT_1D_INPUT_RANGE and 3 values per line)
+// CSV (',', ';', tab or space separated): 'y' or 'r,g,b' lines for evenly spaced x from 0 to 1, 'x,y' or 'x,r,g,b' lines otherwise
+// Empty lines and lines starting with '#' are skipped, the 1st line can be a header
+func ReadCurves(fn string) ([]*Curve, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	cube := strings.EqualFold(filepath.Ext(fn), ".cube")
+	var (
+		rows   [][]float64
+		size   int
+		dmin   = []float64{0, 0, 0}
+		dmax   = []float64{1, 1, 1}
+		header = !cube
+	)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(s, func(r rune) bool {
+			return r == ',' || r == ';' || r == ' ' || r == '\t'
+		})
+		if cube && len(fields) > 0 && fields[0] != "" && (fields[0][0] < '0' || fields[0][0] > '9') && fields[0][0] != '-' && fields[0][0] != '.' {
+			err = cubeKeyword(fields, &size, dmin, dmax)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", fn, line, err)
+			}
+			continue
+		}
+		row := []float64{}
+		for _, field := range fields {
+			v, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				row = nil
+				break
+			}
+			row = append(row, v)
+		}
+		if row == nil {
+			if header && len(rows) == 0 {
+				header = false
+				continue
+			}
+			return nil, fmt.Errorf("%s:%d: invalid values '%s'", fn, line, s)
+		}
+		if len(rows) > 0 && len(row) != len(rows[0]) {
+			return nil, fmt.Errorf("%s:%d: expected %d values, got %d", fn, line, len(rows[0]), len(row))
+		}
+		rows = append(rows, row)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s: no curve values", fn)
+	}
+	ncol := len(rows[0])
+	if cube {
+		if ncol != 3 {
+			return nil, fmt.Errorf("%s: cube LUT lines must have 3 values, got %d", fn, ncol)
+		}
+		if size > 0 && size != len(rows) {
+			return nil, fmt.Errorf("%s: LUT_1D_SIZE is %d, got %d lines", fn, size, len(rows))
+		}
+	} else if ncol > 4 {
+		return nil, fmt.Errorf("%s: expected 1-4 values per line, got %d", fn, ncol)
+	}
+	// x column
+	evenly := cube || ncol == 1 || ncol == 3
+	first := 0
+	if !evenly {
+		first = 1
+	}
+	curves := []*Curve{}
+	for col := first; col < ncol; col++ {
+		x := make([]float64, len(rows))
+		y := make([]float64, len(rows))
+		for i, row := range rows {
+			y[i] = row[col]
+			if !evenly {
+				x[i] = row[0]
+				continue
+			}
+			lo, hi := 0.0, 1.0
+			if cube {
+				lo, hi = dmin[col], dmax[col]
+			}
+			if len(rows) > 1 {
+				x[i] = lo + (hi-lo)*float64(i)/float64(len(rows)-1)
+			}
+		}
+		c, err := NewCurve(x, y)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+		curves = append(curves, c)
+	}
+	return curves, nil
+}
+
+// cubeKeyword - parses .cube file keyword line
+func cubeKeyword(fields []string, size *int, dmin, dmax []float64) error {
+	floats := func(n int) ([]float64, error) {
+		if len(fields) != n+1 {
+			return nil, fmt.Errorf("%s: expected %d values, got %d", fields[0], n, len(fields)-1)
+		}
+		vals := []float64{}
+		for _, field := range fields[1:] {
+			v, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", fields[0], err)
+			}
+			vals = append(vals, v)
+		}
+		return vals, nil
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "TITLE":
+	case "LUT_1D_SIZE":
+		v, err := floats(1)
+		if err != nil {
+			return err
+		}
+		if v[0] < 2 || v[0] > 65536 || v[0] != math.Trunc(v[0]) {
+			return fmt.Errorf("LUT_1D_SIZE must be an integer from 2-65536 range, got %g", v[0])
+		}
+		*size = int(v[0])
+	case "DOMAIN_MIN":
+		v, err := floats(3)
+		if err != nil {
+			return err
+		}
+		copy(dmin, v)
+	case "DOMAIN_MAX":
+		v, err := floats(3)
+		if err != nil {
+			return err
+		}
+		copy(dmax, v)
+	case "LUT_1D_INPUT_RANGE":
+		v, err := floats(2)
+		if err != nil {
+			return err
+		}
+		for i := range dmin {
+			dmin[i], dmax[i] = v[0], v[1]
+		}
+	case "LUT_3D_SIZE":
+		return fmt.Errorf("3D cube LUTs are not supported, only 1D")
+	default:
+		return fmt.Errorf("unknown keyword '%s'", fields[0])
+	}
+	return nil
+}
+
+// readString - reads "..." string literal, ctx.ch is '"'
+func (ctx *FparCtx) readString() string {
+	if ctx.ch != `"` {
+		ctx.syntaxErr(lutSyntax, `'"'`)
+		return ""
+	}
+	s := ""
+	ctx.readNextChar()
+	for ctx.ch != `"` {
+		if ctx.ch == ";" {
+			ctx.syntaxErr("unterminated string", `'"'`)
+			return ""
+		}
+		s += ctx.ch
+		ctx.readNextChar()
+	}
+	ctx.readNextChar()
+	ctx.skipBlanks()
+	return s
+}
+
+// lutCall - parses lut after its name, ctx.ch is '(', curve is resolved when compiling
+// Node is a builtin call with one argument, curve name is kept in vname and interpolation mode in idx (1 - cubic)
+func (ctx *FparCtx) lutCall(off int) *fparNode {
+	ctx.readNextChar()
+	ctx.skipBlanks()
+	noff := ctx.offset()
+	name := ctx.readString()
+	if ctx.err != nil {
+		return nil
+	}
+	c, ok := lookupLUT(name)
+	if !ok {
+		ctx.syntaxErrAt(noff, fmt.Sprintf("%s: unknown curve '%s' (curves are loaded via LUTS)", lutSyntax, name), "curve name", "'"+ctx.rbuffer[noff:noff+len(name)+2]+"'")
+		ctx.hint(suggest(name, LUTNames()))
+		return nil
+	}
+	if ctx.ch != "," {
+		ctx.syntaxErr(lutSyntax, "','")
+		return nil
+	}
+	node := &fparNode{op: opFunc, name: "lut", vname: name, off: off}
+	node.args = []*fparNode{ctx.expression()}
+	if ctx.err != nil {
+		return nil
+	}
+	if ctx.ch == "," {
+		ctx.readNextChar()
+		ctx.skipBlanks()
+		moff := ctx.offset()
+		mode := ctx.readString()
+		if ctx.err != nil {
+			return nil
+		}
+		node.idx = -1
+		for i, m := range lutModes {
+			if m == mode {
+				node.idx = i
+			}
+		}
+		if node.idx < 0 {
+			ctx.syntaxErrAt(moff, lutSyntax+": unknown interpolation", `"linear" or "cubic"`, "'"+ctx.rbuffer[moff:moff+len(mode)+2]+"'")
+			return nil
+		}
+	}
+	if ctx.ch != ")" {
+		ctx.syntaxErr(lutSyntax, "')'")
+		return nil
+	}
+	ctx.readNextChar()
+	ctx.skipBlanks()
+	cubic := node.idx == 1
+	node.fn = func(a []complex128) complex128 {
+		return complex(c.Eval(real(a[0]), cubic), 0.0)
+	}
+	return node
+}
+
+// formatLUT - lut call as it is written
+func formatLUT(n *fparNode, full bool) string {
+	s := `lut("` + n.vname + `", ` + formatNode(n.args[0], full)
+	if n.idx > 0 {
+		s += `, "` + lutModes[n.idx] + `"`
+	}
+	return s + ")"
+}
@@ -0,0 +1,143 @@
+package jpegbw
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCurveEval(t *testing.T) {
+	c, err := NewCurve([]float64{0, 0.5, 1}, []float64{0, 0.25, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testCases = []struct {
+		x     float64
+		cubic bool
+		want  float64
+	}{
+		{x: 0.25, want: 0.125},
+		{x: 0.75, want: 0.625},
+		{x: 0.5, want: 0.25},
+		{x: -1, want: 0},
+		{x: 2, want: 1},
+		{x: 0, cubic: true, want: 0},
+		{x: 0.5, cubic: true, want: 0.25},
+		{x: 1, cubic: true, want: 1},
+		{x: -1, cubic: true, want: 0},
+		{x: 2, cubic: true, want: 1},
+	}
+	for _, tc := range testCases {
+		got := c.Eval(tc.x, tc.cubic)
+		if math.Abs(got-tc.want) > 1e-15 {
+			t.Errorf("Eval(%g, %t): got %g, expected %g", tc.x, tc.cubic, got, tc.want)
+		}
+	}
+	if v := c.Eval(math.NaN(), false); v == v {
+		t.Errorf("Eval(NaN): got %g, expected NaN", v)
+	}
+	// monotone cubic doesn't overshoot: each segment stays between its end points
+	s, err := NewCurve([]float64{0, 0.2, 0.4, 0.6, 1}, []float64{0, 0, 1, 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := 0.0
+	for i := 0; i <= 1000; i++ {
+		x := float64(i) / 1000
+		v := s.Eval(x, true)
+		if v < 0 || v > 1 || v < prev {
+			t.Errorf("cubic Eval(%g) = %g is not monotone, previous %g", x, v, prev)
+		}
+		prev = v
+	}
+}
+
+func TestNewCurveErrors(t *testing.T) {
+	var testCases = []struct {
+		x []float64
+		y []float64
+	}{
+		{x: []float64{0, 1}, y: []float64{0}},
+		{x: []float64{0}, y: []float64{0}},
+		{x: []float64{0, 0}, y: []float64{0, 1}},
+		{x: []float64{1, 0}, y: []float64{0, 1}},
+		{x: []float64{0, math.NaN()}, y: []float64{0, 1}},
+		{x: []float64{0, 1}, y: []float64{0, math.Inf(1)}},
+	}
+	for _, tc := range testCases {
+		_, err := NewCurve(tc.x, tc.y)
+		if err == nil {
+			t.Errorf("NewCurve(%v, %v): expected error", tc.x, tc.y)
+		}
+	}
+}
+
+func TestLoadLUTs(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"xy.csv":   "x,y\n0,0\n0.5,0.25\n1,1\n",
+		"y.csv":    "# evenly spaced\n0\n0.25\n1\n",
+		"rgb.csv":  "0;0;0;0\n0.5;0.25;0.5;0.75\n1;1;1;1\n",
+		"lut.cube": "TITLE \"test\"\nLUT_1D_SIZE 3\n0 0 0\n0.25 0.5 0.75\n1 1 1\n",
+	}
+	for name, data := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	spec := "txy=" + filepath.Join(dir, "xy.csv") + ":ty=" + filepath.Join(dir, "y.csv") + ":trgb=" + filepath.Join(dir, "rgb.csv") + ":tcube=" + filepath.Join(dir, "lut.cube")
+	err := LoadLUTs(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testCases = []struct {
+		expr string
+		x1   complex128
+		want float64
+	}{
+		{expr: `lut("txy", x1)`, x1: 0.25, want: 0.125},
+		{expr: `lut("TXY", x1)`, x1: 0.75, want: 0.625},
+		{expr: `lut("ty", x1)`, x1: 0.25, want: 0.125},
+		{expr: `lut("ty", x1)`, x1: 3, want: 1},
+		{expr: `lut("txy", x1, "cubic")`, x1: 0.5, want: 0.25},
+		{expr: `lut("txy", x1 + 0.5i)`, x1: 0.25, want: 0.125},
+		{expr: `lut("trgb", x1)`, x1: 0.25, want: 0.125},
+		{expr: `lut("trgb.g", x1)`, x1: 0.25, want: 0.25},
+		{expr: `lut("trgb.b", x1)`, x1: 0.5, want: 0.75},
+		{expr: `lut("tcube.r", x1)`, x1: 0.75, want: 0.625},
+		{expr: `lut("tcube.b", x1)`, x1: 0.25, want: 0.375},
+	}
+	for _, tc := range testCases {
+		ctx, err := compile(t, tc.expr, 1)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		got, err := ctx.FparF([]complex128{tc.x1})
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if math.Abs(real(got)-tc.want) > 1e-15 || imag(got) != 0 {
+			t.Errorf("%s(%v): got %v, expected %g", tc.expr, tc.x1, got, tc.want)
+		}
+	}
+	var errCases = []string{
+		"nofile",
+		"bad name=" + filepath.Join(dir, "xy.csv"),
+		"missing=" + filepath.Join(dir, "missing.csv"),
+	}
+	for _, spec := range errCases {
+		if LoadLUTs(spec) == nil {
+			t.Errorf("LoadLUTs(%s): expected error", spec)
+		}
+	}
+	for _, expr := range []string{`lut("nosuchcurve", x1)`, `lut("txy", x1, "quadratic")`, `lut(txy, x1)`} {
+		_, err := compile(t, expr, 1)
+		if err == nil {
+			t.Errorf("%s: expected error", expr)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package jpegbw
+
+import (
+	"math"
+)
+
+// Noise functions are pure functions of their arguments (there is no random generator state),
+// so they give the same values for each pixel regardless of the number of threads and evaluation order
+
+// noiseMaxCoord - noise coordinates are wrapped to this range, so cell indices fit in int64
+const noiseMaxCoord = 1 << 40
+
+// maxOctaves - maximum number of fbm octaves
+const maxOctaves = 16
+
+// hash64 - 64-bit integer hash (splitmix64 finalizer)
+func hash64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// mix - combines hash with next value
+func mix(h, v uint64) uint64 {
+	return hash64(h ^ (v + 0x9e3779b97f4a7c15 + (h << 6) + (h >> 2)))
+}
+
+// unit - maps hash to [0, 1)
+func unit(h uint64) float64 {
+	return float64(h>>11) / (1 << 53)
+}
+
+// floatKey - bits of value, signed zeros and all NaNs give the same key
+func floatKey(f float64) uint64 {
+	if f != f {
+		return 0x7ff8000000000001
+	}
+	if f == 0 {
+		return 0
+	}
+	return math.Float64bits(f)
+}
+
+// seedKey - integer seed from optional argument i (real part rounded down), 0 when it is not given
+func seedKey(a []complex128, i int) uint64 {
+	if len(a) <= i {
+		return 0
+	}
+	s := real(a[i])
+	if s-s != 0 {
+		return floatKey(s)
+	}
+	return uint64(int64(math.Floor(math.Mod(s, noiseMaxCoord))))
+}
+
+// randFn - rand(seed) is random number in [0, 1) for integer seed, rand(seed, z) for seed and z (each z gives different number)
+func randFn(a []complex128) complex128 {
+	h := mix(0x5eed, seedKey(a, 0))
+	if len(a) > 1 {
+		h = mix(mix(h, floatKey(real(a[1]))), floatKey(imag(a[1])))
+	}
+	return complex(unit(h), 0.0)
+}
+
+// hashFn - hash(z) is random number in [0, 1) for z, the same as rand(0, z)
+func hashFn(z complex128) complex128 {
+	return randFn([]complex128{0, z})
+}
+
+// noiseCoord - coordinate scaled and wrapped, split to cell index and position in cell
+func noiseCoord(v float64) (int64, float64) {
+	if v-v != 0 {
+		return 0, 0.0
+	}
+	v = math.Mod(v, noiseMaxCoord)
+	f := math.Floor(v)
+	return int64(f), v - f
+}
+
+// cellHash - hash of grid cell
+func cellHash(ix, iy int64, seed uint64) uint64 {
+	return mix(mix(mix(0xce11, seed), uint64(ix)), uint64(iy))
+}
+
+// grad - dot product of one of 8 gradients (chosen by hash) with (x, y)
+func grad(h uint64, x, y float64) float64 {
+	switch h >> 61 {
+	case 0:
+		return x + y
+	case 1:
+		return x - y
+	case 2:
+		return -x + y
+	case 3:
+		return -x - y
+	case 4:
+		return x
+	case 5:
+		return -x
+	case 6:
+		return y
+	}
+	return -y
+}
+
+func fade(t float64) float64 {
+	return t * t * t * (t*(t*6.0-15.0) + 10.0)
+}
+
+func mixf(a, b, t float64) float64 {
+	return a + (b-a)*t
+}
+
+// perlin2 - 2D gradient noise, -1 to 1
+func perlin2(x, y float64, seed uint64) float64 {
+	ix, fx := noiseCoord(x)
+	iy, fy := noiseCoord(y)
+	u := fade(fx)
+	v := fade(fy)
+	n00 := grad(cellHash(ix, iy, seed), fx, fy)
+	n10 := grad(cellHash(ix+1, iy, seed), fx-1.0, fy)
+	n01 := grad(cellHash(ix, iy+1, seed), fx, fy-1.0)
+	n11 := grad(cellHash(ix+1, iy+1, seed), fx-1.0, fy-1.0)
+	// diagonal gradients are not normalized, so the range is -1 to 1 already
+	return math.Max(-1.0, math.Min(1.0, mixf(mixf(n00, n10, u), mixf(n01, n11, u), v)))
+}
+
+// simplex2 - 2D simplex noise, -1 to 1
+func simplex2(x, y float64, seed uint64) float64 {
+	const (
+		f2 = 0.36602540378443864676 // (sqrt(3)-1)/2
+		g2 = 0.21132486540518711775 // (3-sqrt(3))/6
+	)
+	if x-x != 0 || y-y != 0 {
+		return 0.0
+	}
+	x = math.Mod(x, noiseMaxCoord)
+	y = math.Mod(y, noiseMaxCoord)
+	s := (x + y) * f2
+	i := math.Floor(x + s)
+	j := math.Floor(y + s)
+	t := (i + j) * g2
+	x0 := x - (i - t)
+	y0 := y - (j - t)
+	var i1, j1 int64
+	if x0 > y0 {
+		i1 = 1
+	} else {
+		j1 = 1
+	}
+	ix, iy := int64(i), int64(j)
+	corners := [3][4]float64{
+		{x0, y0, 0, 0},
+		{x0 - float64(i1) + g2, y0 - float64(j1) + g2, float64(i1), float64(j1)},
+		{x0 - 1.0 + 2.0*g2, y0 - 1.0 + 2.0*g2, 1, 1},
+	}
+	n := 0.0
+	for _, c := range corners {
+		tt := 0.5 - c[0]*c[0] - c[1]*c[1]
+		if tt < 0 {
+			continue
+		}
+		tt *= tt
+		n += tt * tt * grad(cellHash(ix+int64(c[2]), iy+int64(c[3]), seed), c[0], c[1])
+	}
+	return math.Max(-1.0, math.Min(1.0, 70.0*n))
+}
+
+// worley2 - distance to the nearest feature point (one random point per cell), clipped to 1
+func worley2(x, y float64, seed uint64) float64 {
+	ix, fx := noiseCoord(x)
+	iy, fy := noiseCoord(y)
+	d := 2.0
+	for dy := int64(-1); dy <= 1; dy++ {
+		for dx := int64(-1); dx <= 1; dx++ {
+			h := cellHash(ix+dx, iy+dy, seed)
+			px := float64(dx) + unit(h) - fx
+			py := float64(dy) + unit(hash64(h)) - fy
+			d = math.Min(d, math.Sqrt(px*px+py*py))
+		}
+	}
+	return math.Min(d, 1.0)
+}
+
+// noiseFn - builtin for noise(z, scale, seed), z's real and imaginary parts are coordinates
+func noiseFn(noise func(float64, float64, uint64) float64, signed bool) func([]complex128) complex128 {
+	return func(a []complex128) complex128 {
+		s := real(a[1])
+		v := noise(real(a[0])*s, imag(a[0])*s, seedKey(a, 2))
+		if signed {
+			v = 0.5 + 0.5*v
+		}
+		return complex(v, 0.0)
+	}
+}
+
+// fbmFn - fbm(z, octaves, scale, seed) is sum of perlin noise octaves, each one has double frequency and half amplitude, 0-1
+func fbmFn(a []complex128) complex128 {
+	octaves := real(a[1])
+	if !(octaves >= 1.0) {
+		octaves = 1.0
+	}
+	if octaves > maxOctaves {
+		octaves = maxOctaves
+	}
+	scale := 1.0
+	if len(a) > 2 {
+		scale = real(a[2])
+	}
+	seed := seedKey(a, 3)
+	x, y := real(a[0])*scale, imag(a[0])*scale
+	sum, norm, amp := 0.0, 0.0, 1.0
+	for o := 0; o < int(octaves); o++ {
+		sum += amp * perlin2(x, y, mix(seed, uint64(o)))
+		norm += amp
+		amp *= 0.5
+		x *= 2.0
+		y *= 2.0
+	}
+	return complex(0.5+0.5*sum/norm, 0.0)
+}
@@ -0,0 +1,95 @@
+package jpegbw
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestNoiseThreads(t *testing.T) {
+	exprs := []string{
+		"x1 + .2*(rand(1, x2) - .5)",
+		"hash(x2 + x1)",
+		"perlin(x2, 8)*simplex(x2, 5, 3)",
+		"worley(x2, 6, 2) + x1/4",
+		"x1*fbm(x2, 5, 8)",
+	}
+	m := grayImage(97, 61, 65535)
+	b := m.Bounds()
+	for _, expr := range exprs {
+		var first [][]uint32
+		for _, noRows := range []bool{false, true} {
+			for _, threads := range []int{1, 2, 7} {
+				fctx, err := compile(t, expr, 5)
+				if err != nil {
+					t.Fatalf("%s: %v", expr, err)
+				}
+				p := &Pipeline{Stages: []Stage{&FuncStage{Func: [4]*FparCtx{fctx}, NoRows: noRows}}, Channels: 1, Threads: threads}
+				out, _, err := p.Process(context.Background(), m)
+				if err != nil {
+					t.Fatalf("%s: %v", expr, err)
+				}
+				pix := [][]uint32{}
+				for y := b.Min.Y; y < b.Max.Y; y++ {
+					row := []uint32{}
+					for x := b.Min.X; x < b.Max.X; x++ {
+						r, _, _, _ := out.At(x, y).RGBA()
+						row = append(row, r)
+					}
+					pix = append(pix, row)
+				}
+				if first == nil {
+					first = pix
+					continue
+				}
+			rows:
+				for y := range pix {
+					for x := range pix[y] {
+						if pix[y][x] != first[y][x] {
+							t.Errorf("%s: %d threads (rows: %t): pixel (%d, %d) is %d, expected %d", expr, threads, !noRows, x, y, pix[y][x], first[y][x])
+							break rows
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestNoiseValues(t *testing.T) {
+	eval := func(expr string, x1 complex128) complex128 {
+		ctx, err := compile(t, expr, 1)
+		if err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		v, err := ctx.FparF([]complex128{x1})
+		if err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		return v
+	}
+	// noise is in [0, 1] range and has no imaginary part
+	for _, expr := range []string{"rand(x1)", "rand(7, x1)", "hash(x1)", "perlin(x1, 8)", "simplex(x1, 8, 2)", "worley(x1, 8)", "fbm(x1, 16, 8)"} {
+		for i := 0; i < 200; i++ {
+			z := complex(float64(i)*0.037-3, float64(i%13)*0.11)
+			v := eval(expr, z)
+			if real(v) < 0 || real(v) > 1 || imag(v) != 0 || math.IsNaN(real(v)) {
+				t.Errorf("%s(%v) = %v, expected value from 0-1 range", expr, z, v)
+				break
+			}
+		}
+	}
+	checkValues(t, []valueCase{
+		// seed is rounded down to integer, hash(z) is rand(0, z), signed zeros are the same
+		{expr: "rand(1.7) - rand(1)", want: 0},
+		{expr: "hash(x1) - rand(0, x1)", x1: 0.25 + 1i, want: 0},
+		{expr: "hash(0) - hash(-0)", want: 0},
+		{expr: "rand(3, x1) - rand(3, x1)", x1: 0.5, want: 0},
+	})
+	if eval("rand(1)", 0) == eval("rand(2)", 0) || eval("rand(1, x1)", 0.5) == eval("rand(1, x1)", 0.5+1e-9) {
+		t.Errorf("different seeds or arguments should give different values")
+	}
+	if eval("perlin(x1, 8)", 0.3+0.4i) == eval("perlin(x1, 8, 1)", 0.3+0.4i) {
+		t.Errorf("different noise seeds should give different values")
+	}
+}
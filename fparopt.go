@@ -0,0 +1,275 @@
+package jpegbw
+
+import (
+	"math"
+	"strconv"
+)
+
+// optimize - constant folding, common subexpressions hoisting, unused assignments removal
+// It also detects which arguments are really used by the expression
+func (ctx *FparCtx) optimize(tree *fparNode) *fparNode {
+	consts := make(map[int]complex128)
+	tree = ctx.fold(tree, consts)
+	ids := make(map[*fparNode]int)
+	subexprIDs(tree, ids, make(map[subexprKey]int))
+	counts := make(map[int]int)
+	ctx.countSubexprs(tree, ids, counts)
+	ctx.ncse = 0
+	tree = ctx.hoist(tree, ids, counts, make(map[int]*fparNode))
+	refs := make(map[int]int)
+	countLocals(tree, refs)
+	tree = removeUnusedLets(tree, refs)
+	ctx.used = make([]bool, ctx.nvar)
+	markUsed(tree, ctx.used)
+	ctx.external = callsExternal(tree)
+	ctx.realArgs = make([]bool, ctx.nvar)
+	ctx.realOK = ctx.inferReal(tree, ctx.realArgs)
+	// debug: fmt.Printf("optimize: %d common subexpressions, used args: %v\n", ctx.ncse, ctx.used)
+	return tree
+}
+
+// isPure - node's value depends only on its arguments, C and registered Go functions are not assumed to be pure
+// Loops write their variables and loop variable changes in each iteration, so they are not pure either
+func isPure(n *fparNode) bool {
+	if !pureOp(n.op) {
+		return false
+	}
+	for _, arg := range n.args {
+		if !isPure(arg) {
+			return false
+		}
+	}
+	return true
+}
+
+// pureOp - node's value depends only on its arguments' values
+func pureOp(op fparOp) bool {
+	switch op {
+	case opCall, opGoFunc, opLet, opSeq, opIter, opSum, opProd, opEscape, opBound:
+		return false
+	}
+	return true
+}
+
+func isConst(n *fparNode) bool {
+	return n.op == opConst
+}
+
+// fold - evaluates all pure subtrees that have only constant arguments
+// consts holds local variables assigned constant values
+func (ctx *FparCtx) fold(n *fparNode, consts map[int]complex128) *fparNode {
+	switch n.op {
+	case opConst, opArg:
+		return n
+	case opLocal:
+		v, ok := consts[n.idx]
+		if ok {
+			return &fparNode{op: opConst, val: v}
+		}
+		return n
+	case opLet:
+		n.args[0] = ctx.fold(n.args[0], consts)
+		if isConst(n.args[0]) {
+			consts[n.idx] = n.args[0].val
+		}
+		return n
+	case opIf:
+		for i := range n.args {
+			n.args[i] = ctx.fold(n.args[i], consts)
+		}
+		if isConst(n.args[0]) {
+			if real(n.args[0].val) > 0 {
+				return n.args[1]
+			}
+			return n.args[2]
+		}
+		return n
+	}
+	allConst := true
+	for i := range n.args {
+		n.args[i] = ctx.fold(n.args[i], consts)
+		if !isConst(n.args[i]) {
+			allConst = false
+		}
+	}
+	if n.op == opPow && isConst(n.args[1]) {
+		// x^n with constant integer n is computed by repeated multiplication
+		e, ok := intExponent(n.args[1].val)
+		if ok {
+			n.op = opPowInt
+			n.idx = e
+		}
+	}
+	if !allConst || !isPure(n) {
+		return n
+	}
+	var tmp FparCtx
+	v := tmp.eval(n)
+	if tmp.err != nil {
+		return n
+	}
+	return &fparNode{op: opConst, val: v}
+}
+
+// subexprKey - structural key of a node, arguments are given by their subexpression ids, the same key means the same value
+// Constant is keyed by its bits, so 0 and -0 are different constants
+type subexprKey struct {
+	op    fparOp
+	re    uint64
+	im    uint64
+	idx   int
+	name  string
+	vname string
+	args  string
+}
+
+// subexprIDs - numbers pure subexpressions bottom-up, structurally equal subexpressions get the same id
+// Each node's key is computed once from its arguments' ids, nodes that are not pure get no id
+func subexprIDs(n *fparNode, ids map[*fparNode]int, keys map[subexprKey]int) {
+	pure := pureOp(n.op)
+	args := []byte{}
+	for _, arg := range n.args {
+		subexprIDs(arg, ids, keys)
+		id, ok := ids[arg]
+		if !ok {
+			pure = false
+		}
+		args = strconv.AppendInt(args, int64(id), 10)
+		args = append(args, ',')
+	}
+	if !pure {
+		return
+	}
+	key := subexprKey{op: n.op, re: math.Float64bits(real(n.val)), im: math.Float64bits(imag(n.val)), idx: n.idx, name: n.name, vname: n.vname, args: string(args)}
+	id, ok := keys[key]
+	if !ok {
+		id = len(keys)
+		keys[key] = id
+	}
+	ids[n] = id
+}
+
+// worthHoisting - pure subexpression (it has an id) which is not just a constant, argument or local variable
+func worthHoisting(n *fparNode, ids map[*fparNode]int) (int, bool) {
+	switch n.op {
+	case opConst, opArg, opLocal, opCse:
+		return 0, false
+	}
+	id, ok := ids[n]
+	return id, ok
+}
+
+// countSubexprs - counts subexpressions, children of repeated subexpression are only counted once
+// so 'x1*2' in 'sin(x1*2)+sin(x1*2)' is not hoisted separately from 'sin(x1*2)'
+func (ctx *FparCtx) countSubexprs(n *fparNode, ids map[*fparNode]int, counts map[int]int) {
+	id, ok := worthHoisting(n, ids)
+	if ok {
+		counts[id]++
+		if counts[id] > 1 {
+			return
+		}
+	}
+	for _, arg := range n.args {
+		ctx.countSubexprs(arg, ids, counts)
+	}
+}
+
+// hoist - replaces repeated subexpressions with a single node evaluated at most once per FparF call
+func (ctx *FparCtx) hoist(n *fparNode, ids map[*fparNode]int, counts map[int]int, cses map[int]*fparNode) *fparNode {
+	id, ok := worthHoisting(n, ids)
+	if ok {
+		if counts[id] > 1 {
+			cse, ok := cses[id]
+			if ok {
+				return cse
+			}
+			for i := range n.args {
+				n.args[i] = ctx.hoist(n.args[i], ids, counts, cses)
+			}
+			cse = &fparNode{op: opCse, idx: ctx.ncse, args: []*fparNode{n}}
+			ctx.ncse++
+			cses[id] = cse
+			return cse
+		}
+	}
+	for i := range n.args {
+		n.args[i] = ctx.hoist(n.args[i], ids, counts, cses)
+	}
+	return n
+}
+
+func countLocals(n *fparNode, refs map[int]int) {
+	if n.op == opLocal {
+		refs[n.idx]++
+	}
+	for _, arg := range n.args {
+		countLocals(arg, refs)
+	}
+}
+
+// removeUnusedLets - removes assignments to never used variables (only when they don't call C or Go functions)
+func removeUnusedLets(n *fparNode, refs map[int]int) *fparNode {
+	if n.op != opSeq {
+		return n
+	}
+	last := len(n.args) - 1
+	stmts := []*fparNode{}
+	for i, stmt := range n.args {
+		if i < last && stmt.op == opLet && refs[stmt.idx] == 0 && isPure(stmt.args[0]) {
+			continue
+		}
+		stmts = append(stmts, stmt)
+	}
+	if len(stmts) == 1 {
+		return stmts[0]
+	}
+	n.args = stmts
+	return n
+}
+
+func markUsed(n *fparNode, used []bool) {
+	if n.op == opArg {
+		used[n.idx] = true
+	}
+	for _, arg := range n.args {
+		markUsed(arg, used)
+	}
+}
+
+func callsExternal(n *fparNode) bool {
+	if n.op == opCall || n.op == opGoFunc {
+		return true
+	}
+	for _, arg := range n.args {
+		if callsExternal(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// External - true if compiled expression calls LIB's C functions or functions registered via RegisterFunc
+func (ctx *FparCtx) External() bool {
+	return ctx.external
+}
+
+// UsedArgs - returns which of x1..xN arguments are used by the compiled expression
+func (ctx *FparCtx) UsedArgs() []bool {
+	used := make([]bool, len(ctx.used))
+	copy(used, ctx.used)
+	return used
+}
+
+// CacheLevel - returns the lowest cache level (see SetCache) that covers all used arguments, 0 if it would be > 4
+func (ctx *FparCtx) CacheLevel() int {
+	lvl := 0
+	for i, used := range ctx.used {
+		if used {
+			lvl = i + 1
+		}
+	}
+	if lvl > 4 {
+		return 0
+	}
+	return lvl
+}
@@ -0,0 +1,82 @@
+package jpegbw
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommonSubexpressions(t *testing.T) {
+	var testCases = []struct {
+		expr string
+		ncse int
+	}{
+		{expr: "x1+x2", ncse: 0},
+		{expr: "sin(x1*2)+sin(x1*2)", ncse: 1},
+		{expr: "sin(x1*2)+cos(x1*2)", ncse: 1},
+		{expr: "(x1+x2)*(x1+x2)+(x2+x1)", ncse: 1},
+		{expr: "x1*0+x1*(-0)", ncse: 0},
+		{expr: "a = x1*x2; a + x1*x2", ncse: 1},
+		{expr: "rand(x1)+rand(x1)", ncse: 1},
+		{expr: "sum(k, 1, 3, x1*k)+sum(k, 1, 3, x1*k)", ncse: 0},
+		{expr: strings.Repeat("(", 2000) + "x1" + strings.Repeat("+sin(x1))", 2000), ncse: 1},
+	}
+	for _, tc := range testCases {
+		ctx, err := compile(t, tc.expr, 2)
+		if err != nil {
+			t.Errorf("%.40s: %v", tc.expr, err)
+			continue
+		}
+		if ctx.ncse != tc.ncse {
+			t.Errorf("%.40s: got %d common subexpressions, expected %d", tc.expr, ctx.ncse, tc.ncse)
+		}
+	}
+}
+
+func TestOptimizerEquivalence(t *testing.T) {
+	var testCases = []string{
+		"3.1416*2*x1",
+		"alpha(x1, 6.28, -.1, .9)",
+		"sin(x1)+sin(x1)^2",
+		"a = x1^2; b = 1 - a; a*b/(a+b)",
+		"a = 2*pi; b = a/4; sin(x1*b) + a",
+		"x1^3 + x1^-2 + x1^0.5 + x1^1",
+		"(x1+x2)*(x1+x2) - (x1+x2)",
+		"x1 < .3 ? 0 : x1 > .7 ? 1 : x1",
+		"2 > 1 ? x1 : x2",
+		"if(1 < 0, x1, x2*x3)",
+		"sum(k, 1, 4, x1^k) + sum(k, 1, 4, x1^k)",
+		"iter(z -> z^2 + x2, 0, 5)",
+		"cabs(2*x2-1_1)*cabs(2*x2-1_1)",
+		"gamma(x1+1)*gamma(x1+1)",
+		"min(x1, x2, .5) + max(x1, x2, .5)",
+		"(x1 - x2) % .3 + (x1 - x2) % .3",
+		"x1^2*x1^2 - x2^2",
+		"exp(i*pi*x1) + exp(i*pi*x1)",
+		"x1*0 + x1*(-0)",
+		"rand(x1) + perlin(x2, 3)",
+		"!(x1 > x2) & (x3 != 0)",
+	}
+	for _, expr := range testCases {
+		ctx, err := compile(t, expr, 3)
+		if err != nil {
+			t.Errorf("%s: %v", expr, err)
+			continue
+		}
+		ctx.SetRealPath(false)
+		for _, args := range testArgs {
+			got, err := ctx.FparF(args)
+			if err != nil {
+				t.Errorf("%s%v: %v", expr, args, err)
+				continue
+			}
+			want, err := evalParsed(ctx, args)
+			if err != nil {
+				t.Errorf("%s%v: parsed tree: %v", expr, args, err)
+				continue
+			}
+			if !same(got, want) {
+				t.Errorf("%s%v: optimized %v, parsed %v", expr, args, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,742 @@
+package jpegbw
+
+import (
+	"math"
+	"math/cmplx"
+)
+
+// maxIntPow - constant exponents that are integers up to this absolute value are computed by repeated multiplication
+const maxIntPow = 1 << 30
+
+// intExponent - integer value of constant exponent
+func intExponent(v complex128) (int, bool) {
+	r := real(v)
+	if imag(v) != 0 || r != math.Trunc(r) || math.Abs(r) > maxIntPow {
+		return 0, false
+	}
+	return int(r), true
+}
+
+// powIntReal - x^n for x > 0 by repeated squaring, it is the same as math.Pow (which does the same on mantissas)
+// as long as all partial products are normal numbers, false otherwise
+func powIntReal(x float64, n int) (float64, bool) {
+	neg := n < 0
+	if neg {
+		n = -n
+	}
+	r := 1.0
+	for n > 0 {
+		if n&1 == 1 {
+			r *= x
+		}
+		n >>= 1
+		if n > 0 {
+			x *= x
+		}
+	}
+	if !normal(r) {
+		return 0.0, false
+	}
+	if neg {
+		r = 1.0 / r
+		if !normal(r) {
+			return 0.0, false
+		}
+	}
+	return r, true
+}
+
+// normal - finite number which is not zero or subnormal
+func normal(x float64) bool {
+	x = math.Abs(x)
+	return x >= 0x1p-1022 && x <= math.MaxFloat64
+}
+
+// powInt - z^n with integer n, the same value as cmplx.Pow(z, n), for positive real z it is computed without math.Pow
+func powInt(z complex128, n int) complex128 {
+	if imag(z) == 0 && real(z) > 0 {
+		v, ok := powIntReal(real(z), n)
+		if ok {
+			// cmplx.Pow's imaginary part is v*sin(n*0), keep sign of its zero
+			return complex(v, v*(float64(n)*imag(z)))
+		}
+	}
+	return cmplx.Pow(z, complex(float64(n), 0.0))
+}
+
+// powReal - real part of cmplx.Pow(a, b), false if imaginary part is not zero
+func powReal(a, b float64) (float64, bool) {
+	if a > 0 && b-b == 0 {
+		v := math.Pow(a, b)
+		if v-v == 0 {
+			return v, true
+		}
+	}
+	v := cmplx.Pow(complex(a, 0.0), complex(b, 0.0))
+	return real(v), imag(v) == 0
+}
+
+// powIntRealOf - real part of powInt(x, n), false if imaginary part is not zero
+func powIntRealOf(x float64, n int) (float64, bool) {
+	if x > 0 {
+		v, ok := powIntReal(x, n)
+		if ok {
+			return v, true
+		}
+	}
+	return powReal(x, float64(n))
+}
+
+// fmodReal - fmod for real numbers
+func fmodReal(a, b float64) float64 {
+	if b == 0 {
+		return a
+	}
+	return a - b*math.Floor(a/b)
+}
+
+func boolReal(b bool) float64 {
+	if b {
+		return 1.0
+	}
+	return 0.0
+}
+
+// exact - complex multiplication and division use imaginary parts (zeros) too, their results have the same real part
+// only when it is finite and not zero (signed zero and infinity could differ), checked after such operations
+func exact(v float64) bool {
+	return v != 0 && v-v == 0
+}
+
+// partFuncs - functions that give real value for complex argument, they are called with argument's complex value
+var partFuncs = map[string]struct{}{
+	"re": {}, "creal": {}, "im": {}, "cimag": {}, "abs": {}, "cabs": {}, "arg": {}, "carg": {},
+}
+
+// complexOnlyFuncs - functions whose result for real argument depends on the sign of argument's imaginary zero
+var complexOnlyFuncs = map[string]struct{}{
+	"im": {}, "cimag": {}, "arg": {}, "carg": {},
+}
+
+// realBuiltins - float64 versions of builtins, false when the complex version could give different real part
+// (they are then called as complex functions)
+var realBuiltins = map[string]func(float64) (float64, bool){
+	"sin":   realSin,
+	"csin":  realSin,
+	"cos":   realCos,
+	"ccos":  realCos,
+	"exp":   realExp,
+	"cexp":  realExp,
+	"sqrt":  realSqrt,
+	"csqrt": realSqrt,
+	"log":   realLog,
+	"clog":  realLog,
+	"abs":   realAbs,
+	"cabs":  realAbs,
+	"re":    realRe,
+	"creal": realRe,
+	"floor": realExactly(math.Floor),
+	"ceil":  realExactly(math.Ceil),
+	"round": realExactly(math.Round),
+	"trunc": realExactly(math.Trunc),
+	"frac":  realExactly(frac),
+	"cbrt":  realExactly(math.Cbrt),
+	"erf":   realExactly(math.Erf),
+	"gamma": realExactly(math.Gamma),
+}
+
+func realExactly(f func(float64) float64) func(float64) (float64, bool) {
+	return func(x float64) (float64, bool) { return f(x), true }
+}
+
+func realSin(x float64) (float64, bool) {
+	s, _ := math.Sincos(x)
+	return s, x-x == 0
+}
+
+func realCos(x float64) (float64, bool) {
+	_, c := math.Sincos(x)
+	return c, x-x == 0
+}
+
+func realExp(x float64) (float64, bool) {
+	v := math.Exp(x)
+	return v, v-v == 0
+}
+
+func realSqrt(x float64) (float64, bool) {
+	return math.Sqrt(x), x > 0
+}
+
+func realLog(x float64) (float64, bool) {
+	return math.Log(x), x > 0
+}
+
+func realAbs(x float64) (float64, bool) {
+	return math.Abs(x), x == x
+}
+
+func realRe(x float64) (float64, bool) {
+	return x, true
+}
+
+// isPart - function from partFuncs called directly on argument, it gives real value even for complex argument
+func isPart(n *fparNode) bool {
+	if n.op != opFunc || len(n.args) != 1 || n.args[0].op != opArg {
+		return false
+	}
+	_, ok := partFuncs[n.name]
+	return ok
+}
+
+// inferReal - true if node's value is real when arguments marked in realArgs are real, so it can be evaluated using float64
+// Arguments only used via re, im, abs and arg are not marked, it also sets float64 versions of builtins
+func (ctx *FparCtx) inferReal(n *fparNode, realArgs []bool) bool {
+	switch n.op {
+	case opConst:
+		return imag(n.val) == 0
+	case opArg:
+		realArgs[n.idx] = true
+		return true
+	case opGoFunc, opIter, opSum, opProd, opEscape, opBound:
+		return false
+	case opCall:
+		if !realSig(n.sig) {
+			return false
+		}
+	case opFunc:
+		if isPart(n) {
+			n.rfn = nil
+			return true
+		}
+		if _, ok := complexOnlyFuncs[n.name]; ok {
+			return false
+		}
+		n.rfn = nil
+		if len(n.args) == 1 {
+			n.rfn = realBuiltins[n.name]
+		}
+	}
+	for _, arg := range n.args {
+		if !ctx.inferReal(arg, realArgs) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsReal - true if compiled expression's value is real for real arguments, it is then evaluated using float64 instead of complex128
+// (unless the real path is disabled by SetRealPath), results are the same
+func (ctx *FparCtx) IsReal() bool {
+	return ctx.realOK
+}
+
+// SetRealPath - enables (default) or disables float64 evaluation of real expressions (see IsReal)
+func (ctx *FparCtx) SetRealPath(enabled bool) {
+	ctx.noReal = !enabled
+}
+
+// realInputs - arguments that the expression needs to be real have zero imaginary parts
+func (ctx *FparCtx) realInputs() bool {
+	for i, r := range ctx.realArgs {
+		if r && imag(ctx.arg[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// evalTop - evaluates the whole expression, real expressions with real arguments are evaluated using float64
+// If float64 value could differ from the complex one (see exact), expression is evaluated again as complex
+func (ctx *FparCtx) evalTop() complex128 {
+	if ctx.realOK && !ctx.noReal && ctx.realInputs() {
+		if len(ctx.varsR) < ctx.nlocals {
+			ctx.varsR = make([]float64, ctx.nlocals)
+		}
+		if len(ctx.cseValR) < ctx.ncse {
+			ctx.cseValR = make([]float64, ctx.ncse)
+		}
+		ctx.rfail = false
+		v := ctx.evalReal(ctx.tree)
+		if !ctx.rfail {
+			return complex(v, 0.0)
+		}
+		// debug: fmt.Printf("evalTop: real evaluation failed for %v\n", ctx.arg)
+		ctx.err = nil
+		ctx.gen++
+	}
+	return ctx.eval(ctx.tree)
+}
+
+// checked - v, sets failure flag when v is not exact
+func (ctx *FparCtx) checked(v float64) float64 {
+	if !exact(v) {
+		ctx.rfail = true
+	}
+	return v
+}
+
+// evalReal - eval for real expressions, it does the same operations on real parts
+func (ctx *FparCtx) evalReal(n *fparNode) float64 {
+	switch n.op {
+	case opConst:
+		return real(n.val)
+	case opArg:
+		return real(ctx.arg[n.idx])
+	case opNeg:
+		return ctx.checked(-ctx.evalReal(n.args[0]))
+	case opAdd:
+		return ctx.evalReal(n.args[0]) + ctx.evalReal(n.args[1])
+	case opSub:
+		return ctx.evalReal(n.args[0]) - ctx.evalReal(n.args[1])
+	case opMul:
+		return ctx.checked(ctx.evalReal(n.args[0]) * ctx.evalReal(n.args[1]))
+	case opDiv:
+		return ctx.checked(ctx.evalReal(n.args[0]) / ctx.evalReal(n.args[1]))
+	case opMod:
+		return ctx.checked(fmodReal(ctx.evalReal(n.args[0]), ctx.evalReal(n.args[1])))
+	case opPow:
+		v, ok := powReal(ctx.evalReal(n.args[0]), ctx.evalReal(n.args[1]))
+		if !ok {
+			ctx.rfail = true
+		}
+		return v
+	case opPowInt:
+		v, ok := powIntRealOf(ctx.evalReal(n.args[0]), n.idx)
+		if !ok {
+			ctx.rfail = true
+		}
+		return v
+	case opLt:
+		return boolReal(ctx.evalReal(n.args[0]) < ctx.evalReal(n.args[1]))
+	case opGt:
+		return boolReal(ctx.evalReal(n.args[0]) > ctx.evalReal(n.args[1]))
+	case opLe:
+		return boolReal(ctx.evalReal(n.args[0]) <= ctx.evalReal(n.args[1]))
+	case opGe:
+		return boolReal(ctx.evalReal(n.args[0]) >= ctx.evalReal(n.args[1]))
+	case opEq:
+		return boolReal(ctx.evalReal(n.args[0]) == ctx.evalReal(n.args[1]))
+	case opNe:
+		return boolReal(ctx.evalReal(n.args[0]) != ctx.evalReal(n.args[1]))
+	case opNot:
+		return boolReal(ctx.evalReal(n.args[0]) <= 0)
+	case opOr:
+		c1 := ctx.evalReal(n.args[0])
+		c2 := ctx.evalReal(n.args[1])
+		return boolReal(c1 > 0 || c2 > 0)
+	case opAnd:
+		c1 := ctx.evalReal(n.args[0])
+		c2 := ctx.evalReal(n.args[1])
+		return boolReal(c1 > 0 && c2 > 0)
+	case opIf:
+		if ctx.evalReal(n.args[0]) > 0 {
+			return ctx.evalReal(n.args[1])
+		}
+		return ctx.evalReal(n.args[2])
+	case opLocal:
+		return ctx.varsR[n.idx]
+	case opLet:
+		ctx.varsR[n.idx] = ctx.evalReal(n.args[0])
+		return ctx.varsR[n.idx]
+	case opSeq:
+		v := 0.0
+		for _, stmt := range n.args {
+			v = ctx.evalReal(stmt)
+		}
+		return v
+	case opCse:
+		if ctx.cseGen[n.idx] != ctx.gen {
+			ctx.cseValR[n.idx] = ctx.evalReal(n.args[0])
+			ctx.cseGen[n.idx] = ctx.gen
+		}
+		return ctx.cseValR[n.idx]
+	case opFunc:
+		// arguments are complex, direct argument references pass argument's value as it is
+		base := len(ctx.stack)
+		for _, arg := range n.args {
+			if arg.op == opArg {
+				ctx.stack = append(ctx.stack, ctx.arg[arg.idx])
+				continue
+			}
+			v := ctx.evalReal(arg)
+			ctx.stack = append(ctx.stack, complex(v, 0.0))
+		}
+		a := ctx.stack[base:]
+		if n.rfn != nil && imag(a[0]) == 0 {
+			v, ok := n.rfn(real(a[0]))
+			if ok {
+				ctx.stack = ctx.stack[:base]
+				return v
+			}
+		}
+		v := n.fn(a)
+		ctx.stack = ctx.stack[:base]
+		if imag(v) != 0 {
+			ctx.rfail = true
+		}
+		return real(v)
+	case opCall:
+		var a [4]float64
+		for i, arg := range n.args {
+			a[i] = ctx.evalReal(arg)
+		}
+		return callCReal(n, a[:len(n.args)])
+	}
+	ctx.rfail = true
+	return 0.0
+}
+
+// fbuf - takes float64 scratch buffer of m values, must be released via freeFBuf in reverse order
+func (rs *rowState) fbuf(m int) []float64 {
+	if rs.nfbufs == len(rs.fbufs) {
+		rs.fbufs = append(rs.fbufs, nil)
+	}
+	if cap(rs.fbufs[rs.nfbufs]) < m {
+		rs.fbufs[rs.nfbufs] = make([]float64, m)
+	}
+	b := rs.fbufs[rs.nfbufs][:m]
+	rs.nfbufs++
+	return b
+}
+
+func (rs *rowState) freeFBuf() {
+	rs.nfbufs--
+}
+
+// prepareReal - prepare for float64 evaluation, per-row failure flags are all false between calls
+func (rs *rowState) prepareReal(n, nlocals, ncse int) {
+	if len(rs.fail) < n {
+		rs.fail = make([]bool, n)
+	}
+	if len(rs.varsR) < nlocals {
+		rs.varsR = make([][]float64, nlocals)
+	}
+	for i := 0; i < nlocals; i++ {
+		if len(rs.varsR[i]) < n {
+			rs.varsR[i] = make([]float64, n)
+		}
+	}
+	if len(rs.cseValR) < ncse {
+		rs.cseValR = make([][]float64, ncse)
+	}
+	for i := 0; i < ncse; i++ {
+		if len(rs.cseValR[i]) < n {
+			rs.cseValR[i] = make([]float64, n)
+		}
+	}
+}
+
+// realRowsInputs - realInputs for rows idx
+func (ctx *FparCtx) realRowsInputs(idx []int) bool {
+	rs := ctx.rows
+	for j, r := range ctx.realArgs {
+		if !r {
+			continue
+		}
+		x := rs.args[j]
+		for _, i := range idx {
+			if imag(x[i]) != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// evalTopRows - evalTop for rows idx, rows where float64 evaluation could differ are evaluated again as complex
+func (ctx *FparCtx) evalTopRows(idx []int, out []complex128) {
+	if !ctx.realOK || ctx.noReal || !ctx.realRowsInputs(idx) {
+		ctx.evalRows(ctx.tree, idx, out)
+		return
+	}
+	rs := ctx.rows
+	m := len(idx)
+	rs.prepareReal(len(rs.idx), ctx.nlocals, ctx.ncse)
+	v := rs.fbuf(m)
+	ctx.realRows(ctx.tree, idx, v)
+	failed := rs.ibuf(m)
+	for k, i := range idx {
+		if rs.fail[i] {
+			rs.fail[i] = false
+			failed = append(failed, k)
+			continue
+		}
+		out[k] = complex(v[k], 0.0)
+	}
+	if len(failed) > 0 {
+		ctx.err = nil
+		ctx.gen++
+		ctx.branchRows(ctx.tree, idx, failed, out)
+	}
+	rs.freeIBuf()
+	rs.freeFBuf()
+}
+
+// checkRows - marks rows whose values are not exact (see exact)
+func (rs *rowState) checkRows(idx []int, v []float64) {
+	for k, i := range idx {
+		if !exact(v[k]) {
+			rs.fail[i] = true
+		}
+	}
+}
+
+// realRows - evalRows for real expressions, the same operations as evalReal
+func (ctx *FparCtx) realRows(n *fparNode, idx []int, out []float64) {
+	rs := ctx.rows
+	m := len(idx)
+	switch n.op {
+	case opConst:
+		for k := range out {
+			out[k] = real(n.val)
+		}
+	case opArg:
+		x := rs.args[n.idx]
+		for k, i := range idx {
+			out[k] = real(x[i])
+		}
+	case opNeg:
+		ctx.realRows(n.args[0], idx, out)
+		for k := range out {
+			out[k] = -out[k]
+		}
+		rs.checkRows(idx, out)
+	case opNot:
+		ctx.realRows(n.args[0], idx, out)
+		for k := range out {
+			out[k] = boolReal(out[k] <= 0)
+		}
+	case opPowInt:
+		ctx.realRows(n.args[0], idx, out)
+		for k, i := range idx {
+			v, ok := powIntRealOf(out[k], n.idx)
+			if !ok {
+				rs.fail[i] = true
+			}
+			out[k] = v
+		}
+	case opAdd, opSub, opMul, opDiv, opMod, opPow, opLt, opGt, opLe, opGe, opEq, opNe, opOr, opAnd:
+		ctx.realRows(n.args[0], idx, out)
+		b := rs.fbuf(m)
+		ctx.realRows(n.args[1], idx, b)
+		ctx.binaryRealRows(n.op, idx, out, b)
+		rs.freeFBuf()
+	case opIf:
+		ctx.realIfRows(n, idx, out)
+	case opLocal:
+		v := rs.varsR[n.idx]
+		for k, i := range idx {
+			out[k] = v[i]
+		}
+	case opLet:
+		ctx.realRows(n.args[0], idx, out)
+		v := rs.varsR[n.idx]
+		for k, i := range idx {
+			v[i] = out[k]
+		}
+	case opSeq:
+		for _, stmt := range n.args {
+			ctx.realRows(stmt, idx, out)
+		}
+	case opCse:
+		ctx.realCseRows(n, idx, out)
+	case opFunc, opCall:
+		ctx.realCallRows(n, idx, out)
+	default:
+		for _, i := range idx {
+			rs.fail[i] = true
+		}
+	}
+}
+
+// binaryRealRows - a = a op b for all values
+func (ctx *FparCtx) binaryRealRows(op fparOp, idx []int, a, b []float64) {
+	rs := ctx.rows
+	b = b[:len(a)]
+	switch op {
+	case opAdd:
+		for k := range a {
+			a[k] = a[k] + b[k]
+		}
+	case opSub:
+		for k := range a {
+			a[k] = a[k] - b[k]
+		}
+	case opMul:
+		for k := range a {
+			a[k] = a[k] * b[k]
+		}
+		rs.checkRows(idx, a)
+	case opDiv:
+		for k := range a {
+			a[k] = a[k] / b[k]
+		}
+		rs.checkRows(idx, a)
+	case opMod:
+		for k := range a {
+			a[k] = fmodReal(a[k], b[k])
+		}
+		rs.checkRows(idx, a)
+	case opPow:
+		for k, i := range idx {
+			v, ok := powReal(a[k], b[k])
+			if !ok {
+				rs.fail[i] = true
+			}
+			a[k] = v
+		}
+	case opLt:
+		for k := range a {
+			a[k] = boolReal(a[k] < b[k])
+		}
+	case opGt:
+		for k := range a {
+			a[k] = boolReal(a[k] > b[k])
+		}
+	case opLe:
+		for k := range a {
+			a[k] = boolReal(a[k] <= b[k])
+		}
+	case opGe:
+		for k := range a {
+			a[k] = boolReal(a[k] >= b[k])
+		}
+	case opEq:
+		for k := range a {
+			a[k] = boolReal(a[k] == b[k])
+		}
+	case opNe:
+		for k := range a {
+			a[k] = boolReal(a[k] != b[k])
+		}
+	case opOr:
+		for k := range a {
+			a[k] = boolReal(a[k] > 0 || b[k] > 0)
+		}
+	case opAnd:
+		for k := range a {
+			a[k] = boolReal(a[k] > 0 && b[k] > 0)
+		}
+	}
+}
+
+// realIfRows - ifRows for real expressions
+func (ctx *FparCtx) realIfRows(n *fparNode, idx []int, out []float64) {
+	rs := ctx.rows
+	m := len(idx)
+	c := rs.fbuf(m)
+	ctx.realRows(n.args[0], idx, c)
+	tPos := rs.ibuf(m)
+	fPos := rs.ibuf(m)
+	for k := range c {
+		if c[k] > 0 {
+			tPos = append(tPos, k)
+		} else {
+			fPos = append(fPos, k)
+		}
+	}
+	switch {
+	case len(fPos) == 0:
+		ctx.realRows(n.args[1], idx, out)
+	case len(tPos) == 0:
+		ctx.realRows(n.args[2], idx, out)
+	default:
+		ctx.realBranchRows(n.args[1], idx, tPos, out)
+		ctx.realBranchRows(n.args[2], idx, fPos, out)
+	}
+	rs.freeIBuf()
+	rs.freeIBuf()
+	rs.freeFBuf()
+}
+
+// realBranchRows - branchRows for real expressions
+func (ctx *FparCtx) realBranchRows(n *fparNode, idx, pos []int, out []float64) {
+	rs := ctx.rows
+	sub := rs.ibuf(len(pos))
+	for _, k := range pos {
+		sub = append(sub, idx[k])
+	}
+	v := rs.fbuf(len(pos))
+	ctx.realRows(n, sub, v)
+	for s, k := range pos {
+		out[k] = v[s]
+	}
+	rs.freeFBuf()
+	rs.freeIBuf()
+}
+
+// realCseRows - cseRows for real expressions
+func (ctx *FparCtx) realCseRows(n *fparNode, idx []int, out []float64) {
+	rs := ctx.rows
+	vals := rs.cseValR[n.idx]
+	gens := rs.cseGen[n.idx]
+	pos := rs.ibuf(len(idx))
+	for k, i := range idx {
+		if gens[i] != ctx.gen {
+			pos = append(pos, k)
+		}
+	}
+	if len(pos) > 0 {
+		if len(pos) == len(idx) {
+			ctx.realRows(n.args[0], idx, out)
+		} else {
+			ctx.realBranchRows(n.args[0], idx, pos, out)
+		}
+		for _, k := range pos {
+			vals[idx[k]] = out[k]
+			gens[idx[k]] = ctx.gen
+		}
+	}
+	for k, i := range idx {
+		out[k] = vals[i]
+	}
+	rs.freeIBuf()
+}
+
+// realCallRows - callRows for real expressions, builtins get complex arguments like in evalReal
+func (ctx *FparCtx) realCallRows(n *fparNode, idx []int, out []float64) {
+	rs := ctx.rows
+	m := len(idx)
+	na := len(n.args)
+	var av [4][]float64
+	for j, arg := range n.args {
+		av[j] = rs.fbuf(m)
+		if n.op == opCall || arg.op != opArg {
+			ctx.realRows(arg, idx, av[j])
+		}
+	}
+	var x [4]float64
+	a := rs.fargs[:na]
+	for k, i := range idx {
+		if n.op == opCall {
+			for j := 0; j < na; j++ {
+				x[j] = av[j][k]
+			}
+			out[k] = callCReal(n, x[:na])
+			continue
+		}
+		for j, arg := range n.args {
+			if arg.op == opArg {
+				a[j] = rs.args[arg.idx][i]
+			} else {
+				a[j] = complex(av[j][k], 0.0)
+			}
+		}
+		if n.rfn != nil && imag(a[0]) == 0 {
+			v, ok := n.rfn(real(a[0]))
+			if ok {
+				out[k] = v
+				continue
+			}
+		}
+		v := n.fn(a)
+		if imag(v) != 0 {
+			rs.fail[i] = true
+		}
+		out[k] = real(v)
+	}
+	for j := 0; j < na; j++ {
+		rs.freeFBuf()
+	}
+}
@@ -0,0 +1,66 @@
+package jpegbw
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRealPath(t *testing.T) {
+	var testCases = []struct {
+		expr string
+		real bool
+	}{
+		{expr: "x1^2*3 - x1/x2", real: true},
+		{expr: "x1^3 + x1^-2 + x1^7", real: true},
+		{expr: "x1^x2", real: true},
+		{expr: "x1^0.5 + sqrt(x1)", real: true},
+		{expr: "log(x1) + exp(x2)", real: true},
+		{expr: "x1 < .5 ? x1*2 : 1/x1", real: true},
+		{expr: "x1 % .3 - x2 % -2", real: true},
+		{expr: "a = x1*x2; a*a - a", real: true},
+		{expr: "floor(x1*10)/10 + round(x2)", real: true},
+		{expr: "min(x1, x2) + max(x1, x2, 1)", real: true},
+		{expr: "0*x1/x2", real: true},
+		{expr: "-x1*0 + x2/0", real: true},
+		{expr: "abs(x1) + re(x2)", real: true},
+		{expr: "atan2(x1, x2) + hypot(x1, x2)", real: true},
+		{expr: "!(x1 > x2) | x1 = x2", real: true},
+		{expr: "x1 + i", real: false},
+		{expr: "sum(k, 1, 3, x1^k)", real: false},
+	}
+	var args = [][]complex128{
+		{0.5, 2},
+		{-0.5, 3},
+		{0, complex(math.Copysign(0, -1), 0)},
+		{2, 0},
+		{-2, 0.5},
+		{-8, 1.0 / 3.0},
+		{1e300, 1e-300},
+		{-1e-300, 1e300},
+		{complex(math.Inf(1), 0), -1},
+		{complex(math.NaN(), 0), 1},
+	}
+	for _, tc := range testCases {
+		ctx, err := compile(t, tc.expr, 2)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if ctx.IsReal() != tc.real {
+			t.Errorf("%s: IsReal %t, expected %t", tc.expr, ctx.IsReal(), tc.real)
+		}
+		cpx := ctx.Cpy()
+		cpx.SetRealPath(false)
+		for _, a := range args {
+			got, err := ctx.FparF(a)
+			want, err2 := cpx.FparF(a)
+			if (err == nil) != (err2 == nil) {
+				t.Errorf("%s%v: real path error %v, complex path error %v", tc.expr, a, err, err2)
+				continue
+			}
+			if !same(complex(real(got), 0), complex(real(want), 0)) {
+				t.Errorf("%s%v: real path %v, complex path %v", tc.expr, a, got, want)
+			}
+		}
+	}
+}
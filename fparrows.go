@@ -0,0 +1,411 @@
+package jpegbw
+
+import (
+	"fmt"
+	"math/cmplx"
+)
+
+// rowState - scratch buffers used by EvalRows, reused between calls so evaluation does not allocate
+type rowState struct {
+	args    [][]complex128
+	idx     []int
+	vars    [][]complex128
+	cseVal  [][]complex128
+	cseGen  [][]uint64
+	bufs    [][]complex128
+	nbufs   int
+	ibufs   [][]int
+	nibufs  int
+	fargs   [4]complex128
+	fbufs   [][]float64
+	nfbufs  int
+	fail    []bool
+	varsR   [][]float64
+	cseValR [][]float64
+}
+
+// buf - takes scratch buffer of m values, must be released via freeBuf in reverse order
+func (rs *rowState) buf(m int) []complex128 {
+	if rs.nbufs == len(rs.bufs) {
+		rs.bufs = append(rs.bufs, nil)
+	}
+	if cap(rs.bufs[rs.nbufs]) < m {
+		rs.bufs[rs.nbufs] = make([]complex128, m)
+	}
+	b := rs.bufs[rs.nbufs][:m]
+	rs.nbufs++
+	return b
+}
+
+func (rs *rowState) freeBuf() {
+	rs.nbufs--
+}
+
+// ibuf - takes scratch indices buffer with capacity m and zero length
+func (rs *rowState) ibuf(m int) []int {
+	if rs.nibufs == len(rs.ibufs) {
+		rs.ibufs = append(rs.ibufs, nil)
+	}
+	if cap(rs.ibufs[rs.nibufs]) < m {
+		rs.ibufs[rs.nibufs] = make([]int, m)
+	}
+	b := rs.ibufs[rs.nibufs][:0]
+	rs.nibufs++
+	return b
+}
+
+func (rs *rowState) freeIBuf() {
+	rs.nibufs--
+}
+
+// prepare - makes sure all per-row buffers can hold n rows
+func (rs *rowState) prepare(n, nlocals, ncse int) {
+	for len(rs.idx) < n {
+		rs.idx = append(rs.idx, len(rs.idx))
+	}
+	if len(rs.vars) < nlocals {
+		rs.vars = make([][]complex128, nlocals)
+	}
+	for i := 0; i < nlocals; i++ {
+		if len(rs.vars[i]) < n {
+			rs.vars[i] = make([]complex128, n)
+		}
+	}
+	if len(rs.cseVal) < ncse {
+		rs.cseVal = make([][]complex128, ncse)
+		rs.cseGen = make([][]uint64, ncse)
+	}
+	for i := 0; i < ncse; i++ {
+		if len(rs.cseVal[i]) < n {
+			rs.cseVal[i] = make([]complex128, n)
+			rs.cseGen[i] = make([]uint64, n)
+		}
+	}
+}
+
+// EvalRows - evaluates compiled expression for many argument sets at once: dst[i] = f(args[0][i], args[1][i], ...)
+// Each of args must have at least len(dst) values, unused arguments (see UsedArgs) can be nil
+// Result is the same as calling FparF for each i, but the expression tree is walked once per call instead of once per value
+// Scratch buffers are kept in the context, so there is no allocation per value, returns the first error
+func (ctx *FparCtx) EvalRows(dst []complex128, args ...[]complex128) error {
+	if ctx.tree == nil {
+		return fmt.Errorf("EvalRows: function not compiled, FparOK must be called first")
+	}
+	if len(args) < ctx.nvar {
+		return fmt.Errorf("EvalRows: expected %d argument slices, got %d", ctx.nvar, len(args))
+	}
+	n := len(dst)
+	for i, used := range ctx.used {
+		if used && len(args[i]) < n {
+			return fmt.Errorf("EvalRows: argument x%d has %d values, expected at least %d", i+1, len(args[i]), n)
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	if ctx.rows == nil {
+		ctx.rows = &rowState{}
+	}
+	rs := ctx.rows
+	rs.prepare(n, ctx.nlocals, ctx.ncse)
+	rs.args = args
+	ctx.err = nil
+	ctx.gen++
+	if ctx.cache == nil {
+		ctx.evalTopRows(rs.idx[:n], dst)
+		rs.args = nil
+		return ctx.err
+	}
+	// only values missing in the cache are computed
+	var a [4]complex128
+	miss := rs.ibuf(n)
+	for i := 0; i < n; i++ {
+		for k := 0; k < ctx.cache.n; k++ {
+			if k < len(args) && len(args[k]) > i {
+				a[k] = args[k][i]
+			} else {
+				a[k] = 0.0
+			}
+		}
+		key, cached := ctx.cache.key(a[:])
+		if cached {
+			v, hit := ctx.cache.get(&key)
+			if hit {
+				dst[i] = v
+				continue
+			}
+		}
+		miss = append(miss, i)
+	}
+	if len(miss) > 0 {
+		out := rs.buf(len(miss))
+		ctx.evalTopRows(miss, out)
+		for m, i := range miss {
+			dst[i] = out[m]
+			if ctx.err != nil {
+				continue
+			}
+			for k := 0; k < ctx.cache.n; k++ {
+				if k < len(args) && len(args[k]) > i {
+					a[k] = args[k][i]
+				} else {
+					a[k] = 0.0
+				}
+			}
+			key, cached := ctx.cache.key(a[:])
+			if cached {
+				ctx.cache.put(&key, out[m])
+			}
+		}
+		rs.freeBuf()
+	}
+	rs.freeIBuf()
+	rs.args = nil
+	return ctx.err
+}
+
+// evalRows - evaluates node for rows idx, out[k] is the value for row idx[k]
+// It does exactly the same operations as eval, so results are bit identical
+func (ctx *FparCtx) evalRows(n *fparNode, idx []int, out []complex128) {
+	rs := ctx.rows
+	m := len(idx)
+	switch n.op {
+	case opConst:
+		for k := range out {
+			out[k] = n.val
+		}
+		return
+	case opArg:
+		x := rs.args[n.idx]
+		for k, i := range idx {
+			out[k] = x[i]
+		}
+		return
+	case opNeg:
+		ctx.evalRows(n.args[0], idx, out)
+		for k := range out {
+			out[k] = out[k] * complex(-1.0, 0.0)
+		}
+		return
+	case opNot:
+		ctx.evalRows(n.args[0], idx, out)
+		for k := range out {
+			out[k] = boolVal(real(out[k]) <= 0)
+		}
+		return
+	case opPowInt:
+		ctx.evalRows(n.args[0], idx, out)
+		for k := range out {
+			out[k] = powInt(out[k], n.idx)
+		}
+		return
+	case opAdd, opSub, opMul, opDiv, opMod, opPow, opLt, opGt, opLe, opGe, opEq, opNe, opOr, opAnd:
+		ctx.evalRows(n.args[0], idx, out)
+		b := rs.buf(m)
+		ctx.evalRows(n.args[1], idx, b)
+		binaryRows(n.op, out, b)
+		rs.freeBuf()
+		return
+	case opIf:
+		ctx.ifRows(n, idx, out)
+		return
+	case opLocal, opBound:
+		v := rs.vars[n.idx]
+		for k, i := range idx {
+			out[k] = v[i]
+		}
+		return
+	case opLet:
+		ctx.evalRows(n.args[0], idx, out)
+		v := rs.vars[n.idx]
+		for k, i := range idx {
+			v[i] = out[k]
+		}
+		return
+	case opSeq:
+		for _, stmt := range n.args {
+			ctx.evalRows(stmt, idx, out)
+		}
+		return
+	case opCse:
+		ctx.cseRows(n, idx, out)
+		return
+	case opFunc, opGoFunc, opCall:
+		ctx.callRows(n, idx, out)
+		return
+	case opIter, opSum, opProd, opEscape:
+		ctx.loopRows(n, idx, out)
+		return
+	}
+	ctx.er(fmt.Errorf("evalRows: unknown node type %d", n.op))
+}
+
+// binaryRows - a = a op b for all values
+func binaryRows(op fparOp, a, b []complex128) {
+	b = b[:len(a)]
+	switch op {
+	case opAdd:
+		for k := range a {
+			a[k] = a[k] + b[k]
+		}
+	case opSub:
+		for k := range a {
+			a[k] = a[k] - b[k]
+		}
+	case opMul:
+		for k := range a {
+			a[k] = a[k] * b[k]
+		}
+	case opDiv:
+		for k := range a {
+			a[k] = a[k] / b[k]
+		}
+	case opMod:
+		for k := range a {
+			a[k] = fmod(a[k], b[k])
+		}
+	case opPow:
+		for k := range a {
+			a[k] = cmplx.Pow(a[k], b[k])
+		}
+	case opLt:
+		for k := range a {
+			a[k] = boolVal(real(a[k]) < real(b[k]))
+		}
+	case opGt:
+		for k := range a {
+			a[k] = boolVal(real(a[k]) > real(b[k]))
+		}
+	case opLe:
+		for k := range a {
+			a[k] = boolVal(real(a[k]) <= real(b[k]))
+		}
+	case opGe:
+		for k := range a {
+			a[k] = boolVal(real(a[k]) >= real(b[k]))
+		}
+	case opEq:
+		for k := range a {
+			a[k] = boolVal(real(a[k]) == real(b[k]))
+		}
+	case opNe:
+		for k := range a {
+			a[k] = boolVal(real(a[k]) != real(b[k]))
+		}
+	case opOr:
+		for k := range a {
+			a[k] = boolVal(real(a[k]) > 0 || real(b[k]) > 0)
+		}
+	case opAnd:
+		for k := range a {
+			a[k] = boolVal(real(a[k]) > 0 && real(b[k]) > 0)
+		}
+	}
+}
+
+// ifRows - each branch is only evaluated for rows that selected it (like in eval), so C functions are not called needlessly
+func (ctx *FparCtx) ifRows(n *fparNode, idx []int, out []complex128) {
+	rs := ctx.rows
+	m := len(idx)
+	c := rs.buf(m)
+	ctx.evalRows(n.args[0], idx, c)
+	tPos := rs.ibuf(m)
+	fPos := rs.ibuf(m)
+	for k := range c {
+		if real(c[k]) > 0 {
+			tPos = append(tPos, k)
+		} else {
+			fPos = append(fPos, k)
+		}
+	}
+	switch {
+	case len(fPos) == 0:
+		ctx.evalRows(n.args[1], idx, out)
+	case len(tPos) == 0:
+		ctx.evalRows(n.args[2], idx, out)
+	default:
+		ctx.branchRows(n.args[1], idx, tPos, out)
+		ctx.branchRows(n.args[2], idx, fPos, out)
+	}
+	rs.freeIBuf()
+	rs.freeIBuf()
+	rs.freeBuf()
+}
+
+// branchRows - evaluates node only for rows idx[pos[...]], results go to out[pos[...]]
+func (ctx *FparCtx) branchRows(n *fparNode, idx, pos []int, out []complex128) {
+	rs := ctx.rows
+	sub := rs.ibuf(len(pos))
+	for _, k := range pos {
+		sub = append(sub, idx[k])
+	}
+	v := rs.buf(len(pos))
+	ctx.evalRows(n, sub, v)
+	for s, k := range pos {
+		out[k] = v[s]
+	}
+	rs.freeBuf()
+	rs.freeIBuf()
+}
+
+// cseRows - common subexpression, evaluated once per row and EvalRows call
+func (ctx *FparCtx) cseRows(n *fparNode, idx []int, out []complex128) {
+	rs := ctx.rows
+	vals := rs.cseVal[n.idx]
+	gens := rs.cseGen[n.idx]
+	pos := rs.ibuf(len(idx))
+	for k, i := range idx {
+		if gens[i] != ctx.gen {
+			pos = append(pos, k)
+		}
+	}
+	if len(pos) > 0 {
+		if len(pos) == len(idx) {
+			ctx.evalRows(n.args[0], idx, out)
+		} else {
+			ctx.branchRows(n.args[0], idx, pos, out)
+		}
+		for _, k := range pos {
+			vals[idx[k]] = out[k]
+			gens[idx[k]] = ctx.gen
+		}
+	}
+	for k, i := range idx {
+		out[k] = vals[i]
+	}
+	rs.freeIBuf()
+}
+
+// callRows - evaluates all arguments for all rows and then calls function once per row
+func (ctx *FparCtx) callRows(n *fparNode, idx []int, out []complex128) {
+	rs := ctx.rows
+	m := len(idx)
+	na := len(n.args)
+	var av [4][]complex128
+	for j, arg := range n.args {
+		av[j] = rs.buf(m)
+		ctx.evalRows(arg, idx, av[j])
+	}
+	a := rs.fargs[:na]
+	for k := range out {
+		for j := 0; j < na; j++ {
+			a[j] = av[j][k]
+		}
+		switch n.op {
+		case opFunc:
+			out[k] = n.fn(a)
+		case opGoFunc:
+			v, err := n.gfn(a...)
+			if err != nil {
+				ctx.er(&EvalError{Func: n.name, Args: append([]complex128{}, a...), Err: err})
+				v = 0.0
+			}
+			out[k] = v
+		default:
+			out[k] = callC(n, a)
+		}
+	}
+	for j := 0; j < na; j++ {
+		rs.freeBuf()
+	}
+}
@@ -0,0 +1,98 @@
+package jpegbw
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEvalRows(t *testing.T) {
+	var testCases = []string{
+		"x1",
+		"x1*x2 + x3",
+		"x1^2*3 - x1/x2",
+		"sin(x1)+sin(x1)^2",
+		"a = x1^2; b = 1 - a; a*b/(a+b)",
+		"x1 < .3 ? 0 : x1 > .7 ? 1 : x1*x2",
+		"if(x2 > 0, sqrt(x1), log(x1))",
+		"sum(k, 1, 4, x1^k/k)",
+		"iter(z -> z^2 + x1, 0, 8)",
+		"escape(z -> z^2 + x2, 0, 50, 2)",
+		"min(x1, x2, x3) + max(x1, x3)",
+		"(x1 - x2) % .3",
+		"0*x1/x2 - x3*0",
+		"cabs(2*x2-1_1) + arg(x3)",
+		"rand(x1) + fbm(x2, 3, 4)",
+		"!(x1 > x2) & (x3 != 0)",
+	}
+	n := 53
+	args := [][]complex128{make([]complex128, n), make([]complex128, n), make([]complex128, n)}
+	for i := 0; i < n; i++ {
+		f := float64(i)
+		args[0][i] = complex(math.Sin(f)*1.5, 0)
+		args[1][i] = complex(math.Cos(f*0.7), 0)
+		if i%3 == 0 {
+			args[1][i] += complex(0, math.Sin(f*0.3))
+		}
+		args[2][i] = complex(f/float64(n)-0.5, 0)
+	}
+	args[0][5], args[1][5] = 0, 0
+	args[1][7] = complex(math.Copysign(0, -1), 0)
+	for _, expr := range testCases {
+		for _, realPath := range []bool{true, false} {
+			ctx, err := compile(t, expr, 3)
+			if err != nil {
+				t.Errorf("%s: %v", expr, err)
+				break
+			}
+			ctx.SetRealPath(realPath)
+			dst := make([]complex128, n)
+			err = ctx.EvalRows(dst, args...)
+			if err != nil {
+				t.Errorf("%s: EvalRows: %v", expr, err)
+				continue
+			}
+			for i := 0; i < n; i++ {
+				want, err := ctx.FparF([]complex128{args[0][i], args[1][i], args[2][i]})
+				if err != nil {
+					t.Errorf("%s: FparF: %v", expr, err)
+					break
+				}
+				if !same(dst[i], want) {
+					t.Errorf("%s (real path %t) row %d: EvalRows %v, FparF %v", expr, realPath, i, dst[i], want)
+				}
+			}
+		}
+	}
+}
+
+func TestEvalRowsArgs(t *testing.T) {
+	ctx, err := compile(t, "x1*2", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := make([]complex128, 4)
+	err = ctx.EvalRows(dst, []complex128{1, 2, 3, 4}, nil, nil)
+	if err != nil {
+		t.Fatalf("unused arguments can be nil: %v", err)
+	}
+	if dst[3] != 8 {
+		t.Errorf("got %v, expected 8", dst[3])
+	}
+	var testCases = []struct {
+		expr string
+		args [][]complex128
+	}{
+		{expr: "x1*2", args: [][]complex128{{1, 2}}},
+		{expr: "x1*2", args: [][]complex128{{1, 2}, nil, nil}},
+		{expr: "x1*x2", args: [][]complex128{{1, 2, 3, 4}, nil, nil}},
+	}
+	for _, tc := range testCases {
+		ctx, err := compile(t, tc.expr, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ctx.EvalRows(dst, tc.args...) == nil {
+			t.Errorf("%s %v: expected error", tc.expr, tc.args)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package jpegbw
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// C types allowed in prototypes, codes must match SIG_* in byname.c
+const (
+	cNone    = 0
+	cDouble  = 1
+	cComplex = 2
+	cInt     = 3
+)
+
+// cSig - C function prototype: return type and argument types
+type cSig struct {
+	ret  int
+	args []int
+}
+
+// defaultSig - functions without declared prototype take and return double complex values
+func defaultSig(nargs int) cSig {
+	sig := cSig{ret: cComplex}
+	for i := 0; i < nargs; i++ {
+		sig.args = append(sig.args, cComplex)
+	}
+	return sig
+}
+
+// code - signature code passed to callsig, 2 bits per type, return type is in the lowest bits
+func (s cSig) code() int {
+	code := s.ret
+	for i, arg := range s.args {
+		code |= arg << uint(2*(i+1))
+	}
+	return code
+}
+
+// realSig - signature code has no double complex argument or return value, so function can be called via callreal
+func realSig(code int) bool {
+	for ; code != 0; code >>= 2 {
+		if code&3 == cComplex {
+			return false
+		}
+	}
+	return true
+}
+
+func cTypeName(t int) string {
+	switch t {
+	case cDouble:
+		return "double"
+	case cComplex:
+		return "double complex"
+	case cInt:
+		return "int"
+	}
+	return "void"
+}
+
+// String - prototype without function name, for example "double(int, double)"
+func (s cSig) String() string {
+	args := []string{}
+	for _, arg := range s.args {
+		args = append(args, cTypeName(arg))
+	}
+	return cTypeName(s.ret) + "(" + strings.Join(args, ", ") + ")"
+}
+
+// parseCType - "double", "double complex" ("complex double", "_Complex double"), "int", optionally followed by a parameter name
+func parseCType(t string) (int, error) {
+	words := strings.Fields(t)
+	cplx, dbl, integer, other := false, false, false, 0
+	for _, w := range words {
+		switch w {
+		case "double":
+			dbl = true
+		case "complex", "_Complex":
+			cplx = true
+		case "int":
+			integer = true
+		case "const":
+		default:
+			other++
+		}
+	}
+	// one other word is allowed: parameter name
+	switch {
+	case other > 1:
+	case dbl && cplx && !integer:
+		return cComplex, nil
+	case dbl && !cplx && !integer:
+		return cDouble, nil
+	case integer && !dbl && !cplx:
+		return cInt, nil
+	}
+	return cNone, fmt.Errorf("unsupported C type '%s', only double, double complex and int are supported", strings.TrimSpace(t))
+}
+
+// parseProto - parses C prototype like "double jn(int n, double x)" or "double complex hexp(double complex, double complex)"
+func parseProto(proto string) (string, cSig, error) {
+	var sig cSig
+	proto = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(proto), ";"))
+	open := strings.Index(proto, "(")
+	if open < 0 || !strings.HasSuffix(proto, ")") {
+		return "", sig, fmt.Errorf("prototype '%s': expected 'type name(type, ...)'", proto)
+	}
+	head := strings.Fields(proto[:open])
+	if len(head) < 2 {
+		return "", sig, fmt.Errorf("prototype '%s': expected return type and function name", proto)
+	}
+	name := head[len(head)-1]
+	ret, err := parseCType(strings.Join(head[:len(head)-1], " "))
+	if err != nil {
+		return "", sig, fmt.Errorf("prototype '%s': %v", proto, err)
+	}
+	sig.ret = ret
+	params := strings.TrimSpace(proto[open+1 : len(proto)-1])
+	if params == "" || params == "void" {
+		return "", sig, fmt.Errorf("prototype '%s': function must have 1-4 arguments", proto)
+	}
+	for _, param := range strings.Split(params, ",") {
+		t, err := parseCType(param)
+		if err != nil {
+			return "", sig, fmt.Errorf("prototype '%s': %v", proto, err)
+		}
+		sig.args = append(sig.args, t)
+	}
+	if len(sig.args) > 4 {
+		return "", sig, fmt.Errorf("prototype '%s': function must have 1-4 arguments", proto)
+	}
+	// expressions are lower case
+	return strings.ToLower(name), sig, nil
+}
+
+// parseProtos - parses ';' separated prototypes
+func parseProtos(protos string, into map[string]cSig) error {
+	for _, proto := range strings.Split(protos, ";") {
+		if strings.TrimSpace(proto) == "" {
+			continue
+		}
+		name, sig, err := parseProto(proto)
+		if err != nil {
+			return err
+		}
+		into[name] = sig
+	}
+	return nil
+}
+
+// readManifest - reads LIB manifest file: 'lib path' lines and C prototypes (one per line) for functions from those libraries
+// Empty lines and lines starting with '#' are skipped, relative library paths are relative to the manifest's directory
+func readManifest(fn string) ([]string, map[string]cSig, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = f.Close() }()
+	libs := []string{}
+	protos := make(map[string]cSig)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		if strings.HasPrefix(s, "lib ") {
+			lib := strings.TrimSpace(s[4:])
+			if strings.Contains(lib, "/") && !filepath.IsAbs(lib) {
+				lib = filepath.Join(filepath.Dir(fn), lib)
+			}
+			libs = append(libs, lib)
+			continue
+		}
+		err = parseProtos(s, protos)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %v", fn, line, err)
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(libs) == 0 {
+		return nil, nil, fmt.Errorf("%s: no 'lib path' line", fn)
+	}
+	return libs, protos, nil
+}
+
+// splitLibs - splits LIB on ':', but not inside inline prototypes in parentheses
+func splitLibs(libs string) []string {
+	items := []string{}
+	depth, start := 0, 0
+	for i, c := range libs {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ':':
+			if depth == 0 {
+				items = append(items, libs[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(items, libs[start:])
+}
@@ -0,0 +1,140 @@
+package jpegbw
+
+import (
+	"math"
+	"math/cmplx"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseProto(t *testing.T) {
+	var testCases = []struct {
+		proto string
+		name  string
+		sig   string
+	}{
+		{proto: "double jn(int n, double x)", name: "jn", sig: "double(int, double)"},
+		{proto: "double J0(double);", name: "j0", sig: "double(double)"},
+		{proto: "complex double f(_Complex double z, const int k)", name: "f", sig: "double complex(double complex, int)"},
+		{proto: "double complex tettest(double complex, double complex, double complex, double complex)", name: "tettest", sig: "double complex(double complex, double complex, double complex, double complex)"},
+		{proto: "double f()"},
+		{proto: "double f(void)"},
+		{proto: "float f(double)"},
+		{proto: "double f(double, double, double, double, double)"},
+		{proto: "double f(unsigned long x)"},
+		{proto: "f(double)"},
+		{proto: "double f"},
+	}
+	for _, tc := range testCases {
+		name, sig, err := parseProto(tc.proto)
+		if tc.name == "" {
+			if err == nil {
+				t.Errorf("%s: expected error", tc.proto)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.proto, err)
+			continue
+		}
+		if name != tc.name || sig.String() != tc.sig {
+			t.Errorf("%s: got %s %s, expected %s %s", tc.proto, name, sig, tc.name, tc.sig)
+		}
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	inline := "libm.so.6(double j0(double); double jn(int, double); double ldexp(double x, int exp))"
+	var testCases = []struct {
+		lib  string
+		expr string
+		want float64
+	}{
+		{lib: inline, expr: "j0(x1)", want: math.J0(0.7)},
+		{lib: inline, expr: "jn(2, x1)", want: math.Jn(2, 0.7)},
+		{lib: inline, expr: "ldexp(x1, 3)", want: math.Ldexp(0.7, 3)},
+		{lib: "libm.sig", expr: "j1(x1) + yn(1, x1)", want: math.J1(0.7) + math.Yn(1, 0.7)},
+		{lib: "libm.sig", expr: "expm1(x1)", want: math.Expm1(0.7)},
+	}
+	for _, tc := range testCases {
+		ctx, err := compileLib(t, tc.lib, tc.expr, 1)
+		if err != nil {
+			t.Errorf("%s: %s: %v", tc.lib, tc.expr, err)
+			continue
+		}
+		got, err := ctx.FparF([]complex128{0.7})
+		if err != nil {
+			t.Errorf("%s: %s: %v", tc.lib, tc.expr, err)
+			continue
+		}
+		if cmplx.Abs(got-complex(tc.want, 0)) > 1e-12 {
+			t.Errorf("%s: %s: got %v, expected %v", tc.lib, tc.expr, got, tc.want)
+		}
+	}
+	// declared number of arguments is checked by FparOK
+	for _, expr := range []string{"j0(x1, 2)", "jn(x1)"} {
+		_, err := compileLib(t, inline, expr, 1)
+		if err == nil {
+			t.Errorf("%s: expected wrong number of arguments error", expr)
+		}
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	var testCases = []struct {
+		manifest string
+		libs     []string
+		protos   map[string]string
+		fail     bool
+	}{
+		{
+			manifest: "# comment\n\nlib libm.so.6\nlib ./sub/libx.so\nlib /abs/liby.so\ndouble j0(double)\ndouble jn(int, double); double y0(double)\n",
+			libs:     []string{"libm.so.6", filepath.Join(dir, "sub", "libx.so"), "/abs/liby.so"},
+			protos:   map[string]string{"j0": "double(double)", "jn": "double(int, double)", "y0": "double(double)"},
+		},
+		{manifest: "double j0(double)\n", fail: true},
+		{manifest: "lib libm.so.6\ndouble j0(float)\n", fail: true},
+	}
+	for i, tc := range testCases {
+		fn := filepath.Join(dir, "test.sig")
+		err := os.WriteFile(fn, []byte(tc.manifest), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		libs, protos, err := readManifest(fn)
+		if tc.fail {
+			if err == nil {
+				t.Errorf("case %d: expected error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: %v", i, err)
+			continue
+		}
+		if len(libs) != len(tc.libs) {
+			t.Errorf("case %d: got libraries %v, expected %v", i, libs, tc.libs)
+		} else {
+			for j := range libs {
+				if libs[j] != tc.libs[j] {
+					t.Errorf("case %d: got libraries %v, expected %v", i, libs, tc.libs)
+					break
+				}
+			}
+		}
+		if len(protos) != len(tc.protos) {
+			t.Errorf("case %d: got %d prototypes, expected %d", i, len(protos), len(tc.protos))
+		}
+		for name, want := range tc.protos {
+			if protos[name].String() != want {
+				t.Errorf("case %d: %s: got %s, expected %s", i, name, protos[name], want)
+			}
+		}
+	}
+	_, _, err := readManifest(filepath.Join(dir, "missing.sig"))
+	if err == nil {
+		t.Errorf("missing manifest: expected error")
+	}
+}
@@ -0,0 +1,369 @@
+package bw
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lukaszgryglicki/jpegbw"
+	"github.com/lukaszgryglicki/jpegbw/internal/cli"
+)
+
+// images2BW: convert given images to bw: iname.ext -> bw_iname.ext, dir/iname.ext -> dir/bw_iname.ext
+// Other parameters are set via env variables (see helpStr, it describes all env params):
+func images2BW(args []string) error {
+	// F, LIB processing
+	var fctx jpegbw.FparCtx
+	fun := os.Getenv("F")
+	lib := ""
+	bFun := false
+	if fun != "" {
+		lib = os.Getenv("LIB")
+		if lib != "" {
+			nf := 128
+			nfs := os.Getenv("NF")
+			if nfs != "" {
+				v, err := strconv.Atoi(nfs)
+				if err != nil {
+					return err
+				}
+				if v < 1 || v > 0xffff {
+					return fmt.Errorf("NF must be from 1-65535 range")
+				}
+				nf = v
+			}
+			err := fctx.Init(lib, uint(nf))
+			if err != nil {
+				return fmt.Errorf("LIB init failed: %w", err)
+			}
+			defer func() { fctx.Tidy() }()
+		}
+		// LUTS - curves used by lut("name", x)
+		err := jpegbw.LoadLUTs(os.Getenv("LUTS"))
+		if err != nil {
+			return err
+		}
+		err = fctx.FparFunction(fun)
+		if err != nil {
+			return err
+		}
+		err = fctx.FparOK(5)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("F: %s\n", fctx.String())
+		// NX (evaluate real function as complex, results are the same)
+		fctx.SetRealPath(os.Getenv("NX") == "")
+		bFun = true
+	}
+	// I (use imaginary part of function result instead of real)
+	useImag := os.Getenv("I") != ""
+	// NL (don't use lookup table for functions using only x1)
+	noLUT := os.Getenv("NL") != ""
+	// NR (don't evaluate function for the whole column at once)
+	noRows := os.Getenv("NR") != ""
+
+	// ENV
+	// JPEG Quality
+	jpegqStr := os.Getenv("Q")
+	jpegq := -1
+	if jpegqStr != "" {
+		v, err := strconv.Atoi(jpegqStr)
+		if err != nil {
+			return err
+		}
+		if v < 1 || v > 100 {
+			return fmt.Errorf("Q must be from 1-100 range")
+		}
+		jpegq = v
+	}
+
+	// PNG Quality
+	pngqStr := os.Getenv("PQ")
+	pngq := png.DefaultCompression
+	if pngqStr != "" {
+		v, err := strconv.Atoi(pngqStr)
+		if err != nil {
+			return err
+		}
+		if v < 0 || v > 3 {
+			return fmt.Errorf("PQ must be from 0-3 range")
+		}
+		pngq = png.CompressionLevel(-v)
+	}
+
+	// R red
+	rS := os.Getenv("R")
+	r := 1.0
+	if rS != "" {
+		v, err := strconv.ParseFloat(rS, 64)
+		if err != nil {
+			return err
+		}
+		r = v
+	}
+
+	// G green
+	gS := os.Getenv("G")
+	g := 1.0
+	if gS != "" {
+		v, err := strconv.ParseFloat(gS, 64)
+		if err != nil {
+			return err
+		}
+		g = v
+	}
+
+	// B blue
+	bS := os.Getenv("B")
+	b := 1.0
+	if bS != "" {
+		v, err := strconv.ParseFloat(bS, 64)
+		if err != nil {
+			return err
+		}
+		b = v
+	}
+	fact := r + g + b
+	if fact <= 0 {
+		return fmt.Errorf("r+g+b is <= 0: %v", fact)
+	}
+	r /= fact
+	g /= fact
+	b /= fact
+
+	// LO
+	loS := os.Getenv("LO")
+	lo := 0.0
+	if loS != "" {
+		v, err := strconv.ParseFloat(loS, 64)
+		if err != nil {
+			return err
+		}
+		if v < 0.0 || v > 100.0 {
+			return fmt.Errorf("LO must be from 0-100 range")
+		}
+		lo = v
+	}
+
+	// HI
+	hiS := os.Getenv("HI")
+	hi := 0.0
+	if hiS != "" {
+		v, err := strconv.ParseFloat(hiS, 64)
+		if err != nil {
+			return err
+		}
+		if v < 0.0 || v > 100.0 {
+			return fmt.Errorf("HI must be from 0-100 range")
+		}
+		hi = v
+	}
+	hiPct := hi
+	hi = 100 - hi
+	if lo >= hi {
+		return fmt.Errorf("invalid lo-hi range: %f%% - %f%%", lo, hi)
+	}
+
+	// GA gamma
+	gaS := os.Getenv("GA")
+	ga := 1.0
+	gaB := false
+	if gaS != "" {
+		v, err := strconv.ParseFloat(gaS, 64)
+		if err != nil {
+			return err
+		}
+		ga = v
+		gaB = true
+	}
+
+	// Threads
+	thrsS := os.Getenv("N")
+	thrs := -1
+	if thrsS != "" {
+		t, err := strconv.Atoi(thrsS)
+		if err != nil {
+			return err
+		}
+		thrs = t
+	}
+	thrN := thrs
+	if thrs < 0 {
+		thrN = runtime.NumCPU()
+	}
+	runtime.GOMAXPROCS(thrN)
+
+	// Override file name config
+	overS := os.Getenv("O")
+	overB := false
+	overFrom := ""
+	overTo := ""
+	if overS != "" {
+		ary := strings.Split(overS, ":")
+		if len(ary) != 2 {
+			return fmt.Errorf("bad override filename config: %s", overS)
+		}
+		overFrom = ary[0]
+		overTo = ary[1]
+		overB = true
+	}
+	fmt.Printf(
+		"Final RGB multiplier: %f(%f, %f, %f), range %f%% - %f%%, quality: %d, gamma: (%v, %f), threads: %d, override: %v,%s,%s\n",
+		fact, r, g, b, lo, hi, jpegq, gaB, ga, thrN, overB, overFrom, overTo,
+	)
+
+	// Flushing before endline
+	flush := bufio.NewWriter(os.Stdout)
+
+	// Gray pipeline: channel mix, percentile stretch, gamma and function
+	stages := []jpegbw.Stage{
+		&jpegbw.MixStage{Weights: [4][3]float64{{r, g, b}}},
+		&jpegbw.StretchStage{Lo: [4]float64{lo}, Hi: [4]float64{hiPct}},
+	}
+	if gaB {
+		stages = append(stages, &jpegbw.GammaStage{Gamma: [4]*float64{&ga}})
+	}
+	if bFun {
+		stages = append(stages, &jpegbw.FuncStage{Func: [4]*jpegbw.FparCtx{&fctx}, Imag: [4]bool{useImag}, NoLUT: noLUT, NoRows: noRows})
+	}
+	pipe := jpegbw.Pipeline{Stages: stages, Channels: 1, Threads: thrN}
+
+	// Iterate given files
+	n := len(args)
+	for k, fn := range args {
+		dtStart := time.Now()
+		fk := float64(k) / float64(n)
+		fmt.Printf("%d/%d %s...", k+1, n, fn)
+		_ = flush.Flush()
+
+		// Input
+		dtStartI := time.Now()
+		reader, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+
+		// Decode input
+		m, _, err := image.Decode(reader)
+		if err != nil {
+			_ = reader.Close()
+			return err
+		}
+		err = reader.Close()
+		if err != nil {
+			return err
+		}
+		bounds := m.Bounds()
+		x := bounds.Max.X
+		y := bounds.Max.Y
+		dtEndI := time.Now()
+		fmt.Printf(" (%d x %d)...", x, y)
+		_ = flush.Flush()
+
+		// Convert
+		target, st, err := pipe.ProcessFrame(context.Background(), m, jpegbw.FrameOpts{Seq: fk})
+		if err != nil {
+			return err
+		}
+		rng := st.Ranges[0]
+		fmt.Printf(" gray: (%d, %d) int: (%d, %d) mult: %f...", rng.Min, rng.Max, rng.Lo, rng.Hi, rng.Mult)
+		_ = flush.Flush()
+
+		// Eventual file name override
+		ifn := fn
+		if overB {
+			ifn = strings.Replace(fn, overFrom, overTo, -1)
+		}
+		// info: fmt.Printf("filename: %s -> %s\n", fn, ifn)
+
+		// Output name
+		ary := strings.Split(ifn, "/")
+		lAry := len(ary)
+		last := ary[lAry-1]
+		ary[lAry-1] = "bw_" + last
+		ofn := strings.Join(ary, "/")
+		fi, err := os.Create(ofn)
+		if err != nil {
+			return err
+		}
+		lfn := strings.ToLower(ifn)
+		// info: fmt.Printf("output filename: %s, lower case %s\n", ofn, lfn)
+
+		// Output write
+		dtStartO := time.Now()
+		var ierr error
+		if strings.Contains(lfn, ".png") {
+			enc := png.Encoder{CompressionLevel: pngq}
+			ierr = enc.Encode(fi, target)
+		} else if strings.Contains(lfn, ".jpg") || strings.Contains(lfn, ".jpeg") {
+			if jpegq < 0 {
+				ierr = jpeg.Encode(fi, target, nil)
+			} else {
+				ierr = jpeg.Encode(fi, target, &jpeg.Options{Quality: jpegq})
+			}
+		} else if strings.Contains(lfn, ".gif") {
+			ierr = gif.Encode(fi, target, nil)
+		}
+		if ierr != nil {
+			_ = fi.Close()
+			return ierr
+		}
+		err = fi.Close()
+		if err != nil {
+			return err
+		}
+		dtEnd := time.Now()
+		fmt.Printf(
+			" %s (time %v, load %v, hist %v, calc %v, save %v, MPPS: %.3f)\n",
+			ofn, dtEnd.Sub(dtStart), dtEndI.Sub(dtStartI), st.Hist, st.Calc, dtEnd.Sub(dtStartO), st.MPPS(),
+		)
+	}
+	return nil
+}
+
+// Command - bw subcommand: converts images to gray
+var Command = &cli.Command{
+	Name:    "bw",
+	Args:    "image...",
+	Summary: "converts images to gray: iname.ext -> bw_iname.ext",
+	Help:    helpStr,
+	Flags:   []cli.Flag{cli.Quality, cli.PNGQuality, cli.Threads, cli.Lib, cli.LUTs},
+	MinArgs: 1,
+	Timed:   true,
+	Run:     images2BW,
+}
+
+// helpStr - env variables
+const helpStr = `
+Environment variables:
+Q - jpeg quality 1-100, will use library default if not specified
+PQ - png quality 0-3 (0 is default): 0=DefaultCompression, 1=NoCompression, 2=BestSpeed, 3=BestCompression
+R - relative red usage for generating gray pixel, 1 if not specified
+G - relative green usage for generating gray pixel, 1 if not specified
+B - relative blue usage for generating gray pixel, 1 if not specified
+(R+G+B) will be normalized to sum to 1, so their sum must be positive
+R=0.2125 G=0.7154 B=0.0721 is a suggested configuration
+LO - when calculating intensity range, discard values than are in this lower %, for example 3
+HI - when calculating intensity range, discard values that are in this higher %, for example 3
+GA - gamma default 1, which uses straight line (0,0) -> (1,1), if set uses (x,y)->(x,pow(x, GA)) mapping
+F - function to apply on final 0-1 range, for example "sin(x1*2)+cos(x1*3)"
+LIB - if F is used and F calls external functions, thery need to be loaded for this C library
+NF - set maximum number of distinct functions in the parser, if not set, default 128 is used
+LUTS - curves for lut("name", x) in F, ':' separated name=file list, files are CSV or 1D .cube, example: "film=film.csv:soft=soft.cube"
+I - use imaginary part of fuction return value instead of real, use like I=1
+NL - do not precompute lookup table for F using only x1 (it is used by default)
+NR - do not evaluate F for the whole column at once, call it per pixel (function using x5 is always called per pixel)
+NX - evaluate F in complex numbers even if it is real (by default real function of real arguments is evaluated in float64, result is the same)
+N - set number of CPUs to process data
+O - eventual overwite file name config, example: ".jpg:.png"
+`
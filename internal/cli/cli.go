@@ -0,0 +1,230 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lukaszgryglicki/jpegbw"
+)
+
+// Flag - string flag with env variable fallback: -Name value is used when given, Env variable otherwise
+// Flags given on command line are exported to their env variables, so code reading env variables sees them
+type Flag struct {
+	Name string
+	Env  string
+	Help string
+}
+
+// UsageError - wrong usage error, command returning it prints help and exits with code 2
+type UsageError struct {
+	Msg string
+}
+
+// Error - error message
+func (e *UsageError) Error() string {
+	return e.Msg
+}
+
+// Usagef - wrong usage error with formatted message
+func Usagef(format string, args ...interface{}) error {
+	return &UsageError{Msg: fmt.Sprintf(format, args...)}
+}
+
+// Shared flags
+var (
+	// Quality - jpeg quality
+	Quality = Flag{Name: "q", Env: "Q", Help: "jpeg quality 1-100, library default if not set"}
+	// PNGQuality - png compression level
+	PNGQuality = Flag{Name: "pq", Env: "PQ", Help: "png quality 0-3: 0=DefaultCompression, 1=NoCompression, 2=BestSpeed, 3=BestCompression"}
+	// Threads - number of threads
+	Threads = Flag{Name: "n", Env: "N", Help: "number of threads, number of CPUs if not set"}
+	// Lib - C libraries with functions used in expressions
+	Lib = Flag{Name: "lib", Env: "LIB", Help: "C libraries (or .sig manifests) with functions used in expressions, separated by ':'"}
+	// LUTs - curves used by lut() in expressions
+	LUTs = Flag{Name: "luts", Env: "LUTS", Help: "curves used by lut(\"name\", x): name=file.csv or file.cube, separated by ':'"}
+)
+
+// Command - program or subcommand: Name, Args (arguments in usage line), Summary (one line), Help (env variables),
+// Flags with env fallbacks, Setup defines other flags, MinArgs is the minimum number of arguments after flags,
+// DashArgs makes the first argument starting with '-' that is not a flag (like '-x1^2' or -7) the first argument,
+// Timed prints run time, Run processes arguments
+type Command struct {
+	Name     string
+	Args     string
+	Summary  string
+	Help     string
+	Flags    []Flag
+	Setup    func(fs *flag.FlagSet)
+	MinArgs  int
+	DashArgs bool
+	Timed    bool
+	Run      func(args []string) error
+}
+
+// boolFlag - flag that doesn't take a value
+type boolFlag interface {
+	IsBoolFlag() bool
+}
+
+// dashArgs - inserts "--" before the first argument starting with '-' that is not a flag name, so flags parsing stops there
+func dashArgs(fs *flag.FlagSet, args []string) []string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || arg == "-" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		value := false
+		eq := strings.Index(name, "=")
+		if eq >= 0 {
+			name = name[:eq]
+			value = true
+		}
+		if name == "h" || name == "help" {
+			continue
+		}
+		f := fs.Lookup(name)
+		if f == nil {
+			return append(append(append([]string{}, args[:i]...), "--"), args[i:]...)
+		}
+		bf, ok := f.Value.(boolFlag)
+		if !value && !(ok && bf.IsBoolFlag()) {
+			// skip flag's value
+			i++
+		}
+	}
+	return args
+}
+
+// usage - prints generated help: usage line, summary, flags and env variables
+func (c *Command) usage(prog string, fs *flag.FlagSet) {
+	fmt.Printf("Usage: %s [flags] %s\n%s\n", prog, c.Args, c.Summary)
+	n := 0
+	fs.VisitAll(func(*flag.Flag) { n++ })
+	if n > 0 {
+		fmt.Printf("\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if c.Help != "" {
+		fmt.Printf("%s\n", c.Help)
+	}
+}
+
+// Execute - parses flags and runs command, returns exit code: 0 - success, 1 - error, 2 - wrong usage
+func (c *Command) Execute(prog string, args []string) int {
+	dtStart := time.Now()
+	fs := flag.NewFlagSet(prog, flag.ContinueOnError)
+	fs.SetOutput(os.Stdout)
+	envs := make(map[string]string)
+	for _, f := range c.Flags {
+		fs.String(f.Name, os.Getenv(f.Env), fmt.Sprintf("%s (env %s)", f.Help, f.Env))
+		envs[f.Name] = f.Env
+	}
+	if c.Setup != nil {
+		c.Setup(fs)
+	}
+	fs.Usage = func() {
+		c.usage(prog, fs)
+	}
+	if c.DashArgs {
+		args = dashArgs(fs, args)
+	}
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		return 2
+	}
+	fs.Visit(func(f *flag.Flag) {
+		env, ok := envs[f.Name]
+		if ok {
+			_ = os.Setenv(env, f.Value.String())
+		}
+	})
+	if fs.NArg() < c.MinArgs {
+		err = Usagef("%s requires at least %d argument(s), got %d", prog, c.MinArgs, fs.NArg())
+	} else {
+		err = c.Run(fs.Args())
+	}
+	var ue *UsageError
+	if errors.As(err, &ue) {
+		fmt.Printf("Error: %v\n\n", err)
+		c.usage(prog, fs)
+		return 2
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n%s", err, jpegbw.ErrorCaret(err))
+		return 1
+	}
+	if c.Timed {
+		dtEnd := time.Now()
+		fmt.Printf("Time: %v\n", dtEnd.Sub(dtStart))
+	}
+	return 0
+}
+
+// Run - runs single command program
+func Run(c *Command) {
+	os.Exit(c.Execute(filepath.Base(os.Args[0]), os.Args[1:]))
+}
+
+// Main - runs subcommand given as the first argument, def command is used when the first argument is not a subcommand name
+func Main(def *Command, cmds ...*Command) {
+	os.Exit(Dispatch(filepath.Base(os.Args[0]), os.Args[1:], def, cmds...))
+}
+
+// Dispatch - runs subcommand args[0] of prog (see Main), "help [subcommand]" prints help, returns exit code
+func Dispatch(prog string, args []string, def *Command, cmds ...*Command) int {
+	find := func(name string) *Command {
+		for _, c := range cmds {
+			if c.Name == name {
+				return c
+			}
+		}
+		return nil
+	}
+	if len(args) == 0 {
+		printCommands(prog, def, cmds)
+		return 2
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		if len(args) > 1 {
+			c := find(args[1])
+			if c == nil {
+				fmt.Printf("Error: unknown subcommand '%s'\n\n", args[1])
+				printCommands(prog, def, cmds)
+				return 2
+			}
+			return c.Execute(prog+" "+c.Name, []string{"-h"})
+		}
+		printCommands(prog, def, cmds)
+		return 0
+	}
+	c := find(args[0])
+	if c != nil {
+		return c.Execute(prog+" "+c.Name, args[1:])
+	}
+	return def.Execute(prog, args)
+}
+
+// printCommands - prints generated list of subcommands
+func printCommands(prog string, def *Command, cmds []*Command) {
+	fmt.Printf("Usage: %s subcommand [flags] arguments...\n\nSubcommands:\n", prog)
+	for _, c := range cmds {
+		fmt.Printf("  %-6s %s\n", c.Name, c.Summary)
+	}
+	fmt.Printf("\n%s [flags] %s runs %s subcommand\n", prog, def.Args, def.Name)
+	fmt.Printf("Use '%s help subcommand' or '%s subcommand -h' for subcommand's flags and env variables\n", prog, prog)
+	shared := []string{}
+	for _, f := range []Flag{Quality, PNGQuality, Threads, Lib, LUTs} {
+		shared = append(shared, fmt.Sprintf("-%s (%s)", f.Name, f.Env))
+	}
+	fmt.Printf("Shared flags (default to env variables): %s\n", strings.Join(shared, ", "))
+}
@@ -0,0 +1,236 @@
+package eval
+
+import (
+	"flag"
+	"fmt"
+	"math/cmplx"
+	"os"
+	"strconv"
+
+	"github.com/lukaszgryglicki/jpegbw"
+	"github.com/lukaszgryglicki/jpegbw/internal/cli"
+)
+
+// initLib - loads LIB libraries (if set) into context and LUTS curves
+func initLib(fzc *jpegbw.FparCtx) error {
+	// LUTS
+	err := jpegbw.LoadLUTs(os.Getenv("LUTS"))
+	if err != nil {
+		return err
+	}
+	// LIB, NF
+	lib := os.Getenv("LIB")
+	if lib != "" {
+		nf := 128
+		nfs := os.Getenv("NF")
+		if nfs != "" {
+			v, err := strconv.Atoi(nfs)
+			if err != nil {
+				return err
+			}
+			if v < 1 || v > 0xffff {
+				return fmt.Errorf("NF must be from 1-65535 range")
+			}
+			nf = v
+		}
+		err := fzc.Init(lib, uint(nf))
+		if err != nil {
+			return fmt.Errorf("LIB init failed: %w", err)
+		}
+	}
+	return nil
+}
+
+func arity(f jpegbw.FuncInfo) string {
+	if f.MinArgs == f.MaxArgs {
+		return strconv.Itoa(f.MinArgs)
+	}
+	return fmt.Sprintf("%d-%d", f.MinArgs, f.MaxArgs)
+}
+
+// listFunctions - prints LIB's functions and builtin functions
+func listFunctions() error {
+	var fzc jpegbw.FparCtx
+	err := initLib(&fzc)
+	if err != nil {
+		return err
+	}
+	defer func() { fzc.Tidy() }()
+	builtins := jpegbw.BuiltinFunctions()
+	if fzc.Loader() != nil {
+		funcs, err := fzc.Loader().Functions()
+		if err != nil {
+			return err
+		}
+		hidden := make(map[string]struct{})
+		for _, f := range builtins {
+			hidden[f.Name] = struct{}{}
+		}
+		for _, f := range funcs {
+			proto := f.Proto
+			if proto == "" {
+				proto = "double complex(double complex, ...) (not declared)"
+			}
+			_, ok := hidden[f.Name]
+			if ok {
+				proto += fmt.Sprintf(" (hidden by built-in, call it as %s%s)", jpegbw.LibPrefix, f.Name)
+			}
+			fmt.Printf("%-16s %-4s %s %s\n", f.Name, arity(f), f.Lib, proto)
+		}
+	}
+	for _, f := range builtins {
+		fmt.Printf("%-16s %-4s %s %s\n", f.Name, arity(f), f.Lib, f.Proto)
+	}
+	for _, name := range jpegbw.LUTNames() {
+		fmt.Printf("%-16s %-4s %s lut(\"%s\", x)\n", name, "1-2", "curve", name)
+	}
+	return nil
+}
+
+// derivative - prints derivative of compiled function with respect to variable dv and its value
+func derivative(fzc *jpegbw.FparCtx, dv string, zar []complex128) error {
+	df, err := fzc.Derive(dv)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("d/d%s = %s\n", dv, df)
+	var dzc jpegbw.FparCtx
+	dzc.SetLoader(fzc.Loader())
+	defer func() { dzc.Tidy() }()
+	err = dzc.FparFunction(df)
+	if err != nil {
+		return err
+	}
+	err = dzc.FparOK(len(zar))
+	if err != nil {
+		return err
+	}
+	dz, err := dzc.FparF(zar)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("f'(...) = %v+%vi\n|f'(...)| = %v\n", real(dz), imag(dz), cmplx.Abs(dz))
+	return nil
+}
+
+func fCall(f string, za []string) error {
+	var fzc jpegbw.FparCtx
+	var zca [4]jpegbw.FparCtx
+
+	if len(za) > 4 {
+		return fmt.Errorf("maximum 4 arguments are allowed")
+	}
+
+	err := initLib(&fzc)
+	if err != nil {
+		return err
+	}
+	defer func() { fzc.Tidy() }()
+	err = fzc.FparFunction(f)
+	if err != nil {
+		return err
+	}
+	err = fzc.FparOK(4)
+	if err != nil {
+		return err
+	}
+
+	var zar [4]complex128
+	for i := 0; i < 4; i++ {
+		def := "0"
+		if len(za) > i {
+			def = za[i]
+		}
+		zca[i].SetLoader(fzc.Loader())
+		defer func(i int) { zca[i].Tidy() }(i)
+		err := zca[i].FparFunction(def)
+		if err != nil {
+			return err
+		}
+		err = zca[i].FparOK(1)
+		if err != nil {
+			return err
+		}
+		zar[i], err = zca[i].FparF([]complex128{complex(0.0, 0.0)})
+		if err != nil {
+			return err
+		}
+	}
+	fz, err := fzc.FparF(zar[:])
+	if err != nil {
+		return err
+	}
+	s := "f("
+	s2 := "|'" + f + "'("
+	csvr := ""
+	for i := 0; i < 4; i++ {
+		if len(za) > i {
+			s += fmt.Sprintf("%v+%vi, ", real(zar[i]), imag(zar[i]))
+			s2 += za[i] + ", "
+			csvr += fmt.Sprintf("%v,%v,%v,", real(zar[i]), imag(zar[i]), cmplx.Abs(zar[i]))
+		} else {
+			break
+		}
+	}
+	l := len(s)
+	if len(za) > 0 {
+		s = s[:l-2]
+	}
+	s += ") = "
+	s += fmt.Sprintf("%v+%vi", real(fz), imag(fz))
+	l2 := len(s2)
+	if len(za) > 0 {
+		s2 = s2[:l2-2]
+	}
+	s2 += ")| = "
+	s2 += fmt.Sprintf("%v", cmplx.Abs(fz))
+	fmt.Printf("%s\n%s\n", s, s2)
+	// D
+	dv := os.Getenv("D")
+	if dv != "" {
+		err = derivative(&fzc, dv, zar[:])
+		if err != nil {
+			return err
+		}
+	}
+	csvr += fmt.Sprintf("%v,%v,%v\n", real(fz), imag(fz), cmplx.Abs(fz))
+	fmt.Fprintf(os.Stderr, csvr)
+	return nil
+}
+
+// list - -list flag: list functions instead of evaluating expression
+var list bool
+
+// Command - eval subcommand: evaluates expression
+var Command = &cli.Command{
+	Name:    "eval",
+	Args:    "'expression' [x1 x2 ...]",
+	Summary: "evaluates expression for given arguments (or lists functions that can be used)",
+	Help:    helpStr,
+	Flags:   []cli.Flag{cli.Lib, cli.LUTs},
+	Setup: func(fs *flag.FlagSet) {
+		fs.BoolVar(&list, "list", false, "list functions that can be used: functions of LIB libraries with their prototypes and built-in functions")
+	},
+	DashArgs: true,
+	Run:      run,
+}
+
+// run - evaluates expression args[0] with arguments args[1:]
+func run(args []string) error {
+	if list {
+		return listFunctions()
+	}
+	if len(args) == 0 {
+		return cli.Usagef("expression required")
+	}
+	return fCall(args[0], args[1:])
+}
+
+// helpStr - examples and env variables
+const helpStr = `
+Examples (expression starting with '-' that is not a flag, like '-x1^2', ends flags):
+LIB=libtet.so f 'csin(x1)*ccos(x2)*cpow(x3, x4)' 1 -2 _3 -_4
+LIB=libtet.sig:libjpegbw.sig f -list (lists functions that can be used)
+D=x1 f 'x1^3*sin(x1)' 2 (also prints derivative with respect to x1 and its value)
+LUTS=film=film.csv f 'lut("film", x1, "cubic")' 0.3 (curves from CSV or 1D .cube files)
+`
@@ -0,0 +1,58 @@
+package eval
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// execute - runs command with args, returns exit code and stdout
+func execute(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	code := Command.Execute("f", args)
+	os.Stdout, os.Stderr = stdout, stderr
+	_ = w.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, string(out)
+}
+
+func TestDashArgs(t *testing.T) {
+	var testCases = []struct {
+		args []string
+		code int
+		want string
+	}{
+		{args: []string{"-x1^2", "3"}, want: "|'-x1^2'(3)| = 9\n"},
+		{args: []string{"-7 % 3"}, want: "f() = 2+0i\n"},
+		{args: []string{"-(x1+1)", "-2"}, want: "f(-2+0i) = 1+0i\n"},
+		{args: []string{"--", "-x1", "2"}, want: "f(2+0i) = -2+0i\n"},
+		{args: []string{"-luts", "", "-x1", "2"}, want: "f(2+0i) = -2+0i\n"},
+		{args: []string{"sum(k, 1, x1, k)", "1e12"}, code: 1, want: "Error: "},
+		{args: []string{"-nosuchflag=1", "2"}, code: 1, want: "'nosuchflag' is not a variable"},
+	}
+	for _, tc := range testCases {
+		code, out := execute(t, tc.args...)
+		if code != tc.code || !strings.Contains(out, tc.want) {
+			t.Errorf("f %q: exit %d, output:\n%s\nexpected exit %d and output containing %q", tc.args, code, out, tc.code, tc.want)
+		}
+	}
+}
+
+func TestEvalError(t *testing.T) {
+	_ = os.Setenv("D", "x1")
+	defer func() { _ = os.Unsetenv("D") }()
+	code, out := execute(t, "sum(k, 1, x1, k)", "1e12")
+	if code != 1 || strings.Contains(out, "f(") || strings.Contains(out, "d/dx1") {
+		t.Errorf("D=x1 f 'sum(k, 1, x1, k)' 1e12: exit %d, output:\n%s\nexpected exit 1 and no result", code, out)
+	}
+}
@@ -0,0 +1,270 @@
+package rgba
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// presetFS - built-in presets, presets/name.json
+//
+//go:embed presets/*.json
+var presetFS embed.FS
+
+// maxPresetDepth - maximum depth of presets/config files extending other presets
+const maxPresetDepth = 8
+
+// configVars - env variables that can be set in config files, X is replaced with R, G, B and A
+var configVars = []string{
+	"Q", "PQ", "N", "O", "NA", "OGS", "GSR", "GSG", "GSB", "ACM", "HINT", "HINTREQ",
+	"CONT", "EDGE", "SURF", "GCONT", "LIB", "NF", "LUTS", "CS", "NL", "NR", "NX", "INF", "EINF", "HPOW", "REV", "STAGES",
+	"XR", "XG", "XB", "XLO", "XHI", "XLOI", "XHII", "XGA", "XCONT", "XEDGE", "XSURF", "XGCONT", "XF", "XC", "XI",
+	"IR3", "IR3GONLY", "IRRATIO", "IRT", "IRS", "IRL", "IRSH", "IRGM", "IRSPLIT", "IRSSPLIT",
+	"IRSENDR", "IRSENDG", "IRSENDB", "IRSHORTENDR", "IRSHORTENDG", "IRSHORTENDB",
+	"IRLSPLIT", "IRLVR", "IRLVG", "IRLVB", "IRLONGVIOLETR", "IRLONGVIOLETG", "IRLONGVIOLETB",
+	"IRLENDR", "IRLENDG", "IRLENDB", "IRLONGENDR", "IRLONGENDG", "IRLONGENDB",
+	"IRGSHORTEND", "IRGLONGMID", "IRGLONGEND", "IRGLONGSPLIT",
+	"MONOVAL", "MVMODE", "MVT", "MVR", "MVG", "MVB", "MVS", "MVC", "MVGAMUT", "MVZERO",
+	"ISOVAL", "IVT", "IVTAUTO", "IVCLIP", "IVR", "IVG", "IVB", "IVBASE",
+}
+
+// knownVars - names of env variables that can be set in config files and stage parameters (configVars with X replaced)
+var knownVars = func() map[string]bool {
+	known := make(map[string]bool)
+	for _, name := range configVars {
+		if strings.HasPrefix(name, "X") {
+			for _, col := range []string{"R", "G", "B", "A"} {
+				known[col+name[1:]] = true
+			}
+			continue
+		}
+		known[name] = true
+	}
+	return known
+}()
+
+// configAliases - groups of env variables that set the same parameter (the first one set is used)
+var configAliases = [][]string{
+	{"IRRATIO", "IRT"},
+	{"IRSPLIT", "IRSSPLIT"},
+	{"IRSENDR", "IRSHORTENDR"},
+	{"IRSENDG", "IRSHORTENDG"},
+	{"IRSENDB", "IRSHORTENDB"},
+	{"IRLVR", "IRLONGVIOLETR"},
+	{"IRLVG", "IRLONGVIOLETG"},
+	{"IRLVB", "IRLONGVIOLETB"},
+	{"IRLENDR", "IRLONGENDR"},
+	{"IRLENDG", "IRLONGENDG"},
+	{"IRLENDB", "IRLONGENDB"},
+	{"MONOVAL", "MVMODE"},
+}
+
+// jpegVars - configuration: env variables loaded from presets and config files
+// Env variables override values from files (also when they are set to empty value, which means not set),
+// values not set anywhere use built-in defaults
+type jpegVars struct {
+	vars    map[string]string
+	known   map[string]bool
+	aliases map[string][]string
+}
+
+// newJPEGVars - empty configuration
+func newJPEGVars() *jpegVars {
+	c := &jpegVars{
+		vars:    make(map[string]string),
+		known:   knownVars,
+		aliases: make(map[string][]string),
+	}
+	for _, group := range configAliases {
+		for _, name := range group {
+			c.aliases[name] = group
+		}
+	}
+	return c
+}
+
+// set - sets variable, other names of the same parameter are removed, empty value removes variable
+func (c *jpegVars) set(name, value string) {
+	for _, alias := range c.aliases[name] {
+		delete(c.vars, alias)
+	}
+	delete(c.vars, name)
+	if value != "" {
+		c.vars[name] = value
+	}
+}
+
+// envSet - returns env variable when it or any other name of the same parameter is set in the environment
+func (c *jpegVars) envSet(name string) (string, bool) {
+	v, ok := os.LookupEnv(name)
+	if ok {
+		return v, true
+	}
+	for _, alias := range c.aliases[name] {
+		_, ok := os.LookupEnv(alias)
+		if ok {
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// getenv - variable's value: from the environment when set there, from presets and config files otherwise
+func (c *jpegVars) getenv(name string) string {
+	v, ok := c.envSet(name)
+	if ok {
+		return v
+	}
+	return c.vars[name]
+}
+
+// effective - all variables set by the environment, presets and config files
+func (c *jpegVars) effective() map[string]string {
+	eff := make(map[string]string)
+	for name := range c.known {
+		v := c.getenv(name)
+		if v != "" {
+			eff[name] = v
+		}
+	}
+	return eff
+}
+
+// load - loads config file data: JSON object with env variables, values can be strings, numbers or booleans
+// (true is 1, false or null removes variable set by preset), "preset" key names a preset this file extends,
+// "description" key describes the file
+func (c *jpegVars) load(data []byte, from string, depth int) error {
+	if depth > maxPresetDepth {
+		return fmt.Errorf("%s: presets nested too deep (max %d)", from, maxPresetDepth)
+	}
+	var raw map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err := dec.Decode(&raw)
+	if err != nil {
+		return fmt.Errorf("%s: %v", from, err)
+	}
+	preset, ok := raw["preset"]
+	if ok {
+		name, ok := preset.(string)
+		if !ok {
+			return fmt.Errorf("%s: preset must be a string, got: %v", from, preset)
+		}
+		err = c.loadPreset(name, depth+1)
+		if err != nil {
+			return fmt.Errorf("%s: %v", from, err)
+		}
+	}
+	names := []string{}
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "preset" || name == "description" {
+			continue
+		}
+		if !c.known[name] {
+			return fmt.Errorf("%s: unknown variable '%s'", from, name)
+		}
+		switch v := raw[name].(type) {
+		case string:
+			c.set(name, v)
+		case json.Number:
+			c.set(name, v.String())
+		case bool:
+			if v {
+				c.set(name, "1")
+			} else {
+				c.set(name, "")
+			}
+		case nil:
+			c.set(name, "")
+		default:
+			return fmt.Errorf("%s: variable '%s' must be a string, number or boolean, got: %v", from, name, v)
+		}
+	}
+	return nil
+}
+
+// loadPreset - loads built-in preset
+func (c *jpegVars) loadPreset(name string, depth int) error {
+	data, err := presetFS.ReadFile(path.Join("presets", name+".json"))
+	if err != nil {
+		return fmt.Errorf("unknown preset '%s', presets are: %s", name, strings.Join(presetNames(), ", "))
+	}
+	return c.load(data, "preset "+name, depth)
+}
+
+// loadFile - loads config file
+func (c *jpegVars) loadFile(fn string) error {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	return c.load(data, fn, 0)
+}
+
+// dump - prints effective configuration as a config file
+func (c *jpegVars) dump() error {
+	data, err := json.MarshalIndent(c.effective(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", data)
+	return nil
+}
+
+// jpegVarsFromFlags - configuration from -preset and -config (config file is applied on top of preset)
+func jpegVarsFromFlags(preset, configFile string) (*jpegVars, error) {
+	c := newJPEGVars()
+	if preset != "" {
+		err := c.loadPreset(preset, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if configFile != "" {
+		err := c.loadFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// presetNames - names of built-in presets
+func presetNames() []string {
+	names := []string{}
+	entries, _ := presetFS.ReadDir("presets")
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// printPresets - lists built-in presets with their descriptions
+func printPresets() error {
+	for _, name := range presetNames() {
+		data, err := presetFS.ReadFile(path.Join("presets", name+".json"))
+		if err != nil {
+			return err
+		}
+		var preset struct {
+			Description string `json:"description"`
+		}
+		err = json.Unmarshal(data, &preset)
+		if err != nil {
+			return fmt.Errorf("preset %s: %v", name, err)
+		}
+		fmt.Printf("%-16s %s\n", name, preset.Description)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package rgba
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig - writes config file to test's temp directory
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "config.json")
+	err := ioutil.WriteFile(fn, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// captureStdout - returns what f printed to stdout
+func captureStdout(t *testing.T, f func() error) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		done <- data
+	}()
+	err = f()
+	os.Stdout = stdout
+	_ = w.Close()
+	data := <-done
+	_ = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPresets(t *testing.T) {
+	names := presetNames()
+	for _, want := range []string{"ir3-v4", "monotone", "isoval-exp"} {
+		found := false
+		for _, name := range names {
+			found = found || name == want
+		}
+		if !found {
+			t.Errorf("preset %s not found in %v", want, names)
+		}
+	}
+	for _, name := range names {
+		c := newJPEGVars()
+		err := c.loadPreset(name, 0)
+		if err != nil {
+			t.Errorf("preset %s: %v", name, err)
+			continue
+		}
+		if len(c.vars) == 0 {
+			t.Errorf("preset %s sets no variables", name)
+		}
+	}
+	out := captureStdout(t, printPresets)
+	if strings.Count(out, "\n") != len(names) || !strings.Contains(out, "monotone ") {
+		t.Errorf("printPresets: unexpected output:\n%s", out)
+	}
+	c := newJPEGVars()
+	err := c.loadPreset("no-such-preset", 0)
+	if err == nil || !strings.Contains(err.Error(), "monotone") {
+		t.Errorf("unknown preset: expected error listing presets, got %v", err)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	fn := writeConfig(t, `{"preset": "monotone", "description": "test", "RF": "x1", "RHI": 2, "NA": false, "IR3": true, "GF": null, "IRT": "1.5"}`)
+	c, err := jpegVarsFromFlags("", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testCases = []struct {
+		name string
+		want string
+	}{
+		// file values override preset values
+		{name: "RF", want: "x1"},
+		{name: "RHI", want: "2"},
+		{name: "NA", want: ""},
+		{name: "GF", want: ""},
+		{name: "IR3", want: "1"},
+		{name: "IRT", want: "1.5"},
+		// values only set by preset
+		{name: "RLO", want: "1.5"},
+		{name: "BF", want: "0.02+x1*(0.82-0.02)"},
+	}
+	for _, tc := range testCases {
+		t.Setenv(tc.name, "")
+		_ = os.Unsetenv(tc.name)
+		if got := c.getenv(tc.name); got != tc.want {
+			t.Errorf("%s: got %q, expected %q", tc.name, got, tc.want)
+		}
+	}
+	// env variables override file values, also when they are empty, and other names of the same parameter too
+	t.Setenv("RF", "1-x1")
+	t.Setenv("RLO", "")
+	t.Setenv("IRRATIO", "2")
+	_ = os.Unsetenv("IRT")
+	for name, want := range map[string]string{"RF": "1-x1", "RLO": "", "IRT": "", "IRRATIO": "2"} {
+		if got := c.getenv(name); got != want {
+			t.Errorf("%s with env set: got %q, expected %q", name, got, want)
+		}
+	}
+	// -preset is applied first, -config on top of it
+	c, err = jpegVarsFromFlags("rgb", writeConfig(t, `{"preset": "monotone"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newJPEGVars()
+	err = m.loadPreset("monotone", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range m.vars {
+		if c.vars[name] != v {
+			t.Errorf("%s: got %q, expected %q from monotone preset", name, c.vars[name], v)
+		}
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	var testCases = []struct {
+		data string
+		err  string
+	}{
+		{data: `{"NOSUCHVAR": 1}`, err: "unknown variable 'NOSUCHVAR'"},
+		{data: `{"RF": [1, 2]}`, err: "must be a string, number or boolean"},
+		{data: `{"preset": 1}`, err: "preset must be a string"},
+		{data: `{"preset": "no-such-preset"}`, err: "unknown preset 'no-such-preset'"},
+		{data: `{"RF": "x1",}`, err: "invalid character"},
+	}
+	for _, tc := range testCases {
+		_, err := jpegVarsFromFlags("", writeConfig(t, tc.data))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.data, tc.err, err)
+		}
+	}
+	_, err := jpegVarsFromFlags("", filepath.Join(t.TempDir(), "missing.json"))
+	if err == nil {
+		t.Errorf("missing config file: expected error")
+	}
+	c := newJPEGVars()
+	err = c.load([]byte(`{"preset": "monotone"}`), "deep", maxPresetDepth)
+	if err == nil || !strings.Contains(err.Error(), "too deep") {
+		t.Errorf("nested presets: expected too deep error, got %v", err)
+	}
+}
+
+func TestDumpConfig(t *testing.T) {
+	flagPreset, flagConfig, flagDumpConfig = "ir3-v4", writeConfig(t, `{"RF": "x1^2", "RHI": 2.5}`), true
+	defer func() { flagPreset, flagConfig, flagDumpConfig = "", "", false }()
+	t.Setenv("GF", "sqrt(x1)")
+	for _, name := range []string{"RF", "RHI"} {
+		t.Setenv(name, "")
+		_ = os.Unsetenv(name)
+	}
+	out := captureStdout(t, func() error { return run(nil) })
+	var dumped map[string]string
+	err := json.Unmarshal([]byte(out), &dumped)
+	if err != nil {
+		t.Fatalf("-dump-config output is not JSON config: %v:\n%s", err, out)
+	}
+	c, err := jpegVarsFromFlags(flagPreset, flagConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dumped, c.effective()) {
+		t.Errorf("-dump-config: got %v, expected %v", dumped, c.effective())
+	}
+	for name, want := range map[string]string{"RF": "x1^2", "RHI": "2.5", "GF": "sqrt(x1)", "IR3": "1"} {
+		if dumped[name] != want {
+			t.Errorf("-dump-config: %s is %q, expected %q", name, dumped[name], want)
+		}
+	}
+	// dumped configuration loads back the same
+	d, err := jpegVarsFromFlags("", writeConfig(t, out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.effective(), c.effective()) {
+		t.Errorf("dumped config loads as %v, expected %v", d.effective(), c.effective())
+	}
+}
@@ -0,0 +1,114 @@
+package rgba
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lukaszgryglicki/jpegbw"
+)
+
+// monoValueConfigFromEnv - MONOVAL stage, enabled by MONOVAL, MVMODE or on (luma mode by default)
+func monoValueConfigFromEnv(getenv func(string) string, on bool) (*jpegbw.MonoValStage, error) {
+	mode := strings.TrimSpace(strings.ToLower(getenv("MONOVAL")))
+	if mode == "" {
+		mode = strings.TrimSpace(strings.ToLower(getenv("MVMODE")))
+	}
+	if mode == "" {
+		if !on {
+			return nil, nil
+		}
+		mode = "luma"
+	}
+	cfg := jpegbw.NewMonoValStage()
+	switch mode {
+	case "lum", "luma", "gray", "mono", "monovalue":
+		cfg.Mode = "luma"
+	case "linear", "lumalin", "lin":
+		cfg.Mode = "linear"
+	case "hsv":
+		cfg.Mode = "hsv"
+	case "hsl":
+		cfg.Mode = "hsl"
+	case "oklab", "oklch":
+		cfg.Mode = "oklch"
+	default:
+		return nil, fmt.Errorf("MONOVAL/MVMODE must be one of: luma, linear, hsv, hsl, oklch")
+	}
+
+	parse := func(env string, dst *float64, lo, hi float64) error {
+		s := getenv(env)
+		if s == "" {
+			return nil
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		if v < lo || v > hi {
+			return fmt.Errorf("%s must be from %f-%f range", env, lo, hi)
+		}
+		*dst = v
+		return nil
+	}
+	if err := parse("MVT", &cfg.Target, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parse("MVR", &cfg.LumaR, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parse("MVG", &cfg.LumaG, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parse("MVB", &cfg.LumaB, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parse("MVS", &cfg.SatOverride, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if getenv("MVS") != "" {
+		cfg.SatOverrideSet = true
+	}
+	if err := parse("MVC", &cfg.ChromaOverride, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if getenv("MVC") != "" {
+		cfg.ChromaOverrideSet = true
+	}
+
+	tot := cfg.LumaR + cfg.LumaG + cfg.LumaB
+	if tot <= 0.0 {
+		return nil, fmt.Errorf("MVR+MVG+MVB must be positive")
+	}
+	cfg.LumaR /= tot
+	cfg.LumaG /= tot
+	cfg.LumaB /= tot
+
+	gamutMode := strings.TrimSpace(strings.ToLower(getenv("MVGAMUT")))
+	if gamutMode != "" {
+		switch gamutMode {
+		case "fit", "clip":
+			cfg.GamutMode = gamutMode
+		default:
+			return nil, fmt.Errorf("MVGAMUT must be 'fit' or 'clip'")
+		}
+	}
+	zeroMode := strings.TrimSpace(strings.ToLower(getenv("MVZERO")))
+	if zeroMode != "" {
+		switch zeroMode {
+		case "gray", "black":
+			cfg.ZeroMode = zeroMode
+		default:
+			return nil, fmt.Errorf("MVZERO must be 'gray' or 'black'")
+		}
+	}
+	fmt.Printf("MONOVAL enabled: mode=%s target=%f gamut=%s zero=%s weights=(%f,%f,%f)", cfg.Mode, cfg.Target, cfg.GamutMode, cfg.ZeroMode, cfg.LumaR, cfg.LumaG, cfg.LumaB)
+	if cfg.SatOverrideSet {
+		fmt.Printf(" sat=%f", cfg.SatOverride)
+	}
+	if cfg.ChromaOverrideSet {
+		fmt.Printf(" chroma=%f", cfg.ChromaOverride)
+	}
+	fmt.Printf("\n")
+	return cfg, nil
+}
@@ -0,0 +1,1176 @@
+package rgba
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lukaszgryglicki/jpegbw"
+	"github.com/lukaszgryglicki/jpegbw/internal/cli"
+)
+
+// ir3ConfigFromEnv - IR3 stage, enabled by IR3, IR3GONLY or on
+func ir3ConfigFromEnv(getenv func(string) string, on bool) (*jpegbw.IR3Stage, error) {
+	if !on && getenv("IR3") == "" && getenv("IR3GONLY") == "" {
+		return nil, nil
+	}
+	cfg := jpegbw.NewIR3Stage()
+	if getenv("IR3GONLY") != "" {
+		cfg.GreenOnly = true
+	}
+	parseAny := func(envs []string, dst *float64, lo, hi float64) error {
+		for _, env := range envs {
+			s := getenv(env)
+			if s == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return err
+			}
+			if v < lo || v > hi {
+				return fmt.Errorf("%s must be from %f-%f range", env, lo, hi)
+			}
+			*dst = v
+			return nil
+		}
+		return nil
+	}
+	if err := parseAny([]string{"IRRATIO", "IRT"}, &cfg.Threshold, 1.01, 65535.0); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRS"}, &cfg.ShortStrength, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRL"}, &cfg.LongStrength, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRSH"}, &cfg.ShadowFloor, 0.0, 0.99); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRGM"}, &cfg.GreenMid, 0.0, 2.0); err != nil {
+		return nil, err
+	}
+
+	if err := parseAny([]string{"IRSPLIT", "IRSSPLIT"}, &cfg.ShortSplit, 0.01, 0.99); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRSENDR", "IRSHORTENDR"}, &cfg.ShortEndR, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRSENDG", "IRSHORTENDG"}, &cfg.ShortEndG, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRSENDB", "IRSHORTENDB"}, &cfg.ShortEndB, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+
+	if err := parseAny([]string{"IRLSPLIT"}, &cfg.LongSplit, 0.01, 0.99); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRLVR", "IRLONGVIOLETR"}, &cfg.LongVioletR, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRLVG", "IRLONGVIOLETG"}, &cfg.LongVioletG, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRLVB", "IRLONGVIOLETB"}, &cfg.LongVioletB, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRLENDR", "IRLONGENDR"}, &cfg.LongEndR, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRLENDG", "IRLONGENDG"}, &cfg.LongEndG, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRLENDB", "IRLONGENDB"}, &cfg.LongEndB, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+
+	if err := parseAny([]string{"IRGSHORTEND"}, &cfg.GOnlyShortEnd, 0.0, 2.0); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRGLONGMID"}, &cfg.GOnlyLongMid, 0.0, 2.0); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRGLONGEND"}, &cfg.GOnlyLongEnd, 0.0, 2.0); err != nil {
+		return nil, err
+	}
+	if err := parseAny([]string{"IRGLONGSPLIT"}, &cfg.GOnlyLongSplit, 0.01, 0.99); err != nil {
+		return nil, err
+	}
+	fmt.Printf("IR3 enabled: threshold=%f short=%f long=%f shadow=%f gmid=%f green_only=%v\n", cfg.Threshold, cfg.ShortStrength, cfg.LongStrength, cfg.ShadowFloor, cfg.GreenMid, cfg.GreenOnly)
+	return cfg, nil
+}
+
+// isoValConfigFromEnv - ISOVAL stage, enabled by ISOVAL or on (add mode by default)
+func isoValConfigFromEnv(getenv func(string) string, on bool) (*jpegbw.IsoValStage, error) {
+	mode := strings.TrimSpace(strings.ToLower(getenv("ISOVAL")))
+	if mode == "" {
+		if !on {
+			return nil, nil
+		}
+		mode = "add"
+	}
+	cfg := jpegbw.NewIsoValStage()
+	switch mode {
+	case "add", "offset", "shift":
+		cfg.Mode = "add"
+	case "mul", "mult", "multiply", "scale":
+		cfg.Mode = "mul"
+	case "exp", "expo", "exponential":
+		cfg.Mode = "exp"
+	default:
+		return nil, fmt.Errorf("ISOVAL must be one of: add, mul, exp")
+	}
+
+	parse := func(env string, dst *float64, lo, hi float64) error {
+		s := getenv(env)
+		if s == "" {
+			return nil
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		if v < lo || v > hi {
+			return fmt.Errorf("%s must be from %f-%f range", env, lo, hi)
+		}
+		*dst = v
+		return nil
+	}
+
+	if err := parse("IVT", &cfg.Target, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parse("IVR", &cfg.WR, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parse("IVG", &cfg.WG, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parse("IVB", &cfg.WB, 0.0, 1.0); err != nil {
+		return nil, err
+	}
+	if err := parse("IVBASE", &cfg.ExpBase, 1.000001, 1000.0); err != nil {
+		return nil, err
+	}
+
+	clipS := getenv("IVCLIP")
+	if clipS != "" {
+		v, err := strconv.ParseFloat(clipS, 64)
+		if err != nil {
+			return nil, err
+		}
+		if v < 0.0 || v >= 50.0 {
+			return nil, fmt.Errorf("IVCLIP must be from 0-<50 range")
+		}
+		cfg.ClipPct = v
+	}
+
+	fact := cfg.WR + cfg.WG + cfg.WB
+	if fact <= 0.0 {
+		return nil, fmt.Errorf("IVR+IVG+IVB must be positive")
+	}
+	cfg.WR /= fact
+	cfg.WG /= fact
+	cfg.WB /= fact
+
+	autoMode := strings.TrimSpace(strings.ToLower(getenv("IVTAUTO")))
+	switch autoMode {
+	case "":
+		cfg.AutoMode = ""
+	case "avg", "average", "mean":
+		cfg.AutoMode = "avg"
+	case "med", "median":
+		cfg.AutoMode = "p"
+		cfg.AutoPct = 50.0
+	case "min", "minimum", "low":
+		cfg.AutoMode = "min"
+	case "max", "maximum", "high":
+		cfg.AutoMode = "max"
+	default:
+		if strings.HasPrefix(autoMode, "p") && len(autoMode) > 1 {
+			pctS := strings.TrimSuffix(autoMode[1:], "%")
+			pct, err := strconv.ParseFloat(pctS, 64)
+			if err != nil {
+				return nil, fmt.Errorf("IVTAUTO percentile '%s' is invalid", autoMode)
+			}
+			if pct < 0.0 || pct > 100.0 {
+				return nil, fmt.Errorf("IVTAUTO percentile must be from 0-100, got %f", pct)
+			}
+			cfg.AutoMode = "p"
+			cfg.AutoPct = pct
+		} else {
+			return nil, fmt.Errorf("IVTAUTO must be one of: avg, med, min, max, pNN")
+		}
+	}
+	autoLabel := cfg.AutoLabel()
+	if cfg.AutoMode == "" {
+		if cfg.Mode == "exp" {
+			fmt.Printf("ISOVAL enabled: mode=%s target=%f base=%f weights=(%f,%f,%f)\n", cfg.Mode, cfg.Target, cfg.ExpBase, cfg.WR, cfg.WG, cfg.WB)
+		} else {
+			fmt.Printf("ISOVAL enabled: mode=%s target=%f weights=(%f,%f,%f)\n", cfg.Mode, cfg.Target, cfg.WR, cfg.WG, cfg.WB)
+		}
+	} else {
+		if cfg.Mode == "exp" {
+			fmt.Printf("ISOVAL enabled: mode=%s target=auto(%s) clip=%f%% base=%f weights=(%f,%f,%f)\n", cfg.Mode, autoLabel, cfg.ClipPct, cfg.ExpBase, cfg.WR, cfg.WG, cfg.WB)
+		} else {
+			fmt.Printf("ISOVAL enabled: mode=%s target=auto(%s) clip=%f%% weights=(%f,%f,%f)\n", cfg.Mode, autoLabel, cfg.ClipPct, cfg.WR, cfg.WG, cfg.WB)
+		}
+	}
+	return cfg, nil
+}
+
+// jpegConfig - settings common to all stages
+type jpegConfig struct {
+	jpegq        int
+	pngq         png.CompressionLevel
+	thrN         int
+	overB        bool
+	overFrom     string
+	overTo       string
+	inf          int
+	einf         bool
+	infPow       float64
+	useHints     bool
+	hintRequired bool
+	noA          bool
+}
+
+// jpegConfigFromEnv - quality, threads, file name override, info, hints and alpha settings
+func jpegConfigFromEnv(getenv func(string) string) (*jpegConfig, error) {
+	cfg := &jpegConfig{}
+	// JPEG Quality
+	jpegqStr := getenv("Q")
+	cfg.jpegq = -1
+	if jpegqStr != "" {
+		v, err := strconv.Atoi(jpegqStr)
+		if err != nil {
+			return nil, err
+		}
+		if v < 1 || v > 100 {
+			return nil, fmt.Errorf("Q must be from 1-100 range")
+		}
+		cfg.jpegq = v
+	}
+
+	// PNG Quality
+	pngqStr := getenv("PQ")
+	cfg.pngq = png.DefaultCompression
+	if pngqStr != "" {
+		v, err := strconv.Atoi(pngqStr)
+		if err != nil {
+			return nil, err
+		}
+		if v < 0 || v > 3 {
+			return nil, fmt.Errorf("PQ must be from 0-3 range")
+		}
+		cfg.pngq = png.CompressionLevel(-v)
+	}
+
+	// Threads
+	thrsS := getenv("N")
+	thrs := -1
+	if thrsS != "" {
+		t, err := strconv.Atoi(thrsS)
+		if err != nil {
+			return nil, err
+		}
+		thrs = t
+	}
+	cfg.thrN = thrs
+	if thrs < 0 {
+		cfg.thrN = runtime.NumCPU()
+	}
+	runtime.GOMAXPROCS(cfg.thrN)
+
+	// Override file name config
+	overS := getenv("O")
+	if overS != "" {
+		ary := strings.Split(overS, ":")
+		if len(ary) != 2 {
+			return nil, fmt.Errorf("bad override filename config: %s", overS)
+		}
+		cfg.overFrom = ary[0]
+		cfg.overTo = ary[1]
+		cfg.overB = true
+	}
+
+	// Additional in-image info: R,G,B,G scale to the right and RGB histogram on the bottom
+	cfg.einf = getenv("EINF") != ""
+	infS := getenv("INF")
+	if infS != "" {
+		in, err := strconv.Atoi(infS)
+		if err != nil {
+			return nil, err
+		}
+		cfg.inf = in
+		shpowS := getenv("HPOW")
+		if shpowS != "" {
+			v, err := strconv.ParseFloat(shpowS, 64)
+			if err != nil {
+				return nil, err
+			}
+			if v < 0.05 || v > 20.0 {
+				return nil, fmt.Errorf("HPOW must be from 0.05-20 range")
+			}
+			cfg.infPow = v
+		}
+	}
+
+	// Hint mode
+	cfg.useHints = getenv("HINT") != ""
+	cfg.hintRequired = getenv("HINTREQ") != ""
+
+	// No alpha processing
+	cfg.noA = getenv("NA") != ""
+	return cfg, nil
+}
+
+// chanStages - per channel stages: mix, stretch, gamma, functions and contours, stages not used are nil
+type chanStages struct {
+	mix     *jpegbw.MixStage
+	stretch *jpegbw.StretchStage
+	gamma   *jpegbw.GammaStage
+	fun     *jpegbw.FuncStage
+	cont    *jpegbw.ContourStage
+}
+
+// chanStagesFromEnv - per channel stages set by env variables (most of them with R, G, B or A prefix)
+// Functions are compiled in copies of mfctx
+func chanStagesFromEnv(getenv func(string) string, mfctx *jpegbw.FparCtx, cfg *jpegConfig) (*chanStages, error) {
+	// RGBA arrays
+	rgba := [4]string{"R", "G", "B", "A"}
+	var (
+		fctx    [4]*jpegbw.FparCtx
+		bFun    [4]bool
+		useImag [4]bool
+		ar      [4]float64
+		ag      [4]float64
+		ab      [4]float64
+		alo     [4]float64
+		aloi    [4]uint16
+		ahi     [4]float64
+		ahii    [4]uint16
+		aga     [4]float64
+		agaB    [4]bool
+		acl     [4]int
+		acont   [4]uint16
+		aedge   [4]uint16
+		asurf   [4]uint16
+		agcont  [4]bool
+	)
+
+	// Global contour setting
+	bGlobCont := false
+	conti := uint16(0)
+	contS := getenv("CONT")
+	if contS != "" {
+		v, err := strconv.Atoi(contS)
+		if err != nil {
+			return nil, err
+		}
+		if v < 1 || v > 0x3fff {
+			return nil, fmt.Errorf("CONT must be from 0001-3FFF range")
+		}
+		conti = uint16(v)
+	}
+	if conti > 0 {
+		bGlobCont = true
+		acont = [4]uint16{conti, conti, conti, conti}
+	}
+
+	// Edge and surface modes
+	// 0 - 0
+	// 1 - 1
+	// 2 - original value
+	// 3 - inverted
+	// Defaults
+	// EDGE=1 SURF=0
+	bGlobEdge := false
+	edge := uint16(1)
+	edgeS := getenv("EDGE")
+	if edgeS != "" {
+		v, err := strconv.Atoi(edgeS)
+		if err != nil {
+			return nil, err
+		}
+		if v < 0 || v > 3 {
+			return nil, fmt.Errorf("EDGE must be from [0, 1, 2, 3]")
+		}
+		edge = uint16(v)
+		bGlobEdge = true
+		aedge = [4]uint16{edge, edge, edge, edge}
+	}
+	bGlobSurf := false
+	surf := uint16(0)
+	surfS := getenv("SURF")
+	if surfS != "" {
+		v, err := strconv.Atoi(surfS)
+		if err != nil {
+			return nil, err
+		}
+		if v < 0 || v > 3 {
+			return nil, fmt.Errorf("SURF must be from [0, 1, 2, 3]")
+		}
+		surf = uint16(v)
+		bGlobSurf = true
+		asurf = [4]uint16{surf, surf, surf, surf}
+	}
+	bGlobGCont := false
+	gcont := false
+	gcontS := getenv("GCONT")
+	if gcontS != "" {
+		v, err := strconv.Atoi(gcontS)
+		if err != nil {
+			return nil, err
+		}
+		if v < 0 || v > 1 {
+			return nil, fmt.Errorf("GCONT must be from [0, 1]")
+		}
+		if v == 1 {
+			gcont = true
+		}
+		bGlobGCont = true
+		agcont = [4]bool{gcont, gcont, gcont, gcont}
+	}
+
+	// No lookup tables for functions using only x1
+	noLUT := getenv("NL") != ""
+
+	// No evaluation of the whole column at once (function is called per pixel)
+	noRows := getenv("NR") != ""
+
+	// Function cache size
+	cs := jpegbw.DefaultCacheSize
+	csS := getenv("CS")
+	if csS != "" {
+		v, err := strconv.Atoi(csS)
+		if err != nil {
+			return nil, err
+		}
+		if v < 1 {
+			return nil, fmt.Errorf("CS (cache size) must be positive")
+		}
+		cs = v
+	}
+
+	// All colors mult (will keep smallest low index, biggest high index and calculate mult accoring to that)
+	acm := getenv("ACM") != ""
+	acmFact := 0.0
+	if acm {
+		acmS := getenv("ACM")
+		v, err := strconv.ParseFloat(acmS, 64)
+		if err != nil {
+			return nil, err
+		}
+		if v < 0.0 || v > 1.0 {
+			return nil, fmt.Errorf("ACM must be from 0-1 range")
+		}
+		acmFact = v
+	}
+
+	// Channel mix and percentile stretch stages, filled per color
+	mix := &jpegbw.MixStage{}
+	stretch := &jpegbw.StretchStage{ACM: acm, ACMFactor: acmFact}
+
+	// Process colors
+	for colidx, colrgba := range rgba {
+		if cfg.noA && colidx == 3 {
+			continue
+		}
+
+		// Per color cache level 0-4, auto if not set
+		clS := getenv(colrgba + "C")
+		cl := -1
+		if clS != "" {
+			v, err := strconv.Atoi(clS)
+			if err != nil {
+				return nil, err
+			}
+			if v < 0 || v > 4 {
+				return nil, fmt.Errorf("C (cache level) must be from 0-4 range")
+			}
+			cl = v
+		}
+
+		fun := getenv(colrgba + "F")
+		bFun[colidx] = false
+		if fun != "" {
+			fc := mfctx.Cpy()
+			fctx[colidx] = &fc
+			err := fctx[colidx].FparFunction(fun)
+			if err != nil {
+				return nil, err
+			}
+			err = fctx[colidx].FparOK(5)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Printf("%sF: %s\n", colrgba, fctx[colidx].String())
+			if cl < 0 {
+				// x2 is pixel position, so caching anything that depends on it would never hit
+				// builtin functions are cheaper to evaluate than cache lookup
+				cl = fctx[colidx].CacheLevel()
+				if cl >= 2 || !fctx[colidx].External() {
+					cl = 0
+				}
+				if cl > 0 {
+					fmt.Printf("%s: using cache level %d\n", colrgba, cl)
+				}
+			}
+			fctx[colidx].SetCacheSize(cl, cs)
+			// NX (evaluate real functions as complex, results are the same)
+			fctx[colidx].SetRealPath(getenv("NX") == "")
+			bFun[colidx] = true
+		}
+		// I (use imaginary part of function result instead of real)
+		useImag[colidx] = getenv(colrgba+"I") != ""
+
+		// ENV
+		// R red
+		rS := getenv(colrgba + "R")
+		r := 1.0
+		if rS != "" {
+			v, err := strconv.ParseFloat(rS, 64)
+			if err != nil {
+				return nil, err
+			}
+			r = v
+		}
+
+		// G green
+		gS := getenv(colrgba + "G")
+		g := 1.0
+		if gS != "" {
+			v, err := strconv.ParseFloat(gS, 64)
+			if err != nil {
+				return nil, err
+			}
+			g = v
+		}
+
+		// B blue
+		bS := getenv(colrgba + "B")
+		b := 1.0
+		if bS != "" {
+			v, err := strconv.ParseFloat(bS, 64)
+			if err != nil {
+				return nil, err
+			}
+			b = v
+		}
+		fact := r + g + b
+		if fact <= 0 {
+			r = 0.0
+			g = 0.0
+			b = 0.0
+		} else {
+			r /= fact
+			g /= fact
+			b /= fact
+		}
+
+		// LO
+		loS := getenv(colrgba + "LO")
+		lo := 0.0
+		if loS != "" {
+			v, err := strconv.ParseFloat(loS, 64)
+			if err != nil {
+				return nil, err
+			}
+			if v < 0.0 || v > 100.0 {
+				return nil, fmt.Errorf("LO must be from 0-100 range")
+			}
+			lo = v
+		}
+
+		// LOI
+		loS = getenv(colrgba + "LOI")
+		loi := uint16(0)
+		if loS != "" {
+			v, err := strconv.Atoi(loS)
+			if err != nil {
+				return nil, err
+			}
+			if v < 1 || v > 0xffff {
+				return nil, fmt.Errorf("LOI must be from 0001-FFFF range")
+			}
+			loi = uint16(v)
+		}
+
+		// HI
+		hiS := getenv(colrgba + "HI")
+		hi := 0.0
+		if hiS != "" {
+			v, err := strconv.ParseFloat(hiS, 64)
+			if err != nil {
+				return nil, err
+			}
+			if v < 0.0 || v > 100.0 {
+				return nil, fmt.Errorf("HI must be from 0-100 range")
+			}
+			hi = v
+		}
+		hiPct := hi
+		hi = 100 - hi
+		if lo >= hi {
+			return nil, fmt.Errorf("invalid lo-hi range: %f%% - %f%%", lo, hi)
+		}
+
+		// HII
+		hiS = getenv(colrgba + "HII")
+		hii := uint16(0xffff)
+		if hiS != "" {
+			v, err := strconv.Atoi(hiS)
+			if err != nil {
+				return nil, err
+			}
+			if v < 0 || v > 0xfffe {
+				return nil, fmt.Errorf("HII must be from 0000-FFFE range")
+			}
+			hii = uint16(v)
+		}
+
+		// GA gamma
+		gaS := getenv(colrgba + "GA")
+		ga := 1.0
+		gaB := false
+		if gaS != "" {
+			v, err := strconv.ParseFloat(gaS, 64)
+			if err != nil {
+				return nil, err
+			}
+			ga = v
+			gaB = true
+		}
+
+		// CONT
+		conti := uint16(0)
+		if !bGlobCont {
+			contS := getenv(colrgba + "CONT")
+			if contS != "" {
+				v, err := strconv.Atoi(contS)
+				if err != nil {
+					return nil, err
+				}
+				if v < 1 || v > 0x3fff {
+					return nil, fmt.Errorf("CONT must be from 0001-3FFF range")
+				}
+				conti = uint16(v)
+			}
+		}
+
+		// SURF and EDGE
+		edge := uint16(1)
+		if !bGlobEdge {
+			edgeS := getenv(colrgba + "EDGE")
+			if edgeS != "" {
+				v, err := strconv.Atoi(edgeS)
+				if err != nil {
+					return nil, err
+				}
+				if v < 0 || v > 3 {
+					return nil, fmt.Errorf("EDGE must be from [0, 1, 2, 3]")
+				}
+				edge = uint16(v)
+			}
+		}
+		surf := uint16(0)
+		if !bGlobSurf {
+			surfS := getenv(colrgba + "SURF")
+			if surfS != "" {
+				v, err := strconv.Atoi(surfS)
+				if err != nil {
+					return nil, err
+				}
+				if v < 0 || v > 3 {
+					return nil, fmt.Errorf("SURF must be from [0, 1, 2, 3]")
+				}
+				surf = uint16(v)
+			}
+		}
+		gcont := false
+		if !bGlobGCont {
+			gcontS := getenv(colrgba + "GCONT")
+			if gcontS != "" {
+				v, err := strconv.Atoi(gcontS)
+				if err != nil {
+					return nil, err
+				}
+				if v < 0 || v > 1 {
+					return nil, fmt.Errorf("GCONT must be from [0, 1]")
+				}
+				if v == 1 {
+					gcont = true
+				}
+			}
+		}
+		ar[colidx] = r
+		ag[colidx] = g
+		ab[colidx] = b
+		mix.Weights[colidx] = [3]float64{r, g, b}
+		stretch.Lo[colidx] = lo
+		stretch.Hi[colidx] = hiPct
+		stretch.LoIdx[colidx] = loi
+		stretch.HiIdx[colidx] = hii
+		alo[colidx] = lo
+		aloi[colidx] = loi
+		acl[colidx] = cl
+		ahi[colidx] = hi
+		ahii[colidx] = hii
+		agaB[colidx] = gaB
+		aga[colidx] = ga
+		if !bGlobCont {
+			acont[colidx] = conti
+		}
+		if !bGlobEdge {
+			aedge[colidx] = edge
+		}
+		if !bGlobSurf {
+			asurf[colidx] = surf
+		}
+		if !bGlobGCont {
+			agcont[colidx] = gcont
+		}
+
+		fmt.Printf(
+			"Final %s RGB multiplier: %f(%f, %f, %f), range %f%% - %f%%, idx range: %04x-%04x, cont: %d/%v, surf/edge: %d/%d, quality: %d, gamma: (%v, %f), cache: %d, threads: %d, override: %v,%s,%s\n",
+			colrgba, fact, ar[colidx], ag[colidx], ab[colidx], alo[colidx], ahi[colidx], aloi[colidx], ahii[colidx], acont[colidx], agcont[colidx], asurf[colidx], aedge[colidx],
+			cfg.jpegq, agaB[colidx], aga[colidx], acl[colidx], cfg.thrN, cfg.overB, cfg.overFrom, cfg.overTo,
+		)
+	}
+
+	ch := &chanStages{mix: mix, stretch: stretch}
+	gamma := &jpegbw.GammaStage{}
+	fun := &jpegbw.FuncStage{Imag: useImag, NoLUT: noLUT, NoRows: noRows}
+	for colidx := range rgba {
+		if agaB[colidx] {
+			gamma.Gamma[colidx] = &aga[colidx]
+			ch.gamma = gamma
+		}
+		if bFun[colidx] {
+			fun.Func[colidx] = fctx[colidx]
+			ch.fun = fun
+		}
+		if acont[colidx] > 0 {
+			ch.cont = &jpegbw.ContourStage{Count: acont, Edge: aedge, Surf: asurf, Global: agcont}
+		}
+	}
+	return ch, nil
+}
+
+// gsConfigFromEnv - grayscale output stage, enabled by OGS or on
+func gsConfigFromEnv(getenv func(string) string, on bool) (*jpegbw.GSStage, error) {
+	// Grayscale output
+	if !on && getenv("OGS") == "" {
+		return nil, nil
+	}
+	// R red
+	rS := getenv("GSR")
+	r := 1.0
+	if rS != "" {
+		v, err := strconv.ParseFloat(rS, 64)
+		if err != nil {
+			return nil, err
+		}
+		r = v
+	}
+
+	// G green
+	gS := getenv("GSG")
+	g := 1.0
+	if gS != "" {
+		v, err := strconv.ParseFloat(gS, 64)
+		if err != nil {
+			return nil, err
+		}
+		g = v
+	}
+
+	// B blue
+	bS := getenv("GSB")
+	b := 1.0
+	if bS != "" {
+		v, err := strconv.ParseFloat(bS, 64)
+		if err != nil {
+			return nil, err
+		}
+		b = v
+	}
+	fact := r + g + b
+	if fact <= 0 {
+		r = 0.0
+		g = 0.0
+		b = 0.0
+	} else {
+		r /= fact
+		g /= fact
+		b /= fact
+	}
+	fmt.Printf("Enabling GS output: %f,%f,%f\n", r, g, b)
+	return &jpegbw.GSStage{R: r, G: g, B: b}, nil
+}
+
+// images2RGBA: convert given images to bw: iname.ext -> co_iname.ext, dir/iname.ext -> dir/co_iname.ext
+// Other parameters are set via env variables (see helpStr, it describes all env params):
+func images2RGBA(getenv func(string) string, args []string) error {
+	cfg, err := jpegConfigFromEnv(getenv)
+	if err != nil {
+		return err
+	}
+
+	// LUTS - curves used by lut("name", x), loaded once and shared by all functions
+	err = jpegbw.LoadLUTs(getenv("LUTS"))
+	if err != nil {
+		return err
+	}
+
+	// Main library context
+	var mfctx jpegbw.FparCtx
+	lib := getenv("LIB")
+	if lib != "" {
+		nf := 128
+		nfs := getenv("NF")
+		if nfs != "" {
+			v, err := strconv.Atoi(nfs)
+			if err != nil {
+				return err
+			}
+			if v < 1 || v > 0xffff {
+				return fmt.Errorf("NF must be from 1-65535 range")
+			}
+			nf = v
+		}
+		err := mfctx.Init(lib, uint(nf))
+		if err != nil {
+			return fmt.Errorf("LIB init failed: %w", err)
+		}
+		defer func() { mfctx.Tidy() }()
+	}
+
+	// Stages in STAGES order or in the default order
+	stages, funcs, err := stagesFromEnv(getenv, &mfctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, fs := range funcs {
+			fs.fctx.Tidy()
+		}
+	}()
+	pipe := jpegbw.Pipeline{Stages: stages, Channels: 4, Threads: cfg.thrN, Info: cfg.inf, InfoExt: cfg.einf, InfoPow: cfg.infPow}
+	if cfg.noA {
+		pipe.Channels = 3
+	}
+	rgba := [4]string{"R", "G", "B", "A"}
+
+	// Flushing before endline
+	flush := bufio.NewWriter(os.Stdout)
+
+	// Iterate given files
+	n := len(args)
+	for k, fn := range args {
+		dtStart := time.Now()
+		fk := float64(k) / float64(n)
+		fmt.Printf("%d/%d %s...", k+1, n, fn)
+		_ = flush.Flush()
+
+		// Input
+		dtStartI := time.Now()
+
+		// Hints
+		opts := jpegbw.FrameOpts{Seq: fk}
+		if cfg.useHints {
+			data, err := ioutil.ReadFile(fn + ".hint")
+			if err != nil {
+				if cfg.hintRequired {
+					return err
+				}
+				fmt.Printf("Missing hint file: %s.hint\n", fn)
+			} else {
+				var hint jpegbw.HintData
+				err = json.Unmarshal(data, &hint)
+				if err != nil {
+					if cfg.hintRequired {
+						return err
+					}
+					fmt.Printf("Invalid hint file: %s.hint\n", fn)
+				} else {
+					opts.Hint = &hint
+					// info: fmt.Printf("Hint: %+v\n", hint)
+				}
+			}
+		}
+
+		// Image
+		reader, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+
+		// Decode input
+		m, _, err := image.Decode(reader)
+		if err != nil {
+			_ = reader.Close()
+			return err
+		}
+		err = reader.Close()
+		if err != nil {
+			return err
+		}
+		bounds := m.Bounds()
+		x := bounds.Max.X
+		y := bounds.Max.Y
+		if cfg.inf > 0 {
+			fmt.Printf(" (%d/%d x %d/%d)...", x, x+cfg.inf, y, y+2*cfg.inf)
+		} else {
+			fmt.Printf(" (%d x %d)...", x, y)
+		}
+		dtEndI := time.Now()
+		_ = flush.Flush()
+
+		// Convert
+		t, st, err := pipe.ProcessFrame(context.Background(), m, opts)
+		if err != nil {
+			return err
+		}
+		for colidx, colrgba := range rgba {
+			if !st.Ranged[colidx] {
+				continue
+			}
+			r := st.Ranges[colidx]
+			fmt.Printf(" %s: (%d, %d) int: (%d, %d) mult: %f...", colrgba, r.Min, r.Max, r.Lo, r.Hi, r.Mult)
+		}
+		for _, note := range st.Notes {
+			fmt.Print(note)
+		}
+		_ = flush.Flush()
+
+		// Eventual file name override
+		ifn := fn
+		if cfg.overB {
+			ifn = strings.Replace(fn, cfg.overFrom, cfg.overTo, -1)
+		}
+		// info: fmt.Printf("filename: %s -> %s\n", fn, ifn)
+
+		// Output name
+		ary := strings.Split(ifn, "/")
+		lAry := len(ary)
+		last := ary[lAry-1]
+		ary[lAry-1] = "co_" + last
+		ofn := strings.Join(ary, "/")
+		fi, err := os.Create(ofn)
+		if err != nil {
+			return err
+		}
+		lfn := strings.ToLower(ifn)
+		// info: fmt.Printf("output filename: %s, lower case %s\n", ofn, lfn)
+
+		// Output write
+		dtStartO := time.Now()
+		var ierr error
+		if strings.Contains(lfn, ".png") {
+			enc := png.Encoder{CompressionLevel: cfg.pngq}
+			ierr = enc.Encode(fi, t)
+		} else if strings.Contains(lfn, ".jpg") || strings.Contains(lfn, ".jpeg") {
+			var jopts *jpeg.Options
+			if cfg.jpegq >= 0 {
+				jopts = &jpeg.Options{Quality: cfg.jpegq}
+			}
+			ierr = jpeg.Encode(fi, t, jopts)
+		} else if strings.Contains(lfn, ".gif") {
+			ierr = gif.Encode(fi, t, nil)
+		}
+		if ierr != nil {
+			_ = fi.Close()
+			return ierr
+		}
+		err = fi.Close()
+		if err != nil {
+			return err
+		}
+		dtEnd := time.Now()
+		fmt.Printf(
+			" %s (time %v, load %v, hist %v, calc %v, save %v, MPPS: %.3f)\n",
+			ofn, dtEnd.Sub(dtStart), dtEndI.Sub(dtStartI), st.Hist, st.Calc, dtEnd.Sub(dtStartO), st.MPPS(),
+		)
+	}
+
+	// Function cache statistics
+	for _, fs := range funcs {
+		st := fs.fctx.CacheStats()
+		all := st.Hits + st.Misses
+		if all == 0 {
+			continue
+		}
+		fmt.Printf(
+			"%s cache: hits: %d, misses: %d, hit ratio: %.2f%%, evictions: %d, entries: %d/%d\n",
+			fs.name, st.Hits, st.Misses, float64(st.Hits)*100.0/float64(all), st.Evictions, st.Entries, st.Capacity,
+		)
+	}
+	return nil
+}
+
+// Flags: -config, -preset, -dump-config, -presets
+var (
+	flagConfig     string
+	flagPreset     string
+	flagDumpConfig bool
+	flagPresets    bool
+)
+
+// Command - rgba subcommand: processes R, G, B, A channels of images
+var Command = &cli.Command{
+	Name:    "rgba",
+	Args:    "image...",
+	Summary: "processes R, G, B, A channels of images (mix, stretch, functions, IR3, MONOVAL, ISOVAL, ... stages): iname.ext -> co_iname.ext",
+	Help:    helpStr,
+	Flags:   []cli.Flag{cli.Quality, cli.PNGQuality, cli.Threads, cli.Lib, cli.LUTs},
+	Setup: func(fs *flag.FlagSet) {
+		fs.StringVar(&flagConfig, "config", "", "JSON config file with env variables, env variables override its values")
+		fs.StringVar(&flagPreset, "preset", "", "built-in preset (see -presets), -config file values override its values")
+		fs.BoolVar(&flagDumpConfig, "dump-config", false, "print effective configuration (preset, config file and env) as JSON config file and exit")
+		fs.BoolVar(&flagPresets, "presets", false, "list built-in presets and exit")
+	},
+	Run: run,
+}
+
+// run - processes images using configuration from flags, presets, config file and env variables
+func run(args []string) error {
+	dtStart := time.Now()
+	if flagPresets {
+		return printPresets()
+	}
+	vars, err := jpegVarsFromFlags(flagPreset, flagConfig)
+	if err != nil {
+		return err
+	}
+	if flagDumpConfig {
+		return vars.dump()
+	}
+	if len(args) == 0 {
+		return cli.Usagef("please provide at least one image to convert")
+	}
+	err = images2RGBA(vars.getenv, args)
+	if err != nil {
+		return err
+	}
+	dtEnd := time.Now()
+	fmt.Printf("Time: %v\n", dtEnd.Sub(dtStart))
+	return nil
+}
+
+// helpStr - config files and env variables
+const helpStr = `
+Config files (-config file.json) and presets (-preset name, -presets lists them):
+  config file is JSON object with env variables: {"preset": "ir3-v4", "IRT": 3, "RLO": "2", "NA": true}
+  "preset" is optional and names a preset the file extends, values can be strings, numbers or booleans (false unsets variable)
+  Precedence: flags > env variables (also set to empty value) > config file > preset > built-in defaults
+Environment variables:
+This program manipulates 4 channels R, G, B, A.
+When you see X replace it with R, G, B or A.
+NA - skip alpha calculation, alpha will be 1 everywhere
+OGS - create grayscale output
+GSR - when OGS output, use this amount of R to generate final GS pixel
+GSG - when OGS output, use this amount of G to generate final GS pixel
+GSB - when OGS output, use this amount of B to generate final GS pixel
+(GSR+GSG+GSB) when OGS output - will be normalized to sum to 1, so their sum must be positive
+ACM - all colors multiplier mode - will calculate minimum index in all RGBA (4 channels), max in RGBA and then mult from this range
+ACM - you can set variable ACM value from ACM=0 (as if it is not specified) to ACM=1, ACM=0.5 will do average between ACM and non-ACM mode
+HINT - use hints saved for every file "file.ext" - "file.ext.hint", if no hint is given warning is displayed
+HINTREQ - make hint file required
+Q - jpeg quality 1-100, will use library default if not specified
+PQ - png quality 0-3 (0 is default): 0=DefaultCompression, 1=NoCompression, 2=BestSpeed, 3=BestCompression
+XR - relative red usage for generating gray pixel, 1 if not specified
+XG - relative green usage for generating gray pixel, 1 if not specified
+XB - relative blue usage for generating gray pixel, 1 if not specified
+(R+G+B) will be normalized to sum to 1, so their sum must be positive
+R=0.2125 G=0.7154 B=0.0721 is a suggested configuration
+XLO - when calculating intensity range, discard values than are in this lower %, for example 3
+XHI - when calculating intensity range, discard values that are in this higher %, for example 3
+XLOI - when calculating intensity range, discard values than are lower than this (range is 0000-FFFF)
+XHII - when calculating intensity range, discard values that are higher than this (range is 0000-FFFF)
+XGA - gamma default 1, which uses straight line (0,0) -> (1,1), if set uses (x,y)->(x,pow(x, GA)) mapping
+XCONT - hanlde countour lines, RCONT=10 will draw 10 countour lines for red color
+CONT - set countours to the same value for all R, G, B, A channels
+EDGE - in countour algorithm, set edge mode: 0, 1, 2 (original), 3 (invert)
+SURF - in countour algorithm, set surface (non-edge) mode: 0, 1, 2 (original), 3 (invert)
+GCONT - set global contours mode, if set contour is detected when R, G, B or A detects contour
+XGCONT - set global contour for one color say RGCONT=1 (red will detect contour when R, G, B, A has contour)
+XEDGE, XSURF, XGCONT - set per color EDGE/SURF/GCONT params (unless global specified)
+XF - function to apply on final 0-1 range, for example "sin(x1*2)+cos(x1*3)"
+XC - function cache level (0-no cache, 1-1st arg caching, 2-1st and 2nd arg caching, ... 4 - 4 args caching), if not set: 1 for functions using only x1 and calling LIB functions, 0 otherwise
+LIB - if F is used and F calls external functions, thery need to be loaded for this C library
+NF - set maximum number of distinct functions in the parser, if not set, default 128 is used
+LUTS - curves for lut("name", x) in XF functions, ':' separated name=file list, files are CSV or 1D .cube, example: "film=film.csv:soft=soft.cube"
+XI - use imaginary part of fuction return value instead of real, use like I=1
+CS - maximum number of cached function values per color (when XC is used), default 1048576
+NL - do not precompute lookup tables for XF functions using only x1 (they are used by default)
+NR - do not evaluate XF functions for the whole column at once, call them per pixel (functions using x5 are always called per pixel)
+NX - evaluate XF functions in complex numbers even if they are real (by default real functions of real arguments are evaluated in float64, results are the same)
+N - set number of CPUs to process data
+O - eventual overwite file name config, example: ".jpg:.png"
+INF - set additional info on image size is N when INF=N
+EINF - more complex info.
+HPOW - INF histogram 0-0x10000 --> 0-1 --> x. f(x) = pow(x, HPOW). Default 1
+REV - reverse the calculation
+MONOVAL / MVMODE - final mono-value stage, one of: luma, linear, hsv, hsl, oklch
+  luma   - flatten the same weighted channel-value measure that jpeg/jpegbw grayscale uses
+  linear - flatten linear-RGB luminance using MVR/MVG/MVB weights
+  hsv    - keep hue and saturation, replace HSV value with MVT
+  hsl    - keep hue and saturation, replace HSL lightness with MVT
+  oklch  - keep OKLCh hue/chroma, replace OK lightness with MVT, optionally gamut-fit
+MVT - target flattened value/lightness/luminance, 0-1, default 0.5
+MVR/MVG/MVB - weights for luma/linear modes, default 0.2126/0.7152/0.0722, normalized internally
+MVGAMUT - fit or clip, default fit. fit reduces chroma to stay inside gamut
+MVZERO - gray or black, default gray. controls undefined-hue / zero-luma pixels in luma/linear modes
+MVS - optional saturation override for hsv/hsl modes. if unset, original saturation is preserved
+MVC - optional chroma override for oklch mode. if unset, original chroma is preserved
+ISOVAL - equalize weighted RGB value/lightness across the image, modes: add, mul or exp
+  add - adds/subtracts the same delta to R,G,B so IVR*R+IVG*G+IVB*B reaches IVT (with clipping)
+  mul - multiplies/divides R,G,B by the same factor so IVR*R+IVG*G+IVB*B reaches IVT (with clipping)
+  exp - exponential-space equalization:
+        outC = IVBASE^(inC + shift), with the same shift for R,G,B in a pixel,
+        solved so IVR*R+IVG*G+IVB*B reaches IVT (with clipping)
+IVT - ISOVAL target value 0-1, default 0.5, ignored when IVTAUTO is set
+IVTAUTO - automatic ISOVAL target selection:
+  avg - use trimmed average weighted value of the current image before ISOVAL
+  med - alias for p50
+  pNN - percentile target, examples: p25, p50, p75, p90, p99.5
+  max - for add: largest target without upper clipping after IVCLIP trimming,
+        for mul: largest target without overflow after IVCLIP trimming,
+        for exp: largest target without overflow after IVCLIP trimming
+  min - for add: smallest target without lower clipping after IVCLIP trimming,
+        for mul: 0,
+        for exp: 0
+IVCLIP - trim / outlier-ignore percentage for IVTAUTO, default 0, range 0-<50
+  avg/med/pNN discard IVCLIP%% low and IVCLIP%% high tails from the value histogram first
+  max ignores the most restrictive IVCLIP%% of safe upper-bound pixels
+  min ignores the most restrictive IVCLIP%% of safe lower-bound pixels in add mode
+IVR/IVG/IVB - ISOVAL value weights, default 0.2126/0.7152/0.0722, normalized internally
+IVBASE - base for ISOVAL=exp, must be > 1, default 2.0
+Note: in add mode there may be no single target that avoids both upper and lower clipping for the whole image.
+Note: in mul mode pixels with weighted value 0 are left unchanged.
+Note: in exp mode black pixels do not stay black unless IVT resolves to 0.
+STAGES - stages order, comma separated list of: mix, stretch, gamma, f, rev, cont, ir3, monoval, isoval, gs
+  if not set, this order is used with stages enabled by their env variables (XGA, XF, REV, XCONT, IR3, MONOVAL, ISOVAL, OGS)
+  listed stages are always used (ir3 with default v4 settings, monoval in luma mode, isoval in add mode), not listed are skipped
+  stage can be listed more than once, stage(VAR=value;VAR=value) sets env variables only for this stage, example:
+  STAGES="mix,stretch,isoval(ISOVAL=mul;IVT=0.4),f,ir3,ir3(IRT=1.5;IRS=0.5)"
+  values with ',', ';' or ')' must be in double quotes: STAGES='mix,stretch,f(RF="a = x1; a*2")'
+  mix, stretch, gamma, f and cont use per color variables (XR, XLO, XGA, XF, XCONT, ...), stretch also uses ACM
+`
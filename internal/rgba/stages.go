@@ -0,0 +1,253 @@
+package rgba
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lukaszgryglicki/jpegbw"
+)
+
+// stageNames - jpeg stages in the default order, STAGES can list them in any order and more than once
+var stageNames = []string{"mix", "stretch", "gamma", "f", "rev", "cont", "ir3", "monoval", "isoval", "gs"}
+
+// stageAliases - other stage names accepted in STAGES
+var stageAliases = map[string]string{
+	"ga":        "gamma",
+	"fun":       "f",
+	"func":      "f",
+	"contour":   "cont",
+	"contours":  "cont",
+	"mono":      "monoval",
+	"monovalue": "monoval",
+	"iso":       "isoval",
+	"ogs":       "gs",
+}
+
+// stageSpec - stage instance from STAGES: name and env variables set only for this instance (params is their text)
+type stageSpec struct {
+	name   string
+	params string
+	env    map[string]string
+}
+
+// lookup - env lookup of stage instance, instance's own variables are used first
+func (s *stageSpec) lookup(getenv func(string) string) func(string) string {
+	return func(name string) string {
+		v, ok := s.env[name]
+		if ok {
+			return v
+		}
+		return getenv(name)
+	}
+}
+
+// funcStat - compiled function of R, G, B or A channel (for cache statistics)
+type funcStat struct {
+	name string
+	fctx *jpegbw.FparCtx
+}
+
+// splitTop - splits s on sep that is not inside parentheses or double quotes
+func splitTop(s string, sep byte) ([]string, error) {
+	var (
+		parts []string
+		depth int
+		quote bool
+	)
+	start := 0
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == '"':
+			quote = !quote
+		case quote:
+		case ch == '(':
+			depth++
+		case ch == ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unexpected ')' at offset %d in: %s", i, s)
+			}
+		case ch == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if quote {
+		return nil, fmt.Errorf("unterminated string in: %s", s)
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("missing ')' in: %s", s)
+	}
+	return append(parts, s[start:]), nil
+}
+
+// parseStages - parses comma separated stages, each stage can set its own env variables, for example:
+// "mix,stretch,isoval(ISOVAL=mul;IVT=0.4),f,ir3,ir3(IRT=1.5;IRS=0.5)"
+func parseStages(s string) ([]stageSpec, error) {
+	items, err := splitTop(s, ',')
+	if err != nil {
+		return nil, err
+	}
+	specs := []stageSpec{}
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		spec := stageSpec{name: item, env: make(map[string]string)}
+		i := strings.Index(item, "(")
+		if i >= 0 {
+			if !strings.HasSuffix(item, ")") {
+				return nil, fmt.Errorf("stage '%s' must be name(VAR=value;VAR=value...)", item)
+			}
+			spec.name = item[:i]
+			spec.params = item[i:]
+			params, err := splitTop(item[i+1:len(item)-1], ';')
+			if err != nil {
+				return nil, err
+			}
+			for _, param := range params {
+				param = strings.TrimSpace(param)
+				if param == "" {
+					continue
+				}
+				ary := strings.SplitN(param, "=", 2)
+				name := strings.TrimSpace(ary[0])
+				if len(ary) != 2 || name == "" {
+					return nil, fmt.Errorf("stage '%s' parameter '%s' must be VAR=value", item, param)
+				}
+				if !knownVars[name] {
+					return nil, fmt.Errorf("stage '%s' parameter '%s': unknown variable '%s'", item, param, name)
+				}
+				value := strings.TrimSpace(ary[1])
+				if len(value) >= 2 && strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
+					// quoted value can have ',', ';' and ')', for example: f(RF="a = x1; a*2")
+					value = value[1 : len(value)-1]
+				}
+				spec.env[name] = value
+			}
+		}
+		spec.name = strings.ToLower(strings.TrimSpace(spec.name))
+		alias, ok := stageAliases[spec.name]
+		if ok {
+			spec.name = alias
+		}
+		known := false
+		for _, name := range stageNames {
+			if spec.name == name {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown stage '%s', stages are: %s", spec.name, strings.Join(stageNames, ", "))
+		}
+		specs = append(specs, spec)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no stages given in: %s", s)
+	}
+	return specs, nil
+}
+
+// stagesFromEnv - pipeline stages in STAGES order or (when STAGES is not set) stages enabled by env variables in the default order
+// Stages listed in STAGES are always used, per channel stages (mix, stretch, gamma, f, cont) with the same parameters share settings
+// Returns stages and compiled functions
+func stagesFromEnv(getenv func(string) string, mfctx *jpegbw.FparCtx, cfg *jpegConfig) ([]jpegbw.Stage, []funcStat, error) {
+	list := getenv("STAGES")
+	on := strings.TrimSpace(list) != ""
+	if !on {
+		list = strings.Join(stageNames, ",")
+	}
+	specs, err := parseStages(list)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		stages []jpegbw.Stage
+		funcs  []funcStat
+	)
+	chans := make(map[string]*chanStages)
+	for i := range specs {
+		spec := &specs[i]
+		env := spec.lookup(getenv)
+		if on {
+			fmt.Printf("Stage %d: %s%s\n", i+1, spec.name, spec.params)
+		}
+		switch spec.name {
+		case "mix", "stretch", "gamma", "f", "cont":
+			ch, ok := chans[spec.params]
+			if !ok {
+				ch, err = chanStagesFromEnv(env, mfctx, cfg)
+				if err != nil {
+					return nil, nil, err
+				}
+				chans[spec.params] = ch
+				if ch.fun != nil {
+					for c, fctx := range ch.fun.Func {
+						if fctx != nil {
+							funcs = append(funcs, funcStat{name: "RGBA"[c:c+1] + spec.params, fctx: fctx})
+						}
+					}
+				}
+			}
+			switch spec.name {
+			case "mix":
+				stages = append(stages, ch.mix)
+			case "stretch":
+				stages = append(stages, ch.stretch)
+			case "gamma":
+				if ch.gamma != nil {
+					stages = append(stages, ch.gamma)
+				}
+			case "f":
+				if ch.fun != nil {
+					stages = append(stages, ch.fun)
+				}
+			case "cont":
+				if ch.cont != nil {
+					stages = append(stages, ch.cont)
+				}
+			}
+		case "rev":
+			// Reverse the calculation
+			if on || env("REV") != "" {
+				stages = append(stages, &jpegbw.RevStage{})
+			}
+		case "ir3":
+			st, err := ir3ConfigFromEnv(env, on)
+			if err != nil {
+				return nil, nil, err
+			}
+			if st != nil {
+				stages = append(stages, st)
+			}
+		case "monoval":
+			st, err := monoValueConfigFromEnv(env, on)
+			if err != nil {
+				return nil, nil, err
+			}
+			if st != nil {
+				stages = append(stages, st)
+			}
+		case "isoval":
+			st, err := isoValConfigFromEnv(env, on)
+			if err != nil {
+				return nil, nil, err
+			}
+			if st != nil {
+				stages = append(stages, st)
+			}
+		case "gs":
+			st, err := gsConfigFromEnv(env, on)
+			if err != nil {
+				return nil, nil, err
+			}
+			if st != nil {
+				stages = append(stages, st)
+			}
+		}
+	}
+	return stages, funcs, nil
+}
@@ -0,0 +1,60 @@
+package rgba
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseStages(t *testing.T) {
+	var testCases = []struct {
+		stages string
+		names  []string
+		env    []map[string]string
+		err    string
+	}{
+		{stages: "mix,stretch,f", names: []string{"mix", "stretch", "f"}},
+		{stages: " Mix , iso ,ogs", names: []string{"mix", "isoval", "gs"}},
+		{
+			stages: "mix,isoval(ISOVAL=mul;IVT=0.4),ir3,ir3(IRT=1.5; IRS = 0.5)",
+			names:  []string{"mix", "isoval", "ir3", "ir3"},
+			env:    []map[string]string{{}, {"ISOVAL": "mul", "IVT": "0.4"}, {}, {"IRT": "1.5", "IRS": "0.5"}},
+		},
+		{stages: "f(RF=min(x1, 0.5))", names: []string{"f"}, env: []map[string]string{{"RF": "min(x1, 0.5)"}}},
+		{
+			stages: `mix,f(RF="a = x1; a*2";GF = "min(x1, 0.5)"),f(BF="")`,
+			names:  []string{"mix", "f", "f"},
+			env:    []map[string]string{{}, {"RF": "a = x1; a*2", "GF": "min(x1, 0.5)"}, {"BF": ""}},
+		},
+		{stages: `f(RF=lut("film", x1))`, names: []string{"f"}, env: []map[string]string{{"RF": `lut("film", x1)`}}},
+		{stages: `f(RF="a = x1; a*2)`, err: "unterminated string"},
+		{stages: "mix,stretch,isoval(IVTTT=0.4;ISOVAL=mul)", err: "unknown variable 'IVTTT'"},
+		{stages: "mix,foo", err: "unknown stage 'foo'"},
+		{stages: "mix(RR=1", err: "missing ')'"},
+		{stages: "mix(RR)", err: "must be VAR=value"},
+		{stages: " , ", err: "no stages given"},
+	}
+	for _, tc := range testCases {
+		specs, err := parseStages(tc.stages)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: got error %v, expected error containing %q", tc.stages, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.stages, err)
+			continue
+		}
+		names := []string{}
+		for i, spec := range specs {
+			names = append(names, spec.name)
+			if tc.env != nil && !reflect.DeepEqual(spec.env, tc.env[i]) {
+				t.Errorf("%s: stage %d env is %v, expected %v", tc.stages, i+1, spec.env, tc.env[i])
+			}
+		}
+		if !reflect.DeepEqual(names, tc.names) {
+			t.Errorf("%s: got stages %v, expected %v", tc.stages, names, tc.names)
+		}
+	}
+}
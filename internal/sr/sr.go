@@ -0,0 +1,499 @@
+package sr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lukaszgryglicki/jpegbw/internal/cli"
+)
+
+func execCommand(debug int, output bool, cmdAndArgs []string, env map[string]string) (string, error) {
+	// Execution time
+	dtStart := time.Now()
+	// STDOUT pipe size
+	pipeSize := 0x100
+
+	// Command & arguments
+	command := cmdAndArgs[0]
+	arguments := cmdAndArgs[1:]
+	if debug > 0 {
+		var args []string
+		for _, arg := range cmdAndArgs {
+			argLen := len(arg)
+			if argLen > 0x200 {
+				arg = arg[0:0x100] + "..." + arg[argLen-0x100:argLen]
+			}
+			if strings.Contains(arg, " ") {
+				args = append(args, "'"+arg+"'")
+			} else {
+				args = append(args, arg)
+			}
+		}
+		fmt.Printf("%s\n", strings.Join(args, " "))
+	}
+	cmd := exec.Command(command, arguments...)
+
+	// Environment setup (if any)
+	if len(env) > 0 {
+		newEnv := os.Environ()
+		for key, value := range env {
+			newEnv = append(newEnv, key+"="+value)
+		}
+		cmd.Env = newEnv
+		if debug > 0 {
+			fmt.Printf("Environment Override: %+v\n", env)
+			if debug > 2 {
+				fmt.Printf("Full Environment: %+v\n", newEnv)
+			}
+		}
+	}
+
+	// Capture STDOUT (non buffered - all at once when command finishes), only used on error and when no buffered/piped version used
+	// Which means it is used on error when debug <= 1
+	// In debug > 1 mode, we're displaying STDOUT during execution, and storing results to 'outputStr'
+	// Capture STDERR (non buffered - all at once when command finishes)
+	var (
+		stdOut    bytes.Buffer
+		stdErr    bytes.Buffer
+		outputStr string
+	)
+	cmd.Stderr = &stdErr
+	if debug <= 1 {
+		cmd.Stdout = &stdOut
+	}
+
+	// Pipe command's STDOUT during execution (if debug > 1)
+	// Or just starts command when no STDOUT debug
+	if debug > 1 {
+		stdOutPipe, e := cmd.StdoutPipe()
+		if e != nil {
+			return "", e
+		}
+		e = cmd.Start()
+		if e != nil {
+			return "", e
+		}
+		buffer := make([]byte, pipeSize, pipeSize)
+		nBytes, e := stdOutPipe.Read(buffer)
+		for e == nil && nBytes > 0 {
+			fmt.Printf("%s", buffer[:nBytes])
+			outputStr += string(buffer[:nBytes])
+			nBytes, e = stdOutPipe.Read(buffer)
+		}
+		if e != io.EOF {
+			return "", e
+		}
+	} else {
+		e := cmd.Start()
+		if e != nil {
+			return "", e
+		}
+	}
+	// Wait for command to finish
+	err := cmd.Wait()
+
+	// If error - then output STDOUT, STDERR and error info
+	if err != nil {
+		if debug <= 1 {
+			outStr := stdOut.String()
+			if len(outStr) > 0 {
+				fmt.Printf("%v\n", outStr)
+			}
+		}
+		errStr := stdErr.String()
+		if len(errStr) > 0 {
+			fmt.Printf("STDERR:\n%v\n", errStr)
+		}
+		if err != nil {
+			return stdOut.String(), err
+		}
+	}
+
+	// If debug > 1 display STDERR contents as well (if any)
+	if debug > 1 {
+		errStr := stdErr.String()
+		if len(errStr) > 0 {
+			fmt.Printf("Errors:\n%v\n", errStr)
+		}
+	}
+	if debug > 0 {
+		info := strings.Join(cmdAndArgs, " ")
+		lenInfo := len(info)
+		if lenInfo > 0x280 {
+			info = info[0:0x140] + "..." + info[lenInfo-0x140:lenInfo]
+		}
+		dtEnd := time.Now()
+		fmt.Printf("%s: %+v\n", info, dtEnd.Sub(dtStart))
+	}
+	outStr := ""
+	if output {
+		if debug <= 1 {
+			outStr = stdOut.String()
+		} else {
+			outStr = outputStr
+		}
+	}
+	return outStr, nil
+}
+
+func srFrame(ch chan error, s, md, jpegq int, pngq png.CompressionLevel, gs bool, args []string) {
+	var ma [][]*image.Image
+	for i := 0; i < s; i++ {
+		var t []*image.Image
+		for j := 0; j < s; j++ {
+			var u *image.Image
+			t = append(t, u)
+		}
+		ma = append(ma, t)
+	}
+	k := 0
+	px := -1
+	py := -1
+	x := -1
+	y := -1
+	for i := 0; i < s; i++ {
+		for j := 0; j < s; j++ {
+			reader, err := os.Open(args[k])
+			if err != nil {
+				ch <- err
+				return
+			}
+			m, _, err := image.Decode(reader)
+			if err != nil {
+				_ = reader.Close()
+				ch <- err
+				return
+			}
+			err = reader.Close()
+			if err != nil {
+				ch <- err
+				return
+			}
+			bounds := m.Bounds()
+			x = bounds.Max.X
+			y = bounds.Max.Y
+			if px == -1 {
+				px = x
+			}
+			if py == -1 {
+				py = y
+			}
+			if px != x {
+				ch <- fmt.Errorf("first image x: %d, %d image x: %d (must be the same)", px, k+1, x)
+				return
+			}
+			if py != y {
+				ch <- fmt.Errorf("first image y: %d, %d image y: %d (must be the same)", py, k+1, y)
+				return
+			}
+			ma[i][j] = &m
+			k++
+		}
+	}
+	// Detect motion
+	var motion [][][2]int
+	for i := 0; i < s; i++ {
+		var row [][2]int
+		for j := 0; j < s; j++ {
+			row = append(row, [2]int{0, 0})
+		}
+		motion = append(motion, row)
+	}
+	ss := s * s
+	for im := 1; im < ss; im++ {
+		si := im % s
+		sj := im / s
+		minI := 0
+		minJ := 0
+		// fmt.Printf("(%d,%d,%d)\n", im, si, sj)
+		minMetric := float64(1e13)
+		for mdi := -md; mdi <= md; mdi++ {
+			for mdj := -md; mdj <= md; mdj++ {
+				metric := 0.0
+				for i := 0; i < x; i++ {
+					ii := i + mdi
+					if ii < 0 || ii >= x {
+						ii = i
+					}
+					for j := 0; j < y; j++ {
+						jj := j + mdj
+						if jj < 0 || jj >= y {
+							jj = j
+						}
+						rr, rg, rb, _ := (*ma[0][0]).At(i, j).RGBA()
+						cr, cg, cb, _ := (*ma[si][sj]).At(ii, jj).RGBA()
+						r := rr + rg + rb
+						c := cr + cg + cb
+						metric += math.Abs(float64(r) - float64(c))
+					}
+				}
+				metric /= float64(x * y)
+				//fmt.Printf("(%d,%d) -> %f\n", mdi, mdj, metric)
+				if metric < minMetric {
+					minMetric = metric
+					minI = mdi
+					minJ = mdj
+				}
+			}
+		}
+		//fmt.Printf("Final (%d,%d,%d) --> (%d,%d,%f)\n", im, si, sj, minI, minJ, minMetric)
+		motion[si][sj] = [2]int{minI, minJ}
+	}
+	// fmt.Printf("%+v\n", motion)
+	var (
+		target   *image.RGBA64
+		targetGS *image.Gray16
+	)
+	if gs {
+		targetGS = image.NewGray16(image.Rect(0, 0, s*x, s*y))
+	} else {
+		target = image.NewRGBA64(image.Rect(0, 0, s*x, s*y))
+	}
+	if gs {
+		for i := 0; i < x; i++ {
+			for j := 0; j < y; j++ {
+				for si := 0; si < s; si++ {
+					for sj := 0; sj < s; sj++ {
+						ii := i + motion[si][sj][0]
+						if ii < 0 || ii >= x {
+							ii = i
+						}
+						jj := j + motion[si][sj][1]
+						if jj < 0 || j >= y {
+							jj = j
+						}
+						targetGS.Set(s*i+si, s*j+sj, (*ma[si][sj]).At(ii, jj))
+					}
+				}
+			}
+		}
+	} else {
+		for i := 0; i < x; i++ {
+			for j := 0; j < y; j++ {
+				for si := 0; si < s; si++ {
+					for sj := 0; sj < s; sj++ {
+						ii := i + motion[si][sj][0]
+						if ii < 0 || ii >= x {
+							ii = i
+						}
+						jj := j + motion[si][sj][1]
+						if jj < 0 || j >= y {
+							jj = j
+						}
+						target.Set(s*i+si, s*j+sj, (*ma[si][sj]).At(ii, jj))
+					}
+				}
+			}
+		}
+	}
+	var (
+		t   image.Image
+		err error
+	)
+	if gs {
+		t = targetGS
+	} else {
+		t = target
+	}
+	ary := strings.Split(args[0], "/")
+	lAry := len(ary)
+	last := ary[lAry-1]
+	ary[lAry-1] = "sr_" + last
+	ofn := strings.Join(ary, "/")
+	fi, err := os.Create(ofn)
+	if err != nil {
+		ch <- err
+		return
+	}
+	lfn := strings.ToLower(args[0])
+	if strings.Contains(lfn, ".png") {
+		enc := png.Encoder{CompressionLevel: pngq}
+		err = enc.Encode(fi, t)
+	} else if strings.Contains(lfn, ".jpg") || strings.Contains(lfn, ".jpeg") {
+		var jopts *jpeg.Options
+		if jpegq >= 0 {
+			jopts = &jpeg.Options{Quality: jpegq}
+		}
+		err = jpeg.Encode(fi, t, jopts)
+	} else if strings.Contains(lfn, ".gif") {
+		err = gif.Encode(fi, t, nil)
+	}
+	if err != nil {
+		_ = fi.Close()
+		ch <- err
+		return
+	}
+	err = fi.Close()
+	ch <- err
+	return
+}
+
+func sr(scaleS string, args []string) error {
+	// Threads
+	thrsS := os.Getenv("N")
+	thrs := -1
+	if thrsS != "" {
+		t, err := strconv.Atoi(thrsS)
+		if err != nil {
+			return err
+		}
+		thrs = t
+	}
+	thrN := thrs
+	if thrs < 0 {
+		thrN = runtime.NumCPU()
+	}
+	runtime.GOMAXPROCS(thrN)
+
+	// JPEG Quality
+	jpegqStr := os.Getenv("Q")
+	jpegq := -1
+	if jpegqStr != "" {
+		v, err := strconv.Atoi(jpegqStr)
+		if err != nil {
+			return err
+		}
+		if v < 1 || v > 100 {
+			return fmt.Errorf("Q must be from 1-100 range")
+		}
+		jpegq = v
+	}
+
+	// PNG Quality
+	pngqStr := os.Getenv("PQ")
+	pngq := png.DefaultCompression
+	if pngqStr != "" {
+		v, err := strconv.Atoi(pngqStr)
+		if err != nil {
+			return err
+		}
+		if v < 0 || v > 3 {
+			return fmt.Errorf("PQ must be from 0-3 range")
+		}
+		pngq = png.CompressionLevel(-v)
+	}
+
+	// Motion detect area
+	mStr := os.Getenv("M")
+	md := 1
+	if mStr != "" {
+		v, err := strconv.Atoi(mStr)
+		if err != nil {
+			return err
+		}
+		if v < 0 || v > 32 {
+			return fmt.Errorf("M must be from 0-32 range")
+		}
+		md = v
+	}
+
+	// Grayscale
+	gs := os.Getenv("GS") != ""
+
+	// In-place mode
+	inpl := os.Getenv("INPL") != ""
+
+	// Pad mode (if not enough files, copy last full)
+	pad := os.Getenv("PAD") != ""
+
+	// Scale
+	scale, err := strconv.Atoi(scaleS)
+	if err != nil {
+		return err
+	}
+	if scale < 2 {
+		return fmt.Errorf("scale must be >=2: %s", scaleS)
+	}
+	sscale := scale * scale
+	n := len(args)
+	ch := make(chan error)
+	nThreads := 0
+	for i := 0; i < n; i++ {
+		to := i + sscale
+		if to > n {
+			break
+		}
+		go srFrame(ch, scale, md, jpegq, pngq, gs, args[i:to])
+		nThreads++
+		if nThreads == thrN {
+			err := <-ch
+			nThreads--
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for nThreads > 0 {
+		err := <-ch
+		nThreads--
+		if err != nil {
+			return err
+		}
+	}
+	if pad {
+		for i := 0; i < n; i++ {
+			to := i + sscale
+			if to <= n {
+				continue
+			}
+			// fmt.Printf("cp %s -> %s\n", "sr_"+args[i-1], "sr_"+args[i])
+			_, err := execCommand(0, false, []string{"cp", "sr_" + args[i-1], "sr_" + args[i]}, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if inpl {
+		for i := 0; i < n; i++ {
+			to := i + sscale
+			if to > n && !pad {
+				break
+			}
+			// fmt.Printf("mv %s -> %s\n", "sr_"+args[i], args[i])
+			_, err := execCommand(0, false, []string{"mv", "sr_" + args[i], args[i]}, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Command - sr subcommand: super resolution image from scale^2 images
+var Command = &cli.Command{
+	Name:    "sr",
+	Args:    "scale image...",
+	Summary: "generates super resolution image from scale^2 images",
+	Help:    helpStr,
+	Flags:   []cli.Flag{cli.Quality, cli.PNGQuality, cli.Threads},
+	MinArgs: 5,
+	Timed:   true,
+	Run: func(args []string) error {
+		return sr(args[0], args[1:])
+	},
+}
+
+// helpStr - env variables
+const helpStr = `
+Parameters: scale and then scale^2 filenames, example: 2 im01.png im02.png im03.png im04.png, will generate sr_im01.png
+Environment variables:
+Q - jpeg quality 1-100, will use library default if not specified
+PQ - png quality 0-3 (0 is default): 0=DefaultCompression, 1=NoCompression, 2=BestSpeed, 3=BestCompression
+GS - set grayscale mode
+INPL - set in-place mode (will overwrite input files)
+PAD - pad mode: if not enough files, copy last full
+N - set number of CPUs to process data
+M - motion detect range araound given pixel, default 1, note that this means <1-p-1>-> 3^2 = 9 checks. (2*M+1)^2
+`
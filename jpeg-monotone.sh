@@ -1,30 +1,21 @@
 #!/usr/bin/env bash
+# Uses built-in monotone preset (jpeg -presets), env variables override preset values
+# TR/TG/TB - gray mix, T0X/T1X - X tint for black and white (X is R, G or B), preset values when not set
 set -euo pipefail
 JPEG_BIN="${JPEG_BIN:-/home/lgryglicki/go/bin/jpeg}"
-TR="${TR:-0.2126}"
-TG="${TG:-0.7152}"
-TB="${TB:-0.0722}"
-RLO="${RLO:-1.5}"
-RHI="${RHI:-1.5}"
-GLO="${GLO:-1.5}"
-GHI="${GHI:-1.5}"
-BLO="${BLO:-1.5}"
-BHI="${BHI:-1.5}"
-T0R="${T0R:-0.10}"
-T0G="${T0G:-0.06}"
-T0B="${T0B:-0.02}"
-T1R="${T1R:-1.00}"
-T1G="${T1G:-0.95}"
-T1B="${T1B:-0.82}"
-exec env \
-  RR="$TR" RG="$TG" RB="$TB" \
-  GR="$TR" GG="$TG" GB="$TB" \
-  BR="$TR" BG="$TG" BB="$TB" \
-  RLO="$RLO" RHI="$RHI" \
-  GLO="$GLO" GHI="$GHI" \
-  BLO="$BLO" BHI="$BHI" \
-  RF="$T0R+x1*($T1R-$T0R)" \
-  GF="$T0G+x1*($T1G-$T0G)" \
-  BF="$T0B+x1*($T1B-$T0B)" \
-  NA=1 \
-  "$JPEG_BIN" "$@"
+if [ -n "${TR:-}${TG:-}${TB:-}" ]; then
+  TR="${TR:-0.2126}"
+  TG="${TG:-0.7152}"
+  TB="${TB:-0.0722}"
+  export RR="$TR" RG="$TG" RB="$TB" GR="$TR" GG="$TG" GB="$TB" BR="$TR" BG="$TG" BB="$TB"
+fi
+if [ -n "${T0R:-}${T1R:-}" ]; then
+  export RF="${T0R:-0.10}+x1*(${T1R:-1.00}-${T0R:-0.10})"
+fi
+if [ -n "${T0G:-}${T1G:-}" ]; then
+  export GF="${T0G:-0.06}+x1*(${T1G:-0.95}-${T0G:-0.06})"
+fi
+if [ -n "${T0B:-}${T1B:-}" ]; then
+  export BF="${T0B:-0.02}+x1*(${T1B:-0.82}-${T0B:-0.02})"
+fi
+exec "$JPEG_BIN" -preset monotone "$@"
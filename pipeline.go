@@ -0,0 +1,368 @@
+package jpegbw
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"runtime"
+	"time"
+)
+
+// Stage - one step of image processing pipeline, it modifies frame's pixels in place
+type Stage interface {
+	// Name - stage name used in errors and notes
+	Name() string
+	// Apply - processes frame
+	Apply(ctx context.Context, f *Frame) error
+}
+
+// toneStage - stages using pending channel mappings (gamma, expression), so values are not rounded to 16 bits between stages
+// Other stages get pixels with all pending channel mappings applied
+type toneStage interface {
+	Stage
+	tone()
+}
+
+// Pipeline - stages applied in order to image's RGBA channels (16 bits per channel)
+// Channels is the number of processed channels: 4 - RGBA, 3 - RGB (alpha is 1), 1 - gray (output is gray too), 0 means 4
+// Threads is the number of columns processed at once, runtime.NumCPU() when not positive
+// Info adds Info columns on the right and 2*Info rows on the bottom: scale of stretched range and histograms (scaled and absolute)
+// InfoExt shows R, G, B scales too, InfoPow is the absolute histogram's x -> x^InfoPow mapping (when not 0)
+type Pipeline struct {
+	Stages   []Stage
+	Channels int
+	Threads  int
+	Info     int
+	InfoExt  bool
+	InfoPow  float64
+}
+
+// FrameOpts - per image parameters: Seq is image's position in processed sequence (0-1, real part of expression's x5),
+// Hint overrides stretch ranges (see HintData)
+type FrameOpts struct {
+	Seq  float64
+	Hint *HintData
+}
+
+// Range - channel's gray values range (Min-Max) and the range stretched to the full 0-FFFF range (Lo-Hi, Mult)
+type Range struct {
+	Min  uint16
+	Max  uint16
+	Lo   uint16
+	Hi   uint16
+	Mult float64
+}
+
+// Stats - processing statistics: number of image pixels, histogram and calculations time,
+// channel ranges found by stretch stage (Ranged) and notes written by stages (like " ir3 (1ms)...")
+type Stats struct {
+	Pixels int
+	Hist   time.Duration
+	Calc   time.Duration
+	Ranges [4]Range
+	Ranged [4]bool
+	Notes  []string
+}
+
+// MPPS - processed megapixels per second of calculations
+func (st *Stats) MPPS() float64 {
+	return (float64(st.Pixels) / st.Calc.Seconds()) / 1048576.0
+}
+
+// Frame - image being processed: Pix has X columns of Y pixels, W x H is image's size (smaller than frame when Info is used)
+// Stages must process channels 0..Channels-1 and can run up to Threads goroutines
+type Frame struct {
+	Pix      [][][4]uint16
+	X        int
+	Y        int
+	W        int
+	H        int
+	Channels int
+	Threads  int
+	Opts     FrameOpts
+	Stats    *Stats
+	orig     [][][4]uint16
+	tone     [4]func(uint16) float64
+	toneKey  [4]string
+	weights  [4]*[3]float64
+	synth    [4]func(i, j int) (uint32, uint32, uint32, uint32)
+	pipe     *Pipeline
+	toneRows int
+	gray     bool
+}
+
+// note - adds note to stats
+func (f *Frame) note(format string, args ...interface{}) {
+	f.Stats.Notes = append(f.Stats.Notes, fmt.Sprintf(format, args...))
+}
+
+// source - input image pixel (16 bits per channel) used by channel c, synthesized info scale and histograms outside of image
+func (f *Frame) source(c, i, j int) (uint32, uint32, uint32, uint32) {
+	if f.synth[c] != nil && (i >= f.W || j >= f.H) {
+		return f.synth[c](i, j)
+	}
+	px := f.orig[i][j]
+	return uint32(px[0]), uint32(px[1]), uint32(px[2]), uint32(px[3])
+}
+
+// mix - channel c value of pixel after channel mix stage (the value itself when there was no channel mix)
+func (f *Frame) mix(c int, pr, pg, pb, pa uint32) uint16 {
+	w := f.weights[c]
+	if w == nil {
+		return uint16([4]uint32{pr, pg, pb, pa}[c])
+	}
+	return uint16(w[0]*float64(pr) + w[1]*float64(pg) + w[2]*float64(pb))
+}
+
+// toneOf - pending channel mapping of channel c, identity when there is none
+// toneKey[c] describes the mapping (stages and their parameters), the same key means the same mapping, empty key is identity
+func (f *Frame) toneOf(c int) func(uint16) float64 {
+	if f.tone[c] != nil {
+		return f.tone[c]
+	}
+	return func(v uint16) float64 {
+		return float64(v)
+	}
+}
+
+// Materialize - applies pending channel mappings (stretch, gamma) to pixels, rows added by Info are not mapped
+// Pipeline calls it before stages that are not channel mappings, so they always see final 16 bit values
+func (f *Frame) Materialize(ctx context.Context) error {
+	for c := 0; c < f.Channels; c++ {
+		tone := f.tone[c]
+		if tone == nil {
+			continue
+		}
+		f.tone[c] = nil
+		f.toneKey[c] = ""
+		col := c
+		err := f.Parallel(ctx, func(i, t int) error {
+			for j := 0; j < f.toneRows; j++ {
+				f.Pix[i][j][col] = uint16(tone(f.Pix[i][j][col]))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parallel - calls fn for all columns using at most Threads goroutines, t is goroutine slot (0..Threads-1)
+// Slot is used by only one call at a time, so it can index per thread buffers
+func (f *Frame) Parallel(ctx context.Context, fn func(i, t int) error) error {
+	thrN := f.Threads
+	slots := make(chan int, thrN)
+	for t := 0; t < thrN; t++ {
+		slots <- t
+	}
+	che := make(chan error)
+	nThreads := 0
+	var err error
+	for ii := 0; ii < f.X && err == nil; ii++ {
+		err = ctx.Err()
+		if err != nil {
+			break
+		}
+		go func(c chan error, i int) {
+			t := <-slots
+			e := fn(i, t)
+			slots <- t
+			c <- e
+		}(che, ii)
+
+		// Keep maximum number of threads
+		nThreads++
+		if nThreads == thrN {
+			e := <-che
+			if e != nil {
+				err = e
+			}
+			nThreads--
+		}
+	}
+	for nThreads > 0 {
+		e := <-che
+		if e != nil && err == nil {
+			err = e
+		}
+		nThreads--
+	}
+	return err
+}
+
+// newFrame - frame with image's pixels, frame's (0, 0) is image's bounds.Min
+func (p *Pipeline) newFrame(ctx context.Context, m image.Image, opts FrameOpts, st *Stats) (*Frame, error) {
+	bounds := m.Bounds()
+	f := &Frame{
+		W:        bounds.Dx(),
+		H:        bounds.Dy(),
+		Channels: p.Channels,
+		Threads:  p.Threads,
+		Opts:     opts,
+		Stats:    st,
+		pipe:     p,
+	}
+	if f.Channels <= 0 || f.Channels > 4 {
+		f.Channels = 4
+	}
+	if f.Threads <= 0 {
+		f.Threads = runtime.NumCPU()
+	}
+	f.X, f.Y = f.W, f.H
+	if p.Info > 0 {
+		f.X += p.Info
+		f.Y += 2 * p.Info
+	}
+	// rows added by Info are not mapped by channel stages
+	f.toneRows = f.H
+	f.orig = make([][][4]uint16, f.X)
+	f.Pix = make([][][4]uint16, f.X)
+	for i := range f.Pix {
+		f.orig[i] = make([][4]uint16, f.Y)
+		f.Pix[i] = make([][4]uint16, f.Y)
+	}
+	err := f.Parallel(ctx, func(i, t int) error {
+		if i >= f.W {
+			return nil
+		}
+		for j := 0; j < f.H; j++ {
+			pr, pg, pb, pa := m.At(bounds.Min.X+i, bounds.Min.Y+j).RGBA()
+			f.orig[i][j] = [4]uint16{uint16(pr), uint16(pg), uint16(pb), uint16(pa)}
+		}
+		copy(f.Pix[i], f.orig[i])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	st.Pixels = f.W * f.H
+	return f, nil
+}
+
+// Process - runs all stages on image, see ProcessFrame
+func (p *Pipeline) Process(ctx context.Context, m image.Image) (image.Image, Stats, error) {
+	return p.ProcessFrame(ctx, m, FrameOpts{})
+}
+
+// ProcessFrame - runs all stages on image, returns *image.Gray16 (1 channel or GS stage) or *image.RGBA64 and statistics
+func (p *Pipeline) ProcessFrame(ctx context.Context, m image.Image, opts FrameOpts) (image.Image, Stats, error) {
+	var st Stats
+	f, err := p.newFrame(ctx, m, opts, &st)
+	if err != nil {
+		return nil, st, err
+	}
+	for _, stage := range p.Stages {
+		err = ctx.Err()
+		if err != nil {
+			return nil, st, err
+		}
+		if _, ok := stage.(toneStage); !ok {
+			err = f.Materialize(ctx)
+			if err != nil {
+				return nil, st, err
+			}
+		}
+		dtStart := time.Now()
+		err = stage.Apply(ctx, f)
+		if err != nil {
+			return nil, st, err
+		}
+		dt := time.Since(dtStart)
+		if _, ok := stage.(*StretchStage); ok {
+			st.Hist += dt
+		} else {
+			st.Calc += dt
+		}
+	}
+	dtStart := time.Now()
+	err = f.Materialize(ctx)
+	if err != nil {
+		return nil, st, err
+	}
+	t, err := f.image(ctx)
+	if err != nil {
+		return nil, st, err
+	}
+	st.Calc += time.Since(dtStart)
+	return t, st, nil
+}
+
+// image - final image: gray when there is 1 channel or GS stage was used, RGB with alpha 1 for 3 channels, RGBA otherwise
+func (f *Frame) image(ctx context.Context) (image.Image, error) {
+	var (
+		target   *image.RGBA64
+		targetGS *image.Gray16
+		fCalc    func(i, t int) error
+	)
+	if f.gray || f.Channels == 1 {
+		targetGS = image.NewGray16(image.Rect(0, 0, f.X, f.Y))
+		fCalc = func(i, t int) error {
+			for j := 0; j < f.Y; j++ {
+				targetGS.Set(i, j, color.Gray16{f.Pix[i][j][0]})
+			}
+			return nil
+		}
+	} else {
+		target = image.NewRGBA64(image.Rect(0, 0, f.X, f.Y))
+		if f.Channels < 4 {
+			fCalc = func(i, t int) error {
+				for j := 0; j < f.Y; j++ {
+					px := f.Pix[i][j]
+					target.Set(i, j, color.RGBA64{px[0], px[1], px[2], 0xffff})
+				}
+				return nil
+			}
+		} else {
+			fCalc = func(i, t int) error {
+				for j := 0; j < f.Y; j++ {
+					px := f.Pix[i][j]
+					target.Set(i, j, color.NRGBA64{px[0], px[1], px[2], px[3]})
+				}
+				return nil
+			}
+		}
+	}
+	err := f.Parallel(ctx, fCalc)
+	if err != nil {
+		return nil, err
+	}
+	if targetGS != nil {
+		return targetGS, nil
+	}
+	return target, nil
+}
+
+// mapRGB - maps R, G and B (0-1) of all pixels, results are clipped and rounded
+func (f *Frame) mapRGB(ctx context.Context, fn func(r, g, b float64) (float64, float64, float64)) error {
+	return f.Parallel(ctx, func(i, t int) error {
+		for j := 0; j < f.Y; j++ {
+			px := f.Pix[i][j]
+			r := float64(px[0]) / 65535.0
+			g := float64(px[1]) / 65535.0
+			b := float64(px[2]) / 65535.0
+			rr, gg, bb := fn(r, g, b)
+			f.Pix[i][j][0] = uint16(clamp01(rr)*65535.0 + 0.5)
+			f.Pix[i][j][1] = uint16(clamp01(gg)*65535.0 + 0.5)
+			f.Pix[i][j][2] = uint16(clamp01(bb)*65535.0 + 0.5)
+		}
+		return nil
+	})
+}
+
+func clamp01(v float64) float64 {
+	if v <= 0.0 {
+		return 0.0
+	}
+	if v >= 1.0 {
+		return 1.0
+	}
+	return v
+}
+
+func smooth01(v float64) float64 {
+	v = clamp01(v)
+	return v * v * (3.0 - 2.0*v)
+}
@@ -0,0 +1,47 @@
+package jpegbw
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestProcessSubImage(t *testing.T) {
+	m := image.NewRGBA64(image.Rect(0, 0, 20, 16))
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 16; j++ {
+			m.Set(i, j, color.RGBA64{uint16(i * 3000), uint16(j * 4000), uint16((i + j) * 1000), 0xffff})
+		}
+	}
+	// rev stage reverses changes made by previous stages, so it reads original pixels but doesn't change them
+	var testCases = []struct {
+		stages []Stage
+	}{
+		{},
+		{stages: []Stage{&RevStage{}}},
+	}
+	for _, rect := range []image.Rectangle{image.Rect(0, 0, 20, 16), image.Rect(5, 5, 15, 12), image.Rect(19, 0, 20, 1)} {
+		sub := m.SubImage(rect)
+		for _, tc := range testCases {
+			p := &Pipeline{Stages: tc.stages, Channels: 3, Threads: 2}
+			out, st, err := p.Process(context.Background(), sub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.Bounds() != image.Rect(0, 0, rect.Dx(), rect.Dy()) || st.Pixels != rect.Dx()*rect.Dy() {
+				t.Errorf("%v: got bounds %v and %d pixels", rect, out.Bounds(), st.Pixels)
+				continue
+			}
+			for i := 0; i < rect.Dx(); i++ {
+				for j := 0; j < rect.Dy(); j++ {
+					r, g, b, _ := sub.At(rect.Min.X+i, rect.Min.Y+j).RGBA()
+					or, og, ob, _ := out.At(i, j).RGBA()
+					if or != r || og != g || ob != b {
+						t.Errorf("%v %d stages: pixel (%d, %d) is (%d, %d, %d), expected (%d, %d, %d)", rect, len(tc.stages), i, j, or, og, ob, r, g, b)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/cmplx"
+)
+
+// Example Go plugin adding expression functions, build: make example.so (go build -buildmode=plugin)
+// Usage: LIB="./example.so" F="sigmoid(x1, 8)" jpegbw in.png
+
+// JpegbwRegister - registration function called by jpegbw when plugin is loaded
+func JpegbwRegister(register func(name string, nargs int, fn func(args ...complex128) (complex128, error)) error) error {
+	// sigmoid(x, k) - S-curve contrast around 0.5, k is the steepness
+	err := register("sigmoid", 2, func(a ...complex128) (complex128, error) {
+		k := real(a[1])
+		if k == 0 {
+			return a[0], nil
+		}
+		lo := 1.0 / (1.0 + math.Exp(k*0.5))
+		hi := 1.0 / (1.0 + math.Exp(-k*0.5))
+		v := 1.0 / (1.0 + math.Exp(-k*(real(a[0])-0.5)))
+		return complex((v-lo)/(hi-lo), 0.0), nil
+	})
+	if err != nil {
+		return err
+	}
+	// lgg(x, lift, gamma, gain) - lift/gamma/gain colour grading
+	err = register("lgg", 4, func(a ...complex128) (complex128, error) {
+		g := real(a[2])
+		if g <= 0 {
+			return 0.0, fmt.Errorf("gamma must be positive, got %f", g)
+		}
+		x := real(a[0])*(1.0-real(a[1])) + real(a[1])
+		if x < 0 {
+			x = 0
+		}
+		return complex(real(a[3])*math.Pow(x, 1.0/g), 0.0), nil
+	})
+	if err != nil {
+		return err
+	}
+	// rot(z, turns) - rotates complex value
+	return register("rot", 2, func(a ...complex128) (complex128, error) {
+		return a[0] * cmplx.Rect(1.0, 2.0*math.Pi*real(a[1])), nil
+	})
+}
+
+// main - not used, it is only needed so 'go build ./...' works for plugin's main package
+func main() {
+}
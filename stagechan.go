@@ -0,0 +1,590 @@
+package jpegbw
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// MixStage - channel mix: each channel (alpha too) becomes weighted sum of pixel's R, G and B, weights are used as they are
+type MixStage struct {
+	Weights [4][3]float64
+}
+
+// Name - stage name
+func (s *MixStage) Name() string {
+	return "mix"
+}
+
+// Apply - mixes channels
+func (s *MixStage) Apply(ctx context.Context, f *Frame) error {
+	for c := 0; c < f.Channels; c++ {
+		w := s.Weights[c]
+		f.weights[c] = &w
+	}
+	return f.Parallel(ctx, func(i, t int) error {
+		for j := 0; j < f.Y; j++ {
+			px := f.Pix[i][j]
+			for c := 0; c < f.Channels; c++ {
+				f.Pix[i][j][c] = f.mix(c, uint32(px[0]), uint32(px[1]), uint32(px[2]), uint32(px[3]))
+			}
+		}
+		return nil
+	})
+}
+
+// StretchStage - percentile stretch: channel's values from Lo% to (100-Hi)% of its histogram are stretched to the full range
+// LoIdx, HiIdx override range ends (0 and FFFF mean not set), FrameOpts.Hint overrides both
+// ACM uses common range of all channels, ACMFactor from 0 (channel's range) to 1 (common range) mixes both ranges
+// Values are rounded to 16 bits after the next non channel stage, so gamma and expression get stretched values as they are
+type StretchStage struct {
+	Lo        [4]float64
+	Hi        [4]float64
+	LoIdx     [4]uint16
+	HiIdx     [4]uint16
+	ACM       bool
+	ACMFactor float64
+}
+
+// Name - stage name
+func (s *StretchStage) Name() string {
+	return "stretch"
+}
+
+// Apply - finds channel ranges and sets stretch mappings
+func (s *StretchStage) Apply(ctx context.Context, f *Frame) error {
+	var (
+		loIs  [4]uint16
+		hiIs  [4]uint16
+		mults [4]float64
+	)
+	all := float64(f.W * f.H)
+	for c := 0; c < f.Channels; c++ {
+		var loI, hiI uint16
+		lo := s.Lo[c]
+		hi := 100 - s.Hi[c]
+		if lo >= hi {
+			return fmt.Errorf("invalid lo-hi range: %f%% - %f%%", lo, hi)
+		}
+		loi := s.LoIdx[c]
+		hii := s.HiIdx[c]
+		if hii == 0 {
+			hii = 0xffff
+		}
+		if f.Opts.Hint != nil {
+			loi = f.Opts.Hint.LoIdx[c]
+			hii = f.Opts.Hint.HiIdx[c]
+		}
+		var hist [0x10000]int64
+		minGs := uint16(0xffff)
+		maxGs := uint16(0)
+		if f.pipe.Info > 0 || loi == 0 || hii == 0xffff {
+			for i := 0; i < f.W; i++ {
+				for j := 0; j < f.H; j++ {
+					gs := f.Pix[i][j][c]
+					if gs < minGs {
+						minGs = gs
+					}
+					if gs > maxGs {
+						maxGs = gs
+					}
+					hist[gs]++
+				}
+			}
+
+			// Calculations
+			var histCum [0x10000]float64
+			sum := int64(0)
+			for i := range histCum {
+				sum += hist[i]
+				histCum[i] = (float64(sum) * 100.0) / all
+			}
+			for i := 1; i < len(histCum); i++ {
+				prev := histCum[i-1]
+				next := histCum[i]
+				if loI == 0 && prev <= lo && lo <= next {
+					loI = uint16(i)
+				}
+				if prev <= hi && hi <= next {
+					hiI = uint16(i)
+				}
+			}
+			if loi > 0 && loi != loI {
+				// info: fmt.Printf("Overwriting %d low index: %04x -> %04x\n", c, loI, loi)
+				loI = loi
+			}
+			if hii < 0xffff && hii != hiI {
+				// info: fmt.Printf("Overwriting %d high index: %04x -> %04x\n", c, hiI, hii)
+				hiI = hii
+			}
+			if loI >= hiI {
+				return fmt.Errorf("calculated integer range is empty: %d-%d", loI, hiI)
+			}
+		} else {
+			loI = loi
+			hiI = hii
+		}
+		mult := 65535.0 / float64(hiI-loI)
+		loIs[c], hiIs[c], mults[c] = loI, hiI, mult
+		f.Stats.Ranges[c] = Range{Min: minGs, Max: maxGs, Lo: loI, Hi: hiI, Mult: mult}
+		f.Stats.Ranged[c] = true
+		if f.pipe.Info > 0 {
+			err := f.setInfo(ctx, c, &hist, loI, hiI)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.ACM {
+		acmloI := uint16(0xffff)
+		acmhiI := uint16(0)
+		for c := 0; c < f.Channels; c++ {
+			if loIs[c] < acmloI {
+				acmloI = loIs[c]
+			}
+			if hiIs[c] > acmhiI {
+				acmhiI = hiIs[c]
+			}
+		}
+		acmmult := 65535.0 / float64(acmhiI-acmloI)
+		f.note(" ACM int: (%d, %d) mult: %f...", acmloI, acmhiI, acmmult)
+		for c := 0; c < f.Channels; c++ {
+			if s.ACMFactor > 0.999999 {
+				loIs[c] = acmloI
+				hiIs[c] = acmhiI
+				mults[c] = acmmult
+			} else if s.ACMFactor > 0.000001 {
+				loI := uint16(float64(loIs[c]) - s.ACMFactor*float64(loIs[c]-acmloI))
+				hiI := uint16(float64(hiIs[c]) + s.ACMFactor*float64(acmhiI-hiIs[c]))
+				mult := mults[c] - s.ACMFactor*(mults[c]-acmmult)
+				f.note(" ACM(%f) int: (%d-%d->%d, %d-%d->%d) mult: %f-%f->%f...", s.ACMFactor, acmloI, loIs[c], loI, hiIs[c], acmhiI, hiI, acmmult, mults[c], mult)
+				loIs[c], hiIs[c], mults[c] = loI, hiI, mult
+			}
+		}
+	}
+	for c := 0; c < f.Channels; c++ {
+		loI, mult := loIs[c], mults[c]
+		f.toneKey[c] = fmt.Sprintf("stretch(%d,%x)", loI, math.Float64bits(mult))
+		f.tone[c] = func(gs uint16) float64 {
+			iv := int(gs) - int(loI)
+			if iv < 0 {
+				iv = 0
+			}
+			fv := float64(iv) * mult
+			if fv > 65535.0 {
+				fv = 65535.0
+			}
+			return fv
+		}
+	}
+	return nil
+}
+
+// setInfo - sets channel's input pixels outside of image (added by Pipeline.Info): scale of stretched range on the right
+// and 2 histograms (scaled to stretched range and absolute) on the bottom, scale goes through the following channel stages
+func (f *Frame) setInfo(ctx context.Context, c int, hist *[0x10000]int64, loI, hiI uint16) error {
+	x, y, inf := f.X, f.Y, f.pipe.Info
+	einf := f.pipe.InfoExt
+	shpow := f.pipe.InfoPow
+	b := 65535.0 / float64(x)
+	histScaled := make([]int64, x)
+	maxHS := int64(0)
+	if shpow != 0 {
+		for i := uint16(0); i < uint16(x); i++ {
+			ff := (float64(i) * b) / 65535.0
+			from := uint16(math.Pow(ff, shpow) * 65535.0)
+			tf := (float64(i+1) * b) / 65535.0
+			to := uint16(math.Pow(tf, shpow) * 65535.0)
+			if to == from {
+				to++
+			}
+			hv := int64(0)
+			for h := from; h < to; h++ {
+				hv += hist[h]
+			}
+			histScaled[i] = hv
+			if hv > maxHS {
+				maxHS = hv
+			}
+		}
+	} else {
+		for i := uint16(0); i < uint16(x); i++ {
+			from := uint16(float64(i) * b)
+			to := uint16(float64(i+1) * b)
+			if to == from {
+				to++
+			}
+			hv := int64(0)
+			for h := from; h < to; h++ {
+				hv += hist[h]
+			}
+			histScaled[i] = hv
+			if hv > maxHS {
+				maxHS = hv
+			}
+		}
+	}
+	fran := float64((hiI - loI) + 1)
+	b2 := fran / float64(x)
+	histScaled2 := make([]int64, x)
+	maxHS2 := int64(0)
+	for i := uint16(0); i < uint16(x); i++ {
+		from := loI + uint16(float64(i)*b2)
+		to := uint16(float64(from) + b2)
+		if to == from {
+			to++
+		}
+		hv := int64(0)
+		for h := from; h < to; h++ {
+			hv += hist[h]
+		}
+		histScaled2[i] = hv
+		if hv > maxHS2 {
+			maxHS2 = hv
+		}
+	}
+	// empty histogram bars are interpolated from their neighbours
+	for _, hs := range [][]int64{histScaled, histScaled2} {
+		prev := int64(0)
+		next := int64(0)
+		prevI := uint16(0xffff)
+		for i := uint16(0); i < uint16(x); i++ {
+			v := hs[i]
+			if v > 0 {
+				prev = v
+				prevI = i
+			} else {
+				nextJ := uint16(0xffff)
+				for j := i + 1; j < uint16(x); j++ {
+					w := hs[j]
+					if w > 0 {
+						next = w
+						nextJ = j
+						break
+					}
+				}
+				if prevI != 0xffff && nextJ != 0xffff {
+					hs[i] = prev + int64((float64(i-prevI)/float64(nextJ-prevI))*float64(next-prev))
+				}
+			}
+		}
+	}
+	maxHSF := float64(maxHS)
+	maxHSF2 := float64(maxHS2)
+	finf := float64(inf * 2)
+	// debug: fmt.Printf("histScaled: %+v\n", histScaled)
+	ran := (hiI - loI) + 1
+	ran4 := (ran + 1) / 4
+	if ran == 0 {
+		ran = 0xffff
+	}
+	if ran4 == 0 {
+		ran4 = 0x4000
+	}
+	synth := func(i, j int) (uint32, uint32, uint32, uint32) {
+		if j < y-(2*inf) {
+			// scale on the right: GS or GS, R, G, B
+			if einf {
+				g := (uint32(j) * uint32(ran)) / uint32(y-2*inf)
+				d := g / uint32(ran4)
+				r := uint32(hiI) - ((g % uint32(ran4)) << 2)
+				switch d {
+				case 0:
+					return r, r, r, uint32(0xffff)
+				case 1:
+					return r, 0, 0, uint32(0xffff)
+				case 2:
+					return 0, r, 0, uint32(0xffff)
+				default:
+					return 0, 0, r, uint32(0xffff)
+				}
+			}
+			g := uint32(hiI) - ((uint32(j) * uint32(ran)) / uint32(y-2*inf))
+			return g, g, g, uint32(0xffff)
+		}
+		// 2 histograms on the botton: scaled & absolute
+		cv := float64((y-j)-1) / finf
+		ncv := cv * 2.
+		g := uint32(0xffff)
+		if cv < .5 {
+			hv := float64(histScaled[uint16(i)]) / maxHSF
+			if ncv >= hv {
+				g = uint32(0)
+			}
+		} else {
+			ncv -= 1.
+			hv2 := float64(histScaled2[uint16(i)]) / maxHSF2
+			if ncv >= hv2 {
+				g = uint32(0)
+			}
+		}
+		return g, g, g, uint32(0xffff)
+	}
+	f.synth[c] = synth
+	return f.Parallel(ctx, func(i, t int) error {
+		for j := 0; j < y; j++ {
+			if i < f.W && j < f.H {
+				continue
+			}
+			pr, pg, pb, pa := synth(i, j)
+			if j < f.H {
+				f.Pix[i][j][c] = f.mix(c, pr, pg, pb, pa)
+			} else {
+				f.Pix[i][j][c] = uint16([4]uint32{pr, pg, pb, pa}[c])
+			}
+		}
+		return nil
+	})
+}
+
+// GammaStage - per channel gamma: v -> v^Gamma (in 0-1 range), channels with nil Gamma are not changed
+type GammaStage struct {
+	Gamma [4]*float64
+}
+
+// Name - stage name
+func (s *GammaStage) Name() string {
+	return "gamma"
+}
+
+func (s *GammaStage) tone() {}
+
+// Apply - adds gamma to channel mappings
+func (s *GammaStage) Apply(ctx context.Context, f *Frame) error {
+	for c := 0; c < f.Channels; c++ {
+		if s.Gamma[c] == nil {
+			continue
+		}
+		ga := *s.Gamma[c]
+		prev := f.toneOf(c)
+		f.toneKey[c] += fmt.Sprintf("gamma(%x)", math.Float64bits(ga))
+		f.tone[c] = func(gs uint16) float64 {
+			fv := math.Pow(prev(gs)/65535.0, ga) * 65535.0
+			if fv < 0.0 {
+				fv = 0.0
+			}
+			if fv > 65535.0 {
+				fv = 65535.0
+			}
+			return fv
+		}
+	}
+	return nil
+}
+
+// FuncStage - applies compiled expressions to channels, channels with nil Func are not changed, arguments are:
+// x1 - channel's value (0-1), x2 - pixel's position (x+yi, 0-1), x3, x4 - input pixel's R+Gi, B+Ai (0-1),
+// x5 - FrameOpts.Seq + previous pixel's result (in the same column) i
+// Real part of the result (imaginary when Imag is set) is the new value (0-1), Func is only copied, so it can be used concurrently
+// Functions using only x1 are precomputed for all values (unless NoLUT is set), functions not using x5 are evaluated for
+// the whole column at once (unless NoRows is set)
+// Precomputed tables are reused by next frames while the channel mapping (stretch, gamma) doesn't change
+type FuncStage struct {
+	Func   [4]*FparCtx
+	Imag   [4]bool
+	NoLUT  bool
+	NoRows bool
+	mtx    sync.Mutex
+	luts   [4]funcLUT
+}
+
+// funcLUT - precomputed table of channel's function for channel mapping described by key, lut is nil when table cannot be used
+type funcLUT struct {
+	key   string
+	built bool
+	lut   *[65536]uint16
+}
+
+// Name - stage name
+func (s *FuncStage) Name() string {
+	return "f"
+}
+
+func (s *FuncStage) tone() {}
+
+// lut16 - table of channel c function for frame's channel mapping, it is built once per mapping: once per run when there is no
+// stretch and gamma, tables for other mappings are not built for frames with fewer pixels than table entries
+// nil when function uses more than x1 or table cannot be built (function fails for some value), values are then computed per pixel
+func (s *FuncStage) lut16(f *Frame, c int, tone func(uint16) float64) *[65536]uint16 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	key := f.toneKey[c]
+	fl := &s.luts[c]
+	if fl.built && fl.key == key {
+		return fl.lut
+	}
+	if key != "" && f.X*f.toneRows < 65536 {
+		return nil
+	}
+	lut, err := s.Func[c].LUT16(f.Threads, tone, s.Imag[c])
+	if err != nil {
+		f.note(" %s LUT not used: %v...", "RGBA"[c:c+1], err)
+		lut = nil
+	}
+	*fl = funcLUT{key: key, built: true, lut: lut}
+	return lut
+}
+
+// Apply - evaluates functions
+func (s *FuncStage) Apply(ctx context.Context, f *Frame) error {
+	thrN := f.Threads
+	ny := f.toneRows
+	for c := 0; c < f.Channels; c++ {
+		if s.Func[c] == nil {
+			continue
+		}
+		fctx := s.Func[c]
+		useImag := s.Imag[c]
+		gsToFv := f.toneOf(c)
+
+		// Function using only x1 is precomputed for all gray values
+		var lut *[65536]uint16
+		if !s.NoLUT {
+			lut = s.lut16(f, c, gsToFv)
+		}
+		f.tone[c] = nil
+		f.toneKey[c] = ""
+
+		// Function not using x5 (previous pixel's value) is evaluated for the whole column at once
+		rowsB := lut == nil && !s.NoRows && !fctx.UsedArgs()[4]
+
+		// Context copy, arguments and values buffers per thread
+		ctxa := make([]FparCtx, thrN)
+		rowArgs := make([][4][]complex128, thrN)
+		rowVals := make([][]complex128, thrN)
+		rowArgv := make([][]complex128, thrN)
+		for t := 0; t < thrN; t++ {
+			ctxa[t] = fctx.Cpy()
+			rowArgv[t] = make([]complex128, 5)
+			if rowsB {
+				for k := range rowArgs[t] {
+					rowArgs[t][k] = make([]complex128, ny)
+				}
+				rowVals[t] = make([]complex128, ny)
+			}
+		}
+		col := c
+		err := f.Parallel(ctx, func(i, t int) error {
+			pix := f.Pix[i]
+			if lut != nil {
+				for j := 0; j < ny; j++ {
+					pix[j][col] = lut[pix[j][col]]
+				}
+				return nil
+			}
+			fi := float64(i) / float64(f.X)
+			if rowsB {
+				args := rowArgs[t]
+				for j := 0; j < ny; j++ {
+					pr, pg, pb, pa := f.source(col, i, j)
+					args[0][j] = complex(gsToFv(pix[j][col])/65535.0, 0.0)
+					args[1][j] = complex(fi, float64(j)/float64(f.Y))
+					args[2][j] = complex(float64(pr)/65535.0, float64(pg)/65535.0)
+					args[3][j] = complex(float64(pb)/65535.0, float64(pa)/65535.0)
+				}
+				e := ctxa[t].EvalRows(rowVals[t], args[0], args[1], args[2], args[3], nil)
+				if e != nil {
+					return e
+				}
+			}
+			trace := 1.0
+			for j := 0; j < ny; j++ {
+				var cv complex128
+				if rowsB {
+					cv = rowVals[t][j]
+				} else {
+					pr, pg, pb, pa := f.source(col, i, j)
+					argv := rowArgv[t]
+					argv[0] = complex(gsToFv(pix[j][col])/65535.0, 0.0)
+					argv[1] = complex(fi, float64(j)/float64(f.Y))
+					argv[2] = complex(float64(pr)/65535.0, float64(pg)/65535.0)
+					argv[3] = complex(float64(pb)/65535.0, float64(pa)/65535.0)
+					argv[4] = complex(f.Opts.Seq, trace)
+					var e error
+					cv, e = ctxa[t].FparF(argv)
+					if e != nil {
+						return e
+					}
+				}
+				fv := real(cv)
+				if useImag {
+					fv = imag(cv)
+				}
+				trace = fv
+				// trace: fmt.Printf("trace is: %v\n", trace)
+				fv *= 65535.0
+				if fv < 0.0 {
+					fv = 0.0
+				}
+				if fv > 65535.0 {
+					fv = 65535.0
+				}
+				pix[j][col] = uint16(fv)
+			}
+			return nil
+		})
+		for t := range ctxa {
+			ctxa[t].Tidy()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevStage - reverses the change made by previous stages: value is input pixel's value minus that change (clipped)
+type RevStage struct{}
+
+// Name - stage name
+func (s *RevStage) Name() string {
+	return "rev"
+}
+
+// Apply - reverses values
+func (s *RevStage) Apply(ctx context.Context, f *Frame) error {
+	return f.Parallel(ctx, func(i, t int) error {
+		for j := 0; j < f.toneRows; j++ {
+			for c := 0; c < f.Channels; c++ {
+				pr, pg, pb, pa := f.source(c, i, j)
+				cv := [4]uint32{pr, pg, pb, pa}[c]
+				delta := int(f.Pix[i][j][c]) - int(cv)
+				set := int(cv) - delta
+				if set < 0 {
+					set = 0
+				}
+				if set > 0xffff {
+					set = 0xffff
+				}
+				f.Pix[i][j][c] = uint16(set)
+			}
+		}
+		return nil
+	})
+}
+
+// GSStage - grayscale output: R, G and B become weighted sum of R, G and B, output image is gray
+type GSStage struct {
+	R float64
+	G float64
+	B float64
+}
+
+// Name - stage name
+func (s *GSStage) Name() string {
+	return "gs"
+}
+
+// Apply - converts pixels to gray
+func (s *GSStage) Apply(ctx context.Context, f *Frame) error {
+	f.gray = true
+	return f.Parallel(ctx, func(i, t int) error {
+		for j := 0; j < f.Y; j++ {
+			px := f.Pix[i][j]
+			gs := uint16(float64(px[0])*s.R + float64(px[1])*s.G + float64(px[2])*s.B)
+			f.Pix[i][j][0], f.Pix[i][j][1], f.Pix[i][j][2] = gs, gs, gs
+		}
+		return nil
+	})
+}
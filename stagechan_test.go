@@ -0,0 +1,110 @@
+package jpegbw
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"sync/atomic"
+	"testing"
+)
+
+// grayImage - image with gray values from 0 to maxv
+func grayImage(w, h int, maxv uint16) *image.RGBA64 {
+	m := image.NewRGBA64(image.Rect(0, 0, w, h))
+	for i := 0; i < w; i++ {
+		for j := 0; j < h; j++ {
+			v := uint16((i*h + j) * int(maxv) / (w*h - 1))
+			m.Set(i, j, color.RGBA64{v, v, v, 0xffff})
+		}
+	}
+	return m
+}
+
+func TestFuncStageLUT(t *testing.T) {
+	var calls int64
+	err := RegisterFunc("testlutcalls", 1, func(args ...complex128) (complex128, error) {
+		atomic.AddInt64(&calls, 1)
+		return 1 - args[0], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RegisterFunc("testlutfails", 1, func(args ...complex128) (complex128, error) {
+		if real(args[0]) > 0.9 {
+			return 0, fmt.Errorf("value %v too big", args[0])
+		}
+		return 1 - args[0], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testCases = []struct {
+		name   string
+		expr   string
+		w, h   int
+		maxv   uint16
+		stages func(f *FuncStage) []Stage
+		calls  []int64
+		fail   bool
+	}{
+		// table is built for the first frame and reused by the next frames
+		{name: "identity", expr: "testlutcalls(x1)", w: 300, h: 250, maxv: 30000, stages: func(f *FuncStage) []Stage { return []Stage{f} }, calls: []int64{65536, 0, 0}},
+		{name: "identity small", expr: "testlutcalls(x1)", w: 10, h: 10, maxv: 30000, stages: func(f *FuncStage) []Stage { return []Stage{f} }, calls: []int64{65536, 0}},
+		// small frames with channel mapping are computed per pixel
+		{name: "gamma small", expr: "testlutcalls(x1)", w: 10, h: 10, maxv: 30000, stages: func(f *FuncStage) []Stage {
+			ga := 0.5
+			return []Stage{&GammaStage{Gamma: [4]*float64{&ga}}, f}
+		}, calls: []int64{100, 100}},
+		{name: "gamma", expr: "testlutcalls(x1)", w: 300, h: 250, maxv: 30000, stages: func(f *FuncStage) []Stage {
+			ga := 0.5
+			return []Stage{&GammaStage{Gamma: [4]*float64{&ga}}, f}
+		}, calls: []int64{65536, 0}},
+		// function fails for values that are not in the image, so table cannot be built, but frame is processed
+		{name: "fallback", expr: "testlutfails(x1)", w: 300, h: 250, maxv: 50000, stages: func(f *FuncStage) []Stage { return []Stage{f} }},
+		// function fails for value in the image
+		{name: "fail", expr: "testlutfails(x1)", w: 20, h: 20, maxv: 65535, stages: func(f *FuncStage) []Stage { return []Stage{f} }, fail: true},
+	}
+	for _, tc := range testCases {
+		fctx, err := compile(t, tc.expr, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs := &FuncStage{Func: [4]*FparCtx{fctx}}
+		p := &Pipeline{Stages: tc.stages(fs), Channels: 1, Threads: 3}
+		m := grayImage(tc.w, tc.h, tc.maxv)
+		frames := len(tc.calls)
+		if frames == 0 {
+			frames = 2
+		}
+		for k := 0; k < frames; k++ {
+			before := atomic.LoadInt64(&calls)
+			out, _, err := p.Process(context.Background(), m)
+			n := atomic.LoadInt64(&calls) - before
+			if tc.fail {
+				if err == nil {
+					t.Errorf("%s: expected error", tc.name)
+				}
+				break
+			}
+			if err != nil {
+				t.Errorf("%s frame %d: %v", tc.name, k, err)
+				break
+			}
+			if tc.calls != nil && n != tc.calls[k] {
+				t.Errorf("%s frame %d: function called %d times, expected %d", tc.name, k, n, tc.calls[k])
+			}
+			if len(tc.stages(fs)) > 1 {
+				continue
+			}
+			for _, pt := range []image.Point{{0, 0}, {tc.w / 2, tc.h / 3}, {tc.w - 1, tc.h - 1}} {
+				v := m.RGBA64At(pt.X, pt.Y).R
+				got, _, _, _ := out.At(pt.X, pt.Y).RGBA()
+				want := uint32((1 - float64(v)/65535.0) * 65535.0)
+				if got != want {
+					t.Errorf("%s frame %d: pixel %v %d -> %d, expected %d", tc.name, k, pt, v, got, want)
+				}
+			}
+		}
+	}
+}
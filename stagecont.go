@@ -0,0 +1,122 @@
+package jpegbw
+
+import (
+	"context"
+	"time"
+)
+
+// ContourStage - draws Count[c] contour lines of channel c (0 - no contours, up to 3FFF)
+// Edge and Surf are values of contour and non contour pixels: 0, 1, 2 (original value), 3 (inverted value)
+// When Global[c] is set, channel c's contour is detected in any channel (R, G, B or A)
+type ContourStage struct {
+	Count  [4]uint16
+	Edge   [4]uint16
+	Surf   [4]uint16
+	Global [4]bool
+}
+
+// Name - stage name
+func (s *ContourStage) Name() string {
+	return "cont"
+}
+
+// Apply - draws contours
+func (s *ContourStage) Apply(ctx context.Context, f *Frame) error {
+	contB := false
+	for c := 0; c < f.Channels; c++ {
+		if s.Count[c] > 0 {
+			contB = true
+			break
+		}
+	}
+	if !contB {
+		return nil
+	}
+	dtContStart := time.Now()
+	x, y := f.X, f.Y
+	pxdata := f.Pix
+	tpxdata := make([][][4]uint16, x)
+	for i := range tpxdata {
+		tpxdata[i] = append([][4]uint16{}, pxdata[i]...)
+	}
+	for colidx := 0; colidx < f.Channels; colidx++ {
+		cont := s.Count[colidx] + 1
+		if cont < 2 {
+			continue
+		}
+		surf := s.Surf[colidx]
+		edge := s.Edge[colidx]
+
+		colidxF := colidx
+		colidxT := colidx
+		if s.Global[colidx] {
+			colidxF = 0
+			colidxT = f.Channels - 1
+		}
+		contours := []uint16{}
+		for t := uint16(1); t < cont; t++ {
+			contours = append(contours, uint16((uint32(t)*uint32(0xffff))/uint32(cont)))
+		}
+		// value of contour (edge) or non contour (surf) pixel
+		set := func(i, j int, mode uint16) {
+			if mode == 0 || mode == 1 {
+				pxdata[i][j][colidx] = uint16(0xffff * mode)
+			} else if mode == 2 {
+				pxdata[i][j][colidx] = tpxdata[i][j][colidx]
+			} else if mode == 3 {
+				pxdata[i][j][colidx] = uint16(0xffff) - tpxdata[i][j][colidx]
+			}
+		}
+		// crosses - contour crosses (j1, j2) in j direction or neighbour columns (i1, i2) in i direction
+		crosses := func(i1, i2, i, j, j1, j2 int) bool {
+			for ci := colidxF; ci <= colidxT; ci++ {
+				di1 := tpxdata[i1][j][ci]
+				di2 := tpxdata[i2][j][ci]
+				dj1 := tpxdata[i][j1][ci]
+				dj2 := tpxdata[i][j2][ci]
+				for _, contour := range contours {
+					if (di1 < contour && di2 >= contour) || (dj1 < contour && dj2 >= contour) || (di1 > contour && di2 <= contour) || (dj1 > contour && dj2 <= contour) {
+						return true
+					}
+				}
+			}
+			return false
+		}
+		err := f.Parallel(ctx, func(i, t int) error {
+			i1 := i - 1
+			i2 := i + 1
+			if i1 < 0 {
+				i1 = 0
+			}
+			if i2 >= x {
+				i2 = x - 1
+			}
+			// the first and the last row compare with their only neighbour row
+			if crosses(i1, i2, i, 0, 0, 1) {
+				set(i, 0, edge)
+			} else {
+				set(i, 0, surf)
+			}
+			yp := y - 1
+			if crosses(i1, i2, i, yp, yp-1, yp) {
+				set(i, yp, edge)
+			} else {
+				pxdata[i][yp][colidx] = uint16(0)
+				set(i, yp, surf)
+			}
+			for j := 1; j < yp; j++ {
+				if crosses(i1, i2, i, j, j-1, j+1) {
+					set(i, j, edge)
+				} else {
+					set(i, j, surf)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	f.note(" contours (%+v)...", time.Since(dtContStart))
+	return nil
+}
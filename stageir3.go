@@ -0,0 +1,186 @@
+package jpegbw
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// IR3Stage - IR3 false color mapping of infrared tails: pixels with blue/(red+blue) ratio far from 1/2 (Threshold is
+// the ratio limit) get shortwave (red to yellow/green) or longwave (violet) colors, GreenOnly changes only the green channel
+// Use NewIR3Stage for v4 defaults, see readme-ir3.md
+type IR3Stage struct {
+	GreenOnly      bool
+	Threshold      float64
+	ShortStrength  float64
+	LongStrength   float64
+	ShadowFloor    float64
+	GreenMid       float64
+	ShortSplit     float64
+	ShortEndR      float64
+	ShortEndG      float64
+	ShortEndB      float64
+	LongSplit      float64
+	LongVioletR    float64
+	LongVioletG    float64
+	LongVioletB    float64
+	LongEndR       float64
+	LongEndG       float64
+	LongEndB       float64
+	GOnlyShortEnd  float64
+	GOnlyLongMid   float64
+	GOnlyLongEnd   float64
+	GOnlyLongSplit float64
+}
+
+// NewIR3Stage - IR3 stage with default (v4) parameters
+func NewIR3Stage() *IR3Stage {
+	return &IR3Stage{
+		Threshold:     2.5,
+		ShortStrength: 1.0,
+		LongStrength:  1.0,
+		ShadowFloor:   0.08,
+		GreenMid:      1.0,
+
+		/* shortwave full-map defaults: unchanged from v3 */
+		ShortSplit: 0.55,
+		ShortEndR:  0.0,
+		ShortEndG:  1.0,
+		ShortEndB:  0.0,
+
+		/*
+			Longwave full-map defaults:
+			- violet should start earlier than in v3
+			- endpoint should be halfway between v2 and v3
+			v2: split=0.55 violet=(0.55,0.00,1.00) end=(1.00,0.30,0.82)
+			v3: split=0.82 violet=(0.34,0.00,1.00) end=(0.50,0.06,0.92)
+			v4 midpoint default:
+			    split=0.685 violet=(0.445,0.00,1.00) end=(0.75,0.18,0.87)
+		*/
+		LongSplit:   0.685,
+		LongVioletR: 0.445,
+		LongVioletG: 0.0,
+		LongVioletB: 1.0,
+		LongEndR:    0.75,
+		LongEndG:    0.18,
+		LongEndB:    0.87,
+
+		/* green-only defaults: unchanged from v3 */
+		GOnlyShortEnd:  1.0,
+		GOnlyLongMid:   0.60,
+		GOnlyLongEnd:   1.0,
+		GOnlyLongSplit: 0.80,
+	}
+}
+
+func ir3ShortRamp(u float64, cfg *IR3Stage) (float64, float64, float64) {
+	u = clamp01(u)
+	t1 := smooth01(u / cfg.ShortSplit)
+	t2 := smooth01((u - cfg.ShortSplit) / (1.0 - cfg.ShortSplit))
+	r := 1.0
+	g := t1
+	b := 0.0
+	r = mixf(r, cfg.ShortEndR, t2)
+	g = mixf(g, cfg.ShortEndG, t2)
+	b = mixf(b, cfg.ShortEndB, t2)
+	return clamp01(r), clamp01(g), clamp01(b)
+}
+
+func ir3LongRamp(u float64, cfg *IR3Stage) (float64, float64, float64) {
+	u = clamp01(u)
+	t1 := smooth01(u / cfg.LongSplit)
+	t2 := smooth01((u - cfg.LongSplit) / (1.0 - cfg.LongSplit))
+	r := mixf(0.0, cfg.LongVioletR, t1)
+	g := mixf(0.0, cfg.LongVioletG, t1)
+	b := mixf(1.0, cfg.LongVioletB, t1)
+	r = mixf(r, cfg.LongEndR, t2)
+	g = mixf(g, cfg.LongEndG, t2)
+	b = mixf(b, cfg.LongEndB, t2)
+	return clamp01(r), clamp01(g), clamp01(b)
+}
+
+func ir3LongRampGOnly(u float64, cfg *IR3Stage) float64 {
+	u = clamp01(u)
+	t1 := smooth01(u / cfg.GOnlyLongSplit)
+	t2 := smooth01((u - cfg.GOnlyLongSplit) / (1.0 - cfg.GOnlyLongSplit))
+	g := mixf(0.0, cfg.GOnlyLongMid, t1)
+	g = mixf(g, cfg.GOnlyLongEnd, t2)
+	return clamp01(g)
+}
+
+func ir3Map(r, g, b float64, cfg *IR3Stage) (float64, float64, float64) {
+	const eps = 1e-12
+
+	r = clamp01(r)
+	g = clamp01(g)
+	b = clamp01(b)
+
+	pos := b / (r + b + eps)
+	shortThr := 1.0 / (cfg.Threshold + 1.0)
+	longThr := cfg.Threshold / (cfg.Threshold + 1.0)
+
+	shortTail := 0.0
+	longTail := 0.0
+	if pos < shortThr {
+		shortTail = smooth01((shortThr - pos) / (shortThr + eps))
+	}
+	if pos > longThr {
+		longTail = smooth01((pos - longThr) / (1.0 - longThr + eps))
+	}
+
+	lum := math.Max(r, b)
+	amp := smooth01((lum - cfg.ShadowFloor) / (1.0 - cfg.ShadowFloor))
+	shortTail *= amp
+	longTail *= amp
+
+	outR := r
+	outG := clamp01(g * cfg.GreenMid)
+	outB := b
+
+	if shortTail > 0.0 {
+		sr, sg, sb := ir3ShortRamp(shortTail, cfg)
+		t := clamp01(cfg.ShortStrength * shortTail)
+		if cfg.GreenOnly {
+			outG = mixf(outG, lum*clamp01(sg*cfg.GOnlyShortEnd), t)
+		} else {
+			outR = mixf(outR, lum*sr, t)
+			outG = mixf(outG, lum*sg, t)
+			outB = mixf(outB, lum*sb, t)
+		}
+	}
+	if longTail > 0.0 {
+		t := clamp01(cfg.LongStrength * longTail)
+		if cfg.GreenOnly {
+			lg := ir3LongRampGOnly(longTail, cfg)
+			outG = mixf(outG, lum*lg, t)
+		} else {
+			lr, lg, lb := ir3LongRamp(longTail, cfg)
+			outR = mixf(outR, lum*lr, t)
+			outG = mixf(outG, lum*lg, t)
+			outB = mixf(outB, lum*lb, t)
+		}
+	}
+
+	if cfg.GreenOnly {
+		return r, clamp01(outG), b
+	}
+	return clamp01(outR), clamp01(outG), clamp01(outB)
+}
+
+// Name - stage name
+func (s *IR3Stage) Name() string {
+	return "ir3"
+}
+
+// Apply - maps R, G, B of all pixels
+func (s *IR3Stage) Apply(ctx context.Context, f *Frame) error {
+	dtStart := time.Now()
+	err := f.mapRGB(ctx, func(r, g, b float64) (float64, float64, float64) {
+		return ir3Map(r, g, b, s)
+	})
+	if err != nil {
+		return err
+	}
+	f.note(" ir3 (%+v)...", time.Since(dtStart))
+	return nil
+}
@@ -0,0 +1,369 @@
+package jpegbw
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// IsoValStage - equalizes weighted RGB value (WR, WG, WB weights) of all pixels to Target (0-1), modes:
+// add - adds the same offset to R, G, B, mul - multiplies R, G, B, exp - multiplies ExpBase^R, ExpBase^G, ExpBase^B
+// AutoMode selects the target from image's values: avg, p (AutoPct percentile), min or max (the widest range not clipped),
+// ClipPct percent of values on both ends is discarded when calculating auto target
+// Use NewIsoValStage for defaults (add mode), see readme-isoval.md
+type IsoValStage struct {
+	Mode     string
+	Target   float64
+	AutoMode string
+	AutoPct  float64
+	ClipPct  float64
+	ExpBase  float64
+	WR       float64
+	WG       float64
+	WB       float64
+}
+
+// NewIsoValStage - iso value stage with default parameters
+func NewIsoValStage() *IsoValStage {
+	return &IsoValStage{
+		Mode:    "add",
+		Target:  0.5,
+		AutoPct: 50.0,
+		ExpBase: 2.0,
+		WR:      0.2126,
+		WG:      0.7152,
+		WB:      0.0722,
+	}
+}
+
+type isoValStats struct {
+	minV         float64
+	maxV         float64
+	avgV         float64
+	medV         float64
+	addTargetMin float64
+	addTargetMax float64
+	mulTargetMax float64
+	expTargetMax float64
+	valueHist    []int64
+}
+
+func isoValValue(r, g, b float64, cfg *IsoValStage) float64 {
+	return cfg.WR*r + cfg.WG*g + cfg.WB*b
+}
+
+func isoValAddMode(r, g, b float64, cfg *IsoValStage) (float64, float64, float64) {
+	delta := cfg.Target - isoValValue(r, g, b, cfg)
+	return clamp01(r + delta), clamp01(g + delta), clamp01(b + delta)
+}
+
+func isoValMulMode(r, g, b float64, cfg *IsoValStage) (float64, float64, float64) {
+	const eps = 1e-12
+	v := isoValValue(r, g, b, cfg)
+	if v <= eps {
+		return r, g, b
+	}
+	s := cfg.Target / v
+	return clamp01(r * s), clamp01(g * s), clamp01(b * s)
+}
+
+func isoValExpMode(r, g, b float64, cfg *IsoValStage) (float64, float64, float64) {
+	const eps = 1e-12
+	if cfg.Target <= eps {
+		return 0.0, 0.0, 0.0
+	}
+	br := math.Pow(cfg.ExpBase, r)
+	bg := math.Pow(cfg.ExpBase, g)
+	bb := math.Pow(cfg.ExpBase, b)
+	denom := cfg.WR*br + cfg.WG*bg + cfg.WB*bb
+	if denom <= eps {
+		return 0.0, 0.0, 0.0
+	}
+	s := cfg.Target / denom
+	return clamp01(br * s), clamp01(bg * s), clamp01(bb * s)
+}
+
+func isoValHistIdx(v float64) int {
+	v = clamp01(v)
+	return int(v*65535.0 + 0.5)
+}
+
+func isoValHistTotal(hist []int64) int64 {
+	total := int64(0)
+	for _, hv := range hist {
+		total += hv
+	}
+	return total
+}
+
+func isoValHistTrimCount(total int64, trimPct float64) int64 {
+	if total <= 0 || trimPct <= 0.0 {
+		return 0
+	}
+	trim := int64((trimPct / 100.0) * float64(total))
+	if trim < 0 {
+		trim = 0
+	}
+	if 2*trim >= total {
+		trim = (total - 1) / 2
+	}
+	return trim
+}
+
+func isoValHistQuantilePct(hist []int64, pct float64) float64 {
+	total := isoValHistTotal(hist)
+	if total <= 0 {
+		return 0.0
+	}
+	if pct < 0.0 {
+		pct = 0.0
+	}
+	if pct > 100.0 {
+		pct = 100.0
+	}
+	rank := int64((pct / 100.0) * float64(total-1))
+	cum := int64(0)
+	for i, hv := range hist {
+		cum += hv
+		if cum > rank {
+			return float64(i) / 65535.0
+		}
+	}
+	return 1.0
+}
+
+func isoValHistQuantileTrimmed(hist []int64, trimPct, pct float64) float64 {
+	total := isoValHistTotal(hist)
+	if total <= 0 {
+		return 0.0
+	}
+	if pct < 0.0 {
+		pct = 0.0
+	}
+	if pct > 100.0 {
+		pct = 100.0
+	}
+	trim := isoValHistTrimCount(total, trimPct)
+	trimmedN := total - 2*trim
+	if trimmedN <= 0 {
+		return 0.0
+	}
+	rank := trim + int64((pct/100.0)*float64(trimmedN-1))
+	cum := int64(0)
+	for i, hv := range hist {
+		cum += hv
+		if cum > rank {
+			return float64(i) / 65535.0
+		}
+	}
+	return 1.0
+}
+
+func isoValHistMeanTrimmed(hist []int64, trimPct float64) float64 {
+	total := isoValHistTotal(hist)
+	if total <= 0 {
+		return 0.0
+	}
+	trim := isoValHistTrimCount(total, trimPct)
+	loRank := trim
+	hiRankEx := total - trim
+	if hiRankEx <= loRank {
+		return 0.0
+	}
+	sum := 0.0
+	cnt := int64(0)
+	cum := int64(0)
+	for i, hv := range hist {
+		if hv <= 0 {
+			continue
+		}
+		start := cum
+		end := cum + hv
+		useStart := start
+		if useStart < loRank {
+			useStart = loRank
+		}
+		useEnd := end
+		if useEnd > hiRankEx {
+			useEnd = hiRankEx
+		}
+		if useEnd > useStart {
+			n := useEnd - useStart
+			sum += (float64(i) / 65535.0) * float64(n)
+			cnt += n
+		}
+		cum = end
+	}
+	if cnt <= 0 {
+		return 0.0
+	}
+	return sum / float64(cnt)
+}
+
+// AutoLabel - auto target mode: avg, min, max or pNN (AutoPct percentile)
+func (s *IsoValStage) AutoLabel() string {
+	if s.AutoMode == "p" {
+		return fmt.Sprintf("p%g", s.AutoPct)
+	}
+	return s.AutoMode
+}
+
+func isoValStatsFromPxdata(pxdata [][][4]uint16, x, y int, cfg *IsoValStage) isoValStats {
+	const eps = 1e-12
+
+	valueHist := make([]int64, 0x10000)
+	addLoHist := make([]int64, 0x10000)
+	addHiHist := make([]int64, 0x10000)
+	mulHiHist := make([]int64, 0x10000)
+	expHiHist := make([]int64, 0x10000)
+
+	st := isoValStats{
+		minV:         0.0,
+		maxV:         0.0,
+		avgV:         0.0,
+		medV:         0.0,
+		addTargetMin: 0.0,
+		addTargetMax: 1.0,
+		mulTargetMax: 0.0,
+		expTargetMax: 0.0,
+		valueHist:    valueHist,
+	}
+
+	first := true
+	for i := 0; i < x; i++ {
+		for j := 0; j < y; j++ {
+			px := pxdata[i][j]
+			r := float64(px[0]) / 65535.0
+			g := float64(px[1]) / 65535.0
+			b := float64(px[2]) / 65535.0
+			v := isoValValue(r, g, b, cfg)
+
+			if first {
+				st.minV = v
+				st.maxV = v
+				first = false
+			} else {
+				if v < st.minV {
+					st.minV = v
+				}
+				if v > st.maxV {
+					st.maxV = v
+				}
+			}
+
+			valueHist[isoValHistIdx(v)]++
+
+			minRGB := math.Min(r, math.Min(g, b))
+			maxRGB := math.Max(r, math.Max(g, b))
+
+			addLo := v - minRGB
+			addHi := v + 1.0 - maxRGB
+			addLoHist[isoValHistIdx(addLo)]++
+			addHiHist[isoValHistIdx(addHi)]++
+
+			if v > eps && maxRGB > eps {
+				mulHi := v / maxRGB
+				mulHiHist[isoValHistIdx(mulHi)]++
+			}
+
+			br := math.Pow(cfg.ExpBase, r)
+			bg := math.Pow(cfg.ExpBase, g)
+			bexp := math.Pow(cfg.ExpBase, b)
+			maxExp := math.Max(br, math.Max(bg, bexp))
+			denomExp := cfg.WR*br + cfg.WG*bg + cfg.WB*bexp
+			if maxExp > eps {
+				expHi := denomExp / maxExp
+				expHiHist[isoValHistIdx(expHi)]++
+			}
+		}
+	}
+
+	st.minV = clamp01(st.minV)
+	st.maxV = clamp01(st.maxV)
+	st.avgV = clamp01(isoValHistMeanTrimmed(valueHist, cfg.ClipPct))
+	st.medV = clamp01(isoValHistQuantileTrimmed(valueHist, cfg.ClipPct, 50.0))
+	st.addTargetMin = clamp01(isoValHistQuantilePct(addLoHist, 100.0-cfg.ClipPct))
+	st.addTargetMax = clamp01(isoValHistQuantilePct(addHiHist, cfg.ClipPct))
+	st.mulTargetMax = clamp01(isoValHistQuantilePct(mulHiHist, cfg.ClipPct))
+	st.expTargetMax = clamp01(isoValHistQuantilePct(expHiHist, cfg.ClipPct))
+
+	return st
+}
+
+func isoValResolveTarget(stage *IsoValStage, st isoValStats) *IsoValStage {
+	cfg := *stage
+	if cfg.AutoMode == "" {
+		return &cfg
+	}
+	switch cfg.AutoMode {
+	case "avg":
+		cfg.Target = st.avgV
+	case "p":
+		cfg.Target = isoValHistQuantileTrimmed(st.valueHist, cfg.ClipPct, cfg.AutoPct)
+	case "min":
+		switch cfg.Mode {
+		case "add":
+			cfg.Target = st.addTargetMin
+		case "mul", "exp":
+			cfg.Target = 0.0
+		}
+	case "max":
+		switch cfg.Mode {
+		case "add":
+			cfg.Target = st.addTargetMax
+		case "mul":
+			cfg.Target = st.mulTargetMax
+		case "exp":
+			cfg.Target = st.expTargetMax
+		}
+	}
+	cfg.Target = clamp01(cfg.Target)
+	return &cfg
+}
+
+// Name - stage name
+func (s *IsoValStage) Name() string {
+	return "isoval"
+}
+
+// Apply - equalizes R, G, B of all pixels, auto target is calculated from the current frame
+func (s *IsoValStage) Apply(ctx context.Context, f *Frame) error {
+	var fn func(r, g, b float64, cfg *IsoValStage) (float64, float64, float64)
+	switch s.Mode {
+	case "add":
+		fn = isoValAddMode
+	case "mul":
+		fn = isoValMulMode
+	case "exp":
+		fn = isoValExpMode
+	default:
+		return fmt.Errorf("ISOVAL mode must be one of: add, mul, exp, got '%s'", s.Mode)
+	}
+	cfg := s
+	if cfg.AutoMode != "" {
+		st := isoValStatsFromPxdata(f.Pix, f.X, f.Y, cfg)
+		cfg = isoValResolveTarget(cfg, st)
+		f.note(
+			" isoval-target=%f(auto=%s, clip=%f%%, avg=%f, med=%f, addmin=%f, addmax=%f, mulmax=%f, expmax=%f)...",
+			cfg.Target,
+			cfg.AutoLabel(),
+			cfg.ClipPct,
+			st.avgV,
+			st.medV,
+			st.addTargetMin,
+			st.addTargetMax,
+			st.mulTargetMax,
+			st.expTargetMax,
+		)
+	}
+	dtStart := time.Now()
+	err := f.mapRGB(ctx, func(r, g, b float64) (float64, float64, float64) {
+		return fn(r, g, b, cfg)
+	})
+	if err != nil {
+		return err
+	}
+	f.note(" isoval (%+v)...", time.Since(dtStart))
+	return nil
+}
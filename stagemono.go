@@ -1,129 +1,43 @@
-package main
+package jpegbw
 
 import (
+	"context"
 	"fmt"
 	"math"
-	"os"
-	"strconv"
-	"strings"
+	"time"
 )
 
-type monoValueConfig struct {
-	enabled           bool
-	mode              string
-	target            float64
-	lumaR             float64
-	lumaG             float64
-	lumaB             float64
-	gamutMode         string
-	zeroMode          string
-	satOverride       float64
-	satOverrideSet    bool
-	chromaOverride    float64
-	chromaOverrideSet bool
+// MonoValStage - flattens pixels' value/lightness to Target (0-1) keeping their hue, modes:
+// luma - weighted channel value (LumaR, LumaG, LumaB weights), linear - linear RGB luminance (the same weights),
+// hsv - HSV value, hsl - HSL lightness, oklch - OKLCh lightness
+// GamutMode is fit (reduce chroma to stay inside gamut) or clip, ZeroMode (gray or black) is used for zero luma pixels,
+// SatOverride (hsv, hsl) and ChromaOverride (oklch) replace original saturation/chroma when set
+// Use NewMonoValStage for defaults (luma mode), see readme-monovalue.md
+type MonoValStage struct {
+	Mode              string
+	Target            float64
+	LumaR             float64
+	LumaG             float64
+	LumaB             float64
+	GamutMode         string
+	ZeroMode          string
+	SatOverride       float64
+	SatOverrideSet    bool
+	ChromaOverride    float64
+	ChromaOverrideSet bool
 }
 
-func monoValueConfigFromEnv() (monoValueConfig, error) {
-	cfg := monoValueConfig{
-		enabled:   false,
-		mode:      "",
-		target:    0.5,
-		lumaR:     0.2126,
-		lumaG:     0.7152,
-		lumaB:     0.0722,
-		gamutMode: "fit",
-		zeroMode:  "gray",
+// NewMonoValStage - mono value stage with default parameters
+func NewMonoValStage() *MonoValStage {
+	return &MonoValStage{
+		Mode:      "luma",
+		Target:    0.5,
+		LumaR:     0.2126,
+		LumaG:     0.7152,
+		LumaB:     0.0722,
+		GamutMode: "fit",
+		ZeroMode:  "gray",
 	}
-	mode := strings.TrimSpace(strings.ToLower(os.Getenv("MONOVAL")))
-	if mode == "" {
-		mode = strings.TrimSpace(strings.ToLower(os.Getenv("MVMODE")))
-	}
-	if mode == "" {
-		return cfg, nil
-	}
-	switch mode {
-	case "lum", "luma", "gray", "mono", "monovalue":
-		cfg.mode = "luma"
-	case "linear", "lumalin", "lin":
-		cfg.mode = "linear"
-	case "hsv":
-		cfg.mode = "hsv"
-	case "hsl":
-		cfg.mode = "hsl"
-	case "oklab", "oklch":
-		cfg.mode = "oklch"
-	default:
-		return cfg, fmt.Errorf("MONOVAL/MVMODE must be one of: luma, linear, hsv, hsl, oklch")
-	}
-	cfg.enabled = true
-
-	parse := func(env string, dst *float64, lo, hi float64) error {
-		s := os.Getenv(env)
-		if s == "" {
-			return nil
-		}
-		v, err := strconv.ParseFloat(s, 64)
-		if err != nil {
-			return err
-		}
-		if v < lo || v > hi {
-			return fmt.Errorf("%s must be from %f-%f range", env, lo, hi)
-		}
-		*dst = v
-		return nil
-	}
-	if err := parse("MVT", &cfg.target, 0.0, 1.0); err != nil {
-		return cfg, err
-	}
-	if err := parse("MVR", &cfg.lumaR, 0.0, 1.0); err != nil {
-		return cfg, err
-	}
-	if err := parse("MVG", &cfg.lumaG, 0.0, 1.0); err != nil {
-		return cfg, err
-	}
-	if err := parse("MVB", &cfg.lumaB, 0.0, 1.0); err != nil {
-		return cfg, err
-	}
-	if err := parse("MVS", &cfg.satOverride, 0.0, 1.0); err != nil {
-		return cfg, err
-	}
-	if os.Getenv("MVS") != "" {
-		cfg.satOverrideSet = true
-	}
-	if err := parse("MVC", &cfg.chromaOverride, 0.0, 1.0); err != nil {
-		return cfg, err
-	}
-	if os.Getenv("MVC") != "" {
-		cfg.chromaOverrideSet = true
-	}
-
-	tot := cfg.lumaR + cfg.lumaG + cfg.lumaB
-	if tot <= 0.0 {
-		return cfg, fmt.Errorf("MVR+MVG+MVB must be positive")
-	}
-	cfg.lumaR /= tot
-	cfg.lumaG /= tot
-	cfg.lumaB /= tot
-
-	gamutMode := strings.TrimSpace(strings.ToLower(os.Getenv("MVGAMUT")))
-	if gamutMode != "" {
-		switch gamutMode {
-		case "fit", "clip":
-			cfg.gamutMode = gamutMode
-		default:
-			return cfg, fmt.Errorf("MVGAMUT must be 'fit' or 'clip'")
-		}
-	}
-	zeroMode := strings.TrimSpace(strings.ToLower(os.Getenv("MVZERO")))
-	if zeroMode != "" {
-		switch zeroMode {
-		case "gray", "black":
-			cfg.zeroMode = zeroMode
-		default:
-			return cfg, fmt.Errorf("MVZERO must be 'gray' or 'black'")
-		}
-	}
-	return cfg, nil
 }
 
 func srgbToLinear(v float64) float64 {
@@ -169,44 +83,44 @@ func fitRGBByGrayMix(r, g, b, gray float64) (float64, float64, float64) {
 	return clamp01(mr), clamp01(mg), clamp01(mb)
 }
 
-func monoValueLuma(r, g, b float64, cfg monoValueConfig) (float64, float64, float64) {
+func monoValueLuma(r, g, b float64, cfg *MonoValStage) (float64, float64, float64) {
 	const eps = 1e-12
-	y := cfg.lumaR*r + cfg.lumaG*g + cfg.lumaB*b
+	y := cfg.LumaR*r + cfg.LumaG*g + cfg.LumaB*b
 	if y <= eps {
-		if cfg.zeroMode == "black" {
+		if cfg.ZeroMode == "black" {
 			return 0.0, 0.0, 0.0
 		}
-		return cfg.target, cfg.target, cfg.target
+		return cfg.Target, cfg.Target, cfg.Target
 	}
-	s := cfg.target / y
+	s := cfg.Target / y
 	cr := r * s
 	cg := g * s
 	cb := b * s
-	if cfg.gamutMode == "fit" {
-		return fitRGBByGrayMix(cr, cg, cb, cfg.target)
+	if cfg.GamutMode == "fit" {
+		return fitRGBByGrayMix(cr, cg, cb, cfg.Target)
 	}
 	return clamp01(cr), clamp01(cg), clamp01(cb)
 }
 
-func monoValueLinear(r, g, b float64, cfg monoValueConfig) (float64, float64, float64) {
+func monoValueLinear(r, g, b float64, cfg *MonoValStage) (float64, float64, float64) {
 	const eps = 1e-12
 	lr := srgbToLinear(r)
 	lg := srgbToLinear(g)
 	lb := srgbToLinear(b)
-	y := cfg.lumaR*lr + cfg.lumaG*lg + cfg.lumaB*lb
+	y := cfg.LumaR*lr + cfg.LumaG*lg + cfg.LumaB*lb
 	if y <= eps {
-		if cfg.zeroMode == "black" {
+		if cfg.ZeroMode == "black" {
 			return 0.0, 0.0, 0.0
 		}
-		gray := linearToSRGB(cfg.target)
+		gray := linearToSRGB(cfg.Target)
 		return gray, gray, gray
 	}
-	s := cfg.target / y
+	s := cfg.Target / y
 	clr := lr * s
 	clg := lg * s
 	clb := lb * s
-	if cfg.gamutMode == "fit" {
-		clr, clg, clb = fitRGBByGrayMix(clr, clg, clb, cfg.target)
+	if cfg.GamutMode == "fit" {
+		clr, clg, clb = fitRGBByGrayMix(clr, clg, clb, cfg.Target)
 	} else {
 		clr = clamp01(clr)
 		clg = clamp01(clg)
@@ -271,12 +185,12 @@ func hsvToRGB(h, s, v float64) (float64, float64, float64) {
 	}
 }
 
-func monoValueHSV(r, g, b float64, cfg monoValueConfig) (float64, float64, float64) {
+func monoValueHSV(r, g, b float64, cfg *MonoValStage) (float64, float64, float64) {
 	h, s, _ := rgbToHSV(r, g, b)
-	if cfg.satOverrideSet {
-		s = cfg.satOverride
+	if cfg.SatOverrideSet {
+		s = cfg.SatOverride
 	}
-	return hsvToRGB(h, s, cfg.target)
+	return hsvToRGB(h, s, cfg.Target)
 }
 
 func rgbToHSL(r, g, b float64) (float64, float64, float64) {
@@ -344,12 +258,12 @@ func hslToRGB(h, s, l float64) (float64, float64, float64) {
 	return hueToRGB(p, q, h+1.0/3.0), hueToRGB(p, q, h), hueToRGB(p, q, h-1.0/3.0)
 }
 
-func monoValueHSL(r, g, b float64, cfg monoValueConfig) (float64, float64, float64) {
+func monoValueHSL(r, g, b float64, cfg *MonoValStage) (float64, float64, float64) {
 	h, s, _ := rgbToHSL(r, g, b)
-	if cfg.satOverrideSet {
-		s = cfg.satOverride
+	if cfg.SatOverrideSet {
+		s = cfg.SatOverride
 	}
-	return hslToRGB(h, s, cfg.target)
+	return hslToRGB(h, s, cfg.Target)
 }
 
 func linearRGBToOklab(r, g, b float64) (float64, float64, float64) {
@@ -378,7 +292,7 @@ func oklabToLinearRGB(L, a, b float64) (float64, float64, float64) {
 	return r, g, bb
 }
 
-func monoValueOKLCh(r, g, b float64, cfg monoValueConfig) (float64, float64, float64) {
+func monoValueOKLCh(r, g, b float64, cfg *MonoValStage) (float64, float64, float64) {
 	lr := srgbToLinear(r)
 	lg := srgbToLinear(g)
 	lb := srgbToLinear(b)
@@ -388,20 +302,20 @@ func monoValueOKLCh(r, g, b float64, cfg monoValueConfig) (float64, float64, flo
 	if C > 1e-12 {
 		H = math.Atan2(bb, a)
 	}
-	if cfg.chromaOverrideSet {
-		C = cfg.chromaOverride
+	if cfg.ChromaOverrideSet {
+		C = cfg.ChromaOverride
 	}
 	newA := C * math.Cos(H)
 	newB := C * math.Sin(H)
-	or, og, ob := oklabToLinearRGB(cfg.target, newA, newB)
-	if cfg.gamutMode == "fit" && !inGamut01(or, og, ob) {
+	or, og, ob := oklabToLinearRGB(cfg.Target, newA, newB)
+	if cfg.GamutMode == "fit" && !inGamut01(or, og, ob) {
 		lo := 0.0
 		hi := C
 		for i := 0; i < 32; i++ {
 			mid := 0.5 * (lo + hi)
 			ma := mid * math.Cos(H)
 			mb := mid * math.Sin(H)
-			tr, tg, tb := oklabToLinearRGB(cfg.target, ma, mb)
+			tr, tg, tb := oklabToLinearRGB(cfg.Target, ma, mb)
 			if inGamut01(tr, tg, tb) {
 				lo = mid
 			} else {
@@ -410,7 +324,7 @@ func monoValueOKLCh(r, g, b float64, cfg monoValueConfig) (float64, float64, flo
 		}
 		newA = lo * math.Cos(H)
 		newB = lo * math.Sin(H)
-		or, og, ob = oklabToLinearRGB(cfg.target, newA, newB)
+		or, og, ob = oklabToLinearRGB(cfg.Target, newA, newB)
 	}
 	or = clamp01(or)
 	og = clamp01(og)
@@ -418,55 +332,35 @@ func monoValueOKLCh(r, g, b float64, cfg monoValueConfig) (float64, float64, flo
 	return linearToSRGB(or), linearToSRGB(og), linearToSRGB(ob)
 }
 
-func applyMonoValue(pxdata [][][4]uint16, x, y, thrN int, cfg monoValueConfig) error {
-	if !cfg.enabled {
-		return nil
-	}
-	che := make(chan error)
-	nThreads := 0
-	for ii := 0; ii < x; ii++ {
-		go func(c chan error, i int) {
-			for j := 0; j < y; j++ {
-				px := pxdata[i][j]
-				r := float64(px[0]) / 65535.0
-				g := float64(px[1]) / 65535.0
-				b := float64(px[2]) / 65535.0
-				var rr, gg, bb float64
-				switch cfg.mode {
-				case "luma":
-					rr, gg, bb = monoValueLuma(r, g, b, cfg)
-				case "linear":
-					rr, gg, bb = monoValueLinear(r, g, b, cfg)
-				case "hsv":
-					rr, gg, bb = monoValueHSV(r, g, b, cfg)
-				case "hsl":
-					rr, gg, bb = monoValueHSL(r, g, b, cfg)
-				case "oklch":
-					rr, gg, bb = monoValueOKLCh(r, g, b, cfg)
-				default:
-					rr, gg, bb = r, g, b
-				}
-				pxdata[i][j][0] = uint16(clamp01(rr)*65535.0 + 0.5)
-				pxdata[i][j][1] = uint16(clamp01(gg)*65535.0 + 0.5)
-				pxdata[i][j][2] = uint16(clamp01(bb)*65535.0 + 0.5)
-			}
-			c <- nil
-		}(che, ii)
-		nThreads++
-		if nThreads == thrN {
-			e := <-che
-			if e != nil {
-				return e
-			}
-			nThreads--
-		}
+// Name - stage name
+func (s *MonoValStage) Name() string {
+	return "monoval"
+}
+
+// Apply - flattens R, G, B of all pixels
+func (s *MonoValStage) Apply(ctx context.Context, f *Frame) error {
+	var fn func(r, g, b float64, cfg *MonoValStage) (float64, float64, float64)
+	switch s.Mode {
+	case "luma":
+		fn = monoValueLuma
+	case "linear":
+		fn = monoValueLinear
+	case "hsv":
+		fn = monoValueHSV
+	case "hsl":
+		fn = monoValueHSL
+	case "oklch":
+		fn = monoValueOKLCh
+	default:
+		return fmt.Errorf("MONOVAL mode must be one of: luma, linear, hsv, hsl, oklch, got '%s'", s.Mode)
 	}
-	for nThreads > 0 {
-		e := <-che
-		if e != nil {
-			return e
-		}
-		nThreads--
+	dtStart := time.Now()
+	err := f.mapRGB(ctx, func(r, g, b float64) (float64, float64, float64) {
+		return fn(r, g, b, s)
+	})
+	if err != nil {
+		return err
 	}
+	f.note(" monoval (%+v)...", time.Since(dtStart))
 	return nil
 }